@@ -2,14 +2,10 @@ package cap
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"maps"
 	"net/netip"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -18,12 +14,34 @@ import (
 // It uses a driver for storing challenges (and optional rate limiting).
 type Cap struct {
 	driver Driver
+
+	keyring           *HMACKeyring
+	redeemKeyring     *TokenKeyring
+	verifyParallelism int
+	observers         []Observer
+	clock             Clock
+	tokens            TokenGenerator
+	schemes           map[string]PoWScheme
+	limiters          []RateLimiter
 }
 
-// NewCap creates a new Cap instance with the specified driver.
-func NewCap(driver Driver) *Cap {
+// NewCap creates a new Cap instance with the specified driver and options.
+func NewCap(driver Driver, opts ...func(c *Cap)) *Cap {
 	s := &Cap{
 		driver: driver,
+
+		keyring:           nil,
+		redeemKeyring:     nil,
+		verifyParallelism: DefaultVerifyParallelism,
+		observers:         nil,
+		clock:             SystemClock,
+		tokens:            RandomTokenGenerator,
+		schemes:           defaultPoWSchemes(),
+		limiters:          nil,
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	return s
@@ -46,9 +64,28 @@ type Challenge struct {
 	// The parameters used to generate the challenge and verify its solution.
 	Params ChallengeParams
 
-	// The expiration time, when solutions will no longer be accepted and the redeem token
-	// will no longer be accepted.
+	// The scope that the redeem token is restricted to.
+	// The zero value means that the redeem token is unscoped.
+	Scope Scope
+
+	// The expiration time, when solutions will no longer be accepted.
 	Expires time.Time
+
+	// How long the redeem token is valid for after the challenge is solved.
+	// If zero, the redeem token expires with the challenge.
+	RedeemValidDuration time.Duration
+
+	// The expiration time of the redeem token, when it will no longer be accepted.
+	// Until the challenge is solved, it is the same as Expires.
+	RedeemExpires time.Time
+
+	// Whether the challenge was solved.
+	// A solved challenge cannot be solved again.
+	Solved bool
+
+	// Metadata attached to the challenge when it was created.
+	// Can be nil.
+	Metadata map[string]string
 }
 
 // ToResponse returns a ChallengeResponse with the data inside the Challenge struct.
@@ -71,6 +108,11 @@ type ChallengeParams struct {
 
 	// The size of the salt in bytes.
 	SaltSize int `json:"s"`
+
+	// The name of the proof-of-work scheme used by the challenge.
+	// Optional; the empty string means SHA256Scheme, which is the only scheme supported by the Cap.js widget.
+	// Other schemes must be registered with WithPoWSchemes.
+	Scheme string `json:"scheme,omitempty"`
 }
 
 // ChallengeRequest is a request to create a challenge
@@ -80,11 +122,31 @@ type ChallengeRequest struct {
 
 	// The IP address that is requesting the challenge.
 	// Can be nil.
-	// Used by the driver for optional rate limiting.
+	// Used by the driver for optional rate limiting if RateLimitSubject is nil.
 	IP *netip.Addr
 
+	// The subject to rate limit challenge creation by, such as the requesting user's account.
+	// Optional; if nil and IP is set, the IP address is used as the subject.
+	RateLimitSubject *RateLimitSubject
+
+	// The scope to restrict the challenge's redeem token to.
+	// Optional; the zero value means that the redeem token is unscoped.
+	Scope Scope
+
 	// The duration for which the challenge is valid.
 	ValidDuration time.Duration
+
+	// The duration for which the redeem token is valid, starting when the challenge is solved.
+	// Optional; if zero, the redeem token expires with the challenge.
+	RedeemValidDuration time.Duration
+
+	// Metadata to attach to the challenge, such as the form or tenant it was issued for.
+	// It is returned when the challenge is solved and when its redeem token is used.
+	// Optional; can have at most MaxMetadataEntries entries of MaxMetadataSize bytes in total.
+	//
+	// Metadata is visible to clients if stateless challenges or signed redeem tokens are enabled,
+	// so it must not contain secrets in that case.
+	Metadata map[string]string
 }
 
 // DefaultChallengeParams are the default parameters to use for challenges.
@@ -97,6 +159,10 @@ var DefaultChallengeParams = ChallengeParams{
 // DefaultValidDuration is the default duration that a Cap challenge is valid before it expires.
 const DefaultValidDuration = 10 * time.Minute
 
+// DefaultRedeemValidDuration is a suggested duration for redeem tokens to be valid after their challenges are solved.
+// It is not applied unless requested; redeem tokens expire with their challenges by default.
+const DefaultRedeemValidDuration = 20 * time.Minute
+
 // ChallengeResponse is a challenge response that can be sent to a client that requested one.
 // It can be serialized to JSON and used as the JSON response for the challenge endpoint.
 type ChallengeResponse struct {
@@ -111,25 +177,90 @@ type ChallengeResponse struct {
 }
 
 // CreateChallenge generates a new challenge.
-// If the request IP is set and the driver has rate limiting enabled, the function may return ErrRateLimited.
-func (s *Cap) CreateChallenge(ctx context.Context, req ChallengeRequest) (*Challenge, error) {
+// If the request's rate limit subject or IP is set and rate limiters are configured with WithRateLimiter, or the driver
+// has rate limiting enabled, the function may return ErrRateLimited.
+// If stateless challenges are enabled, the challenge is not stored and the driver is not called.
+// Returns ErrMetadataTooLarge if the request's metadata exceeds the metadata limits.
+// Returns ErrUnknownPoWScheme if the params' scheme is not registered.
+// Returns ErrInvalidRateLimitSubject if the request's rate limit subject is invalid.
+func (s *Cap) CreateChallenge(ctx context.Context, req ChallengeRequest) (challenge *Challenge, err error) {
+	var driverDuration time.Duration
+	if len(s.observers) > 0 {
+		start := time.Now()
+		defer func() {
+			event := CreateChallengeEvent{
+				Params:         req.Params,
+				Scope:          req.Scope,
+				IP:             req.IP,
+				Duration:       time.Since(start),
+				DriverDuration: driverDuration,
+				Err:            err,
+			}
+			if challenge != nil {
+				event.ChallengeToken = challenge.ChallengeToken
+				event.Expires = challenge.Expires
+			}
+
+			for _, o := range s.observers {
+				o.OnCreateChallenge(ctx, event)
+			}
+		}()
+	}
+
+	if err = validateMetadata(req.Metadata); err != nil {
+		return nil, err
+	}
+	if _, err = s.powScheme(req.Params.Scheme); err != nil {
+		return nil, err
+	}
+	subject := req.RateLimitSubject
+	if subject == nil && req.IP != nil {
+		subject = NewIPRateLimitSubject(*req.IP)
+	}
+	if subject != nil {
+		if err = subject.validate(); err != nil {
+			return nil, err
+		}
+
+		for _, limiter := range s.limiters {
+			var allowed bool
+			allowed, err = limiter.Allow(ctx, subject)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				return nil, ErrRateLimited
+			}
+		}
+	}
+
+	if s.keyring != nil {
+		return s.createStatelessChallenge(req, s.clock.Now().Add(req.ValidDuration)), nil
+	}
+
 	// Generate a random challenge and redeem tokens
 	randBytes := make([]byte, 25)
-	_, _ = rand.Read(randBytes)
+	s.tokens.GenerateToken(randBytes)
 	challengeToken := hex.EncodeToString(randBytes)
-	_, _ = rand.Read(randBytes)
+	s.tokens.GenerateToken(randBytes)
 	redeemToken := hex.EncodeToString(randBytes)
 
-	expires := time.Now().Add(req.ValidDuration)
-
-	challenge := &Challenge{
-		ChallengeToken: challengeToken,
-		RedeemToken:    redeemToken,
-		Params:         req.Params,
-		Expires:        expires,
+	expires := s.clock.Now().Add(req.ValidDuration)
+
+	challenge = &Challenge{
+		ChallengeToken:      challengeToken,
+		RedeemToken:         redeemToken,
+		Params:              req.Params,
+		Scope:               req.Scope,
+		Expires:             expires,
+		RedeemValidDuration: req.RedeemValidDuration,
+		RedeemExpires:       expires,
+		Metadata:            maps.Clone(req.Metadata),
 	}
 
-	err := s.driver.Store(ctx, challenge, req.IP)
+	driverStart := time.Now()
+	err = s.driver.Store(ctx, challenge, subject)
+	driverDuration = time.Since(driverStart)
 	if err != nil {
 		return nil, err
 	}
@@ -147,12 +278,21 @@ type VerifySolutionsRequest struct {
 // RedeemData is the redemption data returned after verifying a successful solution.
 type RedeemData struct {
 	RedeemToken string
-	Expires     time.Time
+
+	// The expiration time of the redeem token.
+	Expires time.Time
+
+	// The metadata attached to the challenge.
+	// Can be nil.
+	Metadata map[string]string
 }
 
 // ErrChallengeNotFound is returned when a challenge is not found, expired, or already redeemed.
 var ErrChallengeNotFound = errors.New("challenge not found (or is expired or already redeemed)")
 
+// ErrChallengeAlreadySolved is returned when solutions are submitted for a challenge that was already solved.
+var ErrChallengeAlreadySolved = errors.New("challenge was already solved")
+
 // ErrInsufficientSolutions is returned when not enough solutions were provided for a challenge.
 var ErrInsufficientSolutions = errors.New("insufficient solutions provided for challenge")
 
@@ -161,17 +301,54 @@ var ErrInvalidSolution = errors.New("invalid solution provided for challenge")
 
 // VerifyChallengeSolutions verifies a challenge's solution in exchange for a redeem token.
 // Returns ErrChallengeNotFound if no challenge with the specified token exists.
+// Returns ErrChallengeAlreadySolved if the challenge was already solved, so each challenge yields one redeem token.
 // Returns ErrInsufficientSolutions if not enough solutions were provided.
 // Returns ErrInvalidSolution if any solution is invalid.
-func (s *Cap) VerifyChallengeSolutions(ctx context.Context, req VerifySolutionsRequest) (*RedeemData, error) {
-	src, err := s.driver.GetUnredeemedChallenge(ctx, req.ChallengeToken)
-	if err != nil {
-		return nil, err
+// Returns ErrUnknownPoWScheme if the challenge's proof-of-work scheme is not registered.
+// Returns the context's error if it is cancelled while verifying.
+func (s *Cap) VerifyChallengeSolutions(ctx context.Context, req VerifySolutionsRequest) (data *RedeemData, err error) {
+	var src *Challenge
+	var driverDuration time.Duration
+	var verifyDuration time.Duration
+	if len(s.observers) > 0 {
+		start := time.Now()
+		defer func() {
+			event := VerifySolutionsEvent{
+				ChallengeToken: req.ChallengeToken,
+				IP:             ClientIPFromContext(ctx),
+				SolutionCount:  len(req.Solutions),
+				Duration:       time.Since(start),
+				DriverDuration: driverDuration,
+				VerifyDuration: verifyDuration,
+				Err:            err,
+			}
+			if src != nil {
+				event.Params = src.Params
+			}
+
+			for _, o := range s.observers {
+				o.OnVerifySolutions(ctx, event)
+			}
+		}()
+	}
+
+	if s.keyring != nil {
+		src = s.parseStatelessChallenge(req.ChallengeToken)
+	} else {
+		driverStart := time.Now()
+		src, err = s.driver.GetUnredeemedChallenge(ctx, req.ChallengeToken)
+		driverDuration += time.Since(driverStart)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if src == nil {
 		return nil, ErrChallengeNotFound
 	}
+	if src.Solved {
+		return nil, ErrChallengeAlreadySolved
+	}
 
 	params := src.Params
 	count := params.Count
@@ -179,51 +356,193 @@ func (s *Cap) VerifyChallengeSolutions(ctx context.Context, req VerifySolutionsR
 		return nil, ErrInsufficientSolutions
 	}
 
-	token := src.ChallengeToken
-
-	type challengeTuple struct {
-		Salt   string
-		Target string
+	scheme, err := s.powScheme(params.Scheme)
+	if err != nil {
+		return nil, err
 	}
-	challenges := make([]challengeTuple, count)
-	for i := 0; i < count; i++ {
-		idx := i + 1
-		challenges[i] = challengeTuple{
-			Salt:   prng(fmt.Sprintf("%s%d", token, idx), params.SaltSize),
-			Target: prng(fmt.Sprintf("%s%dd", token, idx), params.Difficulty),
-		}
+
+	verifyStart := time.Now()
+	isValid, err := verifySolutions(ctx, scheme, src.ChallengeToken, params, req.Solutions, s.verifyParallelism)
+	verifyDuration = time.Since(verifyStart)
+	if err != nil {
+		return nil, err
 	}
 
-	isValid := true
-	for i, challenge := range challenges {
-		// We checked that the number of solutions is equal to the number of challenges earlier, so this can't panic.
-		solution := req.Solutions[i]
+	// Check if solution is valid.
+	if !isValid {
+		return nil, ErrInvalidSolution
+	}
 
-		salt := challenge.Salt
-		target := challenge.Target
-		hasher := sha256.New()
-		hasher.Write([]byte(salt))
-		hasher.Write([]byte(strconv.FormatInt(int64(solution), 10)))
-		hash := hex.EncodeToString(hasher.Sum(nil))
+	// The redeem token's lifetime starts now that the challenge is solved.
+	if src.RedeemValidDuration > 0 {
+		src.RedeemExpires = s.clock.Now().Add(src.RedeemValidDuration)
+	}
 
-		if !strings.HasPrefix(hash, target) {
-			isValid = false
-			break
+	// Stateless challenges with signed redeem tokens are never stored, so they cannot be marked as solved.
+	// Tokens issued for the same challenge share an ID though, so only one of them can be used.
+	if s.keyring == nil || s.redeemKeyring == nil {
+		driverStart := time.Now()
+		var solved bool
+		solved, err = s.solveChallenge(ctx, src)
+		driverDuration += time.Since(driverStart)
+		if err != nil {
+			return nil, err
+		}
+		if !solved {
+			return nil, ErrChallengeAlreadySolved
 		}
 	}
 
-	// Check if solution is valid.
-	if !isValid {
-		return nil, ErrInvalidSolution
+	if s.redeemKeyring != nil {
+		// Signed redeem tokens are not stored; their IDs are recorded as spent when they are used.
+		var token string
+		token, err = s.signRedeemToken(src)
+		if err != nil {
+			return nil, err
+		}
+
+		return &RedeemData{
+			RedeemToken: token,
+			Expires:     src.RedeemExpires,
+			Metadata:    src.Metadata,
+		}, nil
 	}
 
 	return &RedeemData{
 		RedeemToken: src.RedeemToken,
-		Expires:     src.Expires,
+		Expires:     src.RedeemExpires,
+		Metadata:    src.Metadata,
 	}, nil
 }
 
-// UseRedeemToken uses up a redeem token and returns whether it was valid, invalidating it either way.
-func (s *Cap) UseRedeemToken(ctx context.Context, token string) (bool, error) {
+// solveChallenge marks a challenge as solved with the driver.
+// Returns false if it was already solved.
+func (s *Cap) solveChallenge(ctx context.Context, src *Challenge) (bool, error) {
+	if s.keyring != nil {
+		// Stateless challenges are only stored once solved so that the redeem token can be used.
+		// Storing a challenge that was already stored does nothing, so solving it again fails below.
+		if err := s.driver.Store(ctx, src, nil); err != nil {
+			return false, err
+		}
+	}
+
+	return s.driver.SolveChallenge(ctx, src.ChallengeToken, src.RedeemExpires)
+}
+
+// RedeemRequest is a request to use a redeem token.
+type RedeemRequest struct {
+	// The redeem token to use.
+	RedeemToken string
+
+	// The scope that the redeem token must have been issued for.
+	// The zero value only accepts unscoped redeem tokens.
+	Scope Scope
+}
+
+// Redemption is the result of successfully using a redeem token.
+type Redemption struct {
+	// The token of the challenge that the redeem token was issued for.
+	ChallengeToken string
+
+	// The params of the challenge that was solved.
+	Params ChallengeParams
+
+	// The scope that the redeem token was issued for.
+	Scope Scope
+
+	// The expiration time of the redeem token.
+	Expires time.Time
+
+	// The metadata attached to the challenge.
+	// Can be nil.
+	Metadata map[string]string
+}
+
+// ErrInvalidRedeemToken is returned when a redeem token does not exist, is expired, or was already used.
+var ErrInvalidRedeemToken = errors.New("redeem token not found (or is expired or already used)")
+
+// ErrScopeMismatch is returned when a redeem token was issued for a different scope than the one expected.
+var ErrScopeMismatch = errors.New("redeem token was issued for a different scope")
+
+// useRedeemToken uses up a signed or unsigned redeem token.
+func (s *Cap) useRedeemToken(ctx context.Context, token string) (*Challenge, error) {
+	if s.redeemKeyring != nil && isSignedRedeemToken(token) {
+		return s.useSignedRedeemToken(ctx, token)
+	}
+
 	return s.driver.UseRedeemToken(ctx, token)
 }
+
+// Redeem uses up a redeem token and returns its redemption data if it was valid and issued for the expected scope.
+// The redeem token is invalidated either way.
+// For signed redeem tokens, the returned redemption does not include the challenge token or params.
+// Returns ErrInvalidRedeemToken if the redeem token does not exist, is expired, or was already used.
+// Returns ErrScopeMismatch if the redeem token was issued for a different scope than req.Scope.
+func (s *Cap) Redeem(ctx context.Context, req RedeemRequest) (redemption *Redemption, err error) {
+	var chal *Challenge
+	if len(s.observers) > 0 {
+		start := time.Now()
+		var driverDuration time.Duration
+		defer func() {
+			event := UseRedeemTokenEvent{
+				RedeemToken:    req.RedeemToken,
+				Scope:          req.Scope,
+				IP:             ClientIPFromContext(ctx),
+				Duration:       time.Since(start),
+				DriverDuration: driverDuration,
+				WasRedeemed:    redemption != nil,
+				Err:            err,
+			}
+			if chal != nil {
+				event.ChallengeToken = chal.ChallengeToken
+				event.Params = chal.Params
+			}
+
+			for _, o := range s.observers {
+				o.OnUseRedeemToken(ctx, event)
+			}
+		}()
+
+		driverStart := time.Now()
+		chal, err = s.useRedeemToken(ctx, req.RedeemToken)
+		driverDuration = time.Since(driverStart)
+	} else {
+		chal, err = s.useRedeemToken(ctx, req.RedeemToken)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if chal == nil {
+		return nil, ErrInvalidRedeemToken
+	}
+
+	if chal.Scope != req.Scope {
+		return nil, ErrScopeMismatch
+	}
+
+	return &Redemption{
+		ChallengeToken: chal.ChallengeToken,
+		Params:         chal.Params,
+		Scope:          chal.Scope,
+		Expires:        chal.RedeemExpires,
+		Metadata:       chal.Metadata,
+	}, nil
+}
+
+// UseRedeemToken uses up an unscoped redeem token and returns whether it was valid, invalidating it either way.
+// Redeem tokens issued for a scope are not accepted; use Redeem to check them.
+func (s *Cap) UseRedeemToken(ctx context.Context, token string) (bool, error) {
+	_, err := s.Redeem(ctx, RedeemRequest{
+		RedeemToken: token,
+	})
+	if err != nil {
+		if errors.Is(err, ErrInvalidRedeemToken) || errors.Is(err, ErrScopeMismatch) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
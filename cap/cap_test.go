@@ -0,0 +1,840 @@
+package cap_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+// capModes are the combinations of stateless challenges and signed redeem tokens that Cap supports.
+var capModes = []struct {
+	name      string
+	stateless bool
+	signed    bool
+}{
+	{"Stateful", false, false},
+	{"Stateless", true, false},
+	{"StatefulSigned", false, true},
+	{"StatelessSigned", true, true},
+}
+
+// testParams are cheap challenge params for tests.
+var testParams = cap.ChallengeParams{Difficulty: 1, Count: 2, SaltSize: 8}
+
+// solveNewChallenge creates a challenge for the request and submits valid solutions for it.
+func solveNewChallenge(t *testing.T, c *cap.Cap, req cap.ChallengeRequest) *cap.RedeemData {
+	t.Helper()
+	ctx := context.Background()
+
+	chal, err := c.CreateChallenge(ctx, req)
+	if err != nil {
+		t.Fatalf("CreateChallenge: unexpected error: %v", err)
+	}
+
+	data, err := c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{
+		ChallengeToken: chal.ChallengeToken,
+		Solutions:      cap.ReferenceSolve(chal.ChallengeToken, chal.Params),
+	})
+	if err != nil {
+		t.Fatalf("VerifyChallengeSolutions: unexpected error: %v", err)
+	}
+
+	return data
+}
+
+// newModeCap creates a Cap using a fake driver and clock, with stateless challenges and signed redeem tokens
+// enabled as specified.
+func newModeCap(t *testing.T, stateless bool, signed bool) (*cap.Cap, *fake.Clock) {
+	t.Helper()
+
+	clock := fake.NewClock(time.Now())
+	opts := []func(c *cap.Cap){cap.WithClock(clock)}
+	if stateless {
+		keyring, err := cap.NewHMACKeyring(cap.NewRandomHMACKey("challenge"))
+		if err != nil {
+			t.Fatalf("NewHMACKeyring: unexpected error: %v", err)
+		}
+		opts = append(opts, cap.WithStatelessChallenges(keyring))
+	}
+	if signed {
+		keyring, err := cap.NewTokenKeyring(cap.NewRandomEd25519Key("redeem"))
+		if err != nil {
+			t.Fatalf("NewTokenKeyring: unexpected error: %v", err)
+		}
+		opts = append(opts, cap.WithSignedRedeemTokens(keyring))
+	}
+
+	return cap.NewCap(fake.NewDriver(clock), opts...), clock
+}
+
+func TestSolveAndRedeemOnce(t *testing.T) {
+	for _, mode := range capModes {
+		t.Run(mode.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newModeCap(t, mode.stateless, mode.signed)
+
+			chal, err := c.CreateChallenge(ctx, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+			if err != nil {
+				t.Fatalf("CreateChallenge: unexpected error: %v", err)
+			}
+			req := cap.VerifySolutionsRequest{
+				ChallengeToken: chal.ChallengeToken,
+				Solutions:      cap.ReferenceSolve(chal.ChallengeToken, chal.Params),
+			}
+
+			first, err := c.VerifyChallengeSolutions(ctx, req)
+			if err != nil {
+				t.Fatalf("VerifyChallengeSolutions: unexpected error: %v", err)
+			}
+
+			// Stateless challenges with signed redeem tokens are never stored, so solving them again yields another
+			// token with the same ID instead of failing.
+			second, err := c.VerifyChallengeSolutions(ctx, req)
+			if mode.stateless && mode.signed {
+				if err != nil {
+					t.Fatalf("second VerifyChallengeSolutions: unexpected error: %v", err)
+				}
+			} else if err != cap.ErrChallengeAlreadySolved {
+				t.Fatalf("second VerifyChallengeSolutions: error = %v, want %v", err, cap.ErrChallengeAlreadySolved)
+			}
+
+			if ok, err := c.UseRedeemToken(ctx, first.RedeemToken); err != nil || !ok {
+				t.Fatalf("UseRedeemToken: got %t, %v, want true", ok, err)
+			}
+			if ok, err := c.UseRedeemToken(ctx, first.RedeemToken); err != nil || ok {
+				t.Errorf("second UseRedeemToken: got %t, %v, want false", ok, err)
+			}
+			if second != nil {
+				if ok, err := c.UseRedeemToken(ctx, second.RedeemToken); err != nil || ok {
+					t.Errorf("UseRedeemToken with token from second solve: got %t, %v, want false", ok, err)
+				}
+			}
+
+			// A redeemed challenge cannot be solved again, or only yields tokens that were already used.
+			third, err := c.VerifyChallengeSolutions(ctx, req)
+			if mode.stateless && mode.signed {
+				if err != nil {
+					t.Fatalf("VerifyChallengeSolutions after redemption: unexpected error: %v", err)
+				}
+				if ok, err := c.UseRedeemToken(ctx, third.RedeemToken); err != nil || ok {
+					t.Errorf("UseRedeemToken with token from solve after redemption: got %t, %v, want false", ok, err)
+				}
+			} else if err == nil {
+				t.Errorf("VerifyChallengeSolutions after redemption: expected error")
+			}
+		})
+	}
+}
+
+func TestConcurrentSolve(t *testing.T) {
+	const goroutines = 16
+
+	for _, mode := range capModes {
+		if mode.stateless && mode.signed {
+			// Solved state is not stored in this mode.
+			continue
+		}
+
+		t.Run(mode.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, _ := newModeCap(t, mode.stateless, mode.signed)
+
+			chal, err := c.CreateChallenge(ctx, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+			if err != nil {
+				t.Fatalf("CreateChallenge: unexpected error: %v", err)
+			}
+			req := cap.VerifySolutionsRequest{
+				ChallengeToken: chal.ChallengeToken,
+				Solutions:      cap.ReferenceSolve(chal.ChallengeToken, chal.Params),
+			}
+
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			solved := 0
+			start := make(chan struct{})
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+
+					_, err := c.VerifyChallengeSolutions(ctx, req)
+					if err != nil && err != cap.ErrChallengeAlreadySolved {
+						t.Errorf("VerifyChallengeSolutions: unexpected error: %v", err)
+						return
+					}
+
+					if err == nil {
+						mu.Lock()
+						solved++
+						mu.Unlock()
+					}
+				}()
+			}
+			close(start)
+			wg.Wait()
+
+			if solved != 1 {
+				t.Errorf("VerifyChallengeSolutions: challenge was solved %d times, want exactly 1", solved)
+			}
+		})
+	}
+}
+
+func TestVerifyChallengeSolutionsErrors(t *testing.T) {
+	for _, mode := range capModes {
+		t.Run(mode.name, func(t *testing.T) {
+			ctx := context.Background()
+			c, clock := newModeCap(t, mode.stateless, mode.signed)
+
+			if _, err := c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{ChallengeToken: "unknown"}); err != cap.ErrChallengeNotFound {
+				t.Errorf("VerifyChallengeSolutions with unknown token: error = %v, want %v", err, cap.ErrChallengeNotFound)
+			}
+
+			chal, err := c.CreateChallenge(ctx, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+			if err != nil {
+				t.Fatalf("CreateChallenge: unexpected error: %v", err)
+			}
+			solutions := cap.ReferenceSolve(chal.ChallengeToken, chal.Params)
+
+			if _, err = c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{
+				ChallengeToken: chal.ChallengeToken,
+				Solutions:      solutions[:1],
+			}); err != cap.ErrInsufficientSolutions {
+				t.Errorf("VerifyChallengeSolutions with too few solutions: error = %v, want %v", err, cap.ErrInsufficientSolutions)
+			}
+
+			invalid := []uint32{solutions[0], cap.InvalidSolution(t, chal.ChallengeToken, chal.Params, solutions, 1)}
+			if _, err = c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{
+				ChallengeToken: chal.ChallengeToken,
+				Solutions:      invalid,
+			}); err != cap.ErrInvalidSolution {
+				t.Errorf("VerifyChallengeSolutions with invalid solution: error = %v, want %v", err, cap.ErrInvalidSolution)
+			}
+
+			// Failed attempts do not mark the challenge as solved, but it cannot be solved once it expired.
+			clock.Advance(time.Minute)
+			if _, err = c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{
+				ChallengeToken: chal.ChallengeToken,
+				Solutions:      solutions,
+			}); err != cap.ErrChallengeNotFound {
+				t.Errorf("VerifyChallengeSolutions after expiry: error = %v, want %v", err, cap.ErrChallengeNotFound)
+			}
+
+			clock.Advance(-time.Second)
+			if _, err = c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{
+				ChallengeToken: chal.ChallengeToken,
+				Solutions:      solutions,
+			}); err != nil {
+				t.Errorf("VerifyChallengeSolutions after failed attempts: unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRedeemValidDuration(t *testing.T) {
+	tests := []struct {
+		name        string
+		redeemValid time.Duration
+		// solveAfter is how long after the challenge was created it is solved.
+		solveAfter time.Duration
+		// wantExpires is when the redeem token expires, relative to when the challenge was created.
+		wantExpires time.Duration
+	}{
+		{"ExpiresWithChallenge", 0, 30 * time.Second, time.Minute},
+		{"LongerThanChallenge", 5 * time.Minute, 30 * time.Second, 30*time.Second + 5*time.Minute},
+		{"ShorterThanChallenge", 10 * time.Second, 30 * time.Second, 40 * time.Second},
+	}
+
+	for _, mode := range capModes {
+		for _, tt := range tests {
+			t.Run(mode.name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				c, clock := newModeCap(t, mode.stateless, mode.signed)
+				created := clock.Now()
+
+				chal, err := c.CreateChallenge(ctx, cap.ChallengeRequest{
+					Params:              testParams,
+					ValidDuration:       time.Minute,
+					RedeemValidDuration: tt.redeemValid,
+				})
+				if err != nil {
+					t.Fatalf("CreateChallenge: unexpected error: %v", err)
+				}
+
+				clock.Advance(tt.solveAfter)
+				data, err := c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{
+					ChallengeToken: chal.ChallengeToken,
+					Solutions:      cap.ReferenceSolve(chal.ChallengeToken, chal.Params),
+				})
+				if err != nil {
+					t.Fatalf("VerifyChallengeSolutions: unexpected error: %v", err)
+				}
+
+				// Stateless challenge tokens and signed redeem tokens have millisecond and second precision.
+				wantExpires := created.Add(tt.wantExpires)
+				if diff := data.Expires.Sub(wantExpires).Abs(); diff >= time.Second {
+					t.Errorf("VerifyChallengeSolutions: Expires = %v, want %v", data.Expires, wantExpires)
+				}
+
+				clock.Set(wantExpires.Add(-time.Second))
+				redemption, err := c.Redeem(ctx, cap.RedeemRequest{RedeemToken: data.RedeemToken})
+				if err != nil {
+					t.Fatalf("Redeem before expiry: unexpected error: %v", err)
+				}
+				if diff := redemption.Expires.Sub(data.Expires).Abs(); diff >= time.Second {
+					t.Errorf("Redeem: Expires = %v, want %v", redemption.Expires, data.Expires)
+				}
+
+				data = solveNewChallenge(t, c, cap.ChallengeRequest{
+					Params:              testParams,
+					ValidDuration:       time.Minute,
+					RedeemValidDuration: tt.redeemValid,
+				})
+				clock.Set(data.Expires)
+				if _, err = c.Redeem(ctx, cap.RedeemRequest{RedeemToken: data.RedeemToken}); !errors.Is(err, cap.ErrInvalidRedeemToken) {
+					t.Errorf("Redeem after expiry: error = %v, want %v", err, cap.ErrInvalidRedeemToken)
+				}
+			})
+		}
+	}
+}
+
+func TestCreateChallengeRateLimitSubject(t *testing.T) {
+	ip := netip.MustParseAddr("::ffff:192.0.2.1")
+	account := &cap.RateLimitSubject{Kind: cap.RateLimitKindAccount, Value: "123"}
+
+	tests := []struct {
+		name    string
+		ip      *netip.Addr
+		subject *cap.RateLimitSubject
+		want    *cap.RateLimitSubject
+		wantErr error
+	}{
+		{"None", nil, nil, nil, nil},
+		{"IP", &ip, nil, &cap.RateLimitSubject{cap.RateLimitKindIP, "192.0.2.1"}, nil},
+		{"Subject", nil, account, account, nil},
+		{"SubjectOverridesIP", &ip, account, account, nil},
+		{"InvalidSubject", nil, &cap.RateLimitSubject{Kind: "bad:kind", Value: "123"}, nil, cap.ErrInvalidRateLimitSubject},
+		{"InvalidIPSubject", &ip, &cap.RateLimitSubject{Kind: cap.RateLimitKindIP, Value: "nope"}, nil, cap.ErrInvalidRateLimitSubject},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := fake.NewClock(time.Now())
+			driver := fake.NewDriver(clock)
+			c := cap.NewCap(driver, cap.WithClock(clock))
+
+			chal, err := c.CreateChallenge(context.Background(), cap.ChallengeRequest{
+				Params:           testParams,
+				ValidDuration:    time.Minute,
+				IP:               tt.ip,
+				RateLimitSubject: tt.subject,
+			})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("CreateChallenge: error = %v, want %v", err, tt.wantErr)
+				}
+				if driver.Len() != 0 {
+					t.Errorf("CreateChallenge: challenge was stored despite invalid subject")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateChallenge: unexpected error: %v", err)
+			}
+
+			got := driver.Subject(chal.ChallengeToken)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("Store: subject = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedRedeemTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		key  cap.TokenKey
+	}{
+		{"Ed25519", cap.NewRandomEd25519Key("ed-1")},
+		{"HMAC", cap.NewRandomHMACKey("hmac-1")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			clock := fake.NewClock(time.Now())
+
+			keyring, err := cap.NewTokenKeyring(tt.key)
+			if err != nil {
+				t.Fatalf("NewTokenKeyring: unexpected error: %v", err)
+			}
+			c := cap.NewCap(fake.NewDriver(clock), cap.WithClock(clock), cap.WithSignedRedeemTokens(keyring))
+
+			scope := cap.Scope{SiteKey: "site", Action: "signup"}
+			metadata := map[string]string{"form": "signup"}
+			data := solveNewChallenge(t, c, cap.ChallengeRequest{
+				Params:              testParams,
+				Scope:               scope,
+				ValidDuration:       time.Minute,
+				RedeemValidDuration: 5 * time.Minute,
+				Metadata:            metadata,
+			})
+			claims, err := cap.ParseRedeemToken(keyring, data.RedeemToken)
+			if err != nil {
+				t.Fatalf("ParseRedeemToken: unexpected error: %v", err)
+			}
+			if claims.Scope() != scope || !maps.Equal(claims.Metadata, metadata) {
+				t.Errorf("ParseRedeemToken: claims = %+v, want scope %+v and metadata %v", claims, scope, metadata)
+			}
+			if want := clock.Now().Add(5 * time.Minute).Unix(); claims.ExpiresAt != want {
+				t.Errorf("ParseRedeemToken: ExpiresAt = %d, want %d", claims.ExpiresAt, want)
+			}
+
+			// Services can verify Ed25519 tokens with the published keys.
+			if jwk, ok := tt.key.PublicJWK(); ok {
+				published, err := cap.NewTokenKeyringFromJWKS(cap.JWKSet{Keys: []cap.JWK{jwk}})
+				if err != nil {
+					t.Fatalf("NewTokenKeyringFromJWKS: unexpected error: %v", err)
+				}
+				if _, err = cap.ParseRedeemToken(published, data.RedeemToken); err != nil {
+					t.Errorf("ParseRedeemToken with published keys: unexpected error: %v", err)
+				}
+				if _, err = published.Primary().SignToken("input"); err != cap.ErrVerifyOnlyKey {
+					t.Errorf("SignToken with published key: error = %v, want %v", err, cap.ErrVerifyOnlyKey)
+				}
+			}
+
+			redemption, err := c.Redeem(ctx, cap.RedeemRequest{RedeemToken: data.RedeemToken, Scope: scope})
+			if err != nil {
+				t.Fatalf("Redeem: unexpected error: %v", err)
+			}
+			if redemption.Scope != scope || !maps.Equal(redemption.Metadata, metadata) {
+				t.Errorf("Redeem: redemption = %+v, want scope %+v and metadata %v", redemption, scope, metadata)
+			}
+
+			if _, err = c.Redeem(ctx, cap.RedeemRequest{RedeemToken: data.RedeemToken, Scope: scope}); err != cap.ErrInvalidRedeemToken {
+				t.Errorf("second Redeem: error = %v, want %v", err, cap.ErrInvalidRedeemToken)
+			}
+
+			// Tokens are invalidated even if they were redeemed for the wrong scope.
+			data = solveNewChallenge(t, c, cap.ChallengeRequest{Params: testParams, Scope: scope, ValidDuration: time.Minute})
+			if _, err = c.Redeem(ctx, cap.RedeemRequest{RedeemToken: data.RedeemToken}); err != cap.ErrScopeMismatch {
+				t.Errorf("Redeem with other scope: error = %v, want %v", err, cap.ErrScopeMismatch)
+			}
+			if _, err = c.Redeem(ctx, cap.RedeemRequest{RedeemToken: data.RedeemToken, Scope: scope}); err != cap.ErrInvalidRedeemToken {
+				t.Errorf("Redeem after scope mismatch: error = %v, want %v", err, cap.ErrInvalidRedeemToken)
+			}
+
+			data = solveNewChallenge(t, c, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+			clock.Advance(time.Minute)
+			if _, err = c.Redeem(ctx, cap.RedeemRequest{RedeemToken: data.RedeemToken}); err != cap.ErrInvalidRedeemToken {
+				t.Errorf("Redeem after expiry: error = %v, want %v", err, cap.ErrInvalidRedeemToken)
+			}
+		})
+	}
+}
+
+func TestSignedRedeemTokenKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	clock := fake.NewClock(time.Now())
+
+	oldKey := cap.NewRandomEd25519Key("old")
+	keyring, err := cap.NewTokenKeyring(oldKey)
+	if err != nil {
+		t.Fatalf("NewTokenKeyring: unexpected error: %v", err)
+	}
+	c := cap.NewCap(fake.NewDriver(clock), cap.WithClock(clock), cap.WithSignedRedeemTokens(keyring))
+
+	first := solveNewChallenge(t, c, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+	second := solveNewChallenge(t, c, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+
+	if err = keyring.Rotate(cap.NewRandomEd25519Key("new")); err != nil {
+		t.Fatalf("Rotate: unexpected error: %v", err)
+	}
+	rotated := solveNewChallenge(t, c, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+
+	// Tokens signed with the previous primary key are accepted until it is removed.
+	if ok, err := c.UseRedeemToken(ctx, first.RedeemToken); err != nil || !ok {
+		t.Errorf("UseRedeemToken with old key: got %t, %v, want true", ok, err)
+	}
+
+	keyring.Remove("old")
+	if ok, err := c.UseRedeemToken(ctx, second.RedeemToken); err != nil || ok {
+		t.Errorf("UseRedeemToken with removed key: got %t, %v, want false", ok, err)
+	}
+	if ok, err := c.UseRedeemToken(ctx, rotated.RedeemToken); err != nil || !ok {
+		t.Errorf("UseRedeemToken with new key: got %t, %v, want true", ok, err)
+	}
+}
+
+func TestSignedRedeemTokensWithoutSpentTokenDriver(t *testing.T) {
+	clock := fake.NewClock(time.Now())
+	keyring, err := cap.NewTokenKeyring(cap.NewRandomHMACKey("hmac"))
+	if err != nil {
+		t.Fatalf("NewTokenKeyring: unexpected error: %v", err)
+	}
+
+	// Embedding the driver in a struct hides its MarkTokenSpent method.
+	driver := struct{ cap.Driver }{fake.NewDriver(clock)}
+	c := cap.NewCap(driver, cap.WithClock(clock), cap.WithSignedRedeemTokens(keyring))
+
+	data := solveNewChallenge(t, c, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+	if _, err = c.Redeem(context.Background(), cap.RedeemRequest{RedeemToken: data.RedeemToken}); !errors.Is(err, cap.ErrSpentTokensUnsupported) {
+		t.Errorf("Redeem: error = %v, want %v", err, cap.ErrSpentTokensUnsupported)
+	}
+}
+
+func TestStoreLimiterOptions(t *testing.T) {
+	ctx := context.Background()
+	clock := fake.NewClock(time.Now())
+	store := fake.NewDriver(clock)
+
+	l := cap.NewSlidingLogLimiter(store, "test",
+		cap.WithMaxChallengesPerIP(2),
+		cap.WithMaxChallengesPerKind(cap.RateLimitKindAccount, 1),
+		cap.WithMaxChallengesPerKind(cap.RateLimitKindAPIKey, 0),
+		cap.WithMaxChallengesWindow(time.Minute),
+		cap.WithRateLimitClock(clock),
+	)
+
+	tests := []struct {
+		subject cap.RateLimitSubject
+		want    []bool
+	}{
+		{cap.RateLimitSubject{cap.RateLimitKindIP, "192.0.2.1"}, []bool{true, true, false}},
+		{cap.RateLimitSubject{cap.RateLimitKindAccount, "42"}, []bool{true, false}},
+		{cap.RateLimitSubject{cap.RateLimitKindAPIKey, "key"}, []bool{false}},
+	}
+
+	for _, tt := range tests {
+		for i, want := range tt.want {
+			if allowed, err := l.Allow(ctx, &tt.subject); err != nil || allowed != want {
+				t.Errorf("Allow %d for %+v: got %t, %v, want %t", i, tt.subject, allowed, err, want)
+			}
+		}
+	}
+
+	// The limiter uses the clock from its options.
+	clock.Advance(time.Minute)
+	if allowed, err := l.Allow(ctx, &cap.RateLimitSubject{cap.RateLimitKindAccount, "42"}); err != nil || !allowed {
+		t.Errorf("Allow after window: got %t, %v, want true", allowed, err)
+	}
+
+	// Rate limiting is disabled without a window.
+	unlimited := cap.NewGCRALimiter(store, "unlimited", cap.WithMaxChallengesPerIP(0), cap.WithMaxChallengesWindow(0))
+	if allowed, err := unlimited.Allow(ctx, &cap.RateLimitSubject{cap.RateLimitKindIP, "192.0.2.1"}); err != nil || !allowed {
+		t.Errorf("Allow without window: got %t, %v, want true", allowed, err)
+	}
+}
+
+// observerEvents records the events that an observer received.
+type observerEvents struct {
+	mu     sync.Mutex
+	create []cap.CreateChallengeEvent
+	verify []cap.VerifySolutionsEvent
+	redeem []cap.UseRedeemTokenEvent
+}
+
+// observer returns an observer that records events.
+func (e *observerEvents) observer() cap.Observer {
+	return cap.ObserverFuncs{
+		CreateChallenge: func(ctx context.Context, event cap.CreateChallengeEvent) {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.create = append(e.create, event)
+		},
+		VerifySolutions: func(ctx context.Context, event cap.VerifySolutionsEvent) {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.verify = append(e.verify, event)
+		},
+		UseRedeemToken: func(ctx context.Context, event cap.UseRedeemTokenEvent) {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.redeem = append(e.redeem, event)
+		},
+	}
+}
+
+// reset clears the recorded events.
+func (e *observerEvents) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.create, e.verify, e.redeem = nil, nil, nil
+}
+
+// counts returns the number of recorded events of each kind.
+func (e *observerEvents) counts() [3]int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return [3]int{len(e.create), len(e.verify), len(e.redeem)}
+}
+
+func TestObserverEvents(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	ctx := cap.ContextWithClientIP(context.Background(), &ip)
+	scope := cap.Scope{SiteKey: "site", Action: "login"}
+
+	var events observerEvents
+	clock := fake.NewClock(time.Now())
+	c := cap.NewCap(fake.NewDriver(clock),
+		cap.WithClock(clock),
+		cap.WithObserver(events.observer()),
+		cap.WithRateLimiter(cap.NewSlidingLogLimiter(fake.NewDriver(clock), "test",
+			cap.WithMaxChallengesPerIP(1),
+			cap.WithMaxChallengesWindow(time.Minute),
+			cap.WithRateLimitClock(clock),
+		)),
+	)
+
+	expectEvents := func(op string, want [3]int) {
+		t.Helper()
+		if got := events.counts(); got != want {
+			t.Fatalf("%s: created, verified and redeemed events = %v, want %v", op, got, want)
+		}
+	}
+
+	chal, err := c.CreateChallenge(ctx, cap.ChallengeRequest{Params: testParams, Scope: scope, IP: &ip, ValidDuration: time.Minute})
+	if err != nil {
+		t.Fatalf("CreateChallenge: unexpected error: %v", err)
+	}
+	expectEvents("CreateChallenge", [3]int{1, 0, 0})
+	if ev := events.create[0]; ev.ChallengeToken != chal.ChallengeToken || ev.Params != testParams || ev.Scope != scope ||
+		ev.IP == nil || *ev.IP != ip || !ev.Expires.Equal(chal.Expires) || ev.Err != nil {
+		t.Errorf("CreateChallenge: event = %+v", ev)
+	}
+
+	events.reset()
+	_, err = c.CreateChallenge(ctx, cap.ChallengeRequest{Params: testParams, IP: &ip, ValidDuration: time.Minute})
+	if !errors.Is(err, cap.ErrRateLimited) {
+		t.Fatalf("CreateChallenge over limit: error = %v, want %v", err, cap.ErrRateLimited)
+	}
+	expectEvents("CreateChallenge over limit", [3]int{1, 0, 0})
+	if ev := events.create[0]; ev.ChallengeToken != "" || !ev.Expires.IsZero() || !errors.Is(ev.Err, cap.ErrRateLimited) {
+		t.Errorf("CreateChallenge over limit: event = %+v", ev)
+	}
+
+	solutions := cap.ReferenceSolve(chal.ChallengeToken, chal.Params)
+	invalid := []uint32{solutions[0], cap.InvalidSolution(t, chal.ChallengeToken, chal.Params, solutions, 1)}
+
+	events.reset()
+	if _, err = c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{ChallengeToken: chal.ChallengeToken, Solutions: invalid}); err != cap.ErrInvalidSolution {
+		t.Fatalf("VerifyChallengeSolutions with invalid solution: error = %v, want %v", err, cap.ErrInvalidSolution)
+	}
+	expectEvents("VerifyChallengeSolutions with invalid solution", [3]int{0, 1, 0})
+	if ev := events.verify[0]; ev.ChallengeToken != chal.ChallengeToken || ev.Params != testParams || ev.IP == nil || *ev.IP != ip ||
+		ev.SolutionCount != len(invalid) || !errors.Is(ev.Err, cap.ErrInvalidSolution) {
+		t.Errorf("VerifyChallengeSolutions with invalid solution: event = %+v", ev)
+	}
+
+	events.reset()
+	data, err := c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{ChallengeToken: chal.ChallengeToken, Solutions: solutions})
+	if err != nil {
+		t.Fatalf("VerifyChallengeSolutions: unexpected error: %v", err)
+	}
+	expectEvents("VerifyChallengeSolutions", [3]int{0, 1, 0})
+	if ev := events.verify[0]; ev.ChallengeToken != chal.ChallengeToken || ev.SolutionCount != len(solutions) || ev.Err != nil {
+		t.Errorf("VerifyChallengeSolutions: event = %+v", ev)
+	}
+
+	events.reset()
+	if _, err = c.Redeem(ctx, cap.RedeemRequest{RedeemToken: data.RedeemToken, Scope: scope}); err != nil {
+		t.Fatalf("Redeem: unexpected error: %v", err)
+	}
+	expectEvents("Redeem", [3]int{0, 0, 1})
+	if ev := events.redeem[0]; ev.RedeemToken != data.RedeemToken || ev.ChallengeToken != chal.ChallengeToken || ev.Params != testParams ||
+		ev.Scope != scope || ev.IP == nil || *ev.IP != ip || !ev.WasRedeemed || ev.Err != nil {
+		t.Errorf("Redeem: event = %+v", ev)
+	}
+
+	// UseRedeemToken reports false instead of an error, but its event still has the error.
+	events.reset()
+	if ok, err := c.UseRedeemToken(ctx, data.RedeemToken); err != nil || ok {
+		t.Fatalf("UseRedeemToken after Redeem: got %t, %v, want false", ok, err)
+	}
+	expectEvents("UseRedeemToken", [3]int{0, 0, 1})
+	if ev := events.redeem[0]; ev.RedeemToken != data.RedeemToken || ev.WasRedeemed || !errors.Is(ev.Err, cap.ErrInvalidRedeemToken) {
+		t.Errorf("UseRedeemToken: event = %+v", ev)
+	}
+}
+
+func TestObserverEventsWithoutClientIP(t *testing.T) {
+	var events observerEvents
+	c := cap.NewCap(fake.NewDriver(cap.SystemClock), cap.WithObserver(events.observer()))
+
+	data := solveNewChallenge(t, c, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+	if _, err := c.UseRedeemToken(context.Background(), data.RedeemToken); err != nil {
+		t.Fatalf("UseRedeemToken: unexpected error: %v", err)
+	}
+
+	if got, want := events.counts(), [3]int{1, 1, 1}; got != want {
+		t.Fatalf("created, verified and redeemed events = %v, want %v", got, want)
+	}
+	if events.create[0].IP != nil || events.verify[0].IP != nil || events.redeem[0].IP != nil {
+		t.Errorf("events have IPs %v, %v, %v, want nil", events.create[0].IP, events.verify[0].IP, events.redeem[0].IP)
+	}
+}
+
+func TestObserverStatelessDriverDuration(t *testing.T) {
+	keyring, err := cap.NewHMACKeyring(cap.NewRandomHMACKey("challenge"))
+	if err != nil {
+		t.Fatalf("NewHMACKeyring: unexpected error: %v", err)
+	}
+
+	var events observerEvents
+	c := cap.NewCap(fake.NewDriver(cap.SystemClock), cap.WithStatelessChallenges(keyring), cap.WithObserver(events.observer()))
+	ctx := context.Background()
+
+	chal, err := c.CreateChallenge(ctx, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+	if err != nil {
+		t.Fatalf("CreateChallenge: unexpected error: %v", err)
+	}
+	solutions := cap.ReferenceSolve(chal.ChallengeToken, chal.Params)
+	invalid := []uint32{solutions[0], cap.InvalidSolution(t, chal.ChallengeToken, chal.Params, solutions, 1)}
+	if _, err = c.VerifyChallengeSolutions(ctx, cap.VerifySolutionsRequest{ChallengeToken: chal.ChallengeToken, Solutions: invalid}); err != cap.ErrInvalidSolution {
+		t.Fatalf("VerifyChallengeSolutions: error = %v, want %v", err, cap.ErrInvalidSolution)
+	}
+
+	// Stateless challenges are created and checked without the driver.
+	if got := events.create[0].DriverDuration; got != 0 {
+		t.Errorf("CreateChallenge: DriverDuration = %v, want 0", got)
+	}
+	if got := events.verify[0].DriverDuration; got != 0 {
+		t.Errorf("VerifyChallengeSolutions with invalid solution: DriverDuration = %v, want 0", got)
+	}
+}
+
+func TestObserversCalledInOrder(t *testing.T) {
+	var calls []string
+	observer := func(name string) cap.Observer {
+		return cap.ObserverFuncs{
+			CreateChallenge: func(context.Context, cap.CreateChallengeEvent) { calls = append(calls, name+":create") },
+			VerifySolutions: func(context.Context, cap.VerifySolutionsEvent) { calls = append(calls, name+":verify") },
+			UseRedeemToken:  func(context.Context, cap.UseRedeemTokenEvent) { calls = append(calls, name+":redeem") },
+		}
+	}
+
+	c := cap.NewCap(fake.NewDriver(cap.SystemClock),
+		cap.WithObserver(observer("first")),
+		cap.WithObserver(cap.ObserverFuncs{}),
+		cap.WithObserver(observer("second")),
+	)
+
+	data := solveNewChallenge(t, c, cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute})
+	if _, err := c.UseRedeemToken(context.Background(), data.RedeemToken); err != nil {
+		t.Fatalf("UseRedeemToken: unexpected error: %v", err)
+	}
+
+	want := []string{"first:create", "second:create", "first:verify", "second:verify", "first:redeem", "second:redeem"}
+	if !slices.Equal(calls, want) {
+		t.Errorf("observer calls = %v, want %v", calls, want)
+	}
+}
+
+func TestWithTokenGenerator(t *testing.T) {
+	ctx := context.Background()
+	req := cap.ChallengeRequest{Params: testParams, ValidDuration: time.Minute}
+
+	t.Run("Stateful", func(t *testing.T) {
+		c := cap.NewCap(fake.NewDriver(cap.SystemClock), cap.WithTokenGenerator(fake.NewTokenGenerator()))
+
+		// Each challenge takes a token for its challenge token, then one for its redeem token.
+		for i := range 2 {
+			chal, err := c.CreateChallenge(ctx, req)
+			if err != nil {
+				t.Fatalf("CreateChallenge: unexpected error: %v", err)
+			}
+
+			wantChallenge := strings.Repeat("00", 24) + fmt.Sprintf("%02x", 2*i+1)
+			wantRedeem := strings.Repeat("00", 24) + fmt.Sprintf("%02x", 2*i+2)
+			if chal.ChallengeToken != wantChallenge || chal.RedeemToken != wantRedeem {
+				t.Errorf("challenge %d: tokens = %q, %q, want %q, %q", i, chal.ChallengeToken, chal.RedeemToken, wantChallenge, wantRedeem)
+			}
+		}
+	})
+
+	t.Run("Stateless", func(t *testing.T) {
+		keyring, err := cap.NewHMACKeyring(cap.NewRandomHMACKey("k1"))
+		if err != nil {
+			t.Fatalf("NewHMACKeyring: unexpected error: %v", err)
+		}
+		c := cap.NewCap(nil, cap.WithStatelessChallenges(keyring), cap.WithTokenGenerator(fake.NewTokenGenerator()))
+
+		// The 16 byte nonce follows the expiration time and params in the payload.
+		for i := range 2 {
+			chal, err := c.CreateChallenge(ctx, req)
+			if err != nil {
+				t.Fatalf("CreateChallenge: unexpected error: %v", err)
+			}
+
+			payload, err := base64.RawURLEncoding.DecodeString(strings.Split(chal.ChallengeToken, ".")[2])
+			if err != nil {
+				t.Fatalf("decoding payload: %v", err)
+			}
+			want := append(make([]byte, 15), byte(i+1))
+			if nonce := payload[20:36]; !bytes.Equal(nonce, want) {
+				t.Errorf("challenge %d: nonce = %x, want %x", i, nonce, want)
+			}
+		}
+	})
+}
+
+func TestCreateChallengeMetadataTooLarge(t *testing.T) {
+	tooManyEntries := make(map[string]string, cap.MaxMetadataEntries+1)
+	for i := range cap.MaxMetadataEntries + 1 {
+		tooManyEntries[fmt.Sprintf("k%d", i)] = "v"
+	}
+	tooLarge := map[string]string{"key": strings.Repeat("v", cap.MaxMetadataSize)}
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{"TooManyEntries", tooManyEntries},
+		{"TooLarge", tooLarge},
+	}
+
+	for _, stateless := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("Stateless=%t/%s", stateless, tt.name), func(t *testing.T) {
+				clock := fake.NewClock(time.Now())
+				driver := fake.NewDriver(clock)
+				opts := []func(c *cap.Cap){cap.WithClock(clock)}
+				if stateless {
+					keyring, err := cap.NewHMACKeyring(cap.NewRandomHMACKey("k1"))
+					if err != nil {
+						t.Fatalf("NewHMACKeyring: unexpected error: %v", err)
+					}
+					opts = append(opts, cap.WithStatelessChallenges(keyring))
+				}
+				c := cap.NewCap(driver, opts...)
+
+				chal, err := c.CreateChallenge(context.Background(), cap.ChallengeRequest{
+					Params:        testParams,
+					ValidDuration: time.Minute,
+					Metadata:      tt.metadata,
+				})
+				if !errors.Is(err, cap.ErrMetadataTooLarge) || chal != nil {
+					t.Errorf("CreateChallenge = %v, %v, want nil, %v", chal, err, cap.ErrMetadataTooLarge)
+				}
+				if driver.Len() != 0 {
+					t.Errorf("CreateChallenge: challenge was stored despite too large metadata")
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package cap
+
+import (
+	"crypto/rand"
+	"time"
+)
+
+// Clock tells the current time.
+// Cap and the drivers use it for expiration times and rate limit windows, so tests can control time with a fake clock,
+// such as the one in the cap/fake package.
+// Durations of operations reported to observers are always measured with the system clock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+}
+
+// SystemClock is the Clock that reads the system's wall clock.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// TokenGenerator generates the random bytes that challenge tokens and redeem tokens are made of.
+// Tokens must be unguessable, so implementations other than a fake one used in tests must be
+// cryptographically secure.
+type TokenGenerator interface {
+	// GenerateToken fills b with random bytes.
+	GenerateToken(b []byte)
+}
+
+// RandomTokenGenerator is the TokenGenerator that reads from crypto/rand.
+var RandomTokenGenerator TokenGenerator = randomTokenGenerator{}
+
+type randomTokenGenerator struct{}
+
+func (randomTokenGenerator) GenerateToken(b []byte) {
+	_, _ = rand.Read(b)
+}
+
+// WithClock sets the clock used for expiration times.
+// Drivers have their own clock options, which should be set to the same clock.
+// When not specified, uses SystemClock.
+func WithClock(clock Clock) func(c *Cap) {
+	return func(c *Cap) {
+		c.clock = clock
+	}
+}
+
+// WithTokenGenerator sets the generator of challenge tokens, redeem tokens and stateless challenge nonces.
+// When not specified, uses RandomTokenGenerator.
+func WithTokenGenerator(tokens TokenGenerator) func(c *Cap) {
+	return func(c *Cap) {
+		c.tokens = tokens
+	}
+}
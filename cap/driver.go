@@ -3,12 +3,11 @@ package cap
 import (
 	"context"
 	"errors"
-	"net/netip"
 	"time"
 )
 
-// ErrRateLimited is returned when a rate limit for an IP has been reached.
-// This can be returned by Driver.Store when an IP address is specified.
+// ErrRateLimited is returned when a rate limit for a subject, such as an IP address, has been reached.
+// This can be returned by Driver.Store when a rate limit subject is specified.
 // Rate limits are defined by driver implementations.
 var ErrRateLimited = errors.New("captcha could not be created because a rate limit was hit")
 
@@ -17,27 +16,46 @@ var ErrRateLimited = errors.New("captcha could not be created because a rate lim
 // It is also responsible for clearing expired challenges, and optionally
 // enforcing rate limits.
 type Driver interface {
-	// Store stores a challenge.
+	// Store stores a challenge, including its scope and redeem token expiration.
 	// The challenge must not be nil.
-	// The driver is responsible for clearing expired challenges.
+	// The driver is responsible for clearing expired challenges, and must not clear a challenge before both its
+	// expiration time and its redeem token's expiration time have passed.
 	//
-	// If `ip` is not nil, it can be used for rate limiting, and the
+	// If `subject` is not nil, it can be used for rate limiting, and the
 	// driver may return ErrRateLimited.
-	Store(ctx context.Context, challenge *Challenge, ip *netip.Addr) error
+	// Drivers count challenges by the subject's key (see RateLimitSubject.Key).
+	//
+	// Store may be called more than once with the same challenge (for example when solutions for a
+	// stateless challenge are submitted again). Storing a challenge whose token already exists must
+	// do nothing, and must not make an already-used redeem token usable again.
+	Store(ctx context.Context, challenge *Challenge, subject *RateLimitSubject) error
 
 	// GetUnredeemedChallenge returns the unredeemed challenge with the specified challenge token.
 	// Returns nil if the challenge does not exist, is expired, or is already redeemed.
+	// The returned challenge's Solved field must be true if the challenge was solved.
 	//
 	// Will not return ErrRateLimited.
 	GetUnredeemedChallenge(ctx context.Context, challengeToken string) (*Challenge, error)
 
+	// SolveChallenge marks the unredeemed challenge with the specified challenge token as solved,
+	// and sets its redeem token's expiration time to redeemExpires, which may be after the challenge's expiration time.
+	// Returns true if the challenge was marked as solved by this call.
+	// Returns false and does nothing if the challenge does not exist, is expired, is already redeemed, or was
+	// already solved.
+	// Marking a challenge as solved must be atomic: if it is called concurrently for the same challenge, at most one
+	// call may return true.
+	//
+	// Will not return ErrRateLimited.
+	SolveChallenge(ctx context.Context, challengeToken string, redeemExpires time.Time) (bool, error)
+
 	// UseRedeemToken redeems the specified redeem token.
-	// If the challenge did not exist, was expired, or was already redeemed, returns false.
-	// If the redemption was successful, returns true.
+	// If the challenge did not exist, its redeem token was expired, or it was already redeemed, returns nil.
+	// If the redemption was successful, returns the challenge that the redeem token was issued for,
+	// including its scope.
 	// The redeem token must not be able to be re-used after calling this function with it.
 	//
 	// Will not return ErrRateLimited.
-	UseRedeemToken(ctx context.Context, redeemToken string) (wasRedeemed bool, err error)
+	UseRedeemToken(ctx context.Context, redeemToken string) (*Challenge, error)
 }
 
 const DefaultIPv4SignificantBits = 32
@@ -47,16 +65,39 @@ const DefaultMaxChallengesPerIP = 60
 const DefaultMaxChallengesWindow = 1 * time.Minute
 
 // RateLimitOptions are options for applying rate limiting to the Cap drivers.
-// It limits challenge creation based on IP address.
-// The specific rate limit algorithm and implementation is defined by the driver.
-// IP addresses are truncated to a specified number of bits. For example, you can limit based
-// on the /24 subnet for IPv4 and /48 for IPv6 instead of the default /32 and /64.
+// It limits challenge creation based on a RateLimitSubject, such as the client's IP address or user account.
+//
+// Drivers count challenges in a sliding window: Store returns ErrRateLimited if MaxChallenges challenges were already
+// stored for the subject's key within the preceding MaxChallengesWindow, measured with the driver's clock.
+// Rejected challenges are not counted, so a client that keeps retrying is allowed again as soon as its oldest counted
+// challenge leaves the window. Drivers may round creation times to the second.
+//
+// IP addresses are truncated to a network prefix with a specified number of bits (see IPPrefix). For example, you can
+// limit based on the /24 subnet for IPv4 and /48 for IPv6 instead of the default /32 and /64.
+// Any prefix length is supported, up to /32 for IPv4 and /128 for IPv6.
 type RateLimitOptions struct {
 	IPv4SignificantBits int
 	IPv6SignificantBits int
 
 	MaxChallengesPerIP  int
 	MaxChallengesWindow time.Duration
+
+	// Maximum allowed challenges per subject for specific subject kinds.
+	// Kinds not in the map use MaxChallengesPerIP.
+	MaxChallengesPerKind map[RateLimitKind]int
+
+	// The clock used by the rate limiters created with NewTokenBucketLimiter, NewGCRALimiter and NewSlidingLogLimiter.
+	// Drivers use the clock set with their own WithClock option instead.
+	Clock Clock
+}
+
+// MaxChallenges returns the maximum allowed challenges per subject of the specified kind.
+func (rl *RateLimitOptions) MaxChallenges(kind RateLimitKind) int {
+	if max, has := rl.MaxChallengesPerKind[kind]; has {
+		return max
+	}
+
+	return rl.MaxChallengesPerIP
 }
 
 // NewDefaultRateLimitOptions returns a new RateLimitOptions with default values.
@@ -66,10 +107,12 @@ func NewDefaultRateLimitOptions() *RateLimitOptions {
 		IPv6SignificantBits: DefaultIPv6SignificantBits,
 		MaxChallengesPerIP:  DefaultMaxChallengesPerIP,
 		MaxChallengesWindow: DefaultMaxChallengesWindow,
+		Clock:               SystemClock,
 	}
 }
 
 // WithIPv4SignificantBits sets the significant bits (netmask) to use for rate limit counting on IPv4 addresses.
+// Must be between 0 and 32 (inclusive).
 // When not specified, uses DefaultIPv4SignificantBits.
 func WithIPv4SignificantBits(bits int) func(rl *RateLimitOptions) {
 	return func(rl *RateLimitOptions) {
@@ -78,6 +121,7 @@ func WithIPv4SignificantBits(bits int) func(rl *RateLimitOptions) {
 }
 
 // WithIPv6SignificantBits sets the significant bits (netmask) to use for rate limit counting on IPv6 addresses.
+// Must be between 0 and 128 (inclusive).
 // When not specified, uses DefaultIPv6SignificantBits.
 func WithIPv6SignificantBits(bits int) func(rl *RateLimitOptions) {
 	return func(rl *RateLimitOptions) {
@@ -85,8 +129,7 @@ func WithIPv6SignificantBits(bits int) func(rl *RateLimitOptions) {
 	}
 }
 
-// WithMaxChallengesPerIP sets the maximum allowed challenges that can be generated per IP.
-// The underlying window algorithm (e.g. sliding window, fixed window, etc.) is determined by the specific driver.
+// WithMaxChallengesPerIP sets the maximum allowed challenges that can be generated per IP within the window.
 // When not specified, uses DefaultMaxChallengesPerIP.
 func WithMaxChallengesPerIP(max int) func(rl *RateLimitOptions) {
 	return func(rl *RateLimitOptions) {
@@ -94,8 +137,27 @@ func WithMaxChallengesPerIP(max int) func(rl *RateLimitOptions) {
 	}
 }
 
-// WithMaxChallengesWindow sets the window of time in which challenge creations are counted.
-// The underlying window algorithm (e.g. sliding window, fixed window, etc.) is determined by the specific driver.
+// WithMaxChallengesPerKind sets the maximum allowed challenges that can be generated per subject of the specified kind,
+// for example per account for RateLimitKindAccount.
+// When not specified for a kind, uses the value set by WithMaxChallengesPerIP.
+func WithMaxChallengesPerKind(kind RateLimitKind, max int) func(rl *RateLimitOptions) {
+	return func(rl *RateLimitOptions) {
+		if rl.MaxChallengesPerKind == nil {
+			rl.MaxChallengesPerKind = make(map[RateLimitKind]int)
+		}
+		rl.MaxChallengesPerKind[kind] = max
+	}
+}
+
+// WithRateLimitClock sets the clock used by rate limiters to measure windows.
+// When not specified, uses SystemClock.
+func WithRateLimitClock(clock Clock) func(rl *RateLimitOptions) {
+	return func(rl *RateLimitOptions) {
+		rl.Clock = clock
+	}
+}
+
+// WithMaxChallengesWindow sets the duration of the sliding window in which challenge creations are counted.
 // When not specified, uses DefaultMaxChallengesWindow.
 func WithMaxChallengesWindow(window time.Duration) func(rl *RateLimitOptions) {
 	return func(rl *RateLimitOptions) {
@@ -0,0 +1,893 @@
+// Package drivertest provides a conformance test suite for cap.Driver implementations.
+//
+// Driver authors can run it from a test in their own package:
+//
+//	func TestDriver(t *testing.T) {
+//		drivertest.Run(t, func(t *testing.T, clock cap.Clock, rl *cap.RateLimitOptions) cap.Driver {
+//			d := newMyDriver(clock, rl)
+//			t.Cleanup(func() { _ = d.Close() })
+//			return d
+//		})
+//	}
+package drivertest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+// Factory creates a new, empty driver for a single test.
+// The driver must use clock to check expiration times and rate limit windows. The suite advances it instead of waiting.
+// If rl is not nil, the driver must enforce rate limiting with the specified options.
+// The factory is responsible for cleaning up the driver, for example with t.Cleanup.
+type Factory func(t *testing.T, clock cap.Clock, rl *cap.RateLimitOptions) cap.Driver
+
+// expiresTolerance is how far a driver may round challenge expiration times.
+// Some drivers only store expiration times with second precision.
+const expiresTolerance = 1 * time.Second
+
+// expiryWait is how far to advance the clock for a short-lived challenge to expire.
+const expiryWait = 3 * time.Second
+
+// Options are options for Run.
+type Options struct {
+	realTime bool
+}
+
+// WithRealTime makes the suite wait in real time whenever it advances the clock, for drivers whose storage expires
+// entries by its own clock, such as Redis.
+// The suite then takes about half a minute.
+func WithRealTime() func(o *Options) {
+	return func(o *Options) {
+		o.realTime = true
+	}
+}
+
+// suite is the state shared by the tests of a single Run.
+type suite struct {
+	factory Factory
+	opts    Options
+}
+
+// newDriver creates a new driver for a test with a fake clock set to the current time.
+func (s *suite) newDriver(t *testing.T, rl *cap.RateLimitOptions) (cap.Driver, *fake.Clock) {
+	clock := fake.NewClock(time.Now())
+	return s.factory(t, clock, rl), clock
+}
+
+// wait advances the clock by the specified duration, and waits for it to pass if the suite runs in real time.
+func (s *suite) wait(clock *fake.Clock, d time.Duration) {
+	if s.opts.realTime {
+		time.Sleep(d)
+	}
+	clock.Advance(d)
+}
+
+// Run runs the full conformance test suite against drivers created by the factory.
+// Tests for optional interfaces such as cap.ReputationDriver and cap.SpentTokenDriver are skipped if the driver does not implement them.
+func Run(t *testing.T, factory Factory, opts ...func(o *Options)) {
+	s := &suite{factory: factory}
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+
+	t.Run("StoreGetRedeem", func(t *testing.T) { testStoreGetRedeem(t, s) })
+	t.Run("UnknownTokens", func(t *testing.T) { testUnknownTokens(t, s) })
+	t.Run("StoreAgain", func(t *testing.T) { testStoreAgain(t, s) })
+	t.Run("Expiry", func(t *testing.T) { testExpiry(t, s) })
+	t.Run("RedeemExpiry", func(t *testing.T) { testRedeemExpiry(t, s) })
+	t.Run("SolveOnce", func(t *testing.T) { testSolveOnce(t, s) })
+	t.Run("ConcurrentSolve", func(t *testing.T) { testConcurrentSolve(t, s) })
+	t.Run("ConcurrentRedeem", func(t *testing.T) { testConcurrentRedeem(t, s) })
+	t.Run("RateLimitIPv4", func(t *testing.T) { testRateLimitIPv4(t, s) })
+	t.Run("RateLimitIPv6", func(t *testing.T) { testRateLimitIPv6(t, s) })
+	t.Run("RateLimitPrefixBits", func(t *testing.T) { testRateLimitPrefixBits(t, s) })
+	t.Run("RateLimitMappedIPv4", func(t *testing.T) { testRateLimitMappedIPv4(t, s) })
+	t.Run("RateLimitWindow", func(t *testing.T) { testRateLimitWindow(t, s) })
+	t.Run("RateLimitSubjects", func(t *testing.T) { testRateLimitSubjects(t, s) })
+	t.Run("RateLimitDisabled", func(t *testing.T) { testRateLimitDisabled(t, s) })
+	t.Run("ContextCancellation", func(t *testing.T) { testContextCancellation(t, s) })
+	t.Run("Reputation", func(t *testing.T) { testReputation(t, s) })
+	t.Run("SpentTokens", func(t *testing.T) { testSpentTokens(t, s) })
+	t.Run("RateLimitStore", func(t *testing.T) { testRateLimitStore(t, s) })
+}
+
+// NewChallenge returns a new challenge with random tokens that expires after the specified duration.
+// Its redeem token expires at the same time, and it has a proof-of-work scheme, a scope and metadata so that drivers are
+// checked to store them.
+func NewChallenge(validFor time.Duration) *cap.Challenge {
+	return newChallenge(cap.SystemClock, validFor)
+}
+
+// newChallenge is NewChallenge with the expiration time relative to the clock's current time.
+func newChallenge(clock cap.Clock, validFor time.Duration) *cap.Challenge {
+	expires := clock.Now().Add(validFor)
+
+	params := cap.DefaultChallengeParams
+	params.Scheme = "test-scheme"
+
+	return &cap.Challenge{
+		ChallengeToken: randomToken(),
+		RedeemToken:    randomToken(),
+		Params:         params,
+		Scope: cap.Scope{
+			SiteKey:  "site",
+			Action:   "action",
+			Audience: "audience",
+		},
+		Expires:       expires,
+		RedeemExpires: expires,
+		Metadata: map[string]string{
+			"form":   "signup",
+			"tenant": "acme",
+		},
+	}
+}
+
+func randomToken() string {
+	b := make([]byte, 25)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func mustStore(t *testing.T, d cap.Driver, chal *cap.Challenge, subject *cap.RateLimitSubject) {
+	t.Helper()
+
+	if err := d.Store(context.Background(), chal, subject); err != nil {
+		t.Fatalf("Store: unexpected error: %v", err)
+	}
+}
+
+func mustGet(t *testing.T, d cap.Driver, challengeToken string) *cap.Challenge {
+	t.Helper()
+
+	chal, err := d.GetUnredeemedChallenge(context.Background(), challengeToken)
+	if err != nil {
+		t.Fatalf("GetUnredeemedChallenge: unexpected error: %v", err)
+	}
+
+	return chal
+}
+
+func mustRedeem(t *testing.T, d cap.Driver, redeemToken string) *cap.Challenge {
+	t.Helper()
+
+	chal, err := d.UseRedeemToken(context.Background(), redeemToken)
+	if err != nil {
+		t.Fatalf("UseRedeemToken: unexpected error: %v", err)
+	}
+
+	return chal
+}
+
+// checkChallenge fails the test if got does not match want.
+func checkChallenge(t *testing.T, method string, want *cap.Challenge, got *cap.Challenge) {
+	t.Helper()
+
+	if got == nil {
+		t.Fatalf("%s: expected challenge, got nil", method)
+	}
+	if got.ChallengeToken != want.ChallengeToken {
+		t.Errorf("%s: ChallengeToken = %q, want %q", method, got.ChallengeToken, want.ChallengeToken)
+	}
+	if got.RedeemToken != want.RedeemToken {
+		t.Errorf("%s: RedeemToken = %q, want %q", method, got.RedeemToken, want.RedeemToken)
+	}
+	if got.Params != want.Params {
+		t.Errorf("%s: Params = %+v, want %+v", method, got.Params, want.Params)
+	}
+	if got.Scope != want.Scope {
+		t.Errorf("%s: Scope = %+v, want %+v", method, got.Scope, want.Scope)
+	}
+	if diff := got.Expires.Sub(want.Expires).Abs(); diff > expiresTolerance {
+		t.Errorf("%s: Expires = %v, want %v", method, got.Expires, want.Expires)
+	}
+	if got.RedeemValidDuration != want.RedeemValidDuration {
+		t.Errorf("%s: RedeemValidDuration = %v, want %v", method, got.RedeemValidDuration, want.RedeemValidDuration)
+	}
+	if diff := got.RedeemExpires.Sub(want.RedeemExpires).Abs(); diff > expiresTolerance {
+		t.Errorf("%s: RedeemExpires = %v, want %v", method, got.RedeemExpires, want.RedeemExpires)
+	}
+	if got.Solved != want.Solved {
+		t.Errorf("%s: Solved = %t, want %t", method, got.Solved, want.Solved)
+	}
+	if !maps.Equal(got.Metadata, want.Metadata) {
+		t.Errorf("%s: Metadata = %v, want %v", method, got.Metadata, want.Metadata)
+	}
+}
+
+func mustSolve(t *testing.T, d cap.Driver, challengeToken string, redeemExpires time.Time, want bool) {
+	t.Helper()
+
+	solved, err := d.SolveChallenge(context.Background(), challengeToken, redeemExpires)
+	if err != nil {
+		t.Fatalf("SolveChallenge: unexpected error: %v", err)
+	}
+	if solved != want {
+		t.Errorf("SolveChallenge: solved = %t, want %t", solved, want)
+	}
+}
+
+func testStoreGetRedeem(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, nil)
+	chal := newChallenge(clock, time.Minute)
+
+	mustStore(t, d, chal, nil)
+	checkChallenge(t, "GetUnredeemedChallenge", chal, mustGet(t, d, chal.ChallengeToken))
+
+	checkChallenge(t, "UseRedeemToken", chal, mustRedeem(t, d, chal.RedeemToken))
+
+	if got := mustGet(t, d, chal.ChallengeToken); got != nil {
+		t.Errorf("GetUnredeemedChallenge: expected nil after redemption, got %+v", got)
+	}
+	if got := mustRedeem(t, d, chal.RedeemToken); got != nil {
+		t.Errorf("UseRedeemToken: expected nil for second redemption, got %+v", got)
+	}
+}
+
+func testUnknownTokens(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, nil)
+
+	if got := mustGet(t, d, randomToken()); got != nil {
+		t.Errorf("GetUnredeemedChallenge: expected nil for unknown token, got %+v", got)
+	}
+	if got := mustRedeem(t, d, randomToken()); got != nil {
+		t.Errorf("UseRedeemToken: expected nil for unknown token, got %+v", got)
+	}
+
+	// A challenge token must not be accepted as a redeem token.
+	chal := newChallenge(clock, time.Minute)
+	mustStore(t, d, chal, nil)
+	if got := mustRedeem(t, d, chal.ChallengeToken); got != nil {
+		t.Errorf("UseRedeemToken: expected nil for challenge token, got %+v", got)
+	}
+}
+
+func testStoreAgain(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, nil)
+	chal := newChallenge(clock, time.Minute)
+
+	mustStore(t, d, chal, nil)
+	mustStore(t, d, chal, nil)
+	checkChallenge(t, "UseRedeemToken", chal, mustRedeem(t, d, chal.RedeemToken))
+
+	// Storing a redeemed challenge again must not make its redeem token usable again.
+	mustStore(t, d, chal, nil)
+	if got := mustRedeem(t, d, chal.RedeemToken); got != nil {
+		t.Errorf("UseRedeemToken: expected nil after storing redeemed challenge again, got %+v", got)
+	}
+	if got := mustGet(t, d, chal.ChallengeToken); got != nil {
+		t.Errorf("GetUnredeemedChallenge: expected nil after storing redeemed challenge again, got %+v", got)
+	}
+}
+
+func testExpiry(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, nil)
+
+	expired := newChallenge(clock, -time.Minute)
+	mustStore(t, d, expired, nil)
+	if got := mustGet(t, d, expired.ChallengeToken); got != nil {
+		t.Errorf("GetUnredeemedChallenge: expected nil for expired challenge, got %+v", got)
+	}
+	if got := mustRedeem(t, d, expired.RedeemToken); got != nil {
+		t.Errorf("UseRedeemToken: expected nil for expired challenge, got %+v", got)
+	}
+
+	shortLived := newChallenge(clock, 2*time.Second)
+	mustStore(t, d, shortLived, nil)
+	if got := mustGet(t, d, shortLived.ChallengeToken); got == nil {
+		t.Fatalf("GetUnredeemedChallenge: expected challenge before expiry, got nil")
+	}
+
+	s.wait(clock, expiryWait)
+
+	if got := mustGet(t, d, shortLived.ChallengeToken); got != nil {
+		t.Errorf("GetUnredeemedChallenge: expected nil after expiry, got %+v", got)
+	}
+	if got := mustRedeem(t, d, shortLived.RedeemToken); got != nil {
+		t.Errorf("UseRedeemToken: expected nil after expiry, got %+v", got)
+	}
+}
+
+func testRedeemExpiry(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, nil)
+
+	mustSolve(t, d, randomToken(), clock.Now().Add(time.Minute), false)
+
+	// A redeem token can outlive its challenge.
+	longRedeem := newChallenge(clock, 2*time.Second)
+	longRedeem.RedeemValidDuration = time.Minute
+	mustStore(t, d, longRedeem, nil)
+	longRedeem.RedeemExpires = clock.Now().Add(longRedeem.RedeemValidDuration)
+	longRedeem.Solved = true
+	mustSolve(t, d, longRedeem.ChallengeToken, longRedeem.RedeemExpires, true)
+
+	// A redeem token can expire before its challenge.
+	shortRedeem := newChallenge(clock, time.Minute)
+	shortRedeem.RedeemValidDuration = 2 * time.Second
+	mustStore(t, d, shortRedeem, nil)
+	mustSolve(t, d, shortRedeem.ChallengeToken, clock.Now().Add(shortRedeem.RedeemValidDuration), true)
+
+	// Solving a redeemed challenge must not make its redeem token usable again.
+	redeemed := newChallenge(clock, time.Minute)
+	mustStore(t, d, redeemed, nil)
+	checkChallenge(t, "UseRedeemToken", redeemed, mustRedeem(t, d, redeemed.RedeemToken))
+	mustSolve(t, d, redeemed.ChallengeToken, clock.Now().Add(time.Minute), false)
+	if got := mustRedeem(t, d, redeemed.RedeemToken); got != nil {
+		t.Errorf("UseRedeemToken: expected nil after solving redeemed challenge, got %+v", got)
+	}
+
+	s.wait(clock, expiryWait)
+
+	if got := mustGet(t, d, longRedeem.ChallengeToken); got != nil {
+		t.Errorf("GetUnredeemedChallenge: expected nil after challenge expiry, got %+v", got)
+	}
+	checkChallenge(t, "UseRedeemToken", longRedeem, mustRedeem(t, d, longRedeem.RedeemToken))
+
+	if got := mustRedeem(t, d, shortRedeem.RedeemToken); got != nil {
+		t.Errorf("UseRedeemToken: expected nil after redeem token expiry, got %+v", got)
+	}
+}
+
+func testSolveOnce(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, nil)
+	chal := newChallenge(clock, time.Minute)
+	mustStore(t, d, chal, nil)
+
+	chal.RedeemExpires = clock.Now().Add(2 * time.Minute)
+	chal.Solved = true
+	mustSolve(t, d, chal.ChallengeToken, chal.RedeemExpires, true)
+	checkChallenge(t, "GetUnredeemedChallenge", chal, mustGet(t, d, chal.ChallengeToken))
+
+	// Solving a challenge again must fail and must not change its redeem token's expiration time.
+	mustSolve(t, d, chal.ChallengeToken, clock.Now().Add(time.Hour), false)
+	checkChallenge(t, "UseRedeemToken", chal, mustRedeem(t, d, chal.RedeemToken))
+
+	// Storing a solved challenge again must not make it solvable again.
+	solved := newChallenge(clock, time.Minute)
+	mustStore(t, d, solved, nil)
+	mustSolve(t, d, solved.ChallengeToken, solved.RedeemExpires, true)
+	mustStore(t, d, solved, nil)
+	mustSolve(t, d, solved.ChallengeToken, solved.RedeemExpires, false)
+}
+
+func testConcurrentSolve(t *testing.T, s *suite) {
+	const goroutines = 32
+
+	d, clock := s.newDriver(t, nil)
+	chal := newChallenge(clock, time.Minute)
+	mustStore(t, d, chal, nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	solvedCount := 0
+	start := make(chan struct{})
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			solved, err := d.SolveChallenge(context.Background(), chal.ChallengeToken, chal.RedeemExpires)
+			if err != nil {
+				t.Errorf("SolveChallenge: unexpected error: %v", err)
+				return
+			}
+			if solved {
+				mu.Lock()
+				solvedCount++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if solvedCount != 1 {
+		t.Errorf("SolveChallenge: challenge was solved %d times, want exactly 1", solvedCount)
+	}
+}
+
+func testConcurrentRedeem(t *testing.T, s *suite) {
+	const goroutines = 32
+
+	d, clock := s.newDriver(t, nil)
+	chal := newChallenge(clock, time.Minute)
+	mustStore(t, d, chal, nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	start := make(chan struct{})
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			got, err := d.UseRedeemToken(context.Background(), chal.RedeemToken)
+			if err != nil {
+				t.Errorf("UseRedeemToken: unexpected error: %v", err)
+				return
+			}
+
+			if got != nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if redeemed != 1 {
+		t.Errorf("UseRedeemToken: redeem token was redeemed %d times concurrently, want exactly 1", redeemed)
+	}
+}
+
+// checkRateLimit stores challenges for each IP in order and checks whether each store was rate limited.
+func checkRateLimit(t *testing.T, d cap.Driver, clock cap.Clock, ips []string, wantLimited []bool) {
+	t.Helper()
+
+	subjects := make([]*cap.RateLimitSubject, len(ips))
+	for i, str := range ips {
+		subjects[i] = cap.NewIPRateLimitSubject(netip.MustParseAddr(str))
+	}
+	checkSubjectRateLimit(t, d, clock, subjects, wantLimited)
+}
+
+// checkSubjectRateLimit stores challenges for each subject in order and checks whether each store was rate limited.
+func checkSubjectRateLimit(t *testing.T, d cap.Driver, clock cap.Clock, subjects []*cap.RateLimitSubject, wantLimited []bool) {
+	t.Helper()
+
+	for i, subject := range subjects {
+		err := d.Store(context.Background(), newChallenge(clock, time.Minute), subject)
+
+		isLimited := errors.Is(err, cap.ErrRateLimited)
+		if err != nil && !isLimited {
+			t.Fatalf("Store #%d (%s:%s): unexpected error: %v", i, subject.Kind, subject.Value, err)
+		}
+		if isLimited != wantLimited[i] {
+			t.Errorf("Store #%d (%s:%s): rate limited = %t, want %t", i, subject.Kind, subject.Value, isLimited, wantLimited[i])
+		}
+	}
+}
+
+func testRateLimitIPv4(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, &cap.RateLimitOptions{
+		IPv4SignificantBits: 24,
+		IPv6SignificantBits: cap.DefaultIPv6SignificantBits,
+		MaxChallengesPerIP:  3,
+		MaxChallengesWindow: time.Minute,
+	})
+
+	checkRateLimit(t, d, clock,
+		[]string{"192.0.2.1", "192.0.2.2", "192.0.2.200", "192.0.2.1", "198.51.100.1", "192.0.3.1", "192.0.2.9"},
+		[]bool{false, false, false, true, false, false, true},
+	)
+}
+
+func testRateLimitIPv6(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, &cap.RateLimitOptions{
+		IPv4SignificantBits: cap.DefaultIPv4SignificantBits,
+		IPv6SignificantBits: 48,
+		MaxChallengesPerIP:  2,
+		MaxChallengesWindow: time.Minute,
+	})
+
+	checkRateLimit(t, d, clock,
+		[]string{"2001:db8:1::1", "2001:db8:1:ffff::2", "2001:db8:1:2::3", "2001:db8:2::1", "2001:db8:1::1"},
+		[]bool{false, false, true, false, true},
+	)
+}
+
+func testRateLimitPrefixBits(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, &cap.RateLimitOptions{
+		IPv4SignificantBits: 20,
+		IPv6SignificantBits: 120,
+		MaxChallengesPerIP:  2,
+		MaxChallengesWindow: time.Minute,
+	})
+
+	// Prefixes that are not a whole number of bytes are masked bit by bit,
+	// and IPv6 prefixes can be longer than 64 bits.
+	checkRateLimit(t, d, clock,
+		[]string{"198.51.16.1", "198.51.31.255", "198.51.20.1", "198.51.32.1", "198.51.0.1"},
+		[]bool{false, false, true, false, false},
+	)
+	checkRateLimit(t, d, clock,
+		[]string{"2001:db8::1", "2001:db8::ff", "2001:db8::80", "2001:db8::100", "2001:db8::1:1"},
+		[]bool{false, false, true, false, false},
+	)
+}
+
+func testRateLimitMappedIPv4(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, &cap.RateLimitOptions{
+		IPv4SignificantBits: 24,
+		IPv6SignificantBits: cap.DefaultIPv6SignificantBits,
+		MaxChallengesPerIP:  2,
+		MaxChallengesWindow: time.Minute,
+	})
+
+	// IPv4-mapped IPv6 addresses share limits with their IPv4 addresses.
+	checkSubjectRateLimit(t, d, clock,
+		[]*cap.RateLimitSubject{
+			{Kind: cap.RateLimitKindIP, Value: "::ffff:192.0.2.1"},
+			{Kind: cap.RateLimitKindIP, Value: "192.0.2.2"},
+			{Kind: cap.RateLimitKindIP, Value: "::ffff:192.0.2.3"},
+		},
+		[]bool{false, false, true},
+	)
+}
+
+func testRateLimitWindow(t *testing.T, s *suite) {
+	// A store is a challenge stored for the same IP at the specified time after the start, and whether it is rate
+	// limited.
+	// Stores are at least a second away from the window's edges, since some drivers only store times with second
+	// precision.
+	type store struct {
+		at      time.Duration
+		limited bool
+	}
+
+	tests := []struct {
+		name   string
+		max    int
+		stores []store
+	}{
+		{"ResetsAfterWindow", 2, []store{
+			{0, false},
+			{0, false},
+			{0, true},
+			{5 * time.Second, false},
+		}},
+		// A fixed window starting with the first challenge would allow the second store at 5s.
+		{"Slides", 2, []store{
+			{0, false},
+			{2 * time.Second, false},
+			{2 * time.Second, true},
+			{5 * time.Second, false},
+			{5 * time.Second, true},
+			{7 * time.Second, false},
+			{7 * time.Second, true},
+		}},
+		// Rejected challenges would keep the IP limited at 5s if they were counted.
+		{"RejectedNotCounted", 1, []store{
+			{0, false},
+			{1 * time.Second, true},
+			{2 * time.Second, true},
+			{3 * time.Second, true},
+			{5 * time.Second, false},
+			{5 * time.Second, true},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, clock := s.newDriver(t, &cap.RateLimitOptions{
+				IPv4SignificantBits: cap.DefaultIPv4SignificantBits,
+				IPv6SignificantBits: cap.DefaultIPv6SignificantBits,
+				MaxChallengesPerIP:  tt.max,
+				MaxChallengesWindow: 4 * time.Second,
+			})
+
+			var elapsed time.Duration
+			for i, st := range tt.stores {
+				if st.at > elapsed {
+					s.wait(clock, st.at-elapsed)
+					elapsed = st.at
+				}
+
+				err := d.Store(context.Background(), newChallenge(clock, time.Minute), cap.NewIPRateLimitSubject(netip.MustParseAddr("192.0.2.1")))
+
+				isLimited := errors.Is(err, cap.ErrRateLimited)
+				if err != nil && !isLimited {
+					t.Fatalf("Store #%d at %v: unexpected error: %v", i, st.at, err)
+				}
+				if isLimited != st.limited {
+					t.Errorf("Store #%d at %v: rate limited = %t, want %t", i, st.at, isLimited, st.limited)
+				}
+			}
+		})
+	}
+}
+
+func testRateLimitSubjects(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, &cap.RateLimitOptions{
+		IPv4SignificantBits:  cap.DefaultIPv4SignificantBits,
+		IPv6SignificantBits:  cap.DefaultIPv6SignificantBits,
+		MaxChallengesPerIP:   3,
+		MaxChallengesWindow:  time.Minute,
+		MaxChallengesPerKind: map[cap.RateLimitKind]int{cap.RateLimitKindAccount: 1},
+	})
+
+	alice := &cap.RateLimitSubject{Kind: cap.RateLimitKindAccount, Value: "alice"}
+	bob := &cap.RateLimitSubject{Kind: cap.RateLimitKindAccount, Value: "bob"}
+	aliceKey := &cap.RateLimitSubject{Kind: cap.RateLimitKindAPIKey, Value: "alice"}
+	ip := cap.NewIPRateLimitSubject(netip.MustParseAddr("192.0.2.1"))
+
+	// Subjects of different kinds with the same value are counted separately,
+	// and kinds without a specific limit use MaxChallengesPerIP.
+	checkSubjectRateLimit(t, d, clock,
+		[]*cap.RateLimitSubject{alice, alice, bob, aliceKey, aliceKey, aliceKey, aliceKey, ip, bob},
+		[]bool{false, true, false, false, false, false, true, false, true},
+	)
+}
+
+func testRateLimitDisabled(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, nil)
+
+	ips := make([]string, 100)
+	for i := range ips {
+		ips[i] = "192.0.2.1"
+	}
+	checkRateLimit(t, d, clock, ips, make([]bool, len(ips)))
+}
+
+func testContextCancellation(t *testing.T, s *suite) {
+	d, clock := s.newDriver(t, nil)
+	chal := newChallenge(clock, time.Minute)
+	mustStore(t, d, chal, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := d.Store(ctx, newChallenge(clock, time.Minute), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Store: error = %v, want context.Canceled", err)
+	}
+	if _, err := d.GetUnredeemedChallenge(ctx, chal.ChallengeToken); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetUnredeemedChallenge: error = %v, want context.Canceled", err)
+	}
+	if _, err := d.SolveChallenge(ctx, chal.ChallengeToken, clock.Now().Add(time.Minute)); !errors.Is(err, context.Canceled) {
+		t.Errorf("SolveChallenge: error = %v, want context.Canceled", err)
+	}
+	if _, err := d.UseRedeemToken(ctx, chal.RedeemToken); !errors.Is(err, context.Canceled) {
+		t.Errorf("UseRedeemToken: error = %v, want context.Canceled", err)
+	}
+
+	// The failed redemption must not have used up the redeem token.
+	checkChallenge(t, "UseRedeemToken", chal, mustRedeem(t, d, chal.RedeemToken))
+}
+
+func testReputation(t *testing.T, s *suite) {
+	driver, clock := s.newDriver(t, nil)
+	d, ok := driver.(cap.ReputationDriver)
+	if !ok {
+		t.Skip("driver does not implement cap.ReputationDriver")
+	}
+
+	ctx := context.Background()
+
+	getCounts := func(prefix string) cap.ReputationCounts {
+		t.Helper()
+
+		counts, err := d.GetReputation(ctx, netip.MustParsePrefix(prefix))
+		if err != nil {
+			t.Fatalf("GetReputation: unexpected error: %v", err)
+		}
+
+		return counts
+	}
+
+	add := func(prefix string, signal cap.ReputationSignal, window time.Duration) {
+		t.Helper()
+
+		if err := d.AddReputationSignal(ctx, netip.MustParsePrefix(prefix), signal, window); err != nil {
+			t.Fatalf("AddReputationSignal: unexpected error: %v", err)
+		}
+	}
+
+	if got := getCounts("192.0.2.0/24"); got != (cap.ReputationCounts{}) {
+		t.Errorf("GetReputation: expected zero counts for unknown prefix, got %+v", got)
+	}
+
+	add("192.0.2.0/24", cap.ReputationSignalChallenge, time.Minute)
+	add("192.0.2.0/24", cap.ReputationSignalChallenge, time.Minute)
+	add("192.0.2.0/24", cap.ReputationSignalFailedSolution, time.Minute)
+	add("192.0.2.0/24", cap.ReputationSignalRedemption, 2*time.Second)
+	add("2001:db8::/48", cap.ReputationSignalChallenge, time.Minute)
+
+	want := cap.ReputationCounts{Challenges: 2, FailedSolutions: 1, Redemptions: 1}
+	if got := getCounts("192.0.2.0/24"); got != want {
+		t.Errorf("GetReputation: counts = %+v, want %+v", got, want)
+	}
+	if got := getCounts("198.51.100.0/24"); got != (cap.ReputationCounts{}) {
+		t.Errorf("GetReputation: expected zero counts for other prefix, got %+v", got)
+	}
+	if got, want := getCounts("2001:db8::/48"), (cap.ReputationCounts{Challenges: 1}); got != want {
+		t.Errorf("GetReputation: IPv6 counts = %+v, want %+v", got, want)
+	}
+
+	s.wait(clock, expiryWait)
+
+	want = cap.ReputationCounts{Challenges: 2, FailedSolutions: 1}
+	if got := getCounts("192.0.2.0/24"); got != want {
+		t.Errorf("GetReputation: counts after window elapsed = %+v, want %+v", got, want)
+	}
+
+	add("192.0.2.0/24", cap.ReputationSignalRedemption, time.Minute)
+	want.Redemptions = 1
+	if got := getCounts("192.0.2.0/24"); got != want {
+		t.Errorf("GetReputation: counts after new window = %+v, want %+v", got, want)
+	}
+}
+
+func testSpentTokens(t *testing.T, s *suite) {
+	const goroutines = 32
+
+	driver, clock := s.newDriver(t, nil)
+	d, ok := driver.(cap.SpentTokenDriver)
+	if !ok {
+		t.Skip("driver does not implement cap.SpentTokenDriver")
+	}
+
+	ctx := context.Background()
+
+	mark := func(id string) bool {
+		t.Helper()
+
+		wasUnspent, err := d.MarkTokenSpent(ctx, id, clock.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("MarkTokenSpent: unexpected error: %v", err)
+		}
+
+		return wasUnspent
+	}
+
+	id := randomToken()
+	if !mark(id) {
+		t.Errorf("MarkTokenSpent: expected true for unspent token")
+	}
+	if mark(id) {
+		t.Errorf("MarkTokenSpent: expected false for spent token")
+	}
+	if !mark(randomToken()) {
+		t.Errorf("MarkTokenSpent: expected true for other unspent token")
+	}
+
+	id = randomToken()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	spent := 0
+	start := make(chan struct{})
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			wasUnspent, err := d.MarkTokenSpent(ctx, id, clock.Now().Add(time.Minute))
+			if err != nil {
+				t.Errorf("MarkTokenSpent: unexpected error: %v", err)
+				return
+			}
+
+			if wasUnspent {
+				mu.Lock()
+				spent++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if spent != 1 {
+		t.Errorf("MarkTokenSpent: token was spent %d times concurrently, want exactly 1", spent)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := d.MarkTokenSpent(cancelled, randomToken(), clock.Now().Add(time.Minute)); !errors.Is(err, context.Canceled) {
+		t.Errorf("MarkTokenSpent: error = %v, want context.Canceled", err)
+	}
+}
+
+// checkAllow calls the limiter for each subject in order and checks whether each attempt was allowed.
+func checkAllow(t *testing.T, l cap.RateLimiter, subjects []*cap.RateLimitSubject, wantAllowed []bool) {
+	t.Helper()
+
+	for i, subject := range subjects {
+		allowed, err := l.Allow(context.Background(), subject)
+		if err != nil {
+			t.Fatalf("Allow #%d (%s:%s): unexpected error: %v", i, subject.Kind, subject.Value, err)
+		}
+		if allowed != wantAllowed[i] {
+			t.Errorf("Allow #%d (%s:%s): allowed = %t, want %t", i, subject.Kind, subject.Value, allowed, wantAllowed[i])
+		}
+	}
+}
+
+func testRateLimitStore(t *testing.T, s *suite) {
+	driver, _ := s.newDriver(t, nil)
+	store, ok := driver.(cap.RateLimitStore)
+	if !ok {
+		t.Skip("driver does not implement cap.RateLimitStore")
+	}
+
+	limiters := []struct {
+		name string
+		new  func(store cap.RateLimitStore, name string, opts ...func(rl *cap.RateLimitOptions)) cap.RateLimiter
+	}{
+		{"TokenBucket", cap.NewTokenBucketLimiter},
+		{"GCRA", cap.NewGCRALimiter},
+		{"SlidingLog", cap.NewSlidingLogLimiter},
+	}
+
+	for _, limiter := range limiters {
+		t.Run(limiter.name, func(t *testing.T) {
+			clock := fake.NewClock(time.Now())
+			l := limiter.new(store, limiter.name,
+				cap.WithMaxChallengesPerIP(3),
+				cap.WithMaxChallengesWindow(time.Minute),
+				cap.WithRateLimitClock(clock),
+			)
+
+			ip := cap.NewIPRateLimitSubject(netip.MustParseAddr("192.0.2.1"))
+			other := cap.NewIPRateLimitSubject(netip.MustParseAddr("198.51.100.1"))
+
+			checkAllow(t, l,
+				[]*cap.RateLimitSubject{ip, ip, ip, ip, other},
+				[]bool{true, true, true, false, true},
+			)
+
+			// Limits are restored after the window.
+			clock.Advance(time.Minute)
+			checkAllow(t, l,
+				[]*cap.RateLimitSubject{ip, ip, ip, ip},
+				[]bool{true, true, true, false},
+			)
+		})
+	}
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const goroutines = 20
+
+		l := cap.NewSlidingLogLimiter(store, "concurrent",
+			cap.WithMaxChallengesPerIP(5),
+			cap.WithMaxChallengesWindow(time.Minute),
+		)
+		subject := cap.NewIPRateLimitSubject(netip.MustParseAddr("192.0.2.1"))
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		allowed := 0
+		start := make(chan struct{})
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+
+				ok, err := l.Allow(context.Background(), subject)
+				if err != nil {
+					t.Errorf("Allow: unexpected error: %v", err)
+					return
+				}
+
+				if ok {
+					mu.Lock()
+					allowed++
+					mu.Unlock()
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if allowed != 5 {
+			t.Errorf("Allow: %d concurrent attempts were allowed, want exactly 5", allowed)
+		}
+	})
+}
@@ -0,0 +1,7 @@
+package cap
+
+// Exported for tests in the cap_test package, which use the fake driver.
+var (
+	ReferenceSolve  = referenceSolve
+	InvalidSolution = invalidSolution
+)
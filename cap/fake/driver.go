@@ -0,0 +1,141 @@
+package fake
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/termermc/go-capjs/cap"
+)
+
+// Driver is an in-memory cap.Driver, cap.SpentTokenDriver and cap.RateLimitStore that checks expiration times with a
+// cap.Clock, so that tests in packages that cannot import the driver modules can control time.
+// It never prunes expired state and does not rate limit challenge creation, so it must never be used outside of
+// tests.
+// It is safe for concurrent use.
+type Driver struct {
+	clock cap.Clock
+
+	mu         sync.Mutex
+	challenges map[string]*cap.Challenge
+	redeemed   map[string]bool
+	spent      map[string]time.Time
+	subjects   map[string]*cap.RateLimitSubject
+	limits     map[string][]byte
+}
+
+// NewDriver creates a new Driver that uses the specified clock.
+// Use cap.SystemClock if the test does not control time.
+func NewDriver(clock cap.Clock) *Driver {
+	return &Driver{
+		clock:      clock,
+		challenges: make(map[string]*cap.Challenge),
+		redeemed:   make(map[string]bool),
+		spent:      make(map[string]time.Time),
+		subjects:   make(map[string]*cap.RateLimitSubject),
+		limits:     make(map[string][]byte),
+	}
+}
+
+// Len returns the number of stored challenges, including expired and redeemed ones.
+func (d *Driver) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.challenges)
+}
+
+// Subject returns the rate limit subject that the challenge with the specified token was stored with.
+// Returns nil if the challenge was stored without a subject, or was not stored.
+func (d *Driver) Subject(challengeToken string) *cap.RateLimitSubject {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.subjects[challengeToken]
+}
+
+func (d *Driver) Store(ctx context.Context, challenge *cap.Challenge, subject *cap.RateLimitSubject) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, has := d.challenges[challenge.ChallengeToken]; !has {
+		chal := *challenge
+		chal.Metadata = maps.Clone(challenge.Metadata)
+		d.challenges[challenge.ChallengeToken] = &chal
+		d.subjects[challenge.ChallengeToken] = subject
+	}
+
+	return nil
+}
+
+func (d *Driver) GetUnredeemedChallenge(ctx context.Context, challengeToken string) (*cap.Challenge, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chal, has := d.challenges[challengeToken]
+	if !has || d.redeemed[challengeToken] || !chal.Expires.After(d.clock.Now()) {
+		return nil, nil
+	}
+
+	c := *chal
+	c.Metadata = maps.Clone(chal.Metadata)
+	return &c, nil
+}
+
+func (d *Driver) SolveChallenge(ctx context.Context, challengeToken string, redeemExpires time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chal, has := d.challenges[challengeToken]
+	if !has || chal.Solved || d.redeemed[challengeToken] || !chal.Expires.After(d.clock.Now()) {
+		return false, nil
+	}
+
+	chal.Solved = true
+	chal.RedeemExpires = redeemExpires
+	return true, nil
+}
+
+func (d *Driver) UseRedeemToken(ctx context.Context, redeemToken string) (*cap.Challenge, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for token, chal := range d.challenges {
+		if chal.RedeemToken != redeemToken {
+			continue
+		}
+		if d.redeemed[token] || !chal.RedeemExpires.After(d.clock.Now()) {
+			return nil, nil
+		}
+
+		d.redeemed[token] = true
+		c := *chal
+		c.Metadata = maps.Clone(chal.Metadata)
+		return &c, nil
+	}
+
+	return nil, nil
+}
+
+func (d *Driver) MarkTokenSpent(ctx context.Context, id string, expires time.Time) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if spentExpires, has := d.spent[id]; has && spentExpires.After(d.clock.Now()) {
+		return false, nil
+	}
+
+	d.spent[id] = expires
+	return true, nil
+}
+
+// UpdateRateLimitState updates the state stored under the key.
+// The TTL is ignored, since expired state may be passed to update.
+func (d *Driver) UpdateRateLimitState(ctx context.Context, key string, update func(state []byte) ([]byte, time.Duration)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.limits[key], _ = update(d.limits[key])
+	return nil
+}
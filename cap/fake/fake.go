@@ -0,0 +1,87 @@
+// Package fake provides fake implementations of cap.Clock, cap.TokenGenerator and cap.Driver for deterministic tests.
+//
+// Example:
+//
+//	clock := fake.NewClock(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+//	driver := fake.NewDriver(clock)
+//	c := cap.NewCap(driver, cap.WithClock(clock), cap.WithTokenGenerator(fake.NewTokenGenerator()))
+//
+//	// Create a challenge, then let it expire.
+//	clock.Advance(cap.DefaultValidDuration)
+package fake
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// Clock is a cap.Clock that only changes when it is advanced or set.
+// It is safe for concurrent use.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock creates a new Clock set to the specified time.
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by the specified duration.
+// A negative duration moves it backward.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// Set sets the clock's current time.
+func (c *Clock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+}
+
+// TokenGenerator is a cap.TokenGenerator that generates predictable tokens from a counter.
+// Each call fills the buffer with zeros followed by the counter, so tokens are unique but not random.
+// It must never be used outside of tests.
+// It is safe for concurrent use.
+type TokenGenerator struct {
+	mu      sync.Mutex
+	counter uint64
+}
+
+// NewTokenGenerator creates a new TokenGenerator whose first token ends with the counter value 1.
+func NewTokenGenerator() *TokenGenerator {
+	return &TokenGenerator{}
+}
+
+// GenerateToken fills b with the next token.
+// If b is shorter than 8 bytes, only the low bytes of the counter are used.
+func (g *TokenGenerator) GenerateToken(b []byte) {
+	g.mu.Lock()
+	g.counter++
+	counter := g.counter
+	g.mu.Unlock()
+
+	var counterBytes [8]byte
+	binary.BigEndian.PutUint64(counterBytes[:], counter)
+
+	clear(b)
+	if len(b) >= len(counterBytes) {
+		copy(b[len(b)-len(counterBytes):], counterBytes[:])
+	} else {
+		copy(b, counterBytes[len(counterBytes)-len(b):])
+	}
+}
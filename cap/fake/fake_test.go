@@ -0,0 +1,117 @@
+package fake
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewClock(start)
+
+	if got := clock.Now(); !got.Equal(start) {
+		t.Fatalf("Now = %v, want %v", got, start)
+	}
+
+	clock.Advance(90 * time.Second)
+	if got, want := clock.Now(), start.Add(90*time.Second); !got.Equal(want) {
+		t.Errorf("Now after Advance = %v, want %v", got, want)
+	}
+
+	clock.Advance(-30 * time.Second)
+	if got, want := clock.Now(), start.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("Now after negative Advance = %v, want %v", got, want)
+	}
+
+	earlier := start.Add(-time.Hour)
+	clock.Set(earlier)
+	if got := clock.Now(); !got.Equal(earlier) {
+		t.Errorf("Now after Set = %v, want %v", got, earlier)
+	}
+
+	// The clock does not move on its own.
+	time.Sleep(time.Millisecond)
+	if got := clock.Now(); !got.Equal(earlier) {
+		t.Errorf("Now after sleeping = %v, want %v", got, earlier)
+	}
+}
+
+func TestTokenGenerator(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want [][]byte
+	}{
+		{"Long", 10, [][]byte{
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 2},
+		}},
+		{"Exact", 8, [][]byte{
+			{0, 0, 0, 0, 0, 0, 0, 1},
+			{0, 0, 0, 0, 0, 0, 0, 2},
+		}},
+		{"Short", 2, [][]byte{
+			{0, 1},
+			{0, 2},
+		}},
+		{"Empty", 0, [][]byte{{}, {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewTokenGenerator()
+			for i, want := range tt.want {
+				// Buffers are cleared, so leftover bytes do not leak into tokens.
+				b := bytes.Repeat([]byte{0xff}, tt.size)
+				g.GenerateToken(b)
+				if !bytes.Equal(b, want) {
+					t.Errorf("token %d = %v, want %v", i, b, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenGeneratorShortBufferUsesLowBytes(t *testing.T) {
+	g := NewTokenGenerator()
+	g.counter = 0x01020304
+
+	b := make([]byte, 3)
+	g.GenerateToken(b)
+	if want := []byte{0x02, 0x03, 0x05}; !bytes.Equal(b, want) {
+		t.Errorf("token = %v, want %v", b, want)
+	}
+}
+
+func TestTokenGeneratorConcurrent(t *testing.T) {
+	g := NewTokenGenerator()
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				b := make([]byte, 8)
+				g.GenerateToken(b)
+
+				mu.Lock()
+				if seen[string(b)] {
+					t.Errorf("token %v was generated twice", b)
+				}
+				seen[string(b)] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != 800 {
+		t.Errorf("generated %d unique tokens, want 800", len(seen))
+	}
+}
@@ -0,0 +1,127 @@
+package cap
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidSigningKey is returned when a signing key is not valid.
+var ErrInvalidSigningKey = errors.New("invalid signing key")
+
+// Key is a key that can be stored in a Keyring.
+type Key interface {
+	// KeyID returns the key's ID.
+	// It is included in the tokens signed by the key so that the correct key can be found for verification.
+	KeyID() string
+
+	// Validate returns an error wrapping ErrInvalidSigningKey if the key is not valid.
+	Validate() error
+}
+
+// validateKeyID returns an error wrapping ErrInvalidSigningKey if the key ID is not valid.
+func validateKeyID(id string) error {
+	if id == "" || strings.IndexByte(id, '.') != -1 {
+		return fmt.Errorf("%w: ID must be non-empty and not contain '.'", ErrInvalidSigningKey)
+	}
+
+	return nil
+}
+
+// Keyring is a set of keys with a single primary key used for signing.
+// All keys in the keyring can be used to verify signatures, which allows keys to be rotated without
+// invalidating tokens signed by the previous primary key.
+// It is safe for concurrent use.
+type Keyring[K Key] struct {
+	mu      sync.RWMutex
+	primary K
+	keys    map[string]K
+}
+
+// NewKeyring creates a new keyring with the specified primary key and optional verification-only keys.
+// Returns an error wrapping ErrInvalidSigningKey if any of the keys are invalid.
+func NewKeyring[K Key](primary K, verifyOnly ...K) (*Keyring[K], error) {
+	kr := &Keyring[K]{
+		keys: make(map[string]K, len(verifyOnly)+1),
+	}
+
+	for _, k := range verifyOnly {
+		if err := k.Validate(); err != nil {
+			return nil, err
+		}
+
+		kr.keys[k.KeyID()] = k
+	}
+
+	if err := kr.Rotate(primary); err != nil {
+		return nil, err
+	}
+
+	return kr, nil
+}
+
+// Rotate makes the specified key the primary signing key.
+// The previous primary key is kept for verification until it is removed with Remove.
+// Returns an error wrapping ErrInvalidSigningKey if the key is invalid.
+func (kr *Keyring[K]) Rotate(primary K) error {
+	if err := primary.Validate(); err != nil {
+		return err
+	}
+
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	kr.primary = primary
+	kr.keys[primary.KeyID()] = primary
+
+	return nil
+}
+
+// Remove removes the key with the specified ID from the keyring.
+// Tokens signed with the key will no longer be accepted.
+// The primary key cannot be removed; calling Remove with its ID does nothing.
+func (kr *Keyring[K]) Remove(id string) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if id == kr.primary.KeyID() {
+		return
+	}
+
+	delete(kr.keys, id)
+}
+
+// Primary returns the current primary signing key.
+func (kr *Keyring[K]) Primary() K {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	return kr.primary
+}
+
+// Get returns the key with the specified ID, and whether it exists.
+func (kr *Keyring[K]) Get(id string) (K, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	k, has := kr.keys[id]
+	return k, has
+}
+
+// Keys returns all keys in the keyring, including the primary key, sorted by ID.
+func (kr *Keyring[K]) Keys() []K {
+	kr.mu.RLock()
+	keys := make([]K, 0, len(kr.keys))
+	for _, k := range kr.keys {
+		keys = append(keys, k)
+	}
+	kr.mu.RUnlock()
+
+	slices.SortFunc(keys, func(a, b K) int {
+		return strings.Compare(a.KeyID(), b.KeyID())
+	})
+
+	return keys
+}
@@ -0,0 +1,97 @@
+package cap
+
+import (
+	"encoding/binary"
+	"errors"
+	"maps"
+	"slices"
+)
+
+// MaxMetadataEntries is the maximum number of entries in a challenge's metadata.
+const MaxMetadataEntries = 16
+
+// MaxMetadataSize is the maximum total size of the keys and values in a challenge's metadata, in bytes.
+const MaxMetadataSize = 1024
+
+// ErrMetadataTooLarge is returned when challenge metadata has more than MaxMetadataEntries entries,
+// or its keys and values are larger than MaxMetadataSize in total.
+var ErrMetadataTooLarge = errors.New("challenge metadata has too many entries or is too large")
+
+// validateMetadata returns ErrMetadataTooLarge if the metadata exceeds the limits.
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > MaxMetadataEntries {
+		return ErrMetadataTooLarge
+	}
+
+	size := 0
+	for k, v := range metadata {
+		size += len(k) + len(v)
+	}
+	if size > MaxMetadataSize {
+		return ErrMetadataTooLarge
+	}
+
+	return nil
+}
+
+// appendMetadata appends the binary encoding of metadata to buf.
+// The encoding is the number of entries as a uvarint, followed by each key and value sorted by key,
+// each prefixed with its length as a uvarint.
+func appendMetadata(buf []byte, metadata map[string]string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(metadata)))
+	for _, k := range slices.Sorted(maps.Keys(metadata)) {
+		for _, str := range []string{k, metadata[k]} {
+			buf = binary.AppendUvarint(buf, uint64(len(str)))
+			buf = append(buf, str...)
+		}
+	}
+
+	return buf
+}
+
+// readUvarintString reads a string prefixed with its length as a uvarint.
+// Returns false if the data is malformed.
+func readUvarintString(data []byte) (string, []byte, bool) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 || n > uint64(len(data)-size) {
+		return "", nil, false
+	}
+
+	return string(data[size : size+int(n)]), data[size+int(n):], true
+}
+
+// readMetadata reads metadata encoded by appendMetadata.
+// Returns nil metadata if there are no entries, and false if the data is malformed or exceeds the metadata limits.
+func readMetadata(data []byte) (map[string]string, []byte, bool) {
+	count, size := binary.Uvarint(data)
+	if size <= 0 || count > MaxMetadataEntries {
+		return nil, nil, false
+	}
+	data = data[size:]
+
+	if count == 0 {
+		return nil, data, true
+	}
+
+	metadata := make(map[string]string, count)
+	totalSize := 0
+	for range count {
+		var k, v string
+		var ok bool
+		if k, data, ok = readUvarintString(data); !ok {
+			return nil, nil, false
+		}
+		if v, data, ok = readUvarintString(data); !ok {
+			return nil, nil, false
+		}
+
+		totalSize += len(k) + len(v)
+		if totalSize > MaxMetadataSize {
+			return nil, nil, false
+		}
+
+		metadata[k] = v
+	}
+
+	return metadata, data, true
+}
@@ -0,0 +1,125 @@
+package cap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// metadataWithEntries returns metadata with n entries.
+func metadataWithEntries(n int) map[string]string {
+	metadata := make(map[string]string, n)
+	for i := range n {
+		metadata["k"+strconv.Itoa(i)] = "v"
+	}
+	return metadata
+}
+
+func TestValidateMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		wantErr  bool
+	}{
+		{"Nil", nil, false},
+		{"Empty", map[string]string{}, false},
+		{"MaxEntries", metadataWithEntries(MaxMetadataEntries), false},
+		{"TooManyEntries", metadataWithEntries(MaxMetadataEntries + 1), true},
+		{"MaxSize", map[string]string{"key": strings.Repeat("v", MaxMetadataSize-3)}, false},
+		{"TooLargeValue", map[string]string{"key": strings.Repeat("v", MaxMetadataSize-2)}, true},
+		{"TooLargeKeys", map[string]string{strings.Repeat("a", MaxMetadataSize/2): "", strings.Repeat("b", MaxMetadataSize/2+1): ""}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetadata(tt.metadata)
+			if tt.wantErr && !errors.Is(err, ErrMetadataTooLarge) {
+				t.Errorf("validateMetadata: error = %v, want %v", err, ErrMetadataTooLarge)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("validateMetadata: unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMetadataRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{"Nil", nil},
+		{"Single", map[string]string{"form": "signup"}},
+		{"EmptyKeyAndValue", map[string]string{"": "empty key", "empty value": ""}},
+		{"Binary", map[string]string{"\x00\xff": "\n\x80"}},
+		{"MaxEntries", metadataWithEntries(MaxMetadataEntries)},
+		// Lengths of 128 bytes and more take more than one byte to encode.
+		{"MaxSize", map[string]string{"key": strings.Repeat("v", MaxMetadataSize-3)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trailing := []byte("rest")
+			data := append(appendMetadata(nil, tt.metadata), trailing...)
+
+			got, rest, ok := readMetadata(data)
+			if !ok {
+				t.Fatalf("readMetadata: data %x is malformed", data)
+			}
+			if !maps.Equal(got, tt.metadata) {
+				t.Errorf("readMetadata = %v, want %v", got, tt.metadata)
+			}
+			if len(tt.metadata) == 0 && got != nil {
+				t.Errorf("readMetadata = %#v, want nil", got)
+			}
+			if !bytes.Equal(rest, trailing) {
+				t.Errorf("readMetadata: rest = %q, want %q", rest, trailing)
+			}
+		})
+	}
+}
+
+func TestAppendMetadataSortsKeys(t *testing.T) {
+	metadata := map[string]string{"b": "2", "a": "1", "c": "3"}
+	want := []byte{3, 1, 'a', 1, '1', 1, 'b', 1, '2', 1, 'c', 1, '3'}
+
+	// Map iteration order is random, so the encoding is checked several times.
+	for range 10 {
+		if got := appendMetadata(nil, metadata); !bytes.Equal(got, want) {
+			t.Fatalf("appendMetadata = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReadMetadataMalformed(t *testing.T) {
+	valid := appendMetadata(nil, map[string]string{"form": "signup"})
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", nil},
+		{"TruncatedCount", []byte{0x80}},
+		{"CountOverflow", bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1)},
+		{"TooManyEntries", binary.AppendUvarint(nil, MaxMetadataEntries+1)},
+		{"MissingEntries", []byte{1}},
+		{"MissingValue", valid[:1+1+len("form")]},
+		{"TruncatedLength", append(valid[:1+1+len("form")], 0x80)},
+		{"OversizedLength", append([]byte{1, 4}, "form\x7fsignup"...)},
+		{"HugeLength", binary.AppendUvarint([]byte{1}, 1<<63)},
+		{"TruncatedValue", valid[:len(valid)-1]},
+		{"TooLarge", appendMetadata(nil, map[string]string{"key": strings.Repeat("v", MaxMetadataSize)})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, rest, ok := readMetadata(tt.data); ok {
+				t.Errorf("readMetadata(%x) = %v, %x, true, want false", tt.data, got, rest)
+			}
+		})
+	}
+}
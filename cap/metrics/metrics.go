@@ -0,0 +1,223 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	pkg "github.com/termermc/go-capjs/cap"
+)
+
+// DefaultNamespace is the default prefix for metric names.
+const DefaultNamespace = "cap"
+
+// DefaultDriverBuckets are the default histogram buckets for driver call latencies, in seconds.
+var DefaultDriverBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// DefaultVerifyBuckets are the default histogram buckets for solution verification wall-clock time, in seconds.
+var DefaultVerifyBuckets = []float64{0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01}
+
+// DefaultHTTPBuckets are the default histogram buckets for HTTP request durations, in seconds.
+var DefaultHTTPBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Label values for the result of operations.
+const (
+	ResultCreated     = "created"
+	ResultRateLimited = "rate_limited"
+	ResultError       = "error"
+
+	ResultAccepted              = "accepted"
+	ResultInvalidSolution       = "invalid_solution"
+	ResultInsufficientSolutions = "insufficient_solutions"
+	ResultChallengeNotFound     = "challenge_not_found"
+	ResultAlreadySolved         = "already_solved"
+
+	ResultRedeemed      = "redeemed"
+	ResultRejected      = "rejected"
+	ResultScopeMismatch = "scope_mismatch"
+)
+
+// Label values for the Cap operations that driver calls are made for.
+const (
+	OperationCreateChallenge = "create_challenge"
+	OperationVerifySolutions = "verify_solutions"
+	OperationUseRedeemToken  = "use_redeem_token"
+)
+
+// Metrics collects metrics about a Cap instance and its server, and exposes them in the Prometheus text exposition format.
+//
+// It implements cap.Observer, so it must be registered with cap.WithObserver to collect challenge, solution,
+// redemption, driver and verification metrics.
+// To collect HTTP metrics for the Cap endpoints, pass it to server.WithMetrics.
+// It implements http.Handler, so it can be mounted on a route such as `/metrics` to be scraped.
+//
+// Solution verification is measured in wall-clock time rather than CPU time, since Go cannot attribute CPU time to the
+// goroutines that verify a submission.
+// Solutions may be verified in parallel (see cap.WithVerifyParallelism), so the CPU time used can be up to that many
+// times the recorded duration.
+type Metrics struct {
+	namespace string
+
+	challenges  *vec[counter]
+	solutions   *vec[counter]
+	redemptions *vec[counter]
+	driverCalls *vec[histogram]
+	verify      *vec[histogram]
+
+	httpRequests *vec[counter]
+	httpDuration *vec[histogram]
+}
+
+// WithNamespace sets the prefix for metric names.
+// When not specified, uses DefaultNamespace.
+func WithNamespace(namespace string) func(m *Metrics) {
+	return func(m *Metrics) {
+		m.namespace = namespace
+	}
+}
+
+// WithDriverBuckets sets the histogram buckets for driver call latencies, in seconds.
+// The buckets must be sorted in ascending order.
+// When not specified, uses DefaultDriverBuckets.
+func WithDriverBuckets(buckets []float64) func(m *Metrics) {
+	return func(m *Metrics) {
+		m.driverCalls = newVec(func() *histogram { return newHistogram(buckets) }, "operation")
+	}
+}
+
+// WithVerifyBuckets sets the histogram buckets for solution verification wall-clock time, in seconds.
+// The buckets must be sorted in ascending order.
+// When not specified, uses DefaultVerifyBuckets.
+func WithVerifyBuckets(buckets []float64) func(m *Metrics) {
+	return func(m *Metrics) {
+		m.verify = newVec(func() *histogram { return newHistogram(buckets) })
+	}
+}
+
+// WithHTTPBuckets sets the histogram buckets for HTTP request durations, in seconds.
+// The buckets must be sorted in ascending order.
+// When not specified, uses DefaultHTTPBuckets.
+func WithHTTPBuckets(buckets []float64) func(m *Metrics) {
+	return func(m *Metrics) {
+		m.httpDuration = newVec(func() *histogram { return newHistogram(buckets) }, "handler")
+	}
+}
+
+// NewMetrics creates a new Metrics with the specified options.
+func NewMetrics(opts ...func(m *Metrics)) *Metrics {
+	newCounter := func() *counter { return &counter{} }
+
+	m := &Metrics{
+		namespace: DefaultNamespace,
+
+		challenges:  newVec(newCounter, "result"),
+		solutions:   newVec(newCounter, "result"),
+		redemptions: newVec(newCounter, "result"),
+		driverCalls: newVec(func() *histogram { return newHistogram(DefaultDriverBuckets) }, "operation"),
+		verify:      newVec(func() *histogram { return newHistogram(DefaultVerifyBuckets) }),
+
+		httpRequests: newVec(newCounter, "handler", "code"),
+		httpDuration: newVec(func() *histogram { return newHistogram(DefaultHTTPBuckets) }, "handler"),
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	// Initialize the common series so that they are exposed as zero before anything happens.
+	for _, result := range []string{ResultCreated, ResultRateLimited, ResultError} {
+		m.challenges.with(result)
+	}
+	for _, result := range []string{ResultAccepted, ResultInvalidSolution, ResultInsufficientSolutions, ResultChallengeNotFound, ResultAlreadySolved, ResultError} {
+		m.solutions.with(result)
+	}
+	for _, result := range []string{ResultRedeemed, ResultRejected, ResultScopeMismatch, ResultError} {
+		m.redemptions.with(result)
+	}
+
+	return m
+}
+
+func (m *Metrics) OnCreateChallenge(_ context.Context, event pkg.CreateChallengeEvent) {
+	switch {
+	case event.Err == nil:
+		m.challenges.with(ResultCreated).inc()
+	case errors.Is(event.Err, pkg.ErrRateLimited):
+		m.challenges.with(ResultRateLimited).inc()
+	default:
+		m.challenges.with(ResultError).inc()
+	}
+
+	if event.DriverDuration > 0 {
+		m.driverCalls.with(OperationCreateChallenge).observe(event.DriverDuration.Seconds())
+	}
+}
+
+func (m *Metrics) OnVerifySolutions(_ context.Context, event pkg.VerifySolutionsEvent) {
+	switch {
+	case event.Err == nil:
+		m.solutions.with(ResultAccepted).inc()
+	case errors.Is(event.Err, pkg.ErrInvalidSolution):
+		m.solutions.with(ResultInvalidSolution).inc()
+	case errors.Is(event.Err, pkg.ErrInsufficientSolutions):
+		m.solutions.with(ResultInsufficientSolutions).inc()
+	case errors.Is(event.Err, pkg.ErrChallengeNotFound):
+		m.solutions.with(ResultChallengeNotFound).inc()
+	case errors.Is(event.Err, pkg.ErrChallengeAlreadySolved):
+		m.solutions.with(ResultAlreadySolved).inc()
+	default:
+		m.solutions.with(ResultError).inc()
+	}
+
+	if event.DriverDuration > 0 {
+		m.driverCalls.with(OperationVerifySolutions).observe(event.DriverDuration.Seconds())
+	}
+	if event.VerifyDuration > 0 {
+		m.verify.with().observe(event.VerifyDuration.Seconds())
+	}
+}
+
+func (m *Metrics) OnUseRedeemToken(_ context.Context, event pkg.UseRedeemTokenEvent) {
+	switch {
+	case event.Err == nil:
+		m.redemptions.with(ResultRedeemed).inc()
+	case errors.Is(event.Err, pkg.ErrInvalidRedeemToken):
+		m.redemptions.with(ResultRejected).inc()
+	case errors.Is(event.Err, pkg.ErrScopeMismatch):
+		m.redemptions.with(ResultScopeMismatch).inc()
+	default:
+		m.redemptions.with(ResultError).inc()
+	}
+
+	if event.DriverDuration > 0 {
+		m.driverCalls.with(OperationUseRedeemToken).observe(event.DriverDuration.Seconds())
+	}
+}
+
+// ObserveHTTPRequest records a completed HTTP request to a Cap endpoint.
+// It is called by server.Server when metrics are enabled with server.WithMetrics.
+func (m *Metrics) ObserveHTTPRequest(handler string, status int, duration time.Duration) {
+	m.httpRequests.with(handler, strconv.Itoa(status)).inc()
+	m.httpDuration.with(handler).observe(duration.Seconds())
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(res http.ResponseWriter, _ *http.Request) {
+	var buf bytes.Buffer
+	ns := m.namespace + "_"
+
+	writeCounterVec(&buf, ns+"challenges_total", "Challenge creation attempts by result.", m.challenges)
+	writeCounterVec(&buf, ns+"solutions_total", "Challenge solution submissions by result.", m.solutions)
+	writeCounterVec(&buf, ns+"redemptions_total", "Redeem token uses by result.", m.redemptions)
+	writeHistogramVec(&buf, ns+"driver_call_duration_seconds", "Time spent in Cap driver calls by Cap operation.", m.driverCalls)
+	writeHistogramVec(&buf, ns+"verify_duration_seconds", "Wall-clock time spent verifying challenge solutions.", m.verify)
+	writeCounterVec(&buf, ns+"http_requests_total", "HTTP requests to Cap endpoints by handler and status code.", m.httpRequests)
+	writeHistogramVec(&buf, ns+"http_request_duration_seconds", "Duration of HTTP requests to Cap endpoints.", m.httpDuration)
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	res.WriteHeader(200)
+	_, _ = res.Write(buf.Bytes())
+}
@@ -0,0 +1,217 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pkg "github.com/termermc/go-capjs/cap"
+)
+
+// scrape returns the exposition text served by m.
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("ServeHTTP: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got, want := rec.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; got != want {
+		t.Errorf("ServeHTTP: Content-Type = %q, want %q", got, want)
+	}
+
+	return rec.Body.String()
+}
+
+func TestExposition(t *testing.T) {
+	ctx := context.Background()
+
+	// Durations are powers of two in seconds, so that sums are exact.
+	m := NewMetrics(
+		WithNamespace("test"),
+		WithDriverBuckets([]float64{0.25, 1}),
+		WithVerifyBuckets([]float64{0.25}),
+		WithHTTPBuckets([]float64{0.5}),
+	)
+
+	m.OnCreateChallenge(ctx, pkg.CreateChallengeEvent{DriverDuration: 125 * time.Millisecond})
+	m.OnCreateChallenge(ctx, pkg.CreateChallengeEvent{Err: pkg.ErrRateLimited})
+	m.OnCreateChallenge(ctx, pkg.CreateChallengeEvent{Err: pkg.ErrMetadataTooLarge})
+
+	m.OnVerifySolutions(ctx, pkg.VerifySolutionsEvent{Err: pkg.ErrInvalidSolution, VerifyDuration: 125 * time.Millisecond})
+	m.OnVerifySolutions(ctx, pkg.VerifySolutionsEvent{DriverDuration: 500 * time.Millisecond, VerifyDuration: 500 * time.Millisecond})
+	m.OnVerifySolutions(ctx, pkg.VerifySolutionsEvent{Err: pkg.ErrChallengeNotFound, DriverDuration: 2 * time.Second})
+
+	// Observations equal to an upper bound are counted in its bucket.
+	m.OnUseRedeemToken(ctx, pkg.UseRedeemTokenEvent{Err: pkg.ErrScopeMismatch, DriverDuration: 250 * time.Millisecond})
+	m.OnUseRedeemToken(ctx, pkg.UseRedeemTokenEvent{})
+
+	m.ObserveHTTPRequest("challenge", 429, time.Second)
+	m.ObserveHTTPRequest("challenge", 200, 250*time.Millisecond)
+	m.ObserveHTTPRequest("redeem \"x\"\n\\", 200, 250*time.Millisecond)
+
+	want := `# HELP test_challenges_total Challenge creation attempts by result.
+# TYPE test_challenges_total counter
+test_challenges_total{result="created"} 1
+test_challenges_total{result="error"} 1
+test_challenges_total{result="rate_limited"} 1
+# HELP test_solutions_total Challenge solution submissions by result.
+# TYPE test_solutions_total counter
+test_solutions_total{result="accepted"} 1
+test_solutions_total{result="already_solved"} 0
+test_solutions_total{result="challenge_not_found"} 1
+test_solutions_total{result="error"} 0
+test_solutions_total{result="insufficient_solutions"} 0
+test_solutions_total{result="invalid_solution"} 1
+# HELP test_redemptions_total Redeem token uses by result.
+# TYPE test_redemptions_total counter
+test_redemptions_total{result="error"} 0
+test_redemptions_total{result="redeemed"} 1
+test_redemptions_total{result="rejected"} 0
+test_redemptions_total{result="scope_mismatch"} 1
+# HELP test_driver_call_duration_seconds Time spent in Cap driver calls by Cap operation.
+# TYPE test_driver_call_duration_seconds histogram
+test_driver_call_duration_seconds_bucket{operation="create_challenge",le="0.25"} 1
+test_driver_call_duration_seconds_bucket{operation="create_challenge",le="1"} 1
+test_driver_call_duration_seconds_bucket{operation="create_challenge",le="+Inf"} 1
+test_driver_call_duration_seconds_sum{operation="create_challenge"} 0.125
+test_driver_call_duration_seconds_count{operation="create_challenge"} 1
+test_driver_call_duration_seconds_bucket{operation="use_redeem_token",le="0.25"} 1
+test_driver_call_duration_seconds_bucket{operation="use_redeem_token",le="1"} 1
+test_driver_call_duration_seconds_bucket{operation="use_redeem_token",le="+Inf"} 1
+test_driver_call_duration_seconds_sum{operation="use_redeem_token"} 0.25
+test_driver_call_duration_seconds_count{operation="use_redeem_token"} 1
+test_driver_call_duration_seconds_bucket{operation="verify_solutions",le="0.25"} 0
+test_driver_call_duration_seconds_bucket{operation="verify_solutions",le="1"} 1
+test_driver_call_duration_seconds_bucket{operation="verify_solutions",le="+Inf"} 2
+test_driver_call_duration_seconds_sum{operation="verify_solutions"} 2.5
+test_driver_call_duration_seconds_count{operation="verify_solutions"} 2
+# HELP test_verify_duration_seconds Wall-clock time spent verifying challenge solutions.
+# TYPE test_verify_duration_seconds histogram
+test_verify_duration_seconds_bucket{le="0.25"} 1
+test_verify_duration_seconds_bucket{le="+Inf"} 2
+test_verify_duration_seconds_sum 0.625
+test_verify_duration_seconds_count 2
+# HELP test_http_requests_total HTTP requests to Cap endpoints by handler and status code.
+# TYPE test_http_requests_total counter
+test_http_requests_total{handler="challenge",code="200"} 1
+test_http_requests_total{handler="challenge",code="429"} 1
+test_http_requests_total{handler="redeem \"x\"\n\\",code="200"} 1
+# HELP test_http_request_duration_seconds Duration of HTTP requests to Cap endpoints.
+# TYPE test_http_request_duration_seconds histogram
+test_http_request_duration_seconds_bucket{handler="challenge",le="0.5"} 1
+test_http_request_duration_seconds_bucket{handler="challenge",le="+Inf"} 2
+test_http_request_duration_seconds_sum{handler="challenge"} 1.25
+test_http_request_duration_seconds_count{handler="challenge"} 2
+test_http_request_duration_seconds_bucket{handler="redeem \"x\"\n\\",le="0.5"} 1
+test_http_request_duration_seconds_bucket{handler="redeem \"x\"\n\\",le="+Inf"} 1
+test_http_request_duration_seconds_sum{handler="redeem \"x\"\n\\"} 0.25
+test_http_request_duration_seconds_count{handler="redeem \"x\"\n\\"} 1
+`
+
+	if got := scrape(t, m); got != want {
+		t.Errorf("exposition mismatch\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExpositionInitialSeries(t *testing.T) {
+	got := scrape(t, NewMetrics())
+
+	// Result series are exposed as zero before anything happens, while labelled histograms have no series yet.
+	for _, line := range []string{
+		`cap_challenges_total{result="created"} 0`,
+		`cap_challenges_total{result="rate_limited"} 0`,
+		`cap_solutions_total{result="invalid_solution"} 0`,
+		`cap_redemptions_total{result="redeemed"} 0`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("exposition is missing %q", line)
+		}
+	}
+	if strings.Contains(got, "cap_driver_call_duration_seconds_bucket") {
+		t.Errorf("exposition has driver call buckets before any driver call")
+	}
+}
+
+// TestConcurrentScrape checks that scrapes during observations are consistent, and is meant to be run with -race.
+func TestConcurrentScrape(t *testing.T) {
+	m := NewMetrics(WithVerifyBuckets([]float64{0.001, 0.01}))
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				// Observations are spread over all buckets, including the one above the highest bound.
+				d := time.Duration(j%3) * 5 * time.Millisecond
+				m.OnVerifySolutions(context.Background(), pkg.VerifySolutionsEvent{VerifyDuration: d + time.Microsecond})
+				m.ObserveHTTPRequest("challenge"+strconv.Itoa(i), 200, d)
+			}
+		}()
+	}
+
+	for range 200 {
+		checkHistogramsConsistent(t, scrape(t, m))
+	}
+	close(stop)
+	wg.Wait()
+
+	checkHistogramsConsistent(t, scrape(t, m))
+}
+
+// checkHistogramsConsistent checks that the buckets of each histogram series in the exposition text are cumulative,
+// and that the +Inf bucket equals the count.
+func checkHistogramsConsistent(t *testing.T, text string) {
+	t.Helper()
+
+	var last uint64
+	var inf uint64
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value, _ := strings.Cut(line, " ")
+		switch {
+		case strings.Contains(name, "_bucket"):
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				t.Fatalf("bucket %s has value %q: %v", name, value, err)
+			}
+			if v < last {
+				t.Fatalf("bucket %s = %d is smaller than the previous bucket %d", name, v, last)
+			}
+			last = v
+			if strings.Contains(name, `le="+Inf"`) {
+				inf = v
+			}
+		case strings.Contains(name, "_count"):
+			v, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				t.Fatalf("count %s has value %q: %v", name, value, err)
+			}
+			if v != inf {
+				t.Fatalf("count %s = %d, want the +Inf bucket %d", name, v, inf)
+			}
+			last = 0
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package metrics
+
+import (
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// This file contains a minimal implementation of Prometheus counters and histograms, and their text exposition format.
+// It only supports what this package needs, so that the cap module can stay dependency-free.
+
+// counter is a monotonically increasing counter.
+type counter struct {
+	value atomic.Uint64
+}
+
+func (c *counter) inc() {
+	c.value.Add(1)
+}
+
+// atomicFloat is a float64 that can be added to atomically.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) add(v float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+// histogram is a histogram with fixed, cumulative buckets.
+// The count is not stored separately, so that a scrape that happens during an observation never writes a count
+// smaller than one of its buckets.
+type histogram struct {
+	upperBounds []float64
+	// buckets has one more element than upperBounds, for observations above the highest bound.
+	buckets []atomic.Uint64
+	sum     atomicFloat
+}
+
+func newHistogram(upperBounds []float64) *histogram {
+	return &histogram{
+		upperBounds: upperBounds,
+		buckets:     make([]atomic.Uint64, len(upperBounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	// Only the first matching bucket is incremented; buckets are made cumulative when written.
+	i, _ := slices.BinarySearch(h.upperBounds, v)
+	h.buckets[i].Add(1)
+	h.sum.add(v)
+}
+
+// vec is a set of metrics of the same kind, partitioned by label values.
+type vec[M any] struct {
+	labelNames []string
+	newMetric  func() *M
+
+	mu      sync.RWMutex
+	metrics map[string]*M
+	labels  map[string][]string
+}
+
+func newVec[M any](newMetric func() *M, labelNames ...string) *vec[M] {
+	return &vec[M]{
+		labelNames: labelNames,
+		newMetric:  newMetric,
+		metrics:    make(map[string]*M),
+		labels:     make(map[string][]string),
+	}
+}
+
+// with returns the metric with the specified label values, creating it if necessary.
+// The number of values must match the number of label names.
+func (v *vec[M]) with(values ...string) *M {
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	m, has := v.metrics[key]
+	v.mu.RUnlock()
+	if has {
+		return m
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if m, has = v.metrics[key]; has {
+		return m
+	}
+
+	m = v.newMetric()
+	v.metrics[key] = m
+	v.labels[key] = slices.Clone(values)
+
+	return m
+}
+
+// each calls fn for each metric in the vec, sorted by label values.
+func (v *vec[M]) each(fn func(labels string, m *M)) {
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.metrics))
+	for key := range v.metrics {
+		keys = append(keys, key)
+	}
+	v.mu.RUnlock()
+
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		v.mu.RLock()
+		m := v.metrics[key]
+		values := v.labels[key]
+		v.mu.RUnlock()
+
+		var sb strings.Builder
+		for i, name := range v.labelNames {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(name)
+			sb.WriteString(`="`)
+			sb.WriteString(escapeLabelValue(values[i]))
+			sb.WriteByte('"')
+		}
+
+		fn(sb.String(), m)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// joinLabels joins label strings, skipping empty ones.
+func joinLabels(labels ...string) string {
+	nonEmpty := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if l != "" {
+			nonEmpty = append(nonEmpty, l)
+		}
+	}
+
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(nonEmpty, ",") + "}"
+}
+
+// writeHeader writes the HELP and TYPE lines for a metric.
+func writeHeader(w io.Writer, name string, typ string, help string) {
+	_, _ = io.WriteString(w, "# HELP "+name+" "+help+"\n# TYPE "+name+" "+typ+"\n")
+}
+
+// writeCounterVec writes all counters in a vec.
+func writeCounterVec(w io.Writer, name string, help string, v *vec[counter]) {
+	writeHeader(w, name, "counter", help)
+	v.each(func(labels string, c *counter) {
+		_, _ = io.WriteString(w, name+joinLabels(labels)+" "+strconv.FormatUint(c.value.Load(), 10)+"\n")
+	})
+}
+
+// writeHistogramVec writes all histograms in a vec.
+func writeHistogramVec(w io.Writer, name string, help string, v *vec[histogram]) {
+	writeHeader(w, name, "histogram", help)
+	v.each(func(labels string, h *histogram) {
+		var cumulative uint64
+		for i, bound := range h.upperBounds {
+			cumulative += h.buckets[i].Load()
+			_, _ = io.WriteString(w, name+"_bucket"+joinLabels(labels, `le="`+formatFloat(bound)+`"`)+" "+strconv.FormatUint(cumulative, 10)+"\n")
+		}
+
+		// The +Inf bucket and the count include every bucket that was read, so they are never smaller than them.
+		count := cumulative + h.buckets[len(h.upperBounds)].Load()
+		_, _ = io.WriteString(w, name+"_bucket"+joinLabels(labels, `le="+Inf"`)+" "+strconv.FormatUint(count, 10)+"\n")
+		_, _ = io.WriteString(w, name+"_sum"+joinLabels(labels)+" "+formatFloat(h.sum.load())+"\n")
+		_, _ = io.WriteString(w, name+"_count"+joinLabels(labels)+" "+strconv.FormatUint(count, 10)+"\n")
+	})
+}
@@ -0,0 +1,173 @@
+package cap
+
+import (
+	"context"
+	"net/netip"
+	"time"
+)
+
+// Observer receives events about what a Cap instance is doing.
+// It can be used to implement metrics, audit logs and alerting.
+//
+// Observer methods are called synchronously after each operation completes, on the goroutine that performed it,
+// so they should return quickly. They may be called concurrently.
+// To only handle some events, use ObserverFuncs.
+type Observer interface {
+	// OnCreateChallenge is called after Cap.CreateChallenge.
+	OnCreateChallenge(ctx context.Context, event CreateChallengeEvent)
+
+	// OnVerifySolutions is called after Cap.VerifyChallengeSolutions.
+	OnVerifySolutions(ctx context.Context, event VerifySolutionsEvent)
+
+	// OnUseRedeemToken is called after Cap.Redeem and Cap.UseRedeemToken.
+	OnUseRedeemToken(ctx context.Context, event UseRedeemTokenEvent)
+}
+
+// CreateChallengeEvent is the event emitted after a challenge creation attempt.
+type CreateChallengeEvent struct {
+	// The token of the created challenge.
+	// Empty if the challenge could not be created.
+	ChallengeToken string
+
+	// The params requested for the challenge.
+	Params ChallengeParams
+
+	// The scope requested for the challenge.
+	Scope Scope
+
+	// The IP address that requested the challenge.
+	// Can be nil.
+	IP *netip.Addr
+
+	// The expiration time of the created challenge.
+	// Zero if the challenge could not be created.
+	Expires time.Time
+
+	// How long the operation took, including the driver call.
+	Duration time.Duration
+
+	// How long the driver call took.
+	// Zero if the driver was not called, such as for stateless challenges.
+	DriverDuration time.Duration
+
+	// The error returned by the operation, or nil if the challenge was created.
+	// ErrRateLimited if the request was rate limited.
+	Err error
+}
+
+// VerifySolutionsEvent is the event emitted after an attempt to verify challenge solutions.
+type VerifySolutionsEvent struct {
+	// The token of the challenge that solutions were submitted for.
+	ChallengeToken string
+
+	// The params of the challenge.
+	// Zero if the challenge was not found.
+	Params ChallengeParams
+
+	// The IP address that submitted the solutions, if it was set using ContextWithClientIP.
+	// Can be nil.
+	IP *netip.Addr
+
+	// The number of solutions that were submitted.
+	SolutionCount int
+
+	// How long the operation took, including driver calls.
+	Duration time.Duration
+
+	// How long driver calls took in total.
+	// Zero if the driver was not called, such as for stateless challenges with invalid solutions.
+	DriverDuration time.Duration
+
+	// How long verifying the solutions themselves took, in wall-clock time.
+	// Zero if solutions were not checked, such as when the challenge was not found.
+	VerifyDuration time.Duration
+
+	// The error returned by the operation, or nil if the solutions were valid.
+	// ErrChallengeNotFound, ErrChallengeAlreadySolved, ErrInsufficientSolutions or ErrInvalidSolution for rejected
+	// solutions.
+	Err error
+}
+
+// UseRedeemTokenEvent is the event emitted after an attempt to use a redeem token.
+type UseRedeemTokenEvent struct {
+	// The redeem token that was used.
+	RedeemToken string
+
+	// The token of the challenge that the redeem token was issued for.
+	// Empty if the redeem token was invalid.
+	ChallengeToken string
+
+	// The params of the challenge that the redeem token was issued for.
+	// Zero if the redeem token was invalid.
+	Params ChallengeParams
+
+	// The scope that the redeem token was expected to have been issued for.
+	Scope Scope
+
+	// The IP address that used the redeem token, if it was set using ContextWithClientIP.
+	// Can be nil.
+	IP *netip.Addr
+
+	// How long the operation took, including the driver call.
+	Duration time.Duration
+
+	// How long the driver call took.
+	DriverDuration time.Duration
+
+	// Whether the redeem token was valid and has now been redeemed.
+	WasRedeemed bool
+
+	// The error returned by Cap.Redeem, or nil if the redeem token was redeemed.
+	// ErrInvalidRedeemToken or ErrScopeMismatch for rejected redeem tokens.
+	Err error
+}
+
+// ObserverFuncs is an Observer implementation that calls the functions it contains.
+// Nil functions are ignored, so only the events of interest need to be handled.
+type ObserverFuncs struct {
+	CreateChallenge func(ctx context.Context, event CreateChallengeEvent)
+	VerifySolutions func(ctx context.Context, event VerifySolutionsEvent)
+	UseRedeemToken  func(ctx context.Context, event UseRedeemTokenEvent)
+}
+
+func (o ObserverFuncs) OnCreateChallenge(ctx context.Context, event CreateChallengeEvent) {
+	if o.CreateChallenge != nil {
+		o.CreateChallenge(ctx, event)
+	}
+}
+
+func (o ObserverFuncs) OnVerifySolutions(ctx context.Context, event VerifySolutionsEvent) {
+	if o.VerifySolutions != nil {
+		o.VerifySolutions(ctx, event)
+	}
+}
+
+func (o ObserverFuncs) OnUseRedeemToken(ctx context.Context, event UseRedeemTokenEvent) {
+	if o.UseRedeemToken != nil {
+		o.UseRedeemToken(ctx, event)
+	}
+}
+
+// WithObserver registers an observer to receive events.
+// It can be specified more than once to register multiple observers, which are called in order.
+func WithObserver(observer Observer) func(c *Cap) {
+	return func(c *Cap) {
+		c.observers = append(c.observers, observer)
+	}
+}
+
+type clientIPCtxKey struct{}
+
+// ContextWithClientIP returns a copy of the context carrying the IP address of the client that the operation
+// is being performed for.
+// It is used to report IP addresses to observers for operations that do not otherwise take one,
+// such as Cap.VerifyChallengeSolutions and Cap.Redeem.
+func ContextWithClientIP(ctx context.Context, ip *netip.Addr) context.Context {
+	return context.WithValue(ctx, clientIPCtxKey{}, ip)
+}
+
+// ClientIPFromContext returns the client IP address set by ContextWithClientIP, or nil if there is none.
+func ClientIPFromContext(ctx context.Context) *netip.Addr {
+	ip, _ := ctx.Value(clientIPCtxKey{}).(*netip.Addr)
+	return ip
+}
@@ -0,0 +1,73 @@
+package cap
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// PoWScheme is a proof-of-work algorithm that challenges can use.
+//
+// All schemes share the sub-challenge derivation of DeriveSubChallenges: a solution to a sub-challenge is a number
+// which, when appended in decimal to the sub-challenge's salt, produces a digest whose hex encoding starts with the
+// sub-challenge's target.
+// Schemes only differ in how digests are computed.
+type PoWScheme interface {
+	// Name returns the name of the scheme.
+	// It is stored with challenges and sent to clients in the challenge params, so it must be unique and must not
+	// change.
+	Name() string
+
+	// Digest returns the digest of a sub-challenge's salt followed by a candidate solution in decimal.
+	// Must be safe for concurrent use.
+	Digest(input []byte) [sha256.Size]byte
+}
+
+// ErrUnknownPoWScheme is returned when a challenge uses a proof-of-work scheme that is not registered with Cap.
+var ErrUnknownPoWScheme = errors.New("unknown proof-of-work scheme")
+
+// SHA256SchemeName is the name of SHA256Scheme.
+const SHA256SchemeName = "sha256"
+
+// SHA256Scheme is the SHA-256 proof-of-work scheme used by the Cap.js widget.
+// It is always registered, and it is used by challenges whose params have an empty scheme name.
+var SHA256Scheme PoWScheme = sha256Scheme{}
+
+type sha256Scheme struct{}
+
+func (sha256Scheme) Name() string {
+	return SHA256SchemeName
+}
+
+func (sha256Scheme) Digest(input []byte) [sha256.Size]byte {
+	return sha256.Sum256(input)
+}
+
+// WithPoWSchemes registers proof-of-work schemes that challenges can use in addition to SHA256Scheme.
+// A challenge uses the scheme named by the Scheme field of its params.
+// Schemes must stay registered until all challenges using them have expired.
+func WithPoWSchemes(schemes ...PoWScheme) func(c *Cap) {
+	return func(c *Cap) {
+		for _, scheme := range schemes {
+			c.schemes[scheme.Name()] = scheme
+		}
+	}
+}
+
+// defaultPoWSchemes returns the schemes that are always registered.
+func defaultPoWSchemes() map[string]PoWScheme {
+	return map[string]PoWScheme{
+		"":               SHA256Scheme,
+		SHA256SchemeName: SHA256Scheme,
+	}
+}
+
+// powScheme returns the registered scheme with the specified name.
+// Returns ErrUnknownPoWScheme if no such scheme is registered.
+func (s *Cap) powScheme(name string) (PoWScheme, error) {
+	scheme, has := s.schemes[name]
+	if !has {
+		return nil, ErrUnknownPoWScheme
+	}
+
+	return scheme, nil
+}
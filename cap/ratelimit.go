@@ -0,0 +1,82 @@
+package cap
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+)
+
+// RateLimitKind is the kind of subject that challenge creation is rate limited by.
+// Applications can define their own kinds in addition to the ones defined here.
+// Kinds must not be empty and must not contain ':'.
+type RateLimitKind string
+
+const (
+	// RateLimitKindIP rate limits by client IP address.
+	// Addresses are grouped by the significant bits in RateLimitOptions, so that all addresses in the same network
+	// prefix share a limit. IPv4-mapped IPv6 addresses share limits with their IPv4 addresses.
+	RateLimitKindIP RateLimitKind = "ip"
+
+	// RateLimitKindAccount rate limits by authenticated user account.
+	RateLimitKindAccount RateLimitKind = "account"
+
+	// RateLimitKindAPIKey rate limits by API key.
+	RateLimitKindAPIKey RateLimitKind = "api_key"
+
+	// RateLimitKindSession rate limits by session.
+	RateLimitKindSession RateLimitKind = "session"
+)
+
+// ErrInvalidRateLimitSubject is returned when a rate limit subject's kind is empty or contains ':',
+// or an IP subject's value is not a valid IP address.
+var ErrInvalidRateLimitSubject = errors.New("invalid rate limit subject")
+
+// RateLimitSubject is the subject that challenge creation is rate limited by, such as an IP address or a user account.
+// Challenges created for subjects with the same key are counted together.
+type RateLimitSubject struct {
+	// The kind of subject.
+	Kind RateLimitKind
+
+	// The value identifying the subject, such as an account ID.
+	// For IP subjects, this is the IP address in its string form.
+	//
+	// Drivers may store the value, so it should not be a secret such as a raw API key or session token.
+	// Hash secrets before using them as subjects.
+	Value string
+}
+
+// NewIPRateLimitSubject returns a rate limit subject for the specified IP address.
+func NewIPRateLimitSubject(ip netip.Addr) *RateLimitSubject {
+	return &RateLimitSubject{
+		Kind:  RateLimitKindIP,
+		Value: ip.Unmap().String(),
+	}
+}
+
+// validate returns ErrInvalidRateLimitSubject if the subject is invalid.
+func (s *RateLimitSubject) validate() error {
+	if s.Kind == "" || strings.ContainsRune(string(s.Kind), ':') {
+		return ErrInvalidRateLimitSubject
+	}
+	if s.Kind == RateLimitKindIP {
+		if _, err := netip.ParseAddr(s.Value); err != nil {
+			return ErrInvalidRateLimitSubject
+		}
+	}
+
+	return nil
+}
+
+// Key returns the key that drivers count the subject's challenges under.
+// It has the form "<kind>:<value>".
+// For IP subjects, the value is the address's network prefix with the significant bits in rl (see IPPrefix),
+// for example "ip:192.0.2.0/24" or "ip:2001:db8::/48".
+func (s *RateLimitSubject) Key(rl *RateLimitOptions) string {
+	if s.Kind == RateLimitKindIP {
+		if addr, err := netip.ParseAddr(s.Value); err == nil {
+			return string(s.Kind) + ":" + IPPrefix(addr, rl.IPv4SignificantBits, rl.IPv6SignificantBits).String()
+		}
+	}
+
+	return string(s.Kind) + ":" + s.Value
+}
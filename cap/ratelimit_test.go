@@ -0,0 +1,89 @@
+package cap
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestRateLimitSubjectKey(t *testing.T) {
+	defaults := NewDefaultRateLimitOptions()
+	net24 := NewDefaultRateLimitOptions()
+	WithIPv4SignificantBits(24)(net24)
+	WithIPv6SignificantBits(48)(net24)
+
+	tests := []struct {
+		name    string
+		subject RateLimitSubject
+		rl      *RateLimitOptions
+		want    string
+	}{
+		{"IPv4", RateLimitSubject{RateLimitKindIP, "192.0.2.1"}, defaults, "ip:192.0.2.1/32"},
+		{"IPv4Prefix", RateLimitSubject{RateLimitKindIP, "192.0.2.1"}, net24, "ip:192.0.2.0/24"},
+		{"IPv4Mapped", RateLimitSubject{RateLimitKindIP, "::ffff:192.0.2.1"}, net24, "ip:192.0.2.0/24"},
+		{"IPv6", RateLimitSubject{RateLimitKindIP, "2001:db8:1:2:3:4:5:6"}, defaults, "ip:2001:db8:1:2::/64"},
+		{"IPv6Prefix", RateLimitSubject{RateLimitKindIP, "2001:db8:1:2:3:4:5:6"}, net24, "ip:2001:db8:1::/48"},
+		{"Account", RateLimitSubject{RateLimitKindAccount, "123"}, defaults, "account:123"},
+		{"AccountIgnoresIPBits", RateLimitSubject{RateLimitKindAccount, "192.0.2.1"}, net24, "account:192.0.2.1"},
+		{"ValueWithColon", RateLimitSubject{RateLimitKindSession, "a:b"}, defaults, "session:a:b"},
+		{"CustomKind", RateLimitSubject{"tenant", "acme"}, defaults, "tenant:acme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.subject.Key(tt.rl); got != tt.want {
+				t.Errorf("Key() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitSubjectValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject RateLimitSubject
+		wantErr bool
+	}{
+		{"IPv4", RateLimitSubject{RateLimitKindIP, "192.0.2.1"}, false},
+		{"IPv6", RateLimitSubject{RateLimitKindIP, "2001:db8::1"}, false},
+		{"IPv4Mapped", RateLimitSubject{RateLimitKindIP, "::ffff:192.0.2.1"}, false},
+		{"Account", RateLimitSubject{RateLimitKindAccount, "123"}, false},
+		{"ValueWithColon", RateLimitSubject{RateLimitKindAPIKey, "a:b"}, false},
+		{"CustomKind", RateLimitSubject{"tenant", "acme"}, false},
+		{"EmptyKind", RateLimitSubject{"", "123"}, true},
+		{"KindWithColon", RateLimitSubject{"ip:v4", "192.0.2.1"}, true},
+		{"InvalidIP", RateLimitSubject{RateLimitKindIP, "192.0.2"}, true},
+		{"IPPrefix", RateLimitSubject{RateLimitKindIP, "192.0.2.0/24"}, true},
+		{"EmptyIP", RateLimitSubject{RateLimitKindIP, ""}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.subject.validate()
+			if tt.wantErr && !errors.Is(err, ErrInvalidRateLimitSubject) {
+				t.Errorf("validate() = %v, want %v", err, ErrInvalidRateLimitSubject)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("validate(): unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestNewIPRateLimitSubject(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		subject := NewIPRateLimitSubject(netip.MustParseAddr(tt.ip))
+		if subject.Kind != RateLimitKindIP || subject.Value != tt.want {
+			t.Errorf("NewIPRateLimitSubject(%s) = %+v, want value %q", tt.ip, subject, tt.want)
+		}
+	}
+}
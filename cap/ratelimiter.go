@@ -0,0 +1,223 @@
+package cap
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"strings"
+	"time"
+)
+
+// RateLimiter limits how often subjects can create challenges.
+// Rate limiters are applied to challenge creation with WithRateLimiter, independently of the driver that stores
+// challenges.
+type RateLimiter interface {
+	// Allow records an attempt by the subject to create a challenge, and returns whether it is allowed.
+	// The subject must not be nil.
+	Allow(ctx context.Context, subject *RateLimitSubject) (bool, error)
+}
+
+// RateLimitStore stores the state of the rate limiters created by NewTokenBucketLimiter, NewGCRALimiter and
+// NewSlidingLogLimiter.
+// It is implemented by the included drivers, so rate limit state can be stored in a different driver than challenges.
+type RateLimitStore interface {
+	// UpdateRateLimitState atomically updates the rate limit state stored under the specified key.
+	// It calls update with the current state, or nil if there is none, and stores the returned state so that it
+	// expires after the returned TTL, which is always positive.
+	// The state may be passed to update after its TTL has passed, but stores should delete expired state eventually.
+	//
+	// If the state was changed concurrently, the store may call update again with the new state, so update must not
+	// have side effects other than its return values.
+	UpdateRateLimitState(ctx context.Context, key string, update func(state []byte) ([]byte, time.Duration)) error
+}
+
+// WithRateLimiter applies the specified rate limiters to challenge creation.
+// The limiters are called in order with the request's rate limit subject, and CreateChallenge returns ErrRateLimited
+// as soon as one of them does not allow the attempt. Attempts rejected by a limiter still count for the limiters
+// before it.
+//
+// Unlike driver rate limiting, rate limiters are also applied to stateless challenges.
+//
+// Example, limiting per /24 and per /16 IPv4 network:
+//
+//	cap.WithRateLimiter(
+//		cap.NewGCRALimiter(store, "net24", cap.WithIPv4SignificantBits(24), cap.WithMaxChallengesPerIP(60)),
+//		cap.NewGCRALimiter(store, "net16", cap.WithIPv4SignificantBits(16), cap.WithMaxChallengesPerIP(600)),
+//	)
+func WithRateLimiter(limiters ...RateLimiter) func(c *Cap) {
+	return func(c *Cap) {
+		c.limiters = append(c.limiters, limiters...)
+	}
+}
+
+// rateLimitAlgorithm computes the new state of a rate limiter for an attempt at time now, and whether it is allowed.
+// The state is nil if there is no state yet.
+// The returned TTL is the duration after which the new state has the same effect as no state.
+type rateLimitAlgorithm func(state []byte, now time.Time, limit int, window time.Duration) (newState []byte, ttl time.Duration, allowed bool)
+
+// limiterNameEscaper escapes ':' in limiter names, so that a name cannot be confused with the start of a subject key.
+// '%' is escaped too, so that different names never escape to the same string.
+var limiterNameEscaper = strings.NewReplacer("%", "%25", ":", "%3A")
+
+// storeLimiter is a RateLimiter that keeps its state in a RateLimitStore, under keys prefixed with its escaped name.
+type storeLimiter struct {
+	store     RateLimitStore
+	name      string
+	rl        *RateLimitOptions
+	algorithm rateLimitAlgorithm
+}
+
+func newStoreLimiter(store RateLimitStore, name string, algorithm rateLimitAlgorithm, opts []func(rl *RateLimitOptions)) *storeLimiter {
+	rl := NewDefaultRateLimitOptions()
+	for _, opt := range opts {
+		opt(rl)
+	}
+
+	return &storeLimiter{
+		store:     store,
+		name:      limiterNameEscaper.Replace(name),
+		rl:        rl,
+		algorithm: algorithm,
+	}
+}
+
+func (l *storeLimiter) Allow(ctx context.Context, subject *RateLimitSubject) (bool, error) {
+	limit := l.rl.MaxChallenges(subject.Kind)
+	window := l.rl.MaxChallengesWindow
+	if window <= 0 {
+		return true, nil
+	}
+	if limit <= 0 {
+		return false, nil
+	}
+
+	var allowed bool
+	err := l.store.UpdateRateLimitState(ctx, l.name+":"+subject.Key(l.rl), func(state []byte) ([]byte, time.Duration) {
+		var newState []byte
+		var ttl time.Duration
+		newState, ttl, allowed = l.algorithm(state, l.rl.Clock.Now(), limit, window)
+
+		return newState, max(ttl, time.Millisecond)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
+
+// NewTokenBucketLimiter creates a new RateLimiter that uses the token bucket algorithm, storing its state in store.
+// Each subject's bucket holds up to MaxChallengesPerIP (or the subject kind's maximum) tokens and is refilled at a
+// constant rate, so that it is full again after MaxChallengesWindow. Each challenge takes one token.
+//
+// The name distinguishes the limiter's state from other limiters using the same store.
+// When no options are specified, uses the defaults of NewDefaultRateLimitOptions.
+func NewTokenBucketLimiter(store RateLimitStore, name string, opts ...func(rl *RateLimitOptions)) RateLimiter {
+	return newStoreLimiter(store, name, tokenBucket, opts)
+}
+
+// tokenBucket is the token bucket algorithm.
+// State layout (big endian):
+//   - 8 bytes: number of tokens as a float64
+//   - 8 bytes: UNIX nanosecond timestamp of the last refill
+func tokenBucket(state []byte, now time.Time, limit int, window time.Duration) ([]byte, time.Duration, bool) {
+	capacity := float64(limit)
+	tokens := capacity
+	last := now.UnixNano()
+	if len(state) == 16 {
+		tokens = math.Float64frombits(binary.BigEndian.Uint64(state[0:8]))
+		stored := int64(binary.BigEndian.Uint64(state[8:16]))
+		if elapsed := last - stored; elapsed > 0 {
+			tokens = math.Min(capacity, tokens+float64(elapsed)/float64(window)*capacity)
+		} else {
+			last = stored
+		}
+	}
+
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+
+	newState := make([]byte, 16)
+	binary.BigEndian.PutUint64(newState[0:8], math.Float64bits(tokens))
+	binary.BigEndian.PutUint64(newState[8:16], uint64(last))
+
+	// The state expires when the bucket is full again.
+	ttl := time.Duration((capacity-tokens)/capacity*float64(window)) + time.Duration(last-now.UnixNano())
+
+	return newState, ttl, allowed
+}
+
+// NewGCRALimiter creates a new RateLimiter that uses the generic cell rate algorithm (GCRA), storing its state in store.
+// Each subject can create one challenge every MaxChallengesWindow / MaxChallengesPerIP (or the subject kind's
+// maximum), with bursts of up to the maximum. It behaves like a token bucket, but only stores a single timestamp.
+//
+// The name distinguishes the limiter's state from other limiters using the same store.
+// When no options are specified, uses the defaults of NewDefaultRateLimitOptions.
+func NewGCRALimiter(store RateLimitStore, name string, opts ...func(rl *RateLimitOptions)) RateLimiter {
+	return newStoreLimiter(store, name, gcra, opts)
+}
+
+// gcra is the generic cell rate algorithm.
+// State layout (big endian):
+//   - 8 bytes: theoretical arrival time (TAT) as a UNIX nanosecond timestamp
+func gcra(state []byte, now time.Time, limit int, window time.Duration) ([]byte, time.Duration, bool) {
+	interval := window / time.Duration(limit)
+
+	tat := now
+	if len(state) == 8 {
+		if stored := time.Unix(0, int64(binary.BigEndian.Uint64(state))); stored.After(now) {
+			tat = stored
+		}
+	}
+
+	allowed := tat.Add(interval).Sub(now) <= window
+	if allowed {
+		tat = tat.Add(interval)
+	}
+
+	newState := make([]byte, 8)
+	binary.BigEndian.PutUint64(newState, uint64(tat.UnixNano()))
+
+	return newState, tat.Sub(now), allowed
+}
+
+// NewSlidingLogLimiter creates a new RateLimiter that uses the sliding window log algorithm, storing its state in store.
+// It records the time of each challenge created by a subject, and allows at most MaxChallengesPerIP (or the subject
+// kind's maximum) challenges in any MaxChallengesWindow.
+// It is the most precise algorithm, but its state grows with the maximum.
+//
+// The name distinguishes the limiter's state from other limiters using the same store.
+// When no options are specified, uses the defaults of NewDefaultRateLimitOptions.
+func NewSlidingLogLimiter(store RateLimitStore, name string, opts ...func(rl *RateLimitOptions)) RateLimiter {
+	return newStoreLimiter(store, name, slidingLog, opts)
+}
+
+// slidingLog is the sliding window log algorithm.
+// State layout (big endian):
+//   - 8 bytes per challenge in the window: UNIX nanosecond timestamp when it was created, in ascending order
+func slidingLog(state []byte, now time.Time, limit int, window time.Duration) ([]byte, time.Duration, bool) {
+	windowStart := now.Add(-window).UnixNano()
+
+	newState := make([]byte, 0, min(len(state)+8, limit*8))
+	for i := 0; i+8 <= len(state); i += 8 {
+		if int64(binary.BigEndian.Uint64(state[i:i+8])) > windowStart {
+			newState = append(newState, state[i:i+8]...)
+		}
+	}
+
+	allowed := len(newState)/8 < limit
+	if allowed {
+		newState = binary.BigEndian.AppendUint64(newState, uint64(now.UnixNano()))
+	}
+
+	// The state expires when its newest entry leaves the window.
+	var ttl time.Duration
+	if len(newState) > 0 {
+		newest := int64(binary.BigEndian.Uint64(newState[len(newState)-8:]))
+		ttl = time.Duration(newest - windowStart)
+	}
+
+	return newState, ttl, allowed
+}
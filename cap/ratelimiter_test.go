@@ -0,0 +1,238 @@
+package cap
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// limiterStep is an attempt passed to a rate limit algorithm, and its expected result.
+type limiterStep struct {
+	// at is the time of the attempt, relative to the start of the test.
+	at      time.Duration
+	allowed bool
+	// ttl is the expected TTL of the new state, or 0 to not check it.
+	ttl time.Duration
+}
+
+// runAlgorithm passes each step to algorithm in order, starting without state and keeping the returned state.
+func runAlgorithm(t *testing.T, algorithm rateLimitAlgorithm, limit int, window time.Duration, steps []limiterStep) [][]byte {
+	t.Helper()
+
+	start := time.Unix(1_700_000_000, 0)
+	var state []byte
+	var states [][]byte
+	for i, step := range steps {
+		var ttl time.Duration
+		var allowed bool
+		state, ttl, allowed = algorithm(state, start.Add(step.at), limit, window)
+		states = append(states, state)
+
+		if allowed != step.allowed {
+			t.Errorf("step %d at %v: allowed = %t, want %t", i, step.at, allowed, step.allowed)
+		}
+		if step.ttl != 0 && ttl != step.ttl {
+			t.Errorf("step %d at %v: ttl = %v, want %v", i, step.at, ttl, step.ttl)
+		}
+	}
+
+	return states
+}
+
+func TestTokenBucket(t *testing.T) {
+	// The bucket holds 4 tokens and refills one token per second.
+	const limit = 4
+	const window = 4 * time.Second
+
+	tests := []struct {
+		name  string
+		steps []limiterStep
+	}{
+		{"Burst", []limiterStep{
+			{0, true, time.Second},
+			{0, true, 2 * time.Second},
+			{0, true, 3 * time.Second},
+			{0, true, 4 * time.Second},
+			{0, false, 4 * time.Second},
+		}},
+		{"Refill", []limiterStep{
+			{0, true, 0}, {0, true, 0}, {0, true, 0}, {0, true, 0},
+			{500 * time.Millisecond, false, 3500 * time.Millisecond},
+			{time.Second, true, 4 * time.Second},
+			{time.Second, false, 4 * time.Second},
+			{2500 * time.Millisecond, true, 3500 * time.Millisecond},
+		}},
+		{"RefillCappedAtCapacity", []limiterStep{
+			{0, true, 0},
+			{time.Hour, true, time.Second},
+			{time.Hour, true, 0}, {time.Hour, true, 0}, {time.Hour, true, 0},
+			{time.Hour, false, 0},
+		}},
+		{"ClockGoesBackwards", []limiterStep{
+			{10 * time.Second, true, 0}, {10 * time.Second, true, 0}, {10 * time.Second, true, 0}, {10 * time.Second, true, 0},
+			// No tokens are refilled, and the state still expires when the bucket is full after the stored time.
+			{5 * time.Second, false, 9 * time.Second},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runAlgorithm(t, tokenBucket, limit, window, tt.steps)
+		})
+	}
+}
+
+func TestGCRA(t *testing.T) {
+	// One challenge per second, with bursts of up to 4.
+	const limit = 4
+	const window = 4 * time.Second
+
+	tests := []struct {
+		name  string
+		steps []limiterStep
+	}{
+		{"Burst", []limiterStep{
+			{0, true, time.Second},
+			{0, true, 2 * time.Second},
+			{0, true, 3 * time.Second},
+			{0, true, 4 * time.Second},
+			{0, false, 4 * time.Second},
+		}},
+		{"EmissionInterval", []limiterStep{
+			{0, true, 0}, {0, true, 0}, {0, true, 0}, {0, true, 0},
+			{999 * time.Millisecond, false, 3001 * time.Millisecond},
+			{time.Second, true, 4 * time.Second},
+			{time.Second, false, 4 * time.Second},
+			{2500 * time.Millisecond, true, 3500 * time.Millisecond},
+			{2500 * time.Millisecond, false, 3500 * time.Millisecond},
+		}},
+		{"Recovered", []limiterStep{
+			{0, true, 0}, {0, true, 0}, {0, true, 0}, {0, true, 0},
+			{time.Hour, true, time.Second},
+			{time.Hour, true, 2 * time.Second},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			states := runAlgorithm(t, gcra, limit, window, tt.steps)
+			for i, state := range states {
+				if len(state) != 8 {
+					t.Errorf("step %d: state is %d bytes, want 8", i, len(state))
+				}
+			}
+		})
+	}
+}
+
+func TestSlidingLog(t *testing.T) {
+	// At most 3 challenges in any 10 seconds.
+	const limit = 3
+	const window = 10 * time.Second
+
+	tests := []struct {
+		name  string
+		steps []limiterStep
+	}{
+		{"Limit", []limiterStep{
+			{0, true, 10 * time.Second},
+			{time.Second, true, 10 * time.Second},
+			{2 * time.Second, true, 10 * time.Second},
+			{3 * time.Second, false, 9 * time.Second},
+		}},
+		{"Slides", []limiterStep{
+			{0, true, 0},
+			{time.Second, true, 0},
+			{2 * time.Second, true, 0},
+			// The first entry is no longer in the window once exactly the window has passed.
+			{10 * time.Second, true, 10 * time.Second},
+			{10500 * time.Millisecond, false, 9500 * time.Millisecond},
+			{11 * time.Second, true, 10 * time.Second},
+			{11 * time.Second, false, 10 * time.Second},
+		}},
+		{"DeniedAttemptsDoNotCount", []limiterStep{
+			{0, true, 0}, {0, true, 0}, {0, true, 0},
+			{5 * time.Second, false, 0}, {5 * time.Second, false, 0}, {9 * time.Second, false, 0},
+			{10 * time.Second, true, 10 * time.Second},
+			{10 * time.Second, true, 10 * time.Second},
+			{10 * time.Second, true, 10 * time.Second},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			states := runAlgorithm(t, slidingLog, limit, window, tt.steps)
+			for i, state := range states {
+				if len(state) > limit*8 || len(state)%8 != 0 {
+					t.Errorf("step %d: state is %d bytes, want a multiple of 8 up to %d", i, len(state), limit*8)
+				}
+			}
+		})
+	}
+}
+
+// mapStore is a RateLimitStore that keeps state in a map, without expiring it.
+type mapStore struct {
+	mu     sync.Mutex
+	states map[string][]byte
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{states: make(map[string][]byte)}
+}
+
+func (s *mapStore) UpdateRateLimitState(ctx context.Context, key string, update func(state []byte) ([]byte, time.Duration)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[key], _ = update(s.states[key])
+	return nil
+}
+
+func TestStoreLimiterKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		limiter string
+		subject RateLimitSubject
+		want    string
+	}{
+		{"IP", "net24", RateLimitSubject{RateLimitKindIP, "192.0.2.7"}, "net24:ip:192.0.2.0/24"},
+		{"Account", "net24", RateLimitSubject{RateLimitKindAccount, "42"}, "net24:account:42"},
+		{"NameWithColon", "a:account", RateLimitSubject{"x", "y"}, "a%3Aaccount:x:y"},
+		{"NameWithPercent", "a%3Aaccount", RateLimitSubject{"x", "y"}, "a%253Aaccount:x:y"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMapStore()
+			l := NewGCRALimiter(store, tt.limiter, WithIPv4SignificantBits(24))
+			if _, err := l.Allow(context.Background(), &tt.subject); err != nil {
+				t.Fatalf("Allow: unexpected error: %v", err)
+			}
+
+			if keys := slices.Collect(maps.Keys(store.states)); len(keys) != 1 || keys[0] != tt.want {
+				t.Errorf("Allow: stored keys %q, want %q", keys, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoreLimiterNamesDoNotCollide(t *testing.T) {
+	ctx := context.Background()
+	store := newMapStore()
+	opts := []func(rl *RateLimitOptions){WithMaxChallengesPerIP(1)}
+
+	// Without escaping, both limiters would use the key "a:account:x:y".
+	first := NewSlidingLogLimiter(store, "a", opts...)
+	second := NewSlidingLogLimiter(store, "a:account", opts...)
+
+	if allowed, err := first.Allow(ctx, &RateLimitSubject{RateLimitKindAccount, "x:y"}); err != nil || !allowed {
+		t.Fatalf("first Allow: got %t, %v, want true", allowed, err)
+	}
+	if allowed, err := second.Allow(ctx, &RateLimitSubject{"x", "y"}); err != nil || !allowed {
+		t.Errorf("second Allow: got %t, %v, want true", allowed, err)
+	}
+}
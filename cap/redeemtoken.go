@@ -0,0 +1,411 @@
+package cap
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// JWS algorithm names used in signed redeem tokens.
+const (
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+)
+
+// ErrVerifyOnlyKey is returned when a key that only has public key material is used to sign a token.
+var ErrVerifyOnlyKey = errors.New("key can only be used to verify tokens")
+
+// ErrSpentTokensUnsupported is returned by Cap.Redeem when signed redeem tokens are enabled but the driver does not
+// implement SpentTokenDriver.
+var ErrSpentTokensUnsupported = errors.New("driver does not implement SpentTokenDriver, which is required for signed redeem tokens")
+
+// JWK is a JSON Web Key (RFC 7517).
+// Only the fields needed for Ed25519 public keys are included.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg,omitempty"`
+	Use       string `json:"use,omitempty"`
+}
+
+// JWKSet is a JSON Web Key Set, as served by JWKS endpoints.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// TokenKey is a key that can sign and verify signed redeem tokens.
+// HMACKey and Ed25519Key implement it.
+type TokenKey interface {
+	Key
+
+	// Algorithm returns the JWS algorithm name of the key, such as AlgEdDSA.
+	Algorithm() string
+
+	// SignToken returns the signature of a JWS signing input.
+	// Returns ErrVerifyOnlyKey if the key cannot sign.
+	SignToken(signingInput string) ([]byte, error)
+
+	// VerifyToken returns whether sig is a valid signature of a JWS signing input.
+	VerifyToken(signingInput string, sig []byte) bool
+
+	// PublicJWK returns the key's public key as a JWK.
+	// Returns false if the key is symmetric, in which case it must not be published.
+	PublicJWK() (JWK, bool)
+}
+
+func (k HMACKey) Algorithm() string {
+	return AlgHS256
+}
+
+func (k HMACKey) SignToken(signingInput string) ([]byte, error) {
+	return k.sign(signingInput), nil
+}
+
+func (k HMACKey) VerifyToken(signingInput string, sig []byte) bool {
+	return hmac.Equal(sig, k.sign(signingInput))
+}
+
+func (k HMACKey) PublicJWK() (JWK, bool) {
+	return JWK{}, false
+}
+
+// Ed25519Key is a key used to sign and verify tokens with Ed25519.
+// Keys with only a public key can be used to verify tokens, but not to sign them.
+type Ed25519Key struct {
+	// The key ID.
+	// Must not be empty and must not contain '.'.
+	ID string
+
+	// The private key.
+	// Can be nil for verification-only keys.
+	PrivateKey ed25519.PrivateKey
+
+	// The public key.
+	// Ignored if PrivateKey is set.
+	PublicKey ed25519.PublicKey
+}
+
+// NewRandomEd25519Key creates a new Ed25519Key with the specified ID and a random private key.
+func NewRandomEd25519Key(id string) Ed25519Key {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+
+	return Ed25519Key{
+		ID:         id,
+		PrivateKey: priv,
+	}
+}
+
+// public returns the key's public key.
+func (k Ed25519Key) public() ed25519.PublicKey {
+	if len(k.PrivateKey) == ed25519.PrivateKeySize {
+		return k.PrivateKey.Public().(ed25519.PublicKey)
+	}
+
+	return k.PublicKey
+}
+
+func (k Ed25519Key) KeyID() string {
+	return k.ID
+}
+
+// Validate returns an error wrapping ErrInvalidSigningKey if the key is not valid.
+func (k Ed25519Key) Validate() error {
+	if err := validateKeyID(k.ID); err != nil {
+		return err
+	}
+	if k.PrivateKey != nil && len(k.PrivateKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("%w: Ed25519 private key must be %d bytes", ErrInvalidSigningKey, ed25519.PrivateKeySize)
+	}
+	if len(k.public()) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: Ed25519 public key must be %d bytes", ErrInvalidSigningKey, ed25519.PublicKeySize)
+	}
+
+	return nil
+}
+
+func (k Ed25519Key) Algorithm() string {
+	return AlgEdDSA
+}
+
+func (k Ed25519Key) SignToken(signingInput string) ([]byte, error) {
+	if k.PrivateKey == nil {
+		return nil, ErrVerifyOnlyKey
+	}
+
+	return ed25519.Sign(k.PrivateKey, []byte(signingInput)), nil
+}
+
+func (k Ed25519Key) VerifyToken(signingInput string, sig []byte) bool {
+	return ed25519.Verify(k.public(), []byte(signingInput), sig)
+}
+
+func (k Ed25519Key) PublicJWK() (JWK, bool) {
+	return JWK{
+		KeyType:   "OKP",
+		Curve:     "Ed25519",
+		X:         base64.RawURLEncoding.EncodeToString(k.public()),
+		KeyID:     k.ID,
+		Algorithm: AlgEdDSA,
+		Use:       "sig",
+	}, true
+}
+
+// KeyFromJWK creates a verification-only TokenKey from a public JWK.
+// Only Ed25519 keys are supported.
+func KeyFromJWK(jwk JWK) (TokenKey, error) {
+	if jwk.KeyType != "OKP" || jwk.Curve != "Ed25519" {
+		return nil, fmt.Errorf("%w: unsupported JWK key type %q with curve %q", ErrInvalidSigningKey, jwk.KeyType, jwk.Curve)
+	}
+
+	pub, err := base64.RawURLEncoding.DecodeString(jwk.X)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid JWK public key: %w", ErrInvalidSigningKey, err)
+	}
+
+	k := Ed25519Key{
+		ID:        jwk.KeyID,
+		PublicKey: pub,
+	}
+	if err = k.Validate(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// TokenKeyring is a Keyring of keys used to sign and verify redeem tokens.
+type TokenKeyring = Keyring[TokenKey]
+
+// NewTokenKeyring creates a new keyring with the specified primary key and optional verification-only keys.
+// Returns an error wrapping ErrInvalidSigningKey if any of the keys are invalid.
+func NewTokenKeyring(primary TokenKey, verifyOnly ...TokenKey) (*TokenKeyring, error) {
+	return NewKeyring(primary, verifyOnly...)
+}
+
+// NewTokenKeyringFromJWKS creates a verification-only keyring from a JWK set, such as one fetched from a JWKS endpoint.
+// It can be used by services that verify redeem tokens offline with ParseRedeemToken.
+func NewTokenKeyringFromJWKS(set JWKSet) (*TokenKeyring, error) {
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("%w: JWK set is empty", ErrInvalidSigningKey)
+	}
+
+	keys := make([]TokenKey, len(set.Keys))
+	for i, jwk := range set.Keys {
+		k, err := KeyFromJWK(jwk)
+		if err != nil {
+			return nil, err
+		}
+
+		keys[i] = k
+	}
+
+	return NewTokenKeyring(keys[0], keys[1:]...)
+}
+
+// SpentTokenDriver is an optional interface that drivers can implement to record the IDs of used signed redeem tokens.
+// It is required for signed redeem tokens, since they are not stored anywhere else.
+type SpentTokenDriver interface {
+	// MarkTokenSpent records that the token with the specified ID was used.
+	// Returns true if the token was not already marked as spent, or false if it was.
+	// The record can be deleted after the token expires.
+	MarkTokenSpent(ctx context.Context, id string, expires time.Time) (bool, error)
+}
+
+// WithSignedRedeemTokens enables signed redeem tokens, signed with the primary key of the specified keyring.
+//
+// Signed redeem tokens are JWTs containing a unique ID, the expiration time and the scope of the challenge, so
+// services can check them offline with ParseRedeemToken or any JWT library, using the keys published by a JWKS endpoint.
+// Cap.Redeem still enforces that each token can only be used once, using the driver's SpentTokenDriver implementation.
+// Unsigned redeem tokens issued before the option was enabled are still accepted by Cap.Redeem.
+//
+// Use Ed25519 keys if tokens are verified by other services, since HMAC keys cannot be published.
+func WithSignedRedeemTokens(keyring *TokenKeyring) func(c *Cap) {
+	return func(c *Cap) {
+		c.redeemKeyring = keyring
+	}
+}
+
+// RedeemTokenClaims are the claims of a signed redeem token.
+type RedeemTokenClaims struct {
+	// The unique ID of the token.
+	// Tokens issued for the same challenge have the same ID, so only one of them can be used.
+	ID string `json:"jti"`
+
+	// The UNIX timestamp when the token was issued.
+	IssuedAt int64 `json:"iat"`
+
+	// The UNIX timestamp when the token expires.
+	ExpiresAt int64 `json:"exp"`
+
+	// The scope that the token was issued for.
+	SiteKey  string `json:"site_key,omitempty"`
+	Action   string `json:"action,omitempty"`
+	Audience string `json:"aud,omitempty"`
+
+	// The metadata attached to the challenge.
+	Metadata map[string]string `json:"meta,omitempty"`
+}
+
+// Scope returns the scope that the token was issued for.
+func (c *RedeemTokenClaims) Scope() Scope {
+	return Scope{
+		SiteKey:  c.SiteKey,
+		Action:   c.Action,
+		Audience: c.Audience,
+	}
+}
+
+// Expires returns the expiration time of the token.
+func (c *RedeemTokenClaims) Expires() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// jwtHeader is the header of a signed redeem token.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ"`
+}
+
+// isSignedRedeemToken returns whether the token looks like a signed redeem token.
+// Unsigned redeem tokens are hex strings, so they never contain '.'.
+func isSignedRedeemToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// signedRedeemTokenID derives the ID of a signed redeem token from the challenge's unsigned redeem token.
+// Token IDs are readable by clients, so they must not be the unsigned redeem tokens, which the driver accepts.
+func signedRedeemTokenID(redeemToken string) string {
+	sum := sha256.Sum256([]byte(redeemToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// signRedeemToken creates a signed redeem token for a solved challenge.
+func (s *Cap) signRedeemToken(challenge *Challenge) (string, error) {
+	key := s.redeemKeyring.Primary()
+
+	header, err := json.Marshal(jwtHeader{
+		Algorithm: key.Algorithm(),
+		KeyID:     key.KeyID(),
+		Type:      "JWT",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := json.Marshal(RedeemTokenClaims{
+		ID:        signedRedeemTokenID(challenge.RedeemToken),
+		IssuedAt:  s.clock.Now().Unix(),
+		ExpiresAt: challenge.RedeemExpires.Unix(),
+		SiteKey:   challenge.Scope.SiteKey,
+		Action:    challenge.Scope.Action,
+		Audience:  challenge.Scope.Audience,
+		Metadata:  challenge.Metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	sig, err := key.SignToken(signingInput)
+	if err != nil {
+		return "", fmt.Errorf(`failed to sign redeem token: %w`, err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// ParseRedeemToken verifies a signed redeem token with the keys in the keyring and returns its claims.
+// It does not check whether the token was already used; only Cap.Redeem can do that.
+// Returns ErrInvalidRedeemToken if the token is malformed, has an invalid signature, was signed by an unknown key,
+// or is expired.
+func ParseRedeemToken(keyring *TokenKeyring, token string) (*RedeemTokenClaims, error) {
+	return parseRedeemToken(keyring, token, time.Now())
+}
+
+// parseRedeemToken is ParseRedeemToken with the current time passed in.
+func parseRedeemToken(keyring *TokenKeyring, token string, now time.Time) (*RedeemTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidRedeemToken
+	}
+
+	headerJson, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidRedeemToken
+	}
+	var header jwtHeader
+	if json.Unmarshal(headerJson, &header) != nil {
+		return nil, ErrInvalidRedeemToken
+	}
+
+	key, has := keyring.Get(header.KeyID)
+	if !has || header.Algorithm != key.Algorithm() {
+		return nil, ErrInvalidRedeemToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidRedeemToken
+	}
+	if !key.VerifyToken(parts[0]+"."+parts[1], sig) {
+		return nil, ErrInvalidRedeemToken
+	}
+
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidRedeemToken
+	}
+	var claims RedeemTokenClaims
+	if json.Unmarshal(claimsJson, &claims) != nil || claims.ID == "" {
+		return nil, ErrInvalidRedeemToken
+	}
+
+	if !claims.Expires().After(now) {
+		return nil, ErrInvalidRedeemToken
+	}
+
+	return &claims, nil
+}
+
+// useSignedRedeemToken verifies a signed redeem token and marks it as spent.
+// Like Driver.UseRedeemToken, returns nil if the token is invalid, expired or already used.
+// The returned challenge only has its redeem token, scope, expiration times and metadata set.
+func (s *Cap) useSignedRedeemToken(ctx context.Context, token string) (*Challenge, error) {
+	claims, err := parseRedeemToken(s.redeemKeyring, token, s.clock.Now())
+	if err != nil {
+		return nil, nil
+	}
+
+	spent, ok := s.driver.(SpentTokenDriver)
+	if !ok {
+		return nil, ErrSpentTokensUnsupported
+	}
+
+	wasUnspent, err := spent.MarkTokenSpent(ctx, claims.ID, claims.Expires())
+	if err != nil {
+		return nil, err
+	}
+	if !wasUnspent {
+		return nil, nil
+	}
+
+	return &Challenge{
+		RedeemToken:   claims.ID,
+		Scope:         claims.Scope(),
+		Expires:       claims.Expires(),
+		RedeemExpires: claims.Expires(),
+		Metadata:      claims.Metadata,
+	}, nil
+}
@@ -0,0 +1,158 @@
+package cap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// makeToken encodes a JWT with the specified header and claims, signed by sign.
+func makeToken(t *testing.T, header any, claims any, sign func(signingInput string) []byte) string {
+	t.Helper()
+
+	headerJson, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("encoding header: %v", err)
+	}
+	claimsJson, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("encoding claims: %v", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJson) + "." + base64.RawURLEncoding.EncodeToString(claimsJson)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sign(signingInput))
+}
+
+// signWith returns a function that signs tokens with the specified key.
+func signWith(t *testing.T, key TokenKey) func(signingInput string) []byte {
+	return func(signingInput string) []byte {
+		sig, err := key.SignToken(signingInput)
+		if err != nil {
+			t.Fatalf("SignToken: unexpected error: %v", err)
+		}
+		return sig
+	}
+}
+
+// hmacWith returns a function that signs tokens with HMAC-SHA256 using the specified secret.
+func hmacWith(secret []byte) func(signingInput string) []byte {
+	return func(signingInput string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signingInput))
+		return mac.Sum(nil)
+	}
+}
+
+func TestParseRedeemToken(t *testing.T) {
+	now := time.Unix(1_800_000_000, 0)
+
+	ed := NewRandomEd25519Key("ed")
+	hm := NewRandomHMACKey("hm")
+	keyring, err := NewTokenKeyring(ed, hm)
+	if err != nil {
+		t.Fatalf("NewTokenKeyring: unexpected error: %v", err)
+	}
+
+	otherEd := NewRandomEd25519Key("ed")
+	edPublic := []byte(ed.public())
+
+	claims := RedeemTokenClaims{
+		ID:        "token-id",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(time.Minute).Unix(),
+		Action:    "signup",
+	}
+	expired := claims
+	expired.ExpiresAt = now.Unix()
+	noID := claims
+	noID.ID = ""
+
+	none := func(string) []byte { return nil }
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"EdDSA", makeToken(t, jwtHeader{AlgEdDSA, "ed", "JWT"}, claims, signWith(t, ed)), false},
+		{"HS256", makeToken(t, jwtHeader{AlgHS256, "hm", "JWT"}, claims, signWith(t, hm)), false},
+		{"AlgNone", makeToken(t, jwtHeader{"none", "ed", "JWT"}, claims, none), true},
+		{"AlgNoneHMACKey", makeToken(t, jwtHeader{"none", "hm", "JWT"}, claims, none), true},
+		{"AlgMissing", makeToken(t, map[string]string{"kid": "ed"}, claims, signWith(t, ed)), true},
+		{"AlgHS256WithEd25519Key", makeToken(t, jwtHeader{AlgHS256, "ed", "JWT"}, claims, hmacWith(edPublic)), true},
+		{"AlgEdDSAWithHMACKey", makeToken(t, jwtHeader{AlgEdDSA, "hm", "JWT"}, claims, hmacWith(hm.Secret)), true},
+		{"AlgLowercase", makeToken(t, jwtHeader{"eddsa", "ed", "JWT"}, claims, signWith(t, ed)), true},
+		{"UnknownKeyID", makeToken(t, jwtHeader{AlgEdDSA, "unknown", "JWT"}, claims, signWith(t, ed)), true},
+		{"EmptyKeyID", makeToken(t, jwtHeader{AlgEdDSA, "", "JWT"}, claims, signWith(t, ed)), true},
+		{"KeyIDMissing", makeToken(t, map[string]string{"alg": AlgEdDSA}, claims, signWith(t, ed)), true},
+		{"WrongKeySameID", makeToken(t, jwtHeader{AlgEdDSA, "ed", "JWT"}, claims, signWith(t, otherEd)), true},
+		{"Expired", makeToken(t, jwtHeader{AlgEdDSA, "ed", "JWT"}, expired, signWith(t, ed)), true},
+		{"MissingID", makeToken(t, jwtHeader{AlgEdDSA, "ed", "JWT"}, noID, signWith(t, ed)), true},
+		{"MalformedHeader", makeToken(t, "not an object", claims, signWith(t, ed)), true},
+		{"MalformedClaims", makeToken(t, jwtHeader{AlgEdDSA, "ed", "JWT"}, []string{"claims"}, signWith(t, ed)), true},
+		{"TwoParts", "eyJhbGciOiJFZERTQSJ9.e30", true},
+		{"FourParts", makeToken(t, jwtHeader{AlgEdDSA, "ed", "JWT"}, claims, signWith(t, ed)) + ".x", true},
+		{"BadSignatureEncoding", makeToken(t, jwtHeader{AlgEdDSA, "ed", "JWT"}, claims, signWith(t, ed)) + "!", true},
+		{"Empty", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRedeemToken(keyring, tt.token, now)
+			if tt.wantErr {
+				if err != ErrInvalidRedeemToken {
+					t.Errorf("parseRedeemToken: got %+v, %v, want %v", got, err, ErrInvalidRedeemToken)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseRedeemToken: unexpected error: %v", err)
+			}
+			if got.ID != claims.ID || got.Scope() != claims.Scope() || !got.Expires().Equal(claims.Expires()) {
+				t.Errorf("parseRedeemToken: claims = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestKeyFromJWK(t *testing.T) {
+	valid, _ := NewRandomEd25519Key("ed").PublicJWK()
+
+	tests := []struct {
+		name    string
+		mutate  func(jwk *JWK)
+		wantErr bool
+	}{
+		{"Valid", func(jwk *JWK) {}, false},
+		{"WrongKeyType", func(jwk *JWK) { jwk.KeyType = "RSA" }, true},
+		{"WrongCurve", func(jwk *JWK) { jwk.Curve = "X25519" }, true},
+		{"ShortKey", func(jwk *JWK) { jwk.X = jwk.X[:20] }, true},
+		{"InvalidEncoding", func(jwk *JWK) { jwk.X = "!" + jwk.X[1:] }, true},
+		{"EmptyKeyID", func(jwk *JWK) { jwk.KeyID = "" }, true},
+		{"KeyIDWithDot", func(jwk *JWK) { jwk.KeyID = "a.b" }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwk := valid
+			tt.mutate(&jwk)
+
+			_, err := KeyFromJWK(jwk)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("KeyFromJWK: error = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidSigningKey) {
+				t.Errorf("KeyFromJWK: error = %v, want %v", err, ErrInvalidSigningKey)
+			}
+		})
+	}
+
+	if _, ok := NewRandomHMACKey("hmac").PublicJWK(); ok {
+		t.Errorf("HMACKey.PublicJWK: HMAC keys must not be published")
+	}
+}
@@ -0,0 +1,74 @@
+package cap
+
+import (
+	"context"
+	"net/netip"
+	"time"
+)
+
+// ReputationSignal is a kind of client behavior that is counted to determine the reputation of an IP prefix.
+type ReputationSignal int
+
+const (
+	// ReputationSignalChallenge is recorded when a challenge is created.
+	ReputationSignalChallenge ReputationSignal = iota
+
+	// ReputationSignalFailedSolution is recorded when invalid or insufficient solutions are submitted for a challenge.
+	ReputationSignalFailedSolution
+
+	// ReputationSignalRedemption is recorded when valid solutions are submitted for a challenge and a redeem token is issued.
+	ReputationSignalRedemption
+)
+
+// ReputationSignals contains all reputation signals.
+var ReputationSignals = []ReputationSignal{
+	ReputationSignalChallenge,
+	ReputationSignalFailedSolution,
+	ReputationSignalRedemption,
+}
+
+// String returns the name of the signal, suitable for use in storage keys.
+func (s ReputationSignal) String() string {
+	switch s {
+	case ReputationSignalChallenge:
+		return "challenge"
+	case ReputationSignalFailedSolution:
+		return "failed_solution"
+	case ReputationSignalRedemption:
+		return "redemption"
+	default:
+		return "unknown"
+	}
+}
+
+// ReputationCounts are the number of times each reputation signal was recorded for an IP prefix in its current window.
+type ReputationCounts struct {
+	Challenges      int64
+	FailedSolutions int64
+	Redemptions     int64
+}
+
+// Add adds n to the count for the specified signal.
+func (c *ReputationCounts) Add(signal ReputationSignal, n int64) {
+	switch signal {
+	case ReputationSignalChallenge:
+		c.Challenges += n
+	case ReputationSignalFailedSolution:
+		c.FailedSolutions += n
+	case ReputationSignalRedemption:
+		c.Redemptions += n
+	}
+}
+
+// ReputationDriver is an optional interface that drivers can implement to store client reputation signals.
+// It is used by the cap/reputation package to choose challenge params based on the behavior of IP prefixes.
+type ReputationDriver interface {
+	// AddReputationSignal increments the count of the specified signal for the IP prefix.
+	// Counts are kept in fixed windows; a window starts with the first signal of its kind for the prefix,
+	// and its count is reset once the window duration elapses.
+	AddReputationSignal(ctx context.Context, prefix netip.Prefix, signal ReputationSignal, window time.Duration) error
+
+	// GetReputation returns the counts of all signals for the IP prefix.
+	// Counts for windows that elapsed are zero.
+	GetReputation(ctx context.Context, prefix netip.Prefix) (ReputationCounts, error)
+}
@@ -0,0 +1,37 @@
+package reputation
+
+import "math"
+
+// Curve maps a reputation score to a multiplier for a challenge param.
+// A score of zero is neutral, positive scores are noisy and negative scores are well-behaved,
+// so curves should return 1 for a score of zero, more than 1 for positive scores and less than 1 for negative scores.
+type Curve func(score float64) float64
+
+// FlatCurve returns a Curve that always returns 1, which leaves the param unchanged regardless of the score.
+func FlatCurve() Curve {
+	return func(float64) float64 {
+		return 1
+	}
+}
+
+// LinearCurve returns a Curve that changes the multiplier by `slope` for each point of score.
+// The multiplier never goes below 0.
+//
+// Example:
+// LinearCurve(0.01) returns 2 for a score of 100, and 0.5 for a score of -50.
+func LinearCurve(slope float64) Curve {
+	return func(score float64) float64 {
+		return max(0, 1+slope*score)
+	}
+}
+
+// ExponentialCurve returns a Curve that doubles the multiplier every `doublingScore` points of score,
+// and halves it every `doublingScore` points below zero.
+//
+// Example:
+// ExponentialCurve(25) returns 4 for a score of 50, and 0.5 for a score of -25.
+func ExponentialCurve(doublingScore float64) Curve {
+	return func(score float64) float64 {
+		return math.Exp2(score / doublingScore)
+	}
+}
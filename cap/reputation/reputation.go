@@ -0,0 +1,309 @@
+// Package reputation implements adaptive challenge difficulty based on the recent behavior of client IP prefixes.
+//
+// A Tracker records reputation signals (challenges created, failed solutions and successful redemptions) through a
+// driver that implements cap.ReputationDriver, and chooses harder challenge params for noisy prefixes and easier
+// ones for well-behaved prefixes.
+//
+// Example:
+//
+//	tracker := reputation.NewTracker(driver, reputation.WithIPExtractor(ipFunc))
+//	c := cap.NewCap(driver, cap.WithObserver(tracker))
+//	s := server.NewServer(c,
+//		server.WithIPForRateLimit(ipFunc),
+//		server.WithChallengeParamsChooser(tracker.ChooseParams),
+//	)
+package reputation
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"time"
+
+	pkg "github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/server"
+)
+
+// DefaultWindow is the default duration of the windows that reputation signals are counted in.
+const DefaultWindow = 15 * time.Minute
+
+// Default floors and ceilings for challenge params chosen by a Tracker.
+const (
+	DefaultMinDifficulty = 3
+	DefaultMaxDifficulty = 5
+	DefaultMinCount      = 25
+	DefaultMaxCount      = 200
+)
+
+// Weights are how much each reputation signal adds to the score of an IP prefix.
+// Positive weights make a prefix look noisier, and negative weights make it look better behaved.
+type Weights struct {
+	Challenge      float64
+	FailedSolution float64
+	Redemption     float64
+}
+
+// DefaultWeights are the default signal weights.
+// A prefix that redeems every challenge it requests ends up with a negative score, while a prefix that requests
+// challenges without solving them, or submits invalid solutions, ends up with a positive score.
+var DefaultWeights = Weights{
+	Challenge:      1,
+	FailedSolution: 5,
+	Redemption:     -1.5,
+}
+
+// Tracker tracks the reputation of client IP prefixes and chooses challenge params based on it.
+//
+// It implements cap.Observer, so it must be registered with cap.WithObserver to record signals.
+// Its ChooseParams method can be passed to server.WithChallengeParamsChooser.
+//
+// Params are chosen by computing a score for the client's prefix from its signal counts and weights,
+// then multiplying the base difficulty and count by their curves, and finally clamping them between their floors and
+// ceilings.
+// If reputation cannot be looked up, the base params are used.
+type Tracker struct {
+	driver pkg.ReputationDriver
+	logger *slog.Logger
+	ipFunc server.IPExtractorFunc
+
+	ipv4Bits int
+	ipv6Bits int
+	window   time.Duration
+	weights  Weights
+
+	base            pkg.ChallengeParams
+	difficultyCurve Curve
+	countCurve      Curve
+	minDifficulty   int
+	maxDifficulty   int
+	minCount        int
+	maxCount        int
+}
+
+// WithLogger sets the logger.
+// When not specified, uses slog.Default.
+func WithLogger(logger *slog.Logger) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.logger = logger
+	}
+}
+
+// WithIPExtractor sets the function used to get the client IP in ChooseParams.
+// It should be the same function passed to server.WithIPForRateLimit, because signals are recorded for the IPs
+// that the server passes to Cap.
+// When not specified, uses server.RemoteAddrIPExtractor.
+func WithIPExtractor(ipFunc server.IPExtractorFunc) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.ipFunc = ipFunc
+	}
+}
+
+// WithPrefixBits sets the number of significant bits of IPv4 and IPv6 addresses used to group clients into prefixes.
+// When not specified, uses cap.DefaultIPv4SignificantBits and cap.DefaultIPv6SignificantBits.
+func WithPrefixBits(ipv4Bits int, ipv6Bits int) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.ipv4Bits = ipv4Bits
+		t.ipv6Bits = ipv6Bits
+	}
+}
+
+// WithWindow sets the duration of the windows that signals are counted in.
+// When not specified, uses DefaultWindow.
+func WithWindow(window time.Duration) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.window = window
+	}
+}
+
+// WithWeights sets the signal weights used to compute scores.
+// When not specified, uses DefaultWeights.
+func WithWeights(weights Weights) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.weights = weights
+	}
+}
+
+// WithBaseParams sets the params used for prefixes with a neutral score, and when reputation cannot be looked up.
+// When not specified, uses cap.DefaultChallengeParams.
+func WithBaseParams(params pkg.ChallengeParams) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.base = params
+	}
+}
+
+// WithDifficultyCurve sets the curve used to scale the base difficulty.
+// When not specified, uses LinearCurve(0.0025).
+func WithDifficultyCurve(curve Curve) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.difficultyCurve = curve
+	}
+}
+
+// WithCountCurve sets the curve used to scale the base count.
+// When not specified, uses ExponentialCurve(25).
+func WithCountCurve(curve Curve) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.countCurve = curve
+	}
+}
+
+// WithDifficultyBounds sets the floor and ceiling of chosen difficulties.
+// When not specified, uses DefaultMinDifficulty and DefaultMaxDifficulty.
+func WithDifficultyBounds(minDifficulty int, maxDifficulty int) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.minDifficulty = minDifficulty
+		t.maxDifficulty = maxDifficulty
+	}
+}
+
+// WithCountBounds sets the floor and ceiling of chosen counts.
+// When not specified, uses DefaultMinCount and DefaultMaxCount.
+func WithCountBounds(minCount int, maxCount int) func(t *Tracker) {
+	return func(t *Tracker) {
+		t.minCount = minCount
+		t.maxCount = maxCount
+	}
+}
+
+// NewTracker creates a new Tracker that stores signals with the specified driver.
+func NewTracker(driver pkg.ReputationDriver, opts ...func(t *Tracker)) *Tracker {
+	t := &Tracker{
+		driver: driver,
+		logger: slog.Default(),
+		ipFunc: server.RemoteAddrIPExtractor,
+
+		ipv4Bits: pkg.DefaultIPv4SignificantBits,
+		ipv6Bits: pkg.DefaultIPv6SignificantBits,
+		window:   DefaultWindow,
+		weights:  DefaultWeights,
+
+		base:            pkg.DefaultChallengeParams,
+		difficultyCurve: LinearCurve(0.0025),
+		countCurve:      ExponentialCurve(25),
+		minDifficulty:   DefaultMinDifficulty,
+		maxDifficulty:   DefaultMaxDifficulty,
+		minCount:        DefaultMinCount,
+		maxCount:        DefaultMaxCount,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+// prefixOf returns the prefix that the IP belongs to.
+func (t *Tracker) prefixOf(ip netip.Addr) (netip.Prefix, bool) {
+	ip = ip.Unmap()
+
+	bits := t.ipv6Bits
+	if ip.Is4() {
+		bits = t.ipv4Bits
+	}
+
+	prefix, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+
+	return prefix, true
+}
+
+// Score returns the score for the specified signal counts.
+func (t *Tracker) Score(counts pkg.ReputationCounts) float64 {
+	return t.weights.Challenge*float64(counts.Challenges) +
+		t.weights.FailedSolution*float64(counts.FailedSolutions) +
+		t.weights.Redemption*float64(counts.Redemptions)
+}
+
+// ParamsForScore returns the challenge params to use for a prefix with the specified score.
+func (t *Tracker) ParamsForScore(score float64) pkg.ChallengeParams {
+	scale := func(base int, curve Curve, floor int, ceiling int) int {
+		v := int(math.Round(float64(base) * curve(score)))
+		return min(max(v, floor), ceiling)
+	}
+
+	return pkg.ChallengeParams{
+		Difficulty: scale(t.base.Difficulty, t.difficultyCurve, t.minDifficulty, t.maxDifficulty),
+		Count:      scale(t.base.Count, t.countCurve, t.minCount, t.maxCount),
+		SaltSize:   t.base.SaltSize,
+		Scheme:     t.base.Scheme,
+	}
+}
+
+// Params returns the challenge params to use for the specified client IP.
+// If the IP is nil or its reputation cannot be looked up, returns the base params.
+func (t *Tracker) Params(ctx context.Context, ip *netip.Addr) pkg.ChallengeParams {
+	if ip == nil {
+		return t.base
+	}
+
+	prefix, ok := t.prefixOf(*ip)
+	if !ok {
+		return t.base
+	}
+
+	counts, err := t.driver.GetReputation(ctx, prefix)
+	if err != nil {
+		t.logger.Error("failed to get reputation, using base challenge params",
+			"service", "reputation.Tracker",
+			"prefix", prefix.String(),
+			"error", err,
+		)
+		return t.base
+	}
+
+	return t.ParamsForScore(t.Score(counts))
+}
+
+// ChooseParams chooses challenge params for the client that sent the request.
+// It has the signature of server.ChallengeParamChooserFunc, so it can be passed to server.WithChallengeParamsChooser.
+// It never returns an error.
+func (t *Tracker) ChooseParams(req *http.Request) (pkg.ChallengeParams, error) {
+	return t.Params(req.Context(), t.ipFunc(req)), nil
+}
+
+// record records a signal for the specified IP, if it is not nil.
+func (t *Tracker) record(ctx context.Context, ip *netip.Addr, signal pkg.ReputationSignal) {
+	if ip == nil {
+		return
+	}
+
+	prefix, ok := t.prefixOf(*ip)
+	if !ok {
+		return
+	}
+
+	if err := t.driver.AddReputationSignal(ctx, prefix, signal, t.window); err != nil {
+		t.logger.Error("failed to record reputation signal",
+			"service", "reputation.Tracker",
+			"prefix", prefix.String(),
+			"signal", signal.String(),
+			"error", err,
+		)
+	}
+}
+
+func (t *Tracker) OnCreateChallenge(ctx context.Context, event pkg.CreateChallengeEvent) {
+	// Rate limited requests still count, since they are a sign of a noisy prefix.
+	if event.Err == nil || errors.Is(event.Err, pkg.ErrRateLimited) {
+		t.record(ctx, event.IP, pkg.ReputationSignalChallenge)
+	}
+}
+
+func (t *Tracker) OnVerifySolutions(ctx context.Context, event pkg.VerifySolutionsEvent) {
+	switch {
+	case event.Err == nil:
+		t.record(ctx, event.IP, pkg.ReputationSignalRedemption)
+	case errors.Is(event.Err, pkg.ErrInvalidSolution), errors.Is(event.Err, pkg.ErrInsufficientSolutions):
+		t.record(ctx, event.IP, pkg.ReputationSignalFailedSolution)
+	}
+}
+
+func (t *Tracker) OnUseRedeemToken(context.Context, pkg.UseRedeemTokenEvent) {
+	// Redeem tokens are used by the site's backend, not the client, so there is nothing to record.
+}
@@ -0,0 +1,281 @@
+package reputation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	pkg "github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+// memDriver is an in-memory pkg.ReputationDriver that never expires counts.
+// If err is set, all calls fail with it.
+type memDriver struct {
+	mu     sync.Mutex
+	counts map[netip.Prefix]pkg.ReputationCounts
+	err    error
+}
+
+func newMemDriver() *memDriver {
+	return &memDriver{counts: make(map[netip.Prefix]pkg.ReputationCounts)}
+}
+
+func (d *memDriver) AddReputationSignal(ctx context.Context, prefix netip.Prefix, signal pkg.ReputationSignal, window time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return d.err
+	}
+
+	counts := d.counts[prefix]
+	counts.Add(signal, 1)
+	d.counts[prefix] = counts
+	return nil
+}
+
+func (d *memDriver) GetReputation(ctx context.Context, prefix netip.Prefix) (pkg.ReputationCounts, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.err != nil {
+		return pkg.ReputationCounts{}, d.err
+	}
+	return d.counts[prefix], nil
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestCurves(t *testing.T) {
+	tests := []struct {
+		name  string
+		curve Curve
+		score float64
+		want  float64
+	}{
+		{"FlatPositive", FlatCurve(), 100, 1},
+		{"FlatNegative", FlatCurve(), -100, 1},
+		{"LinearNeutral", LinearCurve(0.01), 0, 1},
+		{"LinearPositive", LinearCurve(0.01), 100, 2},
+		{"LinearNegative", LinearCurve(0.01), -50, 0.5},
+		{"LinearNeverNegative", LinearCurve(0.01), -200, 0},
+		{"ExponentialNeutral", ExponentialCurve(25), 0, 1},
+		{"ExponentialPositive", ExponentialCurve(25), 50, 4},
+		{"ExponentialNegative", ExponentialCurve(25), -25, 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.curve(tt.score); got != tt.want {
+				t.Errorf("curve(%v) = %v, want %v", tt.score, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParamsForScore(t *testing.T) {
+	base := pkg.ChallengeParams{Difficulty: 4, Count: 50, SaltSize: 16, Scheme: "test-scheme"}
+	tracker := NewTracker(newMemDriver(), WithBaseParams(base))
+
+	tests := []struct {
+		name           string
+		score          float64
+		wantDifficulty int
+		wantCount      int
+	}{
+		{"Neutral", 0, 4, 50},
+		{"Noisy", 25, 4, 100},
+		{"AtCeilings", 50, 5, 200},
+		{"AboveCeilings", 1000, DefaultMaxDifficulty, DefaultMaxCount},
+		{"WellBehaved", -25, 4, 25},
+		{"BelowFloors", -1000, DefaultMinDifficulty, DefaultMinCount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := pkg.ChallengeParams{Difficulty: tt.wantDifficulty, Count: tt.wantCount, SaltSize: 16, Scheme: "test-scheme"}
+			if got := tracker.ParamsForScore(tt.score); got != want {
+				t.Errorf("ParamsForScore(%v) = %+v, want %+v", tt.score, got, want)
+			}
+		})
+	}
+}
+
+func TestParamsForScoreBounds(t *testing.T) {
+	tracker := NewTracker(newMemDriver(),
+		WithBaseParams(pkg.ChallengeParams{Difficulty: 4, Count: 50, SaltSize: 32}),
+		WithDifficultyCurve(LinearCurve(0.01)),
+		WithCountCurve(LinearCurve(0.01)),
+		WithDifficultyBounds(2, 6),
+		WithCountBounds(40, 60),
+	)
+
+	tests := []struct {
+		name  string
+		score float64
+		want  pkg.ChallengeParams
+	}{
+		{"BelowFloors", -60, pkg.ChallengeParams{Difficulty: 2, Count: 40, SaltSize: 32}},
+		{"AtFloors", -50, pkg.ChallengeParams{Difficulty: 2, Count: 40, SaltSize: 32}},
+		{"WithinBounds", 10, pkg.ChallengeParams{Difficulty: 4, Count: 55, SaltSize: 32}},
+		{"AtCeilings", 50, pkg.ChallengeParams{Difficulty: 6, Count: 60, SaltSize: 32}},
+		{"AboveCeilings", 60, pkg.ChallengeParams{Difficulty: 6, Count: 60, SaltSize: 32}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tracker.ParamsForScore(tt.score); got != tt.want {
+				t.Errorf("ParamsForScore(%v) = %+v, want %+v", tt.score, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScore(t *testing.T) {
+	tracker := NewTracker(newMemDriver())
+
+	counts := pkg.ReputationCounts{Challenges: 10, FailedSolutions: 2, Redemptions: 4}
+	if got, want := tracker.Score(counts), 10*1+2*5-4*1.5; got != want {
+		t.Errorf("Score(%+v) = %v, want %v", counts, got, want)
+	}
+}
+
+func TestParamsFallsBackToBase(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	driver := newMemDriver()
+	driver.counts[netip.MustParsePrefix("192.0.2.0/24")] = pkg.ReputationCounts{Challenges: 1000}
+	tracker := NewTracker(driver, WithPrefixBits(24, 64), WithLogger(discardLogger))
+
+	if got := tracker.Params(context.Background(), nil); got != pkg.DefaultChallengeParams {
+		t.Errorf("Params without IP = %+v, want %+v", got, pkg.DefaultChallengeParams)
+	}
+
+	if got := tracker.Params(context.Background(), &ip); got == pkg.DefaultChallengeParams {
+		t.Fatalf("Params for noisy prefix = base params, want harder params")
+	}
+
+	driver.err = errors.New("storage unavailable")
+	if got := tracker.Params(context.Background(), &ip); got != pkg.DefaultChallengeParams {
+		t.Errorf("Params with driver error = %+v, want %+v", got, pkg.DefaultChallengeParams)
+	}
+
+	// Failing to record signals must not panic.
+	tracker.OnCreateChallenge(context.Background(), pkg.CreateChallengeEvent{IP: &ip})
+}
+
+func TestObserverSignals(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	tests := []struct {
+		name   string
+		notify func(tracker *Tracker)
+		want   pkg.ReputationCounts
+	}{
+		{"ChallengeCreated", func(tracker *Tracker) {
+			tracker.OnCreateChallenge(context.Background(), pkg.CreateChallengeEvent{IP: &ip})
+		}, pkg.ReputationCounts{Challenges: 1}},
+		{"ChallengeRateLimited", func(tracker *Tracker) {
+			tracker.OnCreateChallenge(context.Background(), pkg.CreateChallengeEvent{IP: &ip, Err: pkg.ErrRateLimited})
+		}, pkg.ReputationCounts{Challenges: 1}},
+		{"ChallengeFailed", func(tracker *Tracker) {
+			tracker.OnCreateChallenge(context.Background(), pkg.CreateChallengeEvent{IP: &ip, Err: pkg.ErrMetadataTooLarge})
+		}, pkg.ReputationCounts{}},
+		{"ChallengeWithoutIP", func(tracker *Tracker) {
+			tracker.OnCreateChallenge(context.Background(), pkg.CreateChallengeEvent{})
+		}, pkg.ReputationCounts{}},
+		{"Redeemed", func(tracker *Tracker) {
+			tracker.OnVerifySolutions(context.Background(), pkg.VerifySolutionsEvent{IP: &ip})
+		}, pkg.ReputationCounts{Redemptions: 1}},
+		{"InvalidSolution", func(tracker *Tracker) {
+			tracker.OnVerifySolutions(context.Background(), pkg.VerifySolutionsEvent{IP: &ip, Err: pkg.ErrInvalidSolution})
+		}, pkg.ReputationCounts{FailedSolutions: 1}},
+		{"WrappedInvalidSolution", func(tracker *Tracker) {
+			err := fmt.Errorf("verifying: %w", pkg.ErrInvalidSolution)
+			tracker.OnVerifySolutions(context.Background(), pkg.VerifySolutionsEvent{IP: &ip, Err: err})
+		}, pkg.ReputationCounts{FailedSolutions: 1}},
+		{"InsufficientSolutions", func(tracker *Tracker) {
+			tracker.OnVerifySolutions(context.Background(), pkg.VerifySolutionsEvent{IP: &ip, Err: pkg.ErrInsufficientSolutions})
+		}, pkg.ReputationCounts{FailedSolutions: 1}},
+		{"ChallengeNotFound", func(tracker *Tracker) {
+			tracker.OnVerifySolutions(context.Background(), pkg.VerifySolutionsEvent{IP: &ip, Err: pkg.ErrChallengeNotFound})
+		}, pkg.ReputationCounts{}},
+		{"ChallengeAlreadySolved", func(tracker *Tracker) {
+			tracker.OnVerifySolutions(context.Background(), pkg.VerifySolutionsEvent{IP: &ip, Err: pkg.ErrChallengeAlreadySolved})
+		}, pkg.ReputationCounts{}},
+		{"VerifyCancelled", func(tracker *Tracker) {
+			tracker.OnVerifySolutions(context.Background(), pkg.VerifySolutionsEvent{IP: &ip, Err: context.Canceled})
+		}, pkg.ReputationCounts{}},
+		{"VerifyWithoutIP", func(tracker *Tracker) {
+			tracker.OnVerifySolutions(context.Background(), pkg.VerifySolutionsEvent{})
+		}, pkg.ReputationCounts{}},
+		{"RedeemTokenUsed", func(tracker *Tracker) {
+			tracker.OnUseRedeemToken(context.Background(), pkg.UseRedeemTokenEvent{IP: &ip, WasRedeemed: true})
+		}, pkg.ReputationCounts{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := newMemDriver()
+			tt.notify(NewTracker(driver, WithPrefixBits(24, 64)))
+
+			got, _ := driver.GetReputation(context.Background(), netip.MustParsePrefix("192.0.2.0/24"))
+			if got != tt.want {
+				t.Errorf("counts = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChooseParams(t *testing.T) {
+	driver := newMemDriver()
+	tracker := NewTracker(driver, WithPrefixBits(24, 64))
+	c := pkg.NewCap(fake.NewDriver(pkg.SystemClock), pkg.WithObserver(tracker))
+
+	noisy := netip.MustParseAddr("192.0.2.1")
+	for range 25 {
+		_, err := c.CreateChallenge(context.Background(), pkg.ChallengeRequest{
+			Params:        pkg.DefaultChallengeParams,
+			IP:            &noisy,
+			ValidDuration: time.Minute,
+		})
+		if err != nil {
+			t.Fatalf("CreateChallenge: unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       pkg.ChallengeParams
+	}{
+		// Signals are recorded for the whole prefix, so another IP in it gets the same params.
+		{"NoisyPrefix", "192.0.2.200:1234", pkg.ChallengeParams{Difficulty: 4, Count: 100, SaltSize: 32}},
+		{"OtherPrefix", "198.51.100.1:1234", pkg.DefaultChallengeParams},
+		{"NoIP", "", pkg.DefaultChallengeParams},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/challenge", nil)
+			req.RemoteAddr = tt.remoteAddr
+
+			got, err := tracker.ChooseParams(req)
+			if err != nil {
+				t.Fatalf("ChooseParams: unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ChooseParams = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package cap
+
+// Scope restricts where a redeem token can be used.
+// A redeem token issued for a scope can only be redeemed by passing the same scope to Cap.Redeem,
+// which prevents a token obtained for one form or site from being spent on another.
+// All fields are optional; the zero value is the unscoped scope.
+type Scope struct {
+	// The site key that the challenge was issued for.
+	SiteKey string
+
+	// The action that the challenge was issued for, such as "signup" or "newsletter".
+	Action string
+
+	// The audience that the redeem token is intended for, such as a service name.
+	Audience string
+}
+
+// IsZero returns whether the scope is the zero (unscoped) scope.
+func (s Scope) IsZero() bool {
+	return s == Scope{}
+}
@@ -0,0 +1,180 @@
+package cap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// ErrInvalidScryptParams is returned when scrypt parameters are out of range.
+var ErrInvalidScryptParams = errors.New("invalid scrypt parameters")
+
+// Default scrypt parameters for DefaultScryptScheme.
+// Each digest takes 128 * N * R bytes (1 MiB) of memory.
+const (
+	DefaultScryptN = 1024
+	DefaultScryptR = 8
+	DefaultScryptP = 1
+)
+
+// maxScryptMemory is the maximum amount of memory a single scrypt digest may use, in bytes.
+// Verification computes one digest per sub-challenge, so larger values would let clients exhaust server memory.
+const maxScryptMemory = 16 << 20
+
+// DefaultScryptScheme is a ScryptScheme with the default parameters.
+var DefaultScryptScheme = &ScryptScheme{n: DefaultScryptN, r: DefaultScryptR, p: DefaultScryptP}
+
+// ScryptScheme is a memory-hard PoWScheme based on scrypt (RFC 7914), which is much less GPU-friendly than SHA-256.
+// The digest of an input is the 32-byte scrypt key derived with the input as both the password and the salt.
+//
+// Digests are far more expensive than SHA-256 digests, so challenges using this scheme should have a difficulty
+// of 1 or 2 and a small count.
+// The Cap.js widget does not support this scheme; clients must implement it themselves, or use the cap/solver package.
+type ScryptScheme struct {
+	n int
+	r int
+	p int
+}
+
+// NewScryptScheme creates a new ScryptScheme with the specified CPU/memory cost (n), block size (r) and
+// parallelization (p) parameters.
+// Returns ErrInvalidScryptParams if n is not a power of two greater than 1, r or p is less than 1, or a digest would
+// use more than 16 MiB of memory.
+func NewScryptScheme(n int, r int, p int) (*ScryptScheme, error) {
+	if n <= 1 || n&(n-1) != 0 || r < 1 || p < 1 || r > maxScryptMemory/128/n || p > maxScryptMemory/128/r {
+		return nil, ErrInvalidScryptParams
+	}
+
+	return &ScryptScheme{n: n, r: r, p: p}, nil
+}
+
+// Name returns the scheme's name, which includes its parameters so that clients know how to compute digests.
+// For example, the name of DefaultScryptScheme is "scrypt-n1024-r8-p1".
+func (s *ScryptScheme) Name() string {
+	return fmt.Sprintf("scrypt-n%d-r%d-p%d", s.n, s.r, s.p)
+}
+
+func (s *ScryptScheme) Digest(input []byte) [sha256.Size]byte {
+	var digest [sha256.Size]byte
+	copy(digest[:], scryptKey(input, input, s.n, s.r, s.p, sha256.Size))
+	return digest
+}
+
+// scryptKey derives a key of the specified length with scrypt.
+// The parameters must be valid.
+func scryptKey(password []byte, salt []byte, n int, r int, p int, keyLen int) []byte {
+	blockSize := 128 * r
+
+	b := pbkdf2SHA256(password, salt, p*blockSize)
+	xy := make([]uint32, 64*r)
+	v := make([]uint32, 32*n*r)
+	for i := 0; i < p; i++ {
+		scryptSMix(b[i*blockSize:], r, n, v, xy)
+	}
+
+	return pbkdf2SHA256(password, b, keyLen)
+}
+
+// pbkdf2SHA256 derives a key with PBKDF2-HMAC-SHA256 and a single iteration, as used by scrypt.
+func pbkdf2SHA256(password []byte, salt []byte, keyLen int) []byte {
+	mac := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen+sha256.Size)
+
+	var counter [4]byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		binary.BigEndian.PutUint32(counter[:], block)
+
+		mac.Reset()
+		mac.Write(salt)
+		mac.Write(counter[:])
+		key = mac.Sum(key)
+	}
+
+	return key[:keyLen]
+}
+
+// scryptSMix runs scrypt's ROMix on the block b, using v and xy as scratch space.
+func scryptSMix(b []byte, r int, n int, v []uint32, xy []uint32) {
+	var tmp [16]uint32
+	blockWords := 32 * r
+	x := xy[:blockWords]
+	y := xy[blockWords:]
+
+	for i := range x {
+		x[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+
+	for i := 0; i < n; i += 2 {
+		copy(v[i*blockWords:], x)
+		scryptBlockMix(&tmp, x, y, r)
+		copy(v[(i+1)*blockWords:], y)
+		scryptBlockMix(&tmp, y, x, r)
+	}
+
+	for i := 0; i < n; i += 2 {
+		j := int(x[blockWords-16] & uint32(n-1))
+		scryptBlockXOR(x, v[j*blockWords:])
+		scryptBlockMix(&tmp, x, y, r)
+
+		j = int(y[blockWords-16] & uint32(n-1))
+		scryptBlockXOR(y, v[j*blockWords:])
+		scryptBlockMix(&tmp, y, x, r)
+	}
+
+	for i, w := range x {
+		binary.LittleEndian.PutUint32(b[i*4:], w)
+	}
+}
+
+// scryptBlockXOR XORs src into dst.
+func scryptBlockXOR(dst []uint32, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// scryptBlockMix runs scrypt's BlockMix on in, writing the result to out.
+// Even sub-blocks are written to the first half of out and odd sub-blocks to the second half.
+func scryptBlockMix(tmp *[16]uint32, in []uint32, out []uint32, r int) {
+	copy(tmp[:], in[(2*r-1)*16:])
+	for i := 0; i < 2*r; i += 2 {
+		salsa208XOR(tmp, in[i*16:], out[i*8:])
+		salsa208XOR(tmp, in[i*16+16:], out[i*8+r*16:])
+	}
+}
+
+// salsa208XOR XORs in into tmp, applies the Salsa20/8 core to tmp, and copies the result to out.
+func salsa208XOR(tmp *[16]uint32, in []uint32, out []uint32) {
+	for i := range tmp {
+		tmp[i] ^= in[i]
+	}
+
+	x := *tmp
+	quarterRound := func(a int, b int, c int, d int) {
+		x[b] ^= bits.RotateLeft32(x[a]+x[d], 7)
+		x[c] ^= bits.RotateLeft32(x[b]+x[a], 9)
+		x[d] ^= bits.RotateLeft32(x[c]+x[b], 13)
+		x[a] ^= bits.RotateLeft32(x[d]+x[c], 18)
+	}
+	for range 4 {
+		// Columns.
+		quarterRound(0, 4, 8, 12)
+		quarterRound(5, 9, 13, 1)
+		quarterRound(10, 14, 2, 6)
+		quarterRound(15, 3, 7, 11)
+
+		// Rows.
+		quarterRound(0, 1, 2, 3)
+		quarterRound(5, 6, 7, 4)
+		quarterRound(10, 11, 8, 9)
+		quarterRound(15, 12, 13, 14)
+	}
+
+	for i := range tmp {
+		tmp[i] += x[i]
+	}
+	copy(out, tmp[:])
+}
@@ -0,0 +1,131 @@
+package cap
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// mustDecodeHex decodes a hex string that may contain whitespace.
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatalf("decoding hex: %v", err)
+	}
+	return b
+}
+
+// TestPBKDF2SHA256 checks the test vector from RFC 7914, section 11.
+func TestPBKDF2SHA256(t *testing.T) {
+	want := mustDecodeHex(t, `
+		55 ac 04 6e 56 e3 08 9f ec 16 91 c2 25 44 b6 05
+		f9 41 85 21 6d de 04 65 e6 8b 9d 57 c2 0d ac bc
+		49 ca 9c cc f1 79 b6 45 99 16 64 b3 9d 77 ef 31
+		7c 71 b8 45 b1 e3 0b d5 09 11 20 41 d3 a1 97 83`)
+
+	if got := pbkdf2SHA256([]byte("passwd"), []byte("salt"), len(want)); !bytes.Equal(got, want) {
+		t.Errorf("pbkdf2SHA256 = %x, want %x", got, want)
+	}
+}
+
+// TestScryptKey checks the test vectors from RFC 7914, section 12.
+// The last vector, which uses 1 GiB of memory, is left out.
+func TestScryptKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		salt     string
+		n        int
+		r        int
+		p        int
+		want     string
+	}{
+		{
+			name: "Empty", password: "", salt: "", n: 16, r: 1, p: 1,
+			want: `
+				77 d6 57 62 38 65 7b 20 3b 19 ca 42 c1 8a 04 97
+				f1 6b 48 44 e3 07 4a e8 df df fa 3f ed e2 14 42
+				fc d0 06 9d ed 09 48 f8 32 6a 75 3a 0f c8 1f 17
+				e8 d3 e0 fb 2e 0d 36 28 cf 35 e2 0c 38 d1 89 06`,
+		},
+		{
+			name: "Password", password: "password", salt: "NaCl", n: 1024, r: 8, p: 16,
+			want: `
+				fd ba be 1c 9d 34 72 00 78 56 e7 19 0d 01 e9 fe
+				7c 6a d7 cb c8 23 78 30 e7 73 76 63 4b 37 31 62
+				2e af 30 d9 2e 22 a3 88 6f f1 09 27 9d 98 30 da
+				c7 27 af b9 4a 83 ee 6d 83 60 cb df a2 cc 06 40`,
+		},
+		{
+			name: "PleaseLetMeIn", password: "pleaseletmein", salt: "SodiumChloride", n: 16384, r: 8, p: 1,
+			want: `
+				70 23 bd cb 3a fd 73 48 46 1c 06 cd 81 fd 38 eb
+				fd a8 fb ba 90 4f 8e 3e a9 b5 43 f6 54 5d a1 f2
+				d5 43 29 55 61 3f 0f cf 62 d4 97 05 24 2a 9a f9
+				e6 1e 85 dc 0d 65 1e 40 df cf 01 7b 45 57 58 87`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := mustDecodeHex(t, tt.want)
+			got := scryptKey([]byte(tt.password), []byte(tt.salt), tt.n, tt.r, tt.p, len(want))
+			if !bytes.Equal(got, want) {
+				t.Errorf("scryptKey = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestScryptSchemeDigest(t *testing.T) {
+	scheme, err := NewScryptScheme(16, 1, 1)
+	if err != nil {
+		t.Fatalf("NewScryptScheme: unexpected error: %v", err)
+	}
+
+	// The digest is the first 32 bytes of the key derived with the input as both the password and the salt.
+	input := []byte("salt123")
+	want := scryptKey(input, input, 16, 1, 1, sha256.Size)
+	if got := scheme.Digest(input); !bytes.Equal(got[:], want) {
+		t.Errorf("Digest = %x, want %x", got, want)
+	}
+
+	if got, want := DefaultScryptScheme.Name(), "scrypt-n1024-r8-p1"; got != want {
+		t.Errorf("DefaultScryptScheme.Name() = %q, want %q", got, want)
+	}
+}
+
+func TestNewScryptScheme(t *testing.T) {
+	tests := []struct {
+		n, r, p int
+		wantErr bool
+	}{
+		{1024, 8, 1, false},
+		{2, 1, 1, false},
+		{16384, 8, 1, false},
+		{1, 1, 1, true},
+		{0, 1, 1, true},
+		{1000, 8, 1, true},
+		{1024, 0, 1, true},
+		{1024, 8, 0, true},
+		{-1024, 8, 1, true},
+		// 32 MiB per digest.
+		{32768, 8, 1, true},
+		{16384, 16, 1, true},
+	}
+
+	for _, tt := range tests {
+		_, err := NewScryptScheme(tt.n, tt.r, tt.p)
+		if tt.wantErr != (err != nil) {
+			t.Errorf("NewScryptScheme(%d, %d, %d): error = %v, want error %t", tt.n, tt.r, tt.p, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidScryptParams) {
+			t.Errorf("NewScryptScheme(%d, %d, %d): error = %v, want %v", tt.n, tt.r, tt.p, err, ErrInvalidScryptParams)
+		}
+	}
+}
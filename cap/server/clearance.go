@@ -0,0 +1,359 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	pkg "github.com/termermc/go-capjs/cap"
+)
+
+// clearanceTokenPrefix is the prefix of all clearance cookie values.
+// It includes a version number so that the format can be changed in the future.
+const clearanceTokenPrefix = "c1."
+
+// DefaultClearanceCookieName is the default name of the clearance cookie.
+const DefaultClearanceCookieName = "cap_clearance"
+
+// DefaultClearanceDuration is the default duration that a clearance cookie is valid after it is issued.
+const DefaultClearanceDuration = 30 * time.Minute
+
+// DefaultClearanceIPv4Bits and DefaultClearanceIPv6Bits are the default number of bits of the client IP that clearance
+// cookies are bound to.
+// They are less specific than single addresses so that clients behind NAT pools or with rotating IPv6 privacy
+// addresses keep their clearance.
+const (
+	DefaultClearanceIPv4Bits = 24
+	DefaultClearanceIPv6Bits = 64
+)
+
+// ErrMissingClearance is passed to the rejection handler of Clearance.Middleware when a request has no clearance
+// cookie, or its clearance cookie is invalid, expired, or was issued to a different client.
+var ErrMissingClearance = errors.New("request does not have a valid clearance cookie")
+
+// Clearance issues and verifies clearance cookies.
+//
+// A clearance cookie is an HttpOnly cookie that is issued in exchange for a redeem token, and lets the client through
+// Clearance.Middleware without solving further challenges until it expires, similar to the "under attack" modes of
+// CDNs. It is signed with HMAC-SHA256 and bound to the client's IP prefix and User-Agent, so it cannot be used by
+// other clients.
+//
+// Clearance cookies are stateless; they cannot be revoked before they expire, except by removing the key that signed
+// them from the keyring.
+type Clearance struct {
+	cap     *pkg.Cap
+	keyring *pkg.HMACKeyring
+	clock   pkg.Clock
+
+	cookie     http.Cookie
+	duration   time.Duration
+	v4Bits     int
+	v6Bits     int
+	extractors []TokenExtractorFunc
+	scopeFunc  ScopeChooserFunc
+	ipFunc     IPExtractorFunc
+	rejectFunc RejectionHandlerFunc
+	errFunc    ErrorHandlerFunc
+}
+
+// NewClearance creates a new Clearance that redeems tokens with cap, and signs clearance cookies with keyring.
+// The keyring can be shared with WithStatelessChallenges.
+func NewClearance(cap *pkg.Cap, keyring *pkg.HMACKeyring, opts ...func(c *Clearance)) *Clearance {
+	c := &Clearance{
+		cap:     cap,
+		keyring: keyring,
+		clock:   pkg.SystemClock,
+
+		cookie: http.Cookie{
+			Name:     DefaultClearanceCookieName,
+			Path:     "/",
+			SameSite: http.SameSiteLaxMode,
+		},
+		duration:   DefaultClearanceDuration,
+		v4Bits:     DefaultClearanceIPv4Bits,
+		v6Bits:     DefaultClearanceIPv6Bits,
+		extractors: []TokenExtractorFunc{NewFormTokenExtractor(DefaultTokenField)},
+		scopeFunc:  NewStaticScopeChooser(pkg.Scope{}),
+		ipFunc:     RemoteAddrIPExtractor,
+		rejectFunc: defaultRejectFunc,
+		errFunc:    defaultErrFunc,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// WithClearanceCookie sets the attributes of the clearance cookie.
+// The cookie's Name, Path, Domain, Secure and SameSite fields are used; its value, expiration and HttpOnly attribute
+// are always set by Clearance.
+// When not specified, uses a cookie named DefaultClearanceCookieName with path "/" and SameSite=Lax.
+func WithClearanceCookie(cookie http.Cookie) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.cookie = cookie
+	}
+}
+
+// WithClearanceDuration sets the duration that clearance cookies are valid after they are issued.
+// When not specified, uses DefaultClearanceDuration.
+func WithClearanceDuration(duration time.Duration) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.duration = duration
+	}
+}
+
+// WithClearanceIPBits sets the number of bits of the client IP that clearance cookies are bound to (see cap.IPPrefix).
+// Use 32 and 128 to bind cookies to exact addresses, or 0 and 0 to not bind them to the IP at all.
+// When not specified, uses DefaultClearanceIPv4Bits and DefaultClearanceIPv6Bits.
+func WithClearanceIPBits(v4Bits int, v6Bits int) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.v4Bits = v4Bits
+		c.v6Bits = v6Bits
+	}
+}
+
+// WithClearanceIP sets the function used to extract the client IP that clearance cookies are bound to.
+// The extractor must be suitable for the application's deployment; see NewTrustedProxyIPExtractor.
+// If it returns nil, cookies are only bound to the User-Agent.
+// When not specified, uses RemoteAddrIPExtractor.
+func WithClearanceIP(ipFunc IPExtractorFunc) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.ipFunc = ipFunc
+	}
+}
+
+// WithClearanceTokenExtractors sets the functions used to extract redeem tokens from requests to the exchange handler.
+// When not specified, uses NewFormTokenExtractor(DefaultTokenField).
+func WithClearanceTokenExtractors(extractors ...TokenExtractorFunc) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.extractors = extractors
+	}
+}
+
+// WithClearanceScope sets the scope that redeem tokens must have been issued for to be exchanged for clearance.
+// When not specified, only unscoped redeem tokens are accepted.
+// To specify a dynamic scope chooser, use WithClearanceScopeChooser.
+func WithClearanceScope(scope pkg.Scope) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.scopeFunc = NewStaticScopeChooser(scope)
+	}
+}
+
+// WithClearanceScopeChooser sets the scope chooser used to choose the scope that redeem tokens must have been issued
+// for to be exchanged for clearance.
+// When not specified, see comment on WithClearanceScope.
+func WithClearanceScopeChooser(chooser ScopeChooserFunc) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.scopeFunc = chooser
+	}
+}
+
+// WithClearanceRejectionHandler sets the function that handles requests rejected by Clearance.Middleware, with the
+// reason ErrMissingClearance.
+// When not specified, responds with 403 Forbidden.
+func WithClearanceRejectionHandler(rejectFunc RejectionHandlerFunc) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.rejectFunc = rejectFunc
+	}
+}
+
+// WithClearanceErrorHandler sets the function that handles errors while exchanging redeem tokens.
+// When not specified, logs the error and responds with 500 Internal Server Error.
+func WithClearanceErrorHandler(errFunc ErrorHandlerFunc) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.errFunc = errFunc
+	}
+}
+
+// WithClearanceClock sets the clock used to set and check the expiration of clearance cookies.
+// When not specified, uses cap.SystemClock.
+func WithClearanceClock(clock pkg.Clock) func(c *Clearance) {
+	return func(c *Clearance) {
+		c.clock = clock
+	}
+}
+
+// binding returns the client properties that a clearance cookie issued for the request is bound to.
+// It has the form "<IP prefix>\x00<SHA-256 of User-Agent>".
+func (c *Clearance) binding(req *http.Request) []byte {
+	var prefix string
+	if ip := c.ipFunc(req); ip != nil {
+		prefix = pkg.IPPrefix(*ip, c.v4Bits, c.v6Bits).String()
+	}
+
+	uaHash := sha256.Sum256([]byte(req.UserAgent()))
+
+	binding := make([]byte, 0, len(prefix)+1+len(uaHash))
+	binding = append(binding, prefix...)
+	binding = append(binding, 0)
+	return append(binding, uaHash[:]...)
+}
+
+// clearanceSignature returns the signature of a clearance cookie value bound to the specified client properties.
+// The binding is not included in the cookie; it is recomputed from the request when the cookie is verified.
+func clearanceSignature(key pkg.HMACKey, signed string, binding []byte) []byte {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(signed))
+	mac.Write([]byte{0})
+	mac.Write(binding)
+	return mac.Sum(nil)
+}
+
+// Issue sets a clearance cookie for the request's client on the response, and returns its expiration time.
+// It does not check whether the client solved a challenge; use it from handlers that have already verified a redeem
+// token, for example behind RequireToken, or use ExchangeHandler.
+func (c *Clearance) Issue(res http.ResponseWriter, req *http.Request) time.Time {
+	key := c.keyring.Primary()
+	expires := time.UnixMilli(c.clock.Now().Add(c.duration).UnixMilli())
+
+	// Layout (big endian):
+	//   - 8 bytes: expiration UNIX millisecond timestamp
+	payload := binary.BigEndian.AppendUint64(nil, uint64(expires.UnixMilli()))
+
+	signed := clearanceTokenPrefix + key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	value := signed + "." + base64.RawURLEncoding.EncodeToString(clearanceSignature(key, signed, c.binding(req)))
+
+	cookie := c.cookie
+	cookie.Value = value
+	cookie.Expires = expires
+	cookie.MaxAge = int(c.duration / time.Second)
+	cookie.HttpOnly = true
+	http.SetCookie(res, &cookie)
+
+	return expires
+}
+
+// Verify returns whether the request has a valid clearance cookie that was issued to its client and is not expired.
+func (c *Clearance) Verify(req *http.Request) bool {
+	cookie, err := req.Cookie(c.cookie.Name)
+	if err != nil || !strings.HasPrefix(cookie.Value, clearanceTokenPrefix) {
+		return false
+	}
+
+	value := cookie.Value
+	parts := strings.Split(value[len(clearanceTokenPrefix):], ".")
+	if len(parts) != 3 {
+		return false
+	}
+
+	key, has := c.keyring.Get(parts[0])
+	if !has {
+		return false
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	signed := value[:len(value)-len(parts[2])-1]
+	if !hmac.Equal(mac, clearanceSignature(key, signed, c.binding(req))) {
+		return false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(payload) != 8 {
+		return false
+	}
+
+	expires := time.UnixMilli(int64(binary.BigEndian.Uint64(payload)))
+	return expires.After(c.clock.Now())
+}
+
+// Middleware only passes requests with a valid clearance cookie to the next handler.
+// Requests without one are passed to the rejection handler with ErrMissingClearance, which can, for example, serve a
+// page that solves a challenge and exchanges the redeem token for clearance.
+//
+// Example:
+//
+//	mux.Handle("/", clearance.Middleware(siteHandler))
+func (c *Clearance) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if !c.Verify(req) {
+			c.rejectFunc(ErrMissingClearance, res, req)
+			return
+		}
+
+		next.ServeHTTP(res, req)
+	})
+}
+
+// ExchangeHandler is the HTTP handler that exchanges a redeem token for a clearance cookie.
+// The redeem token is consumed, and the response is a JSON object with "success" set to whether the token was valid,
+// and "expires" set to the UNIX millisecond timestamp when the clearance expires.
+// Should be mounted on `/clearance`.
+func (c *Clearance) ExchangeHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		res.WriteHeader(405)
+		_, _ = res.Write([]byte("method not allowed"))
+		return
+	}
+
+	type clearanceRes struct {
+		Success bool   `json:"success"`
+		Message string `json:"message,omitempty"`
+
+		// UNIX millisecond timestamp when the clearance expires.
+		Expires int64 `json:"expires,omitempty"`
+	}
+
+	doJson := func(status int, data clearanceRes) {
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(status)
+		enc := json.NewEncoder(res)
+		_ = enc.Encode(data)
+	}
+
+	var token string
+	for _, extractor := range c.extractors {
+		if token = extractor(req); token != "" {
+			break
+		}
+	}
+	if token == "" {
+		doJson(400, clearanceRes{
+			Success: false,
+			Message: "missing cap token",
+		})
+		return
+	}
+
+	scope, err := c.scopeFunc(req)
+	if err != nil {
+		c.errFunc(err, res, req)
+		return
+	}
+
+	ctx := pkg.ContextWithClientIP(req.Context(), c.ipFunc(req))
+
+	_, err = c.cap.Redeem(ctx, pkg.RedeemRequest{
+		RedeemToken: token,
+		Scope:       scope,
+	})
+	if err != nil {
+		if errors.Is(err, pkg.ErrInvalidRedeemToken) || errors.Is(err, pkg.ErrScopeMismatch) {
+			doJson(403, clearanceRes{
+				Success: false,
+				Message: "invalid cap token",
+			})
+			return
+		}
+
+		c.errFunc(err, res, req)
+		return
+	}
+
+	expires := c.Issue(res, req)
+	doJson(200, clearanceRes{
+		Success: true,
+		Expires: expires.UnixMilli(),
+	})
+}
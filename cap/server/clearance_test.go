@@ -0,0 +1,348 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	pkg "github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+const (
+	testUserAgent  = "Mozilla/5.0 (X11; Linux x86_64) Test/1.0"
+	testRemoteAddr = "192.0.2.10:1234"
+)
+
+// newTestClearance creates a Clearance with a new keyring and a fake clock.
+func newTestClearance(t *testing.T, opts ...func(c *Clearance)) (*Clearance, *pkg.HMACKeyring, *fake.Clock) {
+	t.Helper()
+
+	keyring, err := pkg.NewHMACKeyring(pkg.NewRandomHMACKey("k1"))
+	if err != nil {
+		t.Fatalf("NewHMACKeyring: unexpected error: %v", err)
+	}
+	clock := fake.NewClock(time.Now())
+
+	opts = append([]func(c *Clearance){WithClearanceClock(clock)}, opts...)
+	return NewClearance(pkg.NewCap(fake.NewDriver(clock), pkg.WithClock(clock)), keyring, opts...), keyring, clock
+}
+
+// clientRequest returns a request from the specified client, with the cookie if it is not nil.
+func clientRequest(remoteAddr string, userAgent string, cookie *http.Cookie) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set("User-Agent", userAgent)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	return req
+}
+
+// issueCookie issues a clearance cookie to the test client and returns it.
+func issueCookie(t *testing.T, c *Clearance) *http.Cookie {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	c.Issue(rec, clientRequest(testRemoteAddr, testUserAgent, nil))
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Issue: set %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+func TestClearanceIssue(t *testing.T) {
+	c, _, clock := newTestClearance(t,
+		WithClearanceDuration(10*time.Minute),
+		WithClearanceCookie(http.Cookie{Name: "clr", Path: "/app", Secure: true, SameSite: http.SameSiteStrictMode}),
+	)
+
+	rec := httptest.NewRecorder()
+	expires := c.Issue(rec, clientRequest(testRemoteAddr, testUserAgent, nil))
+	if want := clock.Now().Add(10 * time.Minute); expires.Sub(want).Abs() >= time.Millisecond {
+		t.Errorf("Issue = %v, want %v", expires, want)
+	}
+
+	cookie := rec.Result().Cookies()[0]
+	if cookie.Name != "clr" || cookie.Path != "/app" || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie attributes = %+v, want those set with WithClearanceCookie", cookie)
+	}
+	if !cookie.HttpOnly || cookie.MaxAge != 600 || !strings.HasPrefix(cookie.Value, "c1.k1.") {
+		t.Errorf("cookie = %+v, want HttpOnly with Max-Age 600 and a c1.k1. value", cookie)
+	}
+}
+
+func TestClearanceVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []func(c *Clearance)
+		// req creates the request to verify from the cookie issued to the test client.
+		req  func(cookie *http.Cookie) *http.Request
+		want bool
+	}{
+		{
+			name: "SameClient",
+			req:  func(cookie *http.Cookie) *http.Request { return clientRequest(testRemoteAddr, testUserAgent, cookie) },
+			want: true,
+		},
+		{
+			name: "SameIPPrefix",
+			req:  func(cookie *http.Cookie) *http.Request { return clientRequest("192.0.2.200:80", testUserAgent, cookie) },
+			want: true,
+		},
+		{
+			name: "MappedIPv4",
+			req: func(cookie *http.Cookie) *http.Request {
+				return clientRequest("[::ffff:192.0.2.10]:80", testUserAgent, cookie)
+			},
+			want: true,
+		},
+		{
+			name: "OtherIPPrefix",
+			req: func(cookie *http.Cookie) *http.Request {
+				return clientRequest("192.0.3.10:1234", testUserAgent, cookie)
+			},
+		},
+		{
+			name: "ExactIP",
+			opts: []func(c *Clearance){WithClearanceIPBits(32, 128)},
+			req: func(cookie *http.Cookie) *http.Request {
+				return clientRequest("192.0.2.11:1234", testUserAgent, cookie)
+			},
+		},
+		{
+			name: "UnboundIP",
+			opts: []func(c *Clearance){WithClearanceIPBits(0, 0)},
+			req: func(cookie *http.Cookie) *http.Request {
+				return clientRequest("198.51.100.1:1234", testUserAgent, cookie)
+			},
+			want: true,
+		},
+		{
+			name: "OtherUserAgent",
+			req:  func(cookie *http.Cookie) *http.Request { return clientRequest(testRemoteAddr, "curl/8.0", cookie) },
+		},
+		{
+			name: "NoCookie",
+			req:  func(cookie *http.Cookie) *http.Request { return clientRequest(testRemoteAddr, testUserAgent, nil) },
+		},
+		{
+			name: "OtherCookieName",
+			req: func(cookie *http.Cookie) *http.Request {
+				return clientRequest(testRemoteAddr, testUserAgent, &http.Cookie{Name: "other", Value: cookie.Value})
+			},
+		},
+		{
+			name: "ExtendedExpiry",
+			req: func(cookie *http.Cookie) *http.Request {
+				parts := strings.Split(cookie.Value, ".")
+				payload := binary.BigEndian.AppendUint64(nil, uint64(time.Now().Add(24*time.Hour).UnixMilli()))
+				parts[2] = base64.RawURLEncoding.EncodeToString(payload)
+				return clientRequest(testRemoteAddr, testUserAgent, withValue(cookie, strings.Join(parts, ".")))
+			},
+		},
+		{
+			name: "TamperedSignature",
+			req: func(cookie *http.Cookie) *http.Request {
+				parts := strings.Split(cookie.Value, ".")
+				sig, _ := base64.RawURLEncoding.DecodeString(parts[3])
+				sig[0] ^= 1
+				parts[3] = base64.RawURLEncoding.EncodeToString(sig)
+				return clientRequest(testRemoteAddr, testUserAgent, withValue(cookie, strings.Join(parts, ".")))
+			},
+		},
+		{
+			name: "UnknownKey",
+			req: func(cookie *http.Cookie) *http.Request {
+				return clientRequest(testRemoteAddr, testUserAgent, withValue(cookie, strings.Replace(cookie.Value, ".k1.", ".k2.", 1)))
+			},
+		},
+		{
+			name: "OtherVersion",
+			req: func(cookie *http.Cookie) *http.Request {
+				return clientRequest(testRemoteAddr, testUserAgent, withValue(cookie, "c2."+strings.TrimPrefix(cookie.Value, "c1.")))
+			},
+		},
+		{
+			name: "ExtraPart",
+			req: func(cookie *http.Cookie) *http.Request {
+				return clientRequest(testRemoteAddr, testUserAgent, withValue(cookie, cookie.Value+".x"))
+			},
+		},
+		{
+			name: "Garbage",
+			req: func(cookie *http.Cookie) *http.Request {
+				return clientRequest(testRemoteAddr, testUserAgent, withValue(cookie, "c1.k1.!!.!!"))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, _ := newTestClearance(t, tt.opts...)
+			cookie := issueCookie(t, c)
+
+			if got := c.Verify(tt.req(cookie)); got != tt.want {
+				t.Errorf("Verify = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// withValue returns a copy of the cookie with the specified value.
+func withValue(cookie *http.Cookie, value string) *http.Cookie {
+	c := *cookie
+	c.Value = value
+	return &c
+}
+
+func TestClearanceExpiry(t *testing.T) {
+	c, _, clock := newTestClearance(t, WithClearanceDuration(time.Minute))
+	cookie := issueCookie(t, c)
+
+	clock.Advance(time.Minute - time.Millisecond)
+	if !c.Verify(clientRequest(testRemoteAddr, testUserAgent, cookie)) {
+		t.Errorf("Verify before expiry = false, want true")
+	}
+
+	clock.Advance(time.Millisecond)
+	if c.Verify(clientRequest(testRemoteAddr, testUserAgent, cookie)) {
+		t.Errorf("Verify at expiry = true, want false")
+	}
+}
+
+func TestClearanceKeyRotation(t *testing.T) {
+	c, keyring, _ := newTestClearance(t)
+	cookie := issueCookie(t, c)
+
+	if err := keyring.Rotate(pkg.NewRandomHMACKey("k2")); err != nil {
+		t.Fatalf("Rotate: unexpected error: %v", err)
+	}
+	if !c.Verify(clientRequest(testRemoteAddr, testUserAgent, cookie)) {
+		t.Errorf("Verify with rotated key = false, want true")
+	}
+	if rotated := issueCookie(t, c); !strings.HasPrefix(rotated.Value, "c1.k2.") {
+		t.Errorf("cookie value %q is not signed with the new primary key", rotated.Value)
+	}
+
+	keyring.Remove("k1")
+	if c.Verify(clientRequest(testRemoteAddr, testUserAgent, cookie)) {
+		t.Errorf("Verify with removed key = true, want false")
+	}
+
+	// A cookie signed by another keyring with the same key ID is rejected.
+	other, _, _ := newTestClearance(t)
+	forged := issueCookie(t, other)
+	if c.Verify(clientRequest(testRemoteAddr, testUserAgent, forged)) {
+		t.Errorf("Verify with cookie from another keyring = true, want false")
+	}
+}
+
+func TestClearanceMiddleware(t *testing.T) {
+	var reason error
+	c, _, _ := newTestClearance(t, WithClearanceRejectionHandler(func(r error, res http.ResponseWriter, req *http.Request) {
+		reason = r
+		res.WriteHeader(403)
+	}))
+	handler := c.Middleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(200)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, clientRequest(testRemoteAddr, testUserAgent, nil))
+	if rec.Code != 403 || !errors.Is(reason, ErrMissingClearance) {
+		t.Errorf("without cookie: got %d and reason %v, want 403 and %v", rec.Code, reason, ErrMissingClearance)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, clientRequest(testRemoteAddr, testUserAgent, issueCookie(t, c)))
+	if rec.Code != 200 {
+		t.Errorf("with cookie: got %d, want 200", rec.Code)
+	}
+}
+
+func TestClearanceExchangeHandler(t *testing.T) {
+	scope := pkg.Scope{SiteKey: "site"}
+
+	tests := []struct {
+		name   string
+		method string
+		// token returns the token to send from a fresh redeem token for scope, and one for another scope.
+		token       func(token string, otherScopeToken string) string
+		reuse       bool
+		wantStatus  int
+		wantSuccess bool
+	}{
+		{"Valid", http.MethodPost, func(token, _ string) string { return token }, false, 200, true},
+		{"MethodNotAllowed", http.MethodGet, func(token, _ string) string { return token }, false, 405, false},
+		{"Missing", http.MethodPost, func(_, _ string) string { return "" }, false, 400, false},
+		{"Unknown", http.MethodPost, func(_, _ string) string { return "unknown" }, false, 403, false},
+		{"Reused", http.MethodPost, func(token, _ string) string { return token }, true, 403, false},
+		{"ScopeMismatch", http.MethodPost, func(_, otherScopeToken string) string { return otherScopeToken }, false, 403, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring, err := pkg.NewHMACKeyring(pkg.NewRandomHMACKey("k1"))
+			if err != nil {
+				t.Fatalf("NewHMACKeyring: unexpected error: %v", err)
+			}
+			capSvc := pkg.NewCap(fake.NewDriver(pkg.SystemClock))
+			c := NewClearance(capSvc, keyring, WithClearanceScope(scope))
+
+			token := newRedeemToken(t, capSvc, scope, nil)
+			otherScopeToken := newRedeemToken(t, capSvc, pkg.Scope{SiteKey: "other"}, nil)
+
+			exchange := func() *httptest.ResponseRecorder {
+				req := formRequest(url.Values{DefaultTokenField: {tt.token(token, otherScopeToken)}})
+				req.Method = tt.method
+				req.RemoteAddr = testRemoteAddr
+				req.Header.Set("User-Agent", testUserAgent)
+
+				rec := httptest.NewRecorder()
+				c.ExchangeHandler(rec, req)
+				return rec
+			}
+			if tt.reuse {
+				exchange()
+			}
+			rec := exchange()
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %q)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			cookies := rec.Result().Cookies()
+			if !tt.wantSuccess {
+				if len(cookies) != 0 {
+					t.Errorf("clearance cookie was set for failed exchange")
+				}
+				return
+			}
+
+			var body struct {
+				Success bool  `json:"success"`
+				Expires int64 `json:"expires"`
+			}
+			if err = json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			// The cookie's Expires attribute has second precision.
+			if !body.Success || len(cookies) != 1 || cookies[0].Expires.Sub(time.UnixMilli(body.Expires)).Abs() >= time.Second {
+				t.Fatalf("response = %+v with cookies %v, want success and a cookie expiring at %d", body, cookies, body.Expires)
+			}
+			if !c.Verify(clientRequest(testRemoteAddr, testUserAgent, cookies[0])) {
+				t.Errorf("Verify with exchanged cookie = false, want true")
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCORSMaxAge is the default duration that browsers may cache the result of CORS preflight requests.
+const DefaultCORSMaxAge = 10 * time.Minute
+
+// CORSPolicy is a policy for cross-origin requests to the Cap endpoints, which allows the widget to be served from a
+// different origin than the API.
+type CORSPolicy struct {
+	anyOrigin        bool
+	origins          []string
+	originPatterns   []*regexp.Regexp
+	allowCredentials bool
+	allowHeaders     []string
+	maxAge           time.Duration
+}
+
+// NewCORSPolicy creates a new CORSPolicy that allows the specified origins.
+//
+// Origins are compared case-insensitively, and have the form "<scheme>://<host>[:<port>]", for example
+// "https://example.com". An origin can contain a single '*' wildcard, which matches one or more subdomain labels, for
+// example "https://*.example.com". The origin "*" allows all origins.
+// For more complex rules, use WithCORSOriginPatterns.
+func NewCORSPolicy(origins []string, opts ...func(p *CORSPolicy)) *CORSPolicy {
+	p := &CORSPolicy{
+		anyOrigin:        false,
+		origins:          nil,
+		originPatterns:   nil,
+		allowCredentials: false,
+		allowHeaders:     []string{"Content-Type"},
+		maxAge:           DefaultCORSMaxAge,
+	}
+
+	for _, origin := range origins {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		if origin == "*" {
+			p.anyOrigin = true
+		} else if origin != "" {
+			p.origins = append(p.origins, origin)
+		}
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
+}
+
+// WithCORSOriginPatterns allows origins that match any of the specified patterns, in addition to the policy's origins.
+// Patterns should be anchored, since they match anywhere in the origin otherwise.
+//
+// Example:
+// WithCORSOriginPatterns(regexp.MustCompile(`^https://[a-z0-9-]+\.preview\.example\.com$`))
+func WithCORSOriginPatterns(patterns ...*regexp.Regexp) func(p *CORSPolicy) {
+	return func(p *CORSPolicy) {
+		p.originPatterns = append(p.originPatterns, patterns...)
+	}
+}
+
+// WithCORSCredentials sets whether cross-origin requests may include credentials such as cookies.
+// When enabled, the request's origin is echoed instead of "*", even if all origins are allowed.
+// When not specified, credentials are not allowed.
+func WithCORSCredentials(allow bool) func(p *CORSPolicy) {
+	return func(p *CORSPolicy) {
+		p.allowCredentials = allow
+	}
+}
+
+// WithCORSAllowedHeaders sets the request headers that cross-origin requests may include, in addition to the
+// CORS-safelisted request headers.
+// When not specified, only Content-Type is allowed.
+func WithCORSAllowedHeaders(headers ...string) func(p *CORSPolicy) {
+	return func(p *CORSPolicy) {
+		p.allowHeaders = headers
+	}
+}
+
+// WithCORSMaxAge sets the duration that browsers may cache the result of preflight requests.
+// When not specified, uses DefaultCORSMaxAge.
+func WithCORSMaxAge(maxAge time.Duration) func(p *CORSPolicy) {
+	return func(p *CORSPolicy) {
+		p.maxAge = maxAge
+	}
+}
+
+// matchWildcardOrigin returns whether the origin matches a pattern with a single '*' wildcard.
+// The wildcard matches one or more subdomain labels, so it cannot match a scheme, port or path separator.
+func matchWildcardOrigin(pattern string, origin string) bool {
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok || len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+
+	middle := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(middle, "/:@*")
+}
+
+// AllowsOrigin returns whether the policy allows requests from the specified origin.
+func (p *CORSPolicy) AllowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if p.anyOrigin {
+		return true
+	}
+
+	lower := strings.ToLower(origin)
+	for _, allowed := range p.origins {
+		if allowed == lower || matchWildcardOrigin(allowed, lower) {
+			return true
+		}
+	}
+
+	for _, pattern := range p.originPatterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handle sets the CORS headers on the response for the request, allowing the specified methods.
+// Returns true if the request was a preflight request, which is fully handled and must not be passed on.
+func (p *CORSPolicy) handle(res http.ResponseWriter, req *http.Request, methods ...string) bool {
+	header := res.Header()
+	header.Add("Vary", "Origin")
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	isPreflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+	if isPreflight {
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+	}
+
+	if !p.AllowsOrigin(origin) {
+		// Responses without CORS headers cannot be read by the origin.
+		if isPreflight {
+			res.WriteHeader(403)
+			_, _ = res.Write([]byte("origin not allowed"))
+		}
+		return isPreflight
+	}
+
+	if p.anyOrigin && !p.allowCredentials {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.allowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if !isPreflight {
+		return false
+	}
+
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(p.allowHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(p.allowHeaders, ", "))
+	}
+	if p.maxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge/time.Second)))
+	}
+	res.WriteHeader(204)
+
+	return true
+}
+
+// Middleware sets the CORS headers for requests to the next handler, and responds to preflight requests for the
+// specified methods without calling it.
+// Server applies its CORS policy itself; use this for other handlers, such as one wrapped with RequireToken.
+func (p *CORSPolicy) Middleware(methods ...string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if p.handle(res, req, methods...) {
+				return
+			}
+
+			next.ServeHTTP(res, req)
+		})
+	}
+}
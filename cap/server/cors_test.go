@@ -0,0 +1,367 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	pkg "github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+func TestMatchWildcardOrigin(t *testing.T) {
+	tests := []struct {
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{"https://*.example.com", "https://a.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com:8443", "https://a.example.com:8443", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://.example.com", false},
+		{"https://*.example.com", "https://evilexample.com", false},
+		{"https://*.example.com", "https://a.example.com.evil.com", false},
+		{"https://*.example.com", "http://a.example.com", false},
+		{"https://*.example.com", "https://a.example.com:8443", false},
+		{"https://*.example.com", "https://evil.com/.example.com", false},
+		{"https://*.example.com", "https://evil.com:1.example.com", false},
+		{"https://*.example.com", "https://user@a.example.com", false},
+		{"https://*.example.com", "https://*.example.com", false},
+		{"https://example.com", "https://example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.origin, func(t *testing.T) {
+			if got := matchWildcardOrigin(tt.pattern, tt.origin); got != tt.want {
+				t.Errorf("matchWildcardOrigin(%q, %q) = %v, want %v", tt.pattern, tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSPolicyAllowsOrigin(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *CORSPolicy
+		origin string
+		want   bool
+	}{
+		{"Exact", NewCORSPolicy([]string{"https://example.com"}), "https://example.com", true},
+		{"CaseInsensitive", NewCORSPolicy([]string{"HTTPS://Example.com"}), "https://EXAMPLE.com", true},
+		{"TrailingSlashInPolicy", NewCORSPolicy([]string{" https://example.com/ "}), "https://example.com", true},
+		{"OtherOrigin", NewCORSPolicy([]string{"https://example.com"}), "https://example.org", false},
+		{"OtherPort", NewCORSPolicy([]string{"https://example.com"}), "https://example.com:8443", false},
+		{"Empty", NewCORSPolicy([]string{"https://example.com"}), "", false},
+		{"NoOrigins", NewCORSPolicy(nil), "https://example.com", false},
+		{"BlankOriginIgnored", NewCORSPolicy([]string{""}), "https://example.com", false},
+		{"Any", NewCORSPolicy([]string{"*"}), "https://example.com", true},
+		{"AnyEmpty", NewCORSPolicy([]string{"*"}), "", false},
+		{"Wildcard", NewCORSPolicy([]string{"https://*.example.com"}), "https://App.Example.com", true},
+		{"WildcardLookAlike", NewCORSPolicy([]string{"https://*.example.com"}), "https://app.example.com.evil.com", false},
+		{
+			name: "Pattern",
+			policy: NewCORSPolicy(nil, WithCORSOriginPatterns(
+				regexp.MustCompile(`^https://[a-z0-9-]+\.preview\.example\.com$`),
+			)),
+			origin: "https://pr-12.preview.example.com",
+			want:   true,
+		},
+		{
+			name: "PatternMismatch",
+			policy: NewCORSPolicy(nil, WithCORSOriginPatterns(
+				regexp.MustCompile(`^https://[a-z0-9-]+\.preview\.example\.com$`),
+			)),
+			origin: "https://a.b.preview.example.com",
+			want:   false,
+		},
+		{
+			name: "OriginsAndPatterns",
+			policy: NewCORSPolicy([]string{"https://example.com"}, WithCORSOriginPatterns(
+				regexp.MustCompile(`^https://[a-z0-9-]+\.preview\.example\.com$`),
+			)),
+			origin: "https://example.com",
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.AllowsOrigin(tt.origin); got != tt.want {
+				t.Errorf("AllowsOrigin(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSPolicyMiddleware(t *testing.T) {
+	const origin = "https://app.example.com"
+
+	tests := []struct {
+		name   string
+		policy *CORSPolicy
+		method string
+		origin string
+		// preflight sets Access-Control-Request-Method on the request.
+		preflight bool
+
+		wantNext        bool
+		wantStatus      int
+		wantAllowOrigin string
+		wantCredentials string
+		wantMethods     string
+		wantHeaders     string
+		wantMaxAge      string
+		wantVary        []string
+	}{
+		{
+			name:            "Simple",
+			policy:          NewCORSPolicy([]string{"https://*.example.com"}),
+			method:          http.MethodPost,
+			origin:          origin,
+			wantNext:        true,
+			wantStatus:      200,
+			wantAllowOrigin: origin,
+			wantVary:        []string{"Origin"},
+		},
+		{
+			name:       "SimpleDisallowed",
+			policy:     NewCORSPolicy([]string{"https://*.example.com"}),
+			method:     http.MethodPost,
+			origin:     "https://example.org",
+			wantNext:   true,
+			wantStatus: 200,
+			wantVary:   []string{"Origin"},
+		},
+		{
+			name:       "NoOrigin",
+			policy:     NewCORSPolicy([]string{"*"}),
+			method:     http.MethodPost,
+			wantNext:   true,
+			wantStatus: 200,
+			wantVary:   []string{"Origin"},
+		},
+		{
+			name:            "Preflight",
+			policy:          NewCORSPolicy([]string{"https://*.example.com"}),
+			method:          http.MethodOptions,
+			origin:          origin,
+			preflight:       true,
+			wantStatus:      204,
+			wantAllowOrigin: origin,
+			wantMethods:     "POST",
+			wantHeaders:     "Content-Type",
+			wantMaxAge:      "600",
+			wantVary:        []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+		},
+		{
+			name:       "PreflightDisallowed",
+			policy:     NewCORSPolicy([]string{"https://*.example.com"}),
+			method:     http.MethodOptions,
+			origin:     "https://example.org",
+			preflight:  true,
+			wantStatus: 403,
+			wantVary:   []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+		},
+		{
+			name:            "OptionsWithoutRequestMethod",
+			policy:          NewCORSPolicy([]string{"https://*.example.com"}),
+			method:          http.MethodOptions,
+			origin:          origin,
+			wantNext:        true,
+			wantStatus:      200,
+			wantAllowOrigin: origin,
+			wantVary:        []string{"Origin"},
+		},
+		{
+			name: "PreflightOptions",
+			policy: NewCORSPolicy([]string{origin},
+				WithCORSAllowedHeaders("Content-Type", "X-Cap-Token"),
+				WithCORSMaxAge(time.Hour),
+			),
+			method:          http.MethodOptions,
+			origin:          origin,
+			preflight:       true,
+			wantStatus:      204,
+			wantAllowOrigin: origin,
+			wantMethods:     "POST",
+			wantHeaders:     "Content-Type, X-Cap-Token",
+			wantMaxAge:      "3600",
+			wantVary:        []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+		},
+		{
+			name:            "PreflightWithoutHeadersOrMaxAge",
+			policy:          NewCORSPolicy([]string{origin}, WithCORSAllowedHeaders(), WithCORSMaxAge(0)),
+			method:          http.MethodOptions,
+			origin:          origin,
+			preflight:       true,
+			wantStatus:      204,
+			wantAllowOrigin: origin,
+			wantMethods:     "POST",
+			wantVary:        []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+		},
+		{
+			name:            "AnyOrigin",
+			policy:          NewCORSPolicy([]string{"*"}),
+			method:          http.MethodPost,
+			origin:          origin,
+			wantNext:        true,
+			wantStatus:      200,
+			wantAllowOrigin: "*",
+			wantVary:        []string{"Origin"},
+		},
+		{
+			name:            "AnyOriginWithCredentials",
+			policy:          NewCORSPolicy([]string{"*"}, WithCORSCredentials(true)),
+			method:          http.MethodPost,
+			origin:          origin,
+			wantNext:        true,
+			wantStatus:      200,
+			wantAllowOrigin: origin,
+			wantCredentials: "true",
+			wantVary:        []string{"Origin"},
+		},
+		{
+			name:            "PreflightWithCredentials",
+			policy:          NewCORSPolicy([]string{"https://*.example.com"}, WithCORSCredentials(true)),
+			method:          http.MethodOptions,
+			origin:          origin,
+			preflight:       true,
+			wantStatus:      204,
+			wantAllowOrigin: origin,
+			wantCredentials: "true",
+			wantMethods:     "POST",
+			wantHeaders:     "Content-Type",
+			wantMaxAge:      "600",
+			wantVary:        []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+		},
+		{
+			name:       "DisallowedWithCredentials",
+			policy:     NewCORSPolicy([]string{"https://*.example.com"}, WithCORSCredentials(true)),
+			method:     http.MethodPost,
+			origin:     "https://example.org",
+			wantNext:   true,
+			wantStatus: 200,
+			wantVary:   []string{"Origin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := tt.policy.Middleware(http.MethodPost)(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				called = true
+				res.WriteHeader(200)
+			}))
+
+			req := httptest.NewRequest(tt.method, "/challenge", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if called != tt.wantNext {
+				t.Errorf("next handler called = %v, want %v", called, tt.wantNext)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			header := rec.Header()
+			for _, h := range []struct{ name, want string }{
+				{"Access-Control-Allow-Origin", tt.wantAllowOrigin},
+				{"Access-Control-Allow-Credentials", tt.wantCredentials},
+				{"Access-Control-Allow-Methods", tt.wantMethods},
+				{"Access-Control-Allow-Headers", tt.wantHeaders},
+				{"Access-Control-Max-Age", tt.wantMaxAge},
+			} {
+				if got := header.Get(h.name); got != h.want {
+					t.Errorf("%s = %q, want %q", h.name, got, h.want)
+				}
+			}
+			if got := header.Values("Vary"); !slices.Equal(got, tt.wantVary) {
+				t.Errorf("Vary = %q, want %q", got, tt.wantVary)
+			}
+		})
+	}
+}
+
+func TestServerCORS(t *testing.T) {
+	const origin = "https://app.example.com"
+
+	tests := []struct {
+		name    string
+		cors    *CORSPolicy
+		handler func(s *Server) http.HandlerFunc
+		// wantStatus is the expected status of a preflight request.
+		wantStatus int
+		// wantCORS is whether responses to the handler carry CORS headers.
+		wantCORS bool
+	}{
+		{
+			name:       "Challenge",
+			cors:       NewCORSPolicy([]string{"https://*.example.com"}),
+			handler:    func(s *Server) http.HandlerFunc { return s.ChallengeHandler },
+			wantStatus: 204,
+			wantCORS:   true,
+		},
+		{
+			name:       "Redeem",
+			cors:       NewCORSPolicy([]string{"https://*.example.com"}),
+			handler:    func(s *Server) http.HandlerFunc { return s.RedeemHandler },
+			wantStatus: 204,
+			wantCORS:   true,
+		},
+		{
+			name:       "Siteverify",
+			cors:       NewCORSPolicy([]string{"https://*.example.com"}),
+			handler:    func(s *Server) http.HandlerFunc { return s.SiteverifyHandler },
+			wantStatus: 405,
+		},
+		{
+			name:       "ChallengeWithoutPolicy",
+			handler:    func(s *Server) http.HandlerFunc { return s.ChallengeHandler },
+			wantStatus: 405,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []func(h *Server){WithChallengeParams(testParams)}
+			if tt.cors != nil {
+				opts = append(opts, WithCORS(tt.cors))
+			}
+			handler := tt.handler(NewServer(pkg.NewCap(fake.NewDriver(pkg.SystemClock)), opts...))
+
+			req := httptest.NewRequest(http.MethodOptions, "/", nil)
+			req.Header.Set("Origin", origin)
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("preflight status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); (got == origin) != tt.wantCORS {
+				t.Errorf("preflight Access-Control-Allow-Origin = %q, want CORS headers %v", got, tt.wantCORS)
+			}
+
+			req = httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Header.Set("Origin", origin)
+			rec = httptest.NewRecorder()
+			handler(rec, req)
+
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); (got == origin) != tt.wantCORS {
+				t.Errorf("Access-Control-Allow-Origin = %q, want CORS headers %v", got, tt.wantCORS)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultGateAPIEndpoint is the default path that the Cap challenge and redeem endpoints are mounted under.
+const DefaultGateAPIEndpoint = "/cap/"
+
+// DefaultWidgetScriptURL is the default URL of the Cap.js widget script included in the interstitial page.
+const DefaultWidgetScriptURL = "https://cdn.jsdelivr.net/npm/@cap.js/widget"
+
+// GateTemplateData is the data that the interstitial page template is executed with.
+type GateTemplateData struct {
+	// The path that the Cap challenge and redeem endpoints are mounted under, with a trailing slash.
+	// Pass it to the widget's data-cap-api-endpoint attribute.
+	APIEndpoint string
+
+	// The path that redeem tokens are exchanged for clearance at.
+	// POST the widget's token to it as the DefaultTokenField form field.
+	ClearanceEndpoint string
+
+	// The URL to redirect to once clearance was received.
+	// It is the path and query of the original request, so it is always on the same site.
+	RedirectURL string
+
+	// The URL of the Cap.js widget script.
+	WidgetScriptURL string
+}
+
+// DefaultGateTemplate is the default interstitial page template.
+// It solves a challenge with the Cap.js widget, exchanges the redeem token for clearance, and redirects back to the
+// original URL.
+var DefaultGateTemplate = template.Must(template.New("gate").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<meta name="robots" content="noindex">
+	<title>Checking your browser</title>
+	<style>
+		body { font-family: sans-serif; display: flex; flex-direction: column; align-items: center; margin-top: 15vh; }
+	</style>
+</head>
+<body>
+	<h1>Checking your browser</h1>
+	<p>This will only take a moment.</p>
+
+	<cap-widget id="cap" data-cap-api-endpoint="{{.APIEndpoint}}"></cap-widget>
+	<p id="error" hidden>Verification failed. Please reload the page to try again.</p>
+
+	<noscript><p>JavaScript is required to continue.</p></noscript>
+
+	<script src="{{.WidgetScriptURL}}"></script>
+	<script>
+		(function () {
+			var widget = document.getElementById("cap");
+			var redirectURL = {{.RedirectURL}};
+
+			widget.addEventListener("solve", function (e) {
+				var body = new URLSearchParams();
+				body.set("cap-token", e.detail.token);
+
+				fetch({{.ClearanceEndpoint}}, { method: "POST", body: body, credentials: "same-origin" })
+					.then(function (res) {
+						if (!res.ok) {
+							throw new Error("clearance failed with status " + res.status);
+						}
+						location.replace(redirectURL);
+					})
+					.catch(function () {
+						document.getElementById("error").hidden = false;
+					});
+			});
+
+			customElements.whenDefined("cap-widget").then(function () {
+				if (typeof widget.solve === "function") {
+					widget.solve();
+				}
+			});
+		})();
+	</script>
+</body>
+</html>
+`))
+
+// Gate puts a proof-of-work interstitial in front of a handler, similar to Anubis or the "under attack" modes of CDNs.
+//
+// Requests with a valid clearance cookie (see Clearance) are passed to the handler. Browser navigations without one
+// receive an interstitial page that solves a challenge using the Cap challenge and redeem endpoints, exchanges the redeem
+// token for clearance, and redirects back to the original URL. Other requests, such as API calls, receive
+// 401 Unauthorized with a JSON body instead.
+//
+// The Cap endpoints under the API endpoint path are always passed to the handler, so they must be mounted on it, and the
+// gate serves the clearance exchange endpoint itself.
+type Gate struct {
+	clearance *Clearance
+
+	apiEndpoint       string
+	clearanceEndpoint string
+	widgetScriptURL   string
+	allowedPaths      []string
+	allowedUserAgents []*regexp.Regexp
+	tmpl              *template.Template
+}
+
+// NewGate creates a new Gate that requires clearance issued by clearance.
+func NewGate(clearance *Clearance, opts ...func(g *Gate)) *Gate {
+	g := &Gate{
+		clearance: clearance,
+
+		apiEndpoint:       DefaultGateAPIEndpoint,
+		clearanceEndpoint: "",
+		widgetScriptURL:   DefaultWidgetScriptURL,
+		allowedPaths:      nil,
+		allowedUserAgents: nil,
+		tmpl:              DefaultGateTemplate,
+	}
+
+	for _, opt := range opts {
+		opt(g)
+	}
+
+	if !strings.HasSuffix(g.apiEndpoint, "/") {
+		g.apiEndpoint += "/"
+	}
+	if g.clearanceEndpoint == "" {
+		g.clearanceEndpoint = g.apiEndpoint + "clearance"
+	}
+
+	return g
+}
+
+// WithGateAPIEndpoint sets the path that the Cap challenge and redeem endpoints are mounted under.
+// Requests under the path are always passed to the handler.
+// When not specified, uses DefaultGateAPIEndpoint.
+func WithGateAPIEndpoint(path string) func(g *Gate) {
+	return func(g *Gate) {
+		g.apiEndpoint = path
+	}
+}
+
+// WithGateClearanceEndpoint sets the path that the gate serves the clearance exchange endpoint on.
+// When not specified, uses "clearance" under the API endpoint path.
+func WithGateClearanceEndpoint(path string) func(g *Gate) {
+	return func(g *Gate) {
+		g.clearanceEndpoint = path
+	}
+}
+
+// WithGateWidgetScript sets the URL of the Cap.js widget script included in the interstitial page, for example to
+// serve it from the application instead of a CDN.
+// When not specified, uses DefaultWidgetScriptURL.
+func WithGateWidgetScript(url string) func(g *Gate) {
+	return func(g *Gate) {
+		g.widgetScriptURL = url
+	}
+}
+
+// WithGateAllowedPaths sets path prefixes that do not require clearance, such as "/robots.txt" or "/.well-known/".
+// A prefix ending in '/' matches all paths under it; other prefixes only match the exact path.
+// Request paths are matched after resolving "." and ".." elements, so "/.well-known/../admin" matches "/admin".
+func WithGateAllowedPaths(paths ...string) func(g *Gate) {
+	return func(g *Gate) {
+		g.allowedPaths = append(g.allowedPaths, paths...)
+	}
+}
+
+// WithGateAllowedUserAgents sets patterns of user agents that do not require clearance, such as search engine crawlers.
+// User agents are trivially spoofed, so only allow-list user agents that are also verified by other means, or that
+// are acceptable to let through unchallenged.
+//
+// Example:
+// WithGateAllowedUserAgents(regexp.MustCompile(`(?i)\bGooglebot\b`))
+func WithGateAllowedUserAgents(patterns ...*regexp.Regexp) func(g *Gate) {
+	return func(g *Gate) {
+		g.allowedUserAgents = append(g.allowedUserAgents, patterns...)
+	}
+}
+
+// WithGateTemplate sets the template of the interstitial page.
+// It is executed with GateTemplateData; see DefaultGateTemplate for an example.
+// When not specified, uses DefaultGateTemplate.
+func WithGateTemplate(tmpl *template.Template) func(g *Gate) {
+	return func(g *Gate) {
+		g.tmpl = tmpl
+	}
+}
+
+// cleanPath returns the path with repeated slashes and "." and ".." elements resolved, keeping a trailing slash.
+// Allowed paths are matched against the cleaned path, so that paths such as "/cap/../admin" do not match the prefix
+// of an allowed path but are routed to a path that is not allowed.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+// isAllowed returns whether the request can be passed to the handler without clearance.
+func (g *Gate) isAllowed(req *http.Request) bool {
+	path := cleanPath(req.URL.Path)
+	if strings.HasPrefix(path, g.apiEndpoint) {
+		return true
+	}
+
+	for _, allowed := range g.allowedPaths {
+		if path == allowed || (strings.HasSuffix(allowed, "/") && strings.HasPrefix(path, allowed)) {
+			return true
+		}
+	}
+
+	if ua := req.UserAgent(); ua != "" {
+		for _, pattern := range g.allowedUserAgents {
+			if pattern.MatchString(ua) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// acceptsHTML returns whether the request is a page load that can show the interstitial page.
+// Requests that cannot be replayed by a redirect, or that do not explicitly accept HTML (such as fetch calls, which
+// accept "*/*" by default), are not. HTML with a quality value of 0 (such as "q=0.0") or an invalid one is not
+// accepted.
+func acceptsHTML(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	for _, val := range req.Header.Values("Accept") {
+		for _, part := range strings.Split(val, ",") {
+			mediaType, params, err := mime.ParseMediaType(part)
+			if err != nil || mediaType != "text/html" {
+				continue
+			}
+
+			if q, has := params["q"]; has {
+				// Also rejects NaN.
+				if weight, err := strconv.ParseFloat(q, 64); err != nil || !(weight > 0) {
+					continue
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+// redirectURL returns the path and query of the request, to redirect back to after clearance was received.
+// Leading slashes and backslashes are collapsed, so that paths such as "//example.com" cannot redirect to other sites.
+func redirectURL(req *http.Request) string {
+	return "/" + strings.TrimLeft(req.URL.RequestURI(), `/\`)
+}
+
+// Middleware only passes requests with clearance, or that are allow-listed, to the next handler.
+// Other requests receive the interstitial page or 401 Unauthorized; see Gate.
+//
+// Example:
+//
+//	mux.HandleFunc("/cap/challenge", capServer.ChallengeHandler)
+//	mux.HandleFunc("/cap/redeem", capServer.RedeemHandler)
+//	mux.Handle("/", siteHandler)
+//	http.ListenAndServe(addr, gate.Middleware(mux))
+func (g *Gate) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == g.clearanceEndpoint {
+			g.clearance.ExchangeHandler(res, req)
+			return
+		}
+
+		if g.isAllowed(req) || g.clearance.Verify(req) {
+			next.ServeHTTP(res, req)
+			return
+		}
+
+		res.Header().Set("Cache-Control", "no-store")
+		res.Header().Add("Vary", "Accept")
+
+		if !acceptsHTML(req) {
+			res.Header().Set("Content-Type", "application/json")
+			res.WriteHeader(401)
+			enc := json.NewEncoder(res)
+			_ = enc.Encode(struct {
+				Success bool   `json:"success"`
+				Message string `json:"message"`
+			}{
+				Success: false,
+				Message: "clearance required",
+			})
+			return
+		}
+
+		res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		res.WriteHeader(200)
+		err := g.tmpl.Execute(res, GateTemplateData{
+			APIEndpoint:       g.apiEndpoint,
+			ClearanceEndpoint: g.clearanceEndpoint,
+			RedirectURL:       redirectURL(req),
+			WidgetScriptURL:   g.widgetScriptURL,
+		})
+		if err != nil {
+			slog.Default().Error("Failed to execute gate template",
+				"service", "cap.Gate",
+				"error", err,
+			)
+		}
+	})
+}
@@ -0,0 +1,311 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	pkg "github.com/termermc/go-capjs/cap"
+)
+
+func TestAcceptsHTML(t *testing.T) {
+	tests := []struct {
+		method string
+		accept []string
+		want   bool
+	}{
+		{http.MethodGet, []string{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"}, true},
+		{http.MethodHead, []string{"text/html"}, true},
+		{http.MethodGet, []string{"TEXT/HTML"}, true},
+		{http.MethodGet, []string{"application/json", "text/html"}, true},
+		{http.MethodGet, []string{"text/html;q=1"}, true},
+		{http.MethodGet, []string{"text/html; q=0.001"}, true},
+		{http.MethodGet, []string{"text/html;level=1"}, true},
+		{http.MethodGet, []string{"text/html;q=0, text/html;q=0.5"}, true},
+		{http.MethodGet, []string{"text/html;q=0"}, false},
+		{http.MethodGet, []string{"text/html;q=0.0"}, false},
+		{http.MethodGet, []string{"text/html;q=0.00"}, false},
+		{http.MethodGet, []string{"text/html;q=0.000, application/json"}, false},
+		{http.MethodGet, []string{"text/html;Q=0.0"}, false},
+		{http.MethodGet, []string{"text/html;q=-1"}, false},
+		{http.MethodGet, []string{"text/html;q=NaN"}, false},
+		{http.MethodGet, []string{"text/html;q=high"}, false},
+		{http.MethodGet, []string{"*/*"}, false},
+		{http.MethodGet, []string{"text/*"}, false},
+		{http.MethodGet, []string{"application/json"}, false},
+		{http.MethodGet, nil, false},
+		{http.MethodPost, []string{"text/html"}, false},
+		{http.MethodDelete, []string{"text/html"}, false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		for _, accept := range tt.accept {
+			req.Header.Add("Accept", accept)
+		}
+
+		if got := acceptsHTML(req); got != tt.want {
+			t.Errorf("acceptsHTML(%s, %q) = %t, want %t", tt.method, tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestRedirectURL(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/", "/"},
+		{"/page?a=b&c=d", "/page?a=b&c=d"},
+		{"//example.com/page", "/example.com/page"},
+		{"///example.com", "/example.com"},
+		// Backslashes in the path are escaped, so browsers do not treat them as slashes.
+		{`/\example.com`, "/%5Cexample.com"},
+		{`/\/\example.com?x=1`, "/%5C/%5Cexample.com?x=1"},
+		{"/%2F%2Fexample.com", "/%2F%2Fexample.com"},
+		{"http://example.com/page?a=b", "/page?a=b"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		if got := redirectURL(req); got != tt.want {
+			t.Errorf("redirectURL(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/cap/", "/cap/"},
+		{"/cap/challenge", "/cap/challenge"},
+		{"/cap/../admin", "/admin"},
+		{"/cap/./../admin/", "/admin/"},
+		{"/cap/..", "/"},
+		{"//cap//challenge", "/cap/challenge"},
+		{"cap/challenge", "/cap/challenge"},
+		{"/../../etc/passwd", "/etc/passwd"},
+	}
+
+	for _, tt := range tests {
+		if got := cleanPath(tt.path); got != tt.want {
+			t.Errorf("cleanPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGateMiddleware(t *testing.T) {
+	const acceptHTML = "text/html"
+	const acceptJSON = "application/json"
+
+	tests := []struct {
+		name      string
+		method    string
+		target    string
+		accept    string
+		userAgent string
+		clearance bool
+		// want is "next" if the request is passed to the next handler, "page" for the interstitial page, or
+		// "unauthorized" for the 401 response.
+		want string
+	}{
+		{name: "WithClearance", target: "/admin", accept: acceptHTML, clearance: true, want: "next"},
+		{name: "PageLoad", target: "/admin?tab=users", accept: acceptHTML, want: "page"},
+		{name: "APICall", target: "/api/items", accept: acceptJSON, want: "unauthorized"},
+		{name: "FetchDefaultAccept", target: "/api/items", accept: "*/*", want: "unauthorized"},
+		{name: "HTMLWithZeroQuality", target: "/admin", accept: "text/html;q=0.0, */*", want: "unauthorized"},
+		{name: "FormPost", method: http.MethodPost, target: "/login", accept: acceptHTML, want: "unauthorized"},
+		{name: "APIEndpoint", method: http.MethodPost, target: "/cap/challenge", accept: acceptJSON, want: "next"},
+		{name: "APIEndpointNotCleaned", method: http.MethodPost, target: "//cap//redeem", accept: acceptJSON, want: "next"},
+		{name: "APIEndpointDotDot", target: "/cap/../admin", accept: acceptHTML, want: "page"},
+		{name: "APIEndpointEncodedDotDot", target: "/cap/%2E%2E/admin", accept: acceptHTML, want: "page"},
+		{name: "APIEndpointDotDotAPI", target: "/cap/../api/items", accept: acceptJSON, want: "unauthorized"},
+		{name: "APIEndpointWithoutSlash", target: "/cap", accept: acceptHTML, want: "page"},
+		{name: "AllowedExactPath", target: "/robots.txt", want: "next"},
+		{name: "AllowedExactPathIsNotPrefix", target: "/robots.txt/admin", accept: acceptHTML, want: "page"},
+		{name: "AllowedPrefix", target: "/.well-known/security.txt", want: "next"},
+		{name: "AllowedPrefixDotDot", target: "/.well-known/../admin", accept: acceptHTML, want: "page"},
+		{name: "AllowedExactPathDotDot", target: "/robots.txt/../robots.txt", want: "next"},
+		{name: "AllowedUserAgent", target: "/admin", userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)", want: "next"},
+		{name: "OtherUserAgent", target: "/admin", accept: acceptHTML, userAgent: "Mozilla/5.0 Firefox/130.0", want: "page"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _, _ := newTestClearance(t)
+			gate := NewGate(c,
+				WithGateAllowedPaths("/robots.txt", "/.well-known/"),
+				WithGateAllowedUserAgents(regexp.MustCompile(`(?i)\bGooglebot\b`)),
+			)
+
+			nextCalled := false
+			handler := gate.Middleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				nextCalled = true
+				res.WriteHeader(200)
+			}))
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.target, nil)
+			req.RemoteAddr = testRemoteAddr
+			req.Header.Set("User-Agent", testUserAgent)
+			if tt.userAgent != "" {
+				req.Header.Set("User-Agent", tt.userAgent)
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			if tt.clearance {
+				req.AddCookie(issueCookie(t, c))
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			switch tt.want {
+			case "next":
+				if !nextCalled {
+					t.Errorf("next handler was not called, got %d %q", rec.Code, rec.Body.String())
+				}
+				return
+			case "page":
+				if rec.Code != 200 || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") {
+					t.Errorf("got %d %q, want the interstitial page", rec.Code, rec.Header().Get("Content-Type"))
+				}
+			case "unauthorized":
+				if rec.Code != 401 || rec.Header().Get("Content-Type") != "application/json" {
+					t.Errorf("got %d %q, want 401 JSON", rec.Code, rec.Header().Get("Content-Type"))
+				}
+			}
+
+			if nextCalled {
+				t.Errorf("next handler was called for request without clearance")
+			}
+			if rec.Header().Get("Cache-Control") != "no-store" || rec.Header().Get("Vary") != "Accept" {
+				t.Errorf("headers = %v, want Cache-Control: no-store and Vary: Accept", rec.Header())
+			}
+		})
+	}
+}
+
+func TestGateUnauthorizedBody(t *testing.T) {
+	c, _, _ := newTestClearance(t)
+	handler := NewGate(c).Middleware(http.NotFoundHandler())
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api", nil))
+
+	var body struct {
+		Success bool   `json:"success"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	if body.Success || body.Message != "clearance required" {
+		t.Errorf("body = %+v, want clearance required", body)
+	}
+}
+
+func TestGateTemplate(t *testing.T) {
+	var data GateTemplateData
+	tmpl := template.Must(template.New("test").Funcs(template.FuncMap{
+		"capture": func(d GateTemplateData) string {
+			data = d
+			return ""
+		},
+	}).Parse(`{{capture .}}<a href="{{.RedirectURL}}">continue</a>`))
+
+	c, _, _ := newTestClearance(t)
+	handler := NewGate(c,
+		WithGateAPIEndpoint("/api/cap"),
+		WithGateWidgetScript("/static/widget.js"),
+		WithGateTemplate(tmpl),
+	).Middleware(http.NotFoundHandler())
+
+	req := httptest.NewRequest(http.MethodGet, `//evil.example/page?q="><script>`, nil)
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	want := GateTemplateData{
+		APIEndpoint:       "/api/cap/",
+		ClearanceEndpoint: "/api/cap/clearance",
+		RedirectURL:       `/evil.example/page?q="><script>`,
+		WidgetScriptURL:   "/static/widget.js",
+	}
+	if data != want {
+		t.Errorf("template data = %+v, want %+v", data, want)
+	}
+	if strings.Contains(rec.Body.String(), "<script>") {
+		t.Errorf("body %q contains the unescaped redirect URL", rec.Body.String())
+	}
+}
+
+func TestGateDefaultTemplate(t *testing.T) {
+	c, _, _ := newTestClearance(t)
+	handler := NewGate(c).Middleware(http.NotFoundHandler())
+
+	req := httptest.NewRequest(http.MethodGet, `/page?next=</script><script>alert(1)</script>`, nil)
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`data-cap-api-endpoint="/cap/"`,
+		`fetch("/cap/clearance"`,
+		`<script src="` + DefaultWidgetScriptURL + `">`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %q", want)
+		}
+	}
+	if strings.Contains(body, "alert(1)</script>") {
+		t.Errorf("body contains the unescaped redirect URL")
+	}
+}
+
+func TestGateClearanceEndpoint(t *testing.T) {
+	c, _, _ := newTestClearance(t)
+	handler := NewGate(c).Middleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		t.Errorf("next handler was called for clearance endpoint")
+	}))
+
+	token := newRedeemToken(t, c.cap, pkg.Scope{}, nil)
+	req := formRequest(url.Values{DefaultTokenField: {token}})
+	req.URL.Path = "/cap/clearance"
+	req.RemoteAddr = testRemoteAddr
+	req.Header.Set("User-Agent", testUserAgent)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	cookies := rec.Result().Cookies()
+	if rec.Code != 200 || len(cookies) != 1 {
+		t.Fatalf("got %d with %d cookies, want 200 with a clearance cookie", rec.Code, len(cookies))
+	}
+
+	// The cookie gives clearance for the rest of the site.
+	called := false
+	handler = NewGate(c).Middleware(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+	page := clientRequest(testRemoteAddr, testUserAgent, cookies[0])
+	page.Header.Set("Accept", "text/html")
+	handler.ServeHTTP(httptest.NewRecorder(), page)
+	if !called {
+		t.Errorf("next handler was not called with clearance cookie")
+	}
+}
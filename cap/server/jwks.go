@@ -0,0 +1,38 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	pkg "github.com/termermc/go-capjs/cap"
+)
+
+// NewJWKSHandler creates an HTTP handler that publishes the public keys of a redeem token keyring as a JWK set,
+// so that other services can verify signed redeem tokens offline.
+// Symmetric keys, such as HMAC keys, are never published.
+// Keys added to or removed from the keyring are reflected immediately.
+// Should be mounted on `/.well-known/jwks.json`.
+func NewJWKSHandler(keyring *pkg.TokenKeyring) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			res.WriteHeader(405)
+			_, _ = res.Write([]byte("method not allowed"))
+			return
+		}
+
+		set := pkg.JWKSet{
+			Keys: make([]pkg.JWK, 0),
+		}
+		for _, key := range keyring.Keys() {
+			if jwk, ok := key.PublicJWK(); ok {
+				set.Keys = append(set.Keys, jwk)
+			}
+		}
+
+		res.Header().Set("Content-Type", "application/jwk-set+json")
+		res.Header().Set("Cache-Control", "public, max-age=300")
+		res.WriteHeader(200)
+		enc := json.NewEncoder(res)
+		_ = enc.Encode(set)
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	pkg "github.com/termermc/go-capjs/cap"
+)
+
+// DefaultTokenField is the name of the form field that the Cap.js widget puts the redeem token in.
+const DefaultTokenField = "cap-token"
+
+// ErrMissingRedeemToken is passed to the rejection handler of RequireToken when a request does not contain a
+// redeem token.
+var ErrMissingRedeemToken = errors.New("request does not contain a redeem token")
+
+// TokenExtractorFunc is a function that extracts a redeem token from a request.
+// If the function returns an empty string, the request does not contain a token.
+type TokenExtractorFunc func(req *http.Request) string
+
+// NewFormTokenExtractor creates a new TokenExtractorFunc that gets the redeem token from a form field, in either the
+// URL query or the request body.
+//
+// Example:
+// NewFormTokenExtractor(DefaultTokenField)
+func NewFormTokenExtractor(field string) TokenExtractorFunc {
+	return func(req *http.Request) string {
+		return req.FormValue(field)
+	}
+}
+
+// NewHeaderTokenExtractor creates a new TokenExtractorFunc that gets the redeem token from a header.
+// A "Bearer " prefix is removed, so the token can be sent in the Authorization header.
+//
+// Example:
+// NewHeaderTokenExtractor("X-Cap-Token")
+func NewHeaderTokenExtractor(header string) TokenExtractorFunc {
+	return func(req *http.Request) string {
+		val := strings.TrimSpace(req.Header.Get(header))
+		if len(val) > 7 && strings.EqualFold(val[:7], "Bearer ") {
+			val = strings.TrimSpace(val[7:])
+		}
+
+		return val
+	}
+}
+
+// NewCookieTokenExtractor creates a new TokenExtractorFunc that gets the redeem token from a cookie.
+func NewCookieTokenExtractor(cookie string) TokenExtractorFunc {
+	return func(req *http.Request) string {
+		c, err := req.Cookie(cookie)
+		if err != nil {
+			return ""
+		}
+
+		return c.Value
+	}
+}
+
+// RejectionHandlerFunc is a function that handles a request rejected by RequireToken, and writes an HTTP response.
+// The reason is ErrMissingRedeemToken, cap.ErrInvalidRedeemToken or cap.ErrScopeMismatch.
+type RejectionHandlerFunc func(reason error, res http.ResponseWriter, req *http.Request)
+
+var defaultRejectFunc RejectionHandlerFunc = func(reason error, res http.ResponseWriter, req *http.Request) {
+	res.WriteHeader(403)
+	if errors.Is(reason, ErrMissingRedeemToken) {
+		_, _ = res.Write([]byte("missing cap token"))
+	} else {
+		_, _ = res.Write([]byte("invalid cap token"))
+	}
+}
+
+// TokenMiddleware is the configuration of the middleware returned by RequireToken.
+type TokenMiddleware struct {
+	cap *pkg.Cap
+
+	extractors []TokenExtractorFunc
+	scopeFunc  ScopeChooserFunc
+	ipFunc     IPExtractorFunc
+	rejectFunc RejectionHandlerFunc
+	errFunc    ErrorHandlerFunc
+}
+
+// WithTokenExtractors sets the functions used to extract the redeem token from requests.
+// The token from the first extractor that returns one is used.
+// When not specified, uses NewFormTokenExtractor(DefaultTokenField).
+func WithTokenExtractors(extractors ...TokenExtractorFunc) func(m *TokenMiddleware) {
+	return func(m *TokenMiddleware) {
+		m.extractors = extractors
+	}
+}
+
+// WithRequiredScope sets the scope that redeem tokens must have been issued for.
+// When not specified, only unscoped redeem tokens are accepted.
+// To specify a dynamic scope chooser, use WithRequiredScopeChooser.
+func WithRequiredScope(scope pkg.Scope) func(m *TokenMiddleware) {
+	return func(m *TokenMiddleware) {
+		m.scopeFunc = NewStaticScopeChooser(scope)
+	}
+}
+
+// WithRequiredScopeChooser sets the scope chooser used to choose the scope that redeem tokens must have been issued
+// for, for example based on the request path.
+// When not specified, see comment on WithRequiredScope.
+func WithRequiredScopeChooser(chooser ScopeChooserFunc) func(m *TokenMiddleware) {
+	return func(m *TokenMiddleware) {
+		m.scopeFunc = chooser
+	}
+}
+
+// WithTokenClientIP uses the specified IP extractor function to report client IPs to the Cap instance's observers.
+func WithTokenClientIP(ipFunc IPExtractorFunc) func(m *TokenMiddleware) {
+	return func(m *TokenMiddleware) {
+		m.ipFunc = ipFunc
+	}
+}
+
+// WithRejectionHandler sets the function that handles requests without a valid redeem token.
+// When not specified, responds with 403 Forbidden.
+func WithRejectionHandler(rejectFunc RejectionHandlerFunc) func(m *TokenMiddleware) {
+	return func(m *TokenMiddleware) {
+		m.rejectFunc = rejectFunc
+	}
+}
+
+// WithTokenErrorHandler sets the function that handles errors while checking redeem tokens, such as when the Cap
+// driver returns an error, or the scope chooser fails.
+// When not specified, logs the error and responds with 500 Internal Server Error.
+func WithTokenErrorHandler(errFunc ErrorHandlerFunc) func(m *TokenMiddleware) {
+	return func(m *TokenMiddleware) {
+		m.errFunc = errFunc
+	}
+}
+
+type redemptionCtxKey struct{}
+
+// RedemptionFromContext returns the redemption of the redeem token that was used by RequireToken for the request,
+// or nil if there is none.
+func RedemptionFromContext(ctx context.Context) *pkg.Redemption {
+	redemption, _ := ctx.Value(redemptionCtxKey{}).(*pkg.Redemption)
+	return redemption
+}
+
+// RequireToken creates a new middleware that only passes requests with a valid redeem token to the next handler.
+// The token is used up with Cap.Redeem, so each token lets one request through, and the resulting redemption
+// (including the challenge's metadata) is available to the next handler with RedemptionFromContext.
+// Requests without a valid token are passed to the rejection handler.
+//
+// Example:
+//
+//	mux.Handle("/signup", server.RequireToken(capSvc)(signupHandler))
+func RequireToken(cap *pkg.Cap, opts ...func(m *TokenMiddleware)) func(next http.Handler) http.Handler {
+	m := &TokenMiddleware{
+		cap: cap,
+
+		extractors: []TokenExtractorFunc{NewFormTokenExtractor(DefaultTokenField)},
+		scopeFunc:  NewStaticScopeChooser(pkg.Scope{}),
+		ipFunc:     nil,
+		rejectFunc: defaultRejectFunc,
+		errFunc:    defaultErrFunc,
+	}
+
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			m.serve(next, res, req)
+		})
+	}
+}
+
+func (m *TokenMiddleware) serve(next http.Handler, res http.ResponseWriter, req *http.Request) {
+	var token string
+	for _, extractor := range m.extractors {
+		if token = extractor(req); token != "" {
+			break
+		}
+	}
+	if token == "" {
+		m.rejectFunc(ErrMissingRedeemToken, res, req)
+		return
+	}
+
+	scope, err := m.scopeFunc(req)
+	if err != nil {
+		m.errFunc(err, res, req)
+		return
+	}
+
+	ctx := req.Context()
+	if m.ipFunc != nil {
+		ctx = pkg.ContextWithClientIP(ctx, m.ipFunc(req))
+	}
+
+	redemption, err := m.cap.Redeem(ctx, pkg.RedeemRequest{
+		RedeemToken: token,
+		Scope:       scope,
+	})
+	if err != nil {
+		if errors.Is(err, pkg.ErrInvalidRedeemToken) || errors.Is(err, pkg.ErrScopeMismatch) {
+			m.rejectFunc(err, res, req)
+			return
+		}
+
+		m.errFunc(err, res, req)
+		return
+	}
+
+	next.ServeHTTP(res, req.WithContext(context.WithValue(req.Context(), redemptionCtxKey{}, redemption)))
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	pkg "github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+func TestRequireToken(t *testing.T) {
+	scope := pkg.Scope{SiteKey: "site", Action: "signup"}
+	errScope := errors.New("scope chooser failed")
+
+	tests := []struct {
+		name string
+		opts []func(m *TokenMiddleware)
+		// request creates the request from a fresh redeem token for scope, and one for another scope.
+		request    func(token string, otherScopeToken string) *http.Request
+		reuse      bool
+		wantReason error
+		wantErr    error
+	}{
+		{
+			name: "FormBody",
+			request: func(token, _ string) *http.Request {
+				return formRequest(url.Values{DefaultTokenField: {token}})
+			},
+		},
+		{
+			name: "FormQuery",
+			request: func(token, _ string) *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/signup?"+url.Values{DefaultTokenField: {token}}.Encode(), nil)
+			},
+		},
+		{
+			name: "Header",
+			opts: []func(m *TokenMiddleware){WithTokenExtractors(NewHeaderTokenExtractor("X-Cap-Token"))},
+			request: func(token, _ string) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/signup", nil)
+				req.Header.Set("X-Cap-Token", token)
+				return req
+			},
+		},
+		{
+			name: "BearerHeader",
+			opts: []func(m *TokenMiddleware){WithTokenExtractors(NewHeaderTokenExtractor("Authorization"))},
+			request: func(token, _ string) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/signup", nil)
+				req.Header.Set("Authorization", "bearer  "+token)
+				return req
+			},
+		},
+		{
+			name: "Cookie",
+			opts: []func(m *TokenMiddleware){WithTokenExtractors(NewCookieTokenExtractor("cap"))},
+			request: func(token, _ string) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/signup", nil)
+				req.AddCookie(&http.Cookie{Name: "cap", Value: token})
+				return req
+			},
+		},
+		{
+			name: "FirstExtractorWithToken",
+			opts: []func(m *TokenMiddleware){WithTokenExtractors(
+				NewHeaderTokenExtractor("X-Cap-Token"),
+				NewCookieTokenExtractor("cap"),
+			)},
+			request: func(token, _ string) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/signup", nil)
+				req.AddCookie(&http.Cookie{Name: "cap", Value: token})
+				return req
+			},
+		},
+		{
+			name: "Missing",
+			request: func(_, _ string) *http.Request {
+				return formRequest(url.Values{"email": {"user@example.com"}})
+			},
+			wantReason: ErrMissingRedeemToken,
+		},
+		{
+			name: "MissingFromConfiguredExtractors",
+			opts: []func(m *TokenMiddleware){WithTokenExtractors(NewHeaderTokenExtractor("X-Cap-Token"))},
+			request: func(token, _ string) *http.Request {
+				return formRequest(url.Values{DefaultTokenField: {token}})
+			},
+			wantReason: ErrMissingRedeemToken,
+		},
+		{
+			name: "Unknown",
+			request: func(_, _ string) *http.Request {
+				return formRequest(url.Values{DefaultTokenField: {"unknown"}})
+			},
+			wantReason: pkg.ErrInvalidRedeemToken,
+		},
+		{
+			name: "Reused",
+			request: func(token, _ string) *http.Request {
+				return formRequest(url.Values{DefaultTokenField: {token}})
+			},
+			reuse:      true,
+			wantReason: pkg.ErrInvalidRedeemToken,
+		},
+		{
+			name: "ScopeMismatch",
+			request: func(_, otherScopeToken string) *http.Request {
+				return formRequest(url.Values{DefaultTokenField: {otherScopeToken}})
+			},
+			wantReason: pkg.ErrScopeMismatch,
+		},
+		{
+			name: "ScopeChooserError",
+			opts: []func(m *TokenMiddleware){WithRequiredScopeChooser(func(req *http.Request) (pkg.Scope, error) {
+				return pkg.Scope{}, errScope
+			})},
+			request: func(token, _ string) *http.Request {
+				return formRequest(url.Values{DefaultTokenField: {token}})
+			},
+			wantErr: errScope,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := pkg.NewCap(fake.NewDriver(pkg.SystemClock))
+			metadata := map[string]string{"form": "signup"}
+			token := newRedeemToken(t, c, scope, metadata)
+			otherScopeToken := newRedeemToken(t, c, pkg.Scope{SiteKey: "site", Action: "login"}, nil)
+
+			var reason, handledErr error
+			var redemption *pkg.Redemption
+			opts := append([]func(m *TokenMiddleware){
+				WithRequiredScope(scope),
+				WithRejectionHandler(func(r error, res http.ResponseWriter, req *http.Request) {
+					reason = r
+					res.WriteHeader(403)
+				}),
+				WithTokenErrorHandler(func(err error, res http.ResponseWriter, req *http.Request) {
+					handledErr = err
+					res.WriteHeader(500)
+				}),
+			}, tt.opts...)
+			handler := RequireToken(c, opts...)(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				redemption = RedemptionFromContext(req.Context())
+				res.WriteHeader(200)
+			}))
+
+			if tt.reuse {
+				handler.ServeHTTP(httptest.NewRecorder(), tt.request(token, otherScopeToken))
+				redemption = nil
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, tt.request(token, otherScopeToken))
+
+			switch {
+			case tt.wantErr != nil:
+				if rec.Code != 500 || !errors.Is(handledErr, tt.wantErr) {
+					t.Errorf("got status %d and error %v, want 500 and %v", rec.Code, handledErr, tt.wantErr)
+				}
+			case tt.wantReason != nil:
+				if rec.Code != 403 || !errors.Is(reason, tt.wantReason) {
+					t.Errorf("got status %d and reason %v, want 403 and %v", rec.Code, reason, tt.wantReason)
+				}
+				if redemption != nil {
+					t.Errorf("next handler was called for rejected request")
+				}
+			default:
+				if rec.Code != 200 || redemption == nil {
+					t.Fatalf("got status %d and redemption %v, want 200 with redemption (reason %v)", rec.Code, redemption, reason)
+				}
+				if redemption.Scope != scope || !maps.Equal(redemption.Metadata, metadata) {
+					t.Errorf("redemption = %+v, want scope %+v and metadata %v", redemption, scope, metadata)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireTokenDefaultRejection(t *testing.T) {
+	handler := RequireToken(pkg.NewCap(fake.NewDriver(pkg.SystemClock)))(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		t.Errorf("next handler was called for rejected request")
+	}))
+
+	tests := []struct {
+		values   url.Values
+		wantBody string
+	}{
+		{url.Values{}, "missing cap token"},
+		{url.Values{DefaultTokenField: {"unknown"}}, "invalid cap token"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, formRequest(tt.values))
+		if rec.Code != 403 || rec.Body.String() != tt.wantBody {
+			t.Errorf("got %d %q, want 403 %q", rec.Code, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestRedemptionFromContextWithoutToken(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if redemption := RedemptionFromContext(req.Context()); redemption != nil {
+		t.Errorf("RedemptionFromContext = %+v, want nil", redemption)
+	}
+}
+
+// formRequest returns a POST request with a URL-encoded form body.
+func formRequest(values url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
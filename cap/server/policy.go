@@ -0,0 +1,328 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	pkg "github.com/termermc/go-capjs/cap"
+)
+
+// PolicyAction is the action that an IP policy rule applies to clients in its range.
+type PolicyAction int
+
+const (
+	// PolicyActionChallenge issues challenges normally, optionally with the rule's params.
+	// It can be used to exempt a smaller range from a broader allow or deny rule.
+	PolicyActionChallenge PolicyAction = iota
+
+	// PolicyActionAllow issues pre-approved challenges that require no solutions, so clients receive a redeem token
+	// without doing any work. Pre-approved challenges are not rate limited.
+	// Unless the Cap uses stateless challenges (see cap.WithStatelessChallenges), each one is still stored until it
+	// expires, so allowed ranges must only contain clients that are trusted not to fill the driver's storage.
+	PolicyActionAllow
+
+	// PolicyActionDeny rejects challenge requests with 403 Forbidden, before anything is stored.
+	PolicyActionDeny
+)
+
+// String returns the name of the action as used in policy files.
+func (a PolicyAction) String() string {
+	switch a {
+	case PolicyActionChallenge:
+		return "challenge"
+	case PolicyActionAllow:
+		return "allow"
+	case PolicyActionDeny:
+		return "deny"
+	default:
+		return "unknown"
+	}
+}
+
+// PreApprovedChallengeParams are the params of challenges issued to clients matching a PolicyActionAllow rule.
+// They have no sub-challenges, so any submission (including one with no solutions) solves them.
+var PreApprovedChallengeParams = pkg.ChallengeParams{
+	Difficulty: pkg.DefaultChallengeParams.Difficulty,
+	Count:      0,
+	SaltSize:   pkg.DefaultChallengeParams.SaltSize,
+}
+
+// PolicyRule is a rule of an IPPolicy.
+type PolicyRule struct {
+	// The range of client IPs that the rule applies to.
+	Prefix netip.Prefix
+
+	// The action to apply.
+	Action PolicyAction
+
+	// The params to use for challenges issued to matching clients when Action is PolicyActionChallenge.
+	// Optional; if nil, the server's params chooser is used.
+	Params *pkg.ChallengeParams
+}
+
+// ErrInvalidIPPolicy is returned when an IP policy file cannot be parsed.
+var ErrInvalidIPPolicy = errors.New("invalid IP policy")
+
+// policyNode is a node of a binary trie of policy rules, indexed by the bits of their prefixes.
+type policyNode struct {
+	children [2]*policyNode
+	rule     *PolicyRule
+}
+
+// policyTrie holds the rules of an IPPolicy, with separate tries for IPv4 and IPv6.
+type policyTrie struct {
+	v4 policyNode
+	v6 policyNode
+}
+
+// insert adds the rule to the trie, replacing any rule with the same prefix.
+func (t *policyTrie) insert(rule PolicyRule) {
+	prefix := rule.Prefix.Masked()
+	addr := prefix.Addr()
+
+	// Rules for IPv4-mapped prefixes apply to the IPv4 addresses.
+	if addr.Is4In6() && prefix.Bits() >= 96 {
+		addr = addr.Unmap()
+		prefix = netip.PrefixFrom(addr, prefix.Bits()-96)
+	}
+
+	node := &t.v6
+	if addr.Is4() {
+		node = &t.v4
+	}
+
+	bytes := addr.AsSlice()
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := bytes[i/8] >> (7 - i%8) & 1
+		if node.children[bit] == nil {
+			node.children[bit] = &policyNode{}
+		}
+		node = node.children[bit]
+	}
+
+	rule.Prefix = prefix
+	node.rule = &rule
+}
+
+// lookup returns the rule with the longest prefix containing the address.
+func (t *policyTrie) lookup(addr netip.Addr) (PolicyRule, bool) {
+	node := &t.v6
+	if addr.Is4() {
+		node = &t.v4
+	}
+
+	match := node.rule
+	bytes := addr.AsSlice()
+	for i := 0; i < len(bytes)*8; i++ {
+		node = node.children[bytes[i/8]>>(7-i%8)&1]
+		if node == nil {
+			break
+		}
+		if node.rule != nil {
+			match = node.rule
+		}
+	}
+
+	if match == nil {
+		return PolicyRule{}, false
+	}
+
+	return *match, true
+}
+
+// IPPolicy is a set of rules that allow, deny or choose challenge params for ranges of client IPs.
+// When several rules contain an IP, the rule with the longest prefix applies.
+// IPv4-mapped IPv6 addresses match IPv4 rules.
+//
+// Rules can be replaced at runtime with SetRules or LoadFile, for example when a policy file changes.
+// It is safe for concurrent use.
+type IPPolicy struct {
+	trie atomic.Pointer[policyTrie]
+}
+
+// NewIPPolicy creates a new IPPolicy with the specified rules.
+func NewIPPolicy(rules ...PolicyRule) *IPPolicy {
+	p := &IPPolicy{}
+	p.SetRules(rules...)
+	return p
+}
+
+// LoadIPPolicy creates a new IPPolicy with the rules in the specified file.
+// See ParseIPPolicy for the file format.
+func LoadIPPolicy(path string) (*IPPolicy, error) {
+	p := &IPPolicy{}
+	if err := p.LoadFile(path); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// SetRules atomically replaces the policy's rules.
+// Rules with invalid prefixes are ignored.
+// If several rules have the same prefix, the last one applies.
+func (p *IPPolicy) SetRules(rules ...PolicyRule) {
+	t := &policyTrie{}
+	for _, rule := range rules {
+		if rule.Prefix.IsValid() {
+			t.insert(rule)
+		}
+	}
+
+	p.trie.Store(t)
+}
+
+// LoadFile atomically replaces the policy's rules with the rules in the specified file.
+// If the file cannot be read or parsed, the policy's rules are not changed.
+// See ParseIPPolicy for the file format.
+func (p *IPPolicy) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf(`server: failed to open IP policy file: %w`, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	rules, err := ParseIPPolicy(f)
+	if err != nil {
+		return fmt.Errorf(`server: failed to load IP policy file "%s": %w`, path, err)
+	}
+
+	p.SetRules(rules...)
+	return nil
+}
+
+// Lookup returns the rule that applies to the specified IP.
+// Returns false if no rule contains the IP.
+func (p *IPPolicy) Lookup(ip netip.Addr) (PolicyRule, bool) {
+	t := p.trie.Load()
+	if t == nil || !ip.IsValid() {
+		return PolicyRule{}, false
+	}
+
+	return t.lookup(ip.Unmap().WithZone(""))
+}
+
+// ParseIPPolicy parses IP policy rules, one per line.
+// Each line has an action (allow, deny or challenge), followed by a CIDR prefix or single IP.
+// Challenge rules can be followed by the params to use, as key=value pairs: difficulty, count, salt_size and scheme.
+// Params that are not specified use the values of cap.DefaultChallengeParams.
+// Empty lines and lines starting with '#' are ignored.
+//
+// Example:
+//
+//	# Monitoring and office ranges
+//	allow 192.0.2.0/24
+//	allow 2001:db8:1::/48
+//	# Known abusive range, except for one partner
+//	deny 198.51.100.0/24
+//	challenge 198.51.100.7 difficulty=5 count=80
+//
+// Returns an error wrapping ErrInvalidIPPolicy if a line is invalid.
+func ParseIPPolicy(r io.Reader) ([]PolicyRule, error) {
+	var rules []PolicyRule
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		rule, err := parsePolicyRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrInvalidIPPolicy, lineNum, err)
+		}
+
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// parsePolicyRule parses the fields of a single policy file line.
+func parsePolicyRule(fields []string) (PolicyRule, error) {
+	var rule PolicyRule
+
+	if len(fields) < 2 {
+		return rule, errors.New("expected an action and a prefix")
+	}
+
+	switch fields[0] {
+	case "challenge":
+		rule.Action = PolicyActionChallenge
+	case "allow":
+		rule.Action = PolicyActionAllow
+	case "deny":
+		rule.Action = PolicyActionDeny
+	default:
+		return rule, fmt.Errorf(`unknown action "%s"`, fields[0])
+	}
+
+	if strings.ContainsRune(fields[1], '/') {
+		prefix, err := netip.ParsePrefix(fields[1])
+		if err != nil {
+			return rule, err
+		}
+		rule.Prefix = prefix
+	} else {
+		addr, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			return rule, err
+		}
+		rule.Prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	if len(fields) == 2 {
+		return rule, nil
+	}
+	if rule.Action != PolicyActionChallenge {
+		return rule, fmt.Errorf(`params can only be specified for challenge rules, not %s rules`, rule.Action)
+	}
+
+	params := pkg.DefaultChallengeParams
+	for _, field := range fields[2:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return rule, fmt.Errorf(`expected key=value param, got "%s"`, field)
+		}
+
+		if key == "scheme" {
+			params.Scheme = value
+			continue
+		}
+
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return rule, fmt.Errorf(`invalid value for param "%s": "%s"`, key, value)
+		}
+
+		switch key {
+		case "difficulty":
+			params.Difficulty = n
+		case "count":
+			params.Count = n
+		case "salt_size":
+			params.SaltSize = n
+		default:
+			return rule, fmt.Errorf(`unknown param "%s"`, key)
+		}
+	}
+	rule.Params = &params
+
+	return rule, nil
+}
@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pkg "github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+func TestIPPolicyLookup(t *testing.T) {
+	policy := NewIPPolicy(
+		PolicyRule{Prefix: netip.MustParsePrefix("0.0.0.0/0"), Action: PolicyActionChallenge},
+		PolicyRule{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Action: PolicyActionAllow},
+		PolicyRule{Prefix: netip.MustParsePrefix("198.51.96.0/20"), Action: PolicyActionDeny},
+		PolicyRule{Prefix: netip.MustParsePrefix("198.51.100.7/32"), Action: PolicyActionChallenge},
+		// Not masked; applies to 203.0.113.0/25.
+		PolicyRule{Prefix: netip.MustParsePrefix("203.0.113.99/25"), Action: PolicyActionDeny},
+		PolicyRule{Prefix: netip.MustParsePrefix("::ffff:100.64.0.0/106"), Action: PolicyActionDeny},
+		PolicyRule{Prefix: netip.MustParsePrefix("2001:db8::/32"), Action: PolicyActionDeny},
+		PolicyRule{Prefix: netip.MustParsePrefix("2001:db8:1::/48"), Action: PolicyActionAllow},
+		PolicyRule{Prefix: netip.MustParsePrefix("2001:db8:1:2::1/128"), Action: PolicyActionChallenge},
+		// Invalid prefixes are ignored.
+		PolicyRule{Action: PolicyActionDeny},
+	)
+
+	tests := []struct {
+		ip         string
+		wantPrefix string
+		wantAction PolicyAction
+	}{
+		{"192.0.2.1", "192.0.2.0/24", PolicyActionAllow},
+		{"192.0.3.1", "0.0.0.0/0", PolicyActionChallenge},
+		{"198.51.96.0", "198.51.96.0/20", PolicyActionDeny},
+		{"198.51.111.255", "198.51.96.0/20", PolicyActionDeny},
+		{"198.51.112.0", "0.0.0.0/0", PolicyActionChallenge},
+		{"198.51.100.6", "198.51.96.0/20", PolicyActionDeny},
+		{"198.51.100.7", "198.51.100.7/32", PolicyActionChallenge},
+		{"198.51.100.8", "198.51.96.0/20", PolicyActionDeny},
+		{"203.0.113.1", "203.0.113.0/25", PolicyActionDeny},
+		{"203.0.113.128", "0.0.0.0/0", PolicyActionChallenge},
+		{"::ffff:192.0.2.1", "192.0.2.0/24", PolicyActionAllow},
+		{"::ffff:198.51.100.7", "198.51.100.7/32", PolicyActionChallenge},
+		{"100.64.1.1", "100.64.0.0/10", PolicyActionDeny},
+		{"::ffff:100.127.255.255", "100.64.0.0/10", PolicyActionDeny},
+		{"2001:db8:ffff::1", "2001:db8::/32", PolicyActionDeny},
+		{"2001:db8:1:ffff::1", "2001:db8:1::/48", PolicyActionAllow},
+		{"2001:db8:1:2::1", "2001:db8:1:2::1/128", PolicyActionChallenge},
+		{"2001:db8:1:2::1%eth0", "2001:db8:1:2::1/128", PolicyActionChallenge},
+		{"2001:db8:1:2::2", "2001:db8:1::/48", PolicyActionAllow},
+	}
+
+	for _, tt := range tests {
+		rule, ok := policy.Lookup(netip.MustParseAddr(tt.ip))
+		if !ok || rule.Prefix.String() != tt.wantPrefix || rule.Action != tt.wantAction {
+			t.Errorf("Lookup(%s) = %s %s, %t, want %s %s", tt.ip, rule.Action, rule.Prefix, ok, tt.wantAction, tt.wantPrefix)
+		}
+	}
+
+	// IPv4 rules do not apply to IPv6 addresses, even with a /0 prefix.
+	for _, ip := range []string{"2001:db9::1", "::1", "::192.0.2.1"} {
+		if rule, ok := policy.Lookup(netip.MustParseAddr(ip)); ok {
+			t.Errorf("Lookup(%s) = %s %s, want no rule", ip, rule.Action, rule.Prefix)
+		}
+	}
+	if _, ok := policy.Lookup(netip.Addr{}); ok {
+		t.Errorf("Lookup of invalid address: got a rule, want none")
+	}
+}
+
+func TestIPPolicySetRules(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	prefix := netip.MustParsePrefix("192.0.2.0/24")
+
+	// The last rule with the same prefix applies.
+	policy := NewIPPolicy(
+		PolicyRule{Prefix: prefix, Action: PolicyActionDeny},
+		PolicyRule{Prefix: netip.MustParsePrefix("192.0.2.128/24"), Action: PolicyActionAllow},
+	)
+	if rule, _ := policy.Lookup(ip); rule.Action != PolicyActionAllow {
+		t.Errorf("Lookup = %s, want %s", rule.Action, PolicyActionAllow)
+	}
+
+	policy.SetRules(PolicyRule{Prefix: prefix, Action: PolicyActionDeny})
+	if rule, _ := policy.Lookup(ip); rule.Action != PolicyActionDeny {
+		t.Errorf("Lookup after SetRules = %s, want %s", rule.Action, PolicyActionDeny)
+	}
+
+	policy.SetRules()
+	if _, ok := policy.Lookup(ip); ok {
+		t.Errorf("Lookup after removing all rules: got a rule, want none")
+	}
+	if _, ok := (&IPPolicy{}).Lookup(ip); ok {
+		t.Errorf("Lookup on zero IPPolicy: got a rule, want none")
+	}
+}
+
+func TestParseIPPolicy(t *testing.T) {
+	rules, err := ParseIPPolicy(strings.NewReader(`
+# Monitoring
+allow 192.0.2.0/24
+  deny   198.51.100.0/24
+challenge 198.51.100.7 difficulty=5 count=80
+challenge 2001:db8::/32 scheme=scrypt-n1024-r8-p1 salt_size=16
+challenge 203.0.113.0/24
+`))
+	if err != nil {
+		t.Fatalf("ParseIPPolicy: unexpected error: %v", err)
+	}
+
+	want := []struct {
+		prefix string
+		action PolicyAction
+		params *pkg.ChallengeParams
+	}{
+		{"192.0.2.0/24", PolicyActionAllow, nil},
+		{"198.51.100.0/24", PolicyActionDeny, nil},
+		{"198.51.100.7/32", PolicyActionChallenge, &pkg.ChallengeParams{
+			Difficulty: 5,
+			Count:      80,
+			SaltSize:   pkg.DefaultChallengeParams.SaltSize,
+		}},
+		{"2001:db8::/32", PolicyActionChallenge, &pkg.ChallengeParams{
+			Difficulty: pkg.DefaultChallengeParams.Difficulty,
+			Count:      pkg.DefaultChallengeParams.Count,
+			SaltSize:   16,
+			Scheme:     "scrypt-n1024-r8-p1",
+		}},
+		{"203.0.113.0/24", PolicyActionChallenge, nil},
+	}
+	if len(rules) != len(want) {
+		t.Fatalf("ParseIPPolicy: got %d rules, want %d", len(rules), len(want))
+	}
+	for i, w := range want {
+		rule := rules[i]
+		if rule.Prefix.String() != w.prefix || rule.Action != w.action {
+			t.Errorf("rule %d = %s %s, want %s %s", i, rule.Action, rule.Prefix, w.action, w.prefix)
+		}
+		if (rule.Params == nil) != (w.params == nil) || (rule.Params != nil && *rule.Params != *w.params) {
+			t.Errorf("rule %d params = %+v, want %+v", i, rule.Params, w.params)
+		}
+	}
+}
+
+func TestParseIPPolicyErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"MissingPrefix", "allow"},
+		{"UnknownAction", "block 192.0.2.0/24"},
+		{"InvalidPrefix", "deny 192.0.2.0/33"},
+		{"InvalidIP", "deny 192.0.2"},
+		{"ParamsOnAllow", "allow 192.0.2.0/24 difficulty=5"},
+		{"ParamWithoutValue", "challenge 192.0.2.0/24 difficulty"},
+		{"UnknownParam", "challenge 192.0.2.0/24 rounds=5"},
+		{"NegativeParam", "challenge 192.0.2.0/24 count=-1"},
+		{"NonNumericParam", "challenge 192.0.2.0/24 count=many"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseIPPolicy(strings.NewReader("allow 192.0.2.1\n" + tt.line))
+			if !errors.Is(err, ErrInvalidIPPolicy) {
+				t.Fatalf("ParseIPPolicy(%q): error = %v, want %v", tt.line, err, ErrInvalidIPPolicy)
+			}
+			if !strings.Contains(err.Error(), "line 2") {
+				t.Errorf("ParseIPPolicy(%q): error %q does not contain the line number", tt.line, err)
+			}
+		})
+	}
+}
+
+func TestIPPolicyLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.txt")
+	writeFile := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write policy file: %v", err)
+		}
+	}
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	writeFile("deny 192.0.2.0/24\n")
+	policy, err := LoadIPPolicy(path)
+	if err != nil {
+		t.Fatalf("LoadIPPolicy: unexpected error: %v", err)
+	}
+	if rule, _ := policy.Lookup(ip); rule.Action != PolicyActionDeny {
+		t.Errorf("Lookup = %s, want %s", rule.Action, PolicyActionDeny)
+	}
+
+	writeFile("allow 192.0.2.0/24\n")
+	if err = policy.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile: unexpected error: %v", err)
+	}
+	if rule, _ := policy.Lookup(ip); rule.Action != PolicyActionAllow {
+		t.Errorf("Lookup after reload = %s, want %s", rule.Action, PolicyActionAllow)
+	}
+
+	// A file that cannot be parsed leaves the rules unchanged.
+	writeFile("deny 192.0.2.0/24\nallow nonsense\n")
+	if err = policy.LoadFile(path); !errors.Is(err, ErrInvalidIPPolicy) {
+		t.Errorf("LoadFile with invalid file: error = %v, want %v", err, ErrInvalidIPPolicy)
+	}
+	if rule, _ := policy.Lookup(ip); rule.Action != PolicyActionAllow {
+		t.Errorf("Lookup after failed reload = %s, want %s", rule.Action, PolicyActionAllow)
+	}
+
+	if _, err = LoadIPPolicy(filepath.Join(t.TempDir(), "missing.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("LoadIPPolicy with missing file: error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestChallengeHandlerIPPolicy(t *testing.T) {
+	ruleParams := pkg.ChallengeParams{Difficulty: 2, Count: 3, SaltSize: 8}
+	policy := NewIPPolicy(
+		PolicyRule{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Action: PolicyActionAllow},
+		PolicyRule{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Action: PolicyActionDeny},
+		PolicyRule{Prefix: netip.MustParsePrefix("203.0.113.0/24"), Action: PolicyActionChallenge, Params: &ruleParams},
+	)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantStatus int
+		wantParams pkg.ChallengeParams
+	}{
+		{"Allow", "192.0.2.1:1234", 200, PreApprovedChallengeParams},
+		{"Deny", "198.51.100.1:1234", 403, pkg.ChallengeParams{}},
+		{"ChallengeWithParams", "203.0.113.1:1234", 200, ruleParams},
+		{"NoRule", "[2001:db8::1]:1234", 200, testParams},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := fake.NewDriver(pkg.SystemClock)
+			c := pkg.NewCap(driver)
+			s := NewServer(c,
+				WithIPForRateLimit(RemoteAddrIPExtractor),
+				WithIPPolicy(policy),
+				WithChallengeParams(testParams),
+			)
+
+			req := httptest.NewRequest(http.MethodPost, "/challenge", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			s.ChallengeHandler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %q)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if rec.Code != 200 {
+				if driver.Len() != 0 {
+					t.Errorf("challenge was stored for denied client")
+				}
+				return
+			}
+
+			var chal pkg.ChallengeResponse
+			if err := json.NewDecoder(rec.Body).Decode(&chal); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if chal.Params != tt.wantParams {
+				t.Errorf("params = %+v, want %+v", chal.Params, tt.wantParams)
+			}
+
+			// Pre-approved challenges are solved without any solutions.
+			if tt.wantParams.Count == 0 {
+				_, err := c.VerifyChallengeSolutions(context.Background(), pkg.VerifySolutionsRequest{
+					ChallengeToken: chal.ChallengeHash,
+				})
+				if err != nil {
+					t.Errorf("VerifyChallengeSolutions without solutions: unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestPreApprovedChallengeStorage(t *testing.T) {
+	policy := NewIPPolicy(PolicyRule{Prefix: netip.MustParsePrefix("192.0.2.0/24"), Action: PolicyActionAllow})
+
+	tests := []struct {
+		name      string
+		stateless bool
+		// wantStored is the number of challenges stored after three requests.
+		wantStored int
+	}{
+		// Pre-approved challenges are not rate limited, so every request stores one.
+		{"Stateful", false, 3},
+		{"Stateless", true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver := fake.NewDriver(pkg.SystemClock)
+			var capOpts []func(c *pkg.Cap)
+			if tt.stateless {
+				keyring, err := pkg.NewHMACKeyring(pkg.NewRandomHMACKey("k1"))
+				if err != nil {
+					t.Fatalf("NewHMACKeyring: unexpected error: %v", err)
+				}
+				capOpts = append(capOpts, pkg.WithStatelessChallenges(keyring))
+			}
+			c := pkg.NewCap(driver, capOpts...)
+			s := NewServer(c,
+				WithIPForRateLimit(RemoteAddrIPExtractor),
+				WithIPPolicy(policy),
+			)
+
+			var chal pkg.ChallengeResponse
+			for range 3 {
+				req := httptest.NewRequest(http.MethodPost, "/challenge", nil)
+				req.RemoteAddr = "192.0.2.1:1234"
+				rec := httptest.NewRecorder()
+				s.ChallengeHandler(rec, req)
+
+				if rec.Code != 200 {
+					t.Fatalf("status = %d, want 200 (body %q)", rec.Code, rec.Body.String())
+				}
+				if err := json.NewDecoder(rec.Body).Decode(&chal); err != nil {
+					t.Fatalf("decoding response: %v", err)
+				}
+			}
+
+			if got := driver.Len(); got != tt.wantStored {
+				t.Errorf("stored challenges = %d, want %d", got, tt.wantStored)
+			}
+
+			// Stateless pre-approved challenges are only stored once solved.
+			data, err := c.VerifyChallengeSolutions(context.Background(), pkg.VerifySolutionsRequest{ChallengeToken: chal.ChallengeHash})
+			if err != nil {
+				t.Fatalf("VerifyChallengeSolutions without solutions: unexpected error: %v", err)
+			}
+			if ok, err := c.UseRedeemToken(context.Background(), data.RedeemToken); err != nil || !ok {
+				t.Errorf("UseRedeemToken: got %t, %v, want true", ok, err)
+			}
+		})
+	}
+}
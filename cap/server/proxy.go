@@ -0,0 +1,223 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Header names used by common reverse proxies and CDNs to pass the client IP.
+const (
+	HeaderXForwardedFor  = "X-Forwarded-For"
+	HeaderForwarded      = "Forwarded"
+	HeaderXRealIP        = "X-Real-IP"
+	HeaderCFConnectingIP = "CF-Connecting-IP"
+	HeaderTrueClientIP   = "True-Client-IP"
+)
+
+// isTrusted returns whether the address is in one of the trusted prefixes.
+func isTrusted(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHopAddr parses an address from a proxy header.
+// Accepts IP addresses with or without a port, and IPv6 addresses with or without brackets.
+func parseHopAddr(str string) (netip.Addr, bool) {
+	str = strings.TrimSpace(str)
+
+	if addr, err := netip.ParseAddr(str); err == nil {
+		return addr.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(str); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	if strings.HasPrefix(str, "[") && strings.HasSuffix(str, "]") {
+		if addr, err := netip.ParseAddr(str[1 : len(str)-1]); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+
+	return netip.Addr{}, false
+}
+
+// clientFromHops returns the client IP from a list of hops, ordered from the client to the nearest proxy, that were
+// appended by the trusted proxy at remote.
+// The hops are walked from the right, skipping trusted proxies, and the first untrusted address is the client.
+// If a hop cannot be parsed, the last trusted address is returned, since anything to its left may be forged.
+func clientFromHops(remote netip.Addr, hops []string, trustedProxies []netip.Prefix) netip.Addr {
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHopAddr(hops[i])
+		if !ok {
+			break
+		}
+
+		client = addr
+		if !isTrusted(addr, trustedProxies) {
+			break
+		}
+	}
+
+	return client
+}
+
+// trustedRemoteAddr returns the request's remote address, and whether it is a trusted proxy.
+// Returns false for the address if the remote address cannot be parsed.
+func trustedRemoteAddr(req *http.Request, trustedProxies []netip.Prefix) (remote netip.Addr, ok bool, trusted bool) {
+	addrPort, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false, false
+	}
+
+	remote = addrPort.Addr().Unmap()
+	return remote, true, isTrusted(remote, trustedProxies)
+}
+
+// NewTrustedProxyIPExtractor creates a new IPExtractorFunc for applications behind reverse proxies that append the
+// address of the connecting client to the X-Forwarded-For header.
+//
+// If the request's remote address is not one of the trusted proxies, the remote address is used and the header is
+// ignored. Otherwise, the X-Forwarded-For entries are walked from the right, skipping trusted proxies, and the first
+// untrusted address is used. Entries to the left of it are set by the client and cannot be trusted.
+// If all entries are trusted proxies, the leftmost entry is used.
+//
+// Example, behind load balancers in 10.0.0.0/8:
+// NewTrustedProxyIPExtractor(netip.MustParsePrefix("10.0.0.0/8"))
+func NewTrustedProxyIPExtractor(trustedProxies ...netip.Prefix) IPExtractorFunc {
+	return func(req *http.Request) *netip.Addr {
+		remote, ok, trusted := trustedRemoteAddr(req, trustedProxies)
+		if !ok {
+			return nil
+		}
+		if !trusted {
+			return &remote
+		}
+
+		var hops []string
+		for _, val := range req.Header.Values(HeaderXForwardedFor) {
+			hops = append(hops, strings.Split(val, ",")...)
+		}
+
+		client := clientFromHops(remote, hops, trustedProxies)
+		return &client
+	}
+}
+
+// NewForwardedIPExtractor creates a new IPExtractorFunc for applications behind reverse proxies that append the
+// address of the connecting client to the RFC 7239 Forwarded header.
+// It works like NewTrustedProxyIPExtractor, using the "for" parameters of the Forwarded header's elements.
+// Obfuscated and "unknown" identifiers cannot be walked past, so the last trusted address is used if one is reached.
+//
+// Example, behind load balancers in 10.0.0.0/8:
+// NewForwardedIPExtractor(netip.MustParsePrefix("10.0.0.0/8"))
+func NewForwardedIPExtractor(trustedProxies ...netip.Prefix) IPExtractorFunc {
+	return func(req *http.Request) *netip.Addr {
+		remote, ok, trusted := trustedRemoteAddr(req, trustedProxies)
+		if !ok {
+			return nil
+		}
+		if !trusted {
+			return &remote
+		}
+
+		var hops []string
+		for _, val := range req.Header.Values(HeaderForwarded) {
+			hops = append(hops, parseForwardedFor(val)...)
+		}
+
+		client := clientFromHops(remote, hops, trustedProxies)
+		return &client
+	}
+}
+
+// parseForwardedFor returns the values of the "for" parameters of each element of a Forwarded header value.
+// Elements without a "for" parameter yield an empty value, which does not parse as an address.
+func parseForwardedFor(val string) []string {
+	var values []string
+	for _, element := range splitQuoted(val, ',') {
+		forValue := ""
+		for _, pair := range splitQuoted(element, ';') {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				forValue = strings.Trim(value, `"`)
+			}
+		}
+
+		values = append(values, forValue)
+	}
+
+	return values
+}
+
+// splitQuoted splits a string by a separator that is not inside a quoted string.
+func splitQuoted(str string, sep byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(str); i++ {
+		switch {
+		case str[i] == '\\' && inQuotes:
+			i++
+		case str[i] == '"':
+			inQuotes = !inQuotes
+		case str[i] == sep && !inQuotes:
+			parts = append(parts, str[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, str[start:])
+}
+
+// NewTrustedHeaderIPExtractor creates a new IPExtractorFunc that gets the request IP from a header containing a single
+// address, which is only trusted if the request's remote address is one of the trusted proxies.
+// Otherwise, or if the header is missing or invalid, the remote address is used.
+//
+// Example:
+// NewTrustedHeaderIPExtractor("X-Real-IP", netip.MustParsePrefix("10.0.0.0/8"))
+func NewTrustedHeaderIPExtractor(header string, trustedProxies ...netip.Prefix) IPExtractorFunc {
+	return func(req *http.Request) *netip.Addr {
+		remote, ok, trusted := trustedRemoteAddr(req, trustedProxies)
+		if !ok {
+			return nil
+		}
+		if !trusted {
+			return &remote
+		}
+
+		if addr, ok := parseHopAddr(req.Header.Get(header)); ok {
+			return &addr
+		}
+
+		return &remote
+	}
+}
+
+// NewXRealIPExtractor creates a new IPExtractorFunc that uses the X-Real-IP header set by trusted proxies,
+// as commonly configured with nginx.
+// See NewTrustedHeaderIPExtractor.
+func NewXRealIPExtractor(trustedProxies ...netip.Prefix) IPExtractorFunc {
+	return NewTrustedHeaderIPExtractor(HeaderXRealIP, trustedProxies...)
+}
+
+// NewCloudflareIPExtractor creates a new IPExtractorFunc that uses the CF-Connecting-IP header set by Cloudflare.
+// The trusted proxies must be Cloudflare's published IP ranges, or the ranges of proxies between Cloudflare and the
+// application if the application does not receive connections from Cloudflare directly.
+// See NewTrustedHeaderIPExtractor.
+func NewCloudflareIPExtractor(trustedProxies ...netip.Prefix) IPExtractorFunc {
+	return NewTrustedHeaderIPExtractor(HeaderCFConnectingIP, trustedProxies...)
+}
+
+// NewTrueClientIPExtractor creates a new IPExtractorFunc that uses the True-Client-IP header set by CDNs such as
+// Akamai and Cloudflare Enterprise.
+// See NewTrustedHeaderIPExtractor.
+func NewTrueClientIPExtractor(trustedProxies ...netip.Prefix) IPExtractorFunc {
+	return NewTrustedHeaderIPExtractor(HeaderTrueClientIP, trustedProxies...)
+}
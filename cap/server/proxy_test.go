@@ -0,0 +1,292 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// trustedProxies are the proxy ranges used by the extractor tests.
+var trustedProxies = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("2001:db8:ffff::/48"),
+}
+
+// extractorTest is a request passed to an IPExtractorFunc, and the expected IP.
+type extractorTest struct {
+	name       string
+	remoteAddr string
+	// headers are added to the request in order, so a header can have several values.
+	headers [][2]string
+	// want is the expected IP, or empty if the extractor must return nil.
+	want string
+}
+
+func runExtractorTests(t *testing.T, extractor IPExtractorFunc, tests []extractorTest) {
+	t.Helper()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/challenge", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, h := range tt.headers {
+				req.Header.Add(h[0], h[1])
+			}
+
+			got := extractor(req)
+			switch {
+			case tt.want == "" && got != nil:
+				t.Errorf("extractor = %s, want nil", got)
+			case tt.want != "" && (got == nil || *got != netip.MustParseAddr(tt.want)):
+				t.Errorf("extractor = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTrustedProxyIPExtractor(t *testing.T) {
+	runExtractorTests(t, NewTrustedProxyIPExtractor(trustedProxies...), []extractorTest{
+		{
+			name:       "UntrustedRemoteIgnoresHeader",
+			remoteAddr: "192.0.2.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "198.51.100.1"}},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "TrustedRemoteWithoutHeader",
+			remoteAddr: "10.0.0.1:1234",
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "SingleHop",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "198.51.100.1"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "SpoofedLeftmostEntry",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "1.2.3.4, 198.51.100.1"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "SkipsTrustedHops",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "1.2.3.4, 198.51.100.1, 10.1.1.1,10.2.2.2"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "SeveralHeaderLines",
+			remoteAddr: "10.0.0.1:1234",
+			headers: [][2]string{
+				{HeaderXForwardedFor, "1.2.3.4"},
+				{HeaderXForwardedFor, "198.51.100.1, 10.1.1.1"},
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:       "AllTrusted",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "10.3.3.3, 10.2.2.2"}},
+			want:       "10.3.3.3",
+		},
+		{
+			name:       "InvalidHopStopsWalk",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "198.51.100.1, garbage, 10.2.2.2"}},
+			want:       "10.2.2.2",
+		},
+		{
+			name:       "EmptyEntry",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "198.51.100.1,"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "HopsWithPorts",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "[2001:db8::1]:4711, 10.2.2.2:80"}},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "BracketedIPv6",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "[2001:db8::1]"}},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "MappedHopUsesIPv4Trust",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "198.51.100.1, ::ffff:10.2.2.2"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "MappedRemote",
+			remoteAddr: "[::ffff:10.0.0.1]:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "198.51.100.1"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "IPv6Proxy",
+			remoteAddr: "[2001:db8:ffff::1]:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "2001:db8::1, 2001:db8:ffff::2"}},
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "InvalidRemoteAddr",
+			remoteAddr: "not an address",
+			headers:    [][2]string{{HeaderXForwardedFor, "198.51.100.1"}},
+		},
+	})
+}
+
+func TestNewForwardedIPExtractor(t *testing.T) {
+	runExtractorTests(t, NewForwardedIPExtractor(trustedProxies...), []extractorTest{
+		{
+			name:       "UntrustedRemoteIgnoresHeader",
+			remoteAddr: "192.0.2.1:1234",
+			headers:    [][2]string{{HeaderForwarded, "for=198.51.100.1"}},
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "SingleElement",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderForwarded, "for=198.51.100.1;proto=https;by=10.0.0.1"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "SpoofedLeftmostElement",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderForwarded, "for=1.2.3.4, for=198.51.100.1, for=10.2.2.2"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "CaseInsensitiveParameter",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderForwarded, "proto=http;For=198.51.100.1"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "QuotedIPv6WithPort",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderForwarded, `for="[2001:db8:cafe::17]:4711"`}},
+			want:       "2001:db8:cafe::17",
+		},
+		{
+			name:       "QuotedSeparators",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderForwarded, `for=198.51.100.1;host="a,b;c", for=10.2.2.2`}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "SeveralHeaderLines",
+			remoteAddr: "10.0.0.1:1234",
+			headers: [][2]string{
+				{HeaderForwarded, "for=1.2.3.4"},
+				{HeaderForwarded, "for=198.51.100.1"},
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:       "ObfuscatedStopsWalk",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderForwarded, "for=198.51.100.1, for=_hidden, for=10.2.2.2"}},
+			want:       "10.2.2.2",
+		},
+		{
+			name:       "UnknownStopsWalk",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderForwarded, "for=198.51.100.1, for=unknown"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "ElementWithoutFor",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderForwarded, "for=198.51.100.1, proto=https"}},
+			want:       "10.0.0.1",
+		},
+		{
+			name:       "IgnoresXForwardedFor",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "198.51.100.1"}},
+			want:       "10.0.0.1",
+		},
+	})
+}
+
+func TestNewTrustedHeaderIPExtractor(t *testing.T) {
+	extractors := map[string]IPExtractorFunc{
+		HeaderXRealIP:        NewXRealIPExtractor(trustedProxies...),
+		HeaderCFConnectingIP: NewCloudflareIPExtractor(trustedProxies...),
+		HeaderTrueClientIP:   NewTrueClientIPExtractor(trustedProxies...),
+	}
+
+	for header, extractor := range extractors {
+		t.Run(header, func(t *testing.T) {
+			runExtractorTests(t, extractor, []extractorTest{
+				{
+					name:       "Trusted",
+					remoteAddr: "10.0.0.1:1234",
+					headers:    [][2]string{{header, "198.51.100.1"}},
+					want:       "198.51.100.1",
+				},
+				{
+					name:       "MappedAddress",
+					remoteAddr: "10.0.0.1:1234",
+					headers:    [][2]string{{header, "::ffff:198.51.100.1"}},
+					want:       "198.51.100.1",
+				},
+				{
+					name:       "Untrusted",
+					remoteAddr: "192.0.2.1:1234",
+					headers:    [][2]string{{header, "198.51.100.1"}},
+					want:       "192.0.2.1",
+				},
+				{
+					name:       "Missing",
+					remoteAddr: "10.0.0.1:1234",
+					want:       "10.0.0.1",
+				},
+				{
+					name:       "List",
+					remoteAddr: "10.0.0.1:1234",
+					headers:    [][2]string{{header, "1.2.3.4, 198.51.100.1"}},
+					want:       "10.0.0.1",
+				},
+				{
+					name:       "OtherHeader",
+					remoteAddr: "10.0.0.1:1234",
+					headers:    [][2]string{{"X-Other-IP", "198.51.100.1"}},
+					want:       "10.0.0.1",
+				},
+			})
+		})
+	}
+}
+
+func TestNewHeaderIPExtractor(t *testing.T) {
+	runExtractorTests(t, NewHeaderIPExtractor(HeaderXForwardedFor), []extractorTest{
+		{
+			name:       "Single",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, " 198.51.100.1 "}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "Leftmost",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, "198.51.100.1, 10.2.2.2"}},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "EmptyLeftmost",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    [][2]string{{HeaderXForwardedFor, ", 10.2.2.2"}},
+		},
+		{
+			name:       "Missing",
+			remoteAddr: "10.0.0.1:1234",
+		},
+	})
+}
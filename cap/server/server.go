@@ -1,10 +1,14 @@
 package server
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	pkg "github.com/termermc/go-capjs/cap"
 	"log/slog"
+	"mime"
 	"net/http"
 	"net/netip"
 	"strings"
@@ -24,6 +28,25 @@ func NewStaticChallengeParamsChooser(params pkg.ChallengeParams) ChallengeParamC
 	}
 }
 
+// ScopeChooserFunc is a function that chooses the scope of a challenge's redeem token based on a request.
+// It is used when creating challenges, and by the siteverify endpoint to choose the scope that redeem tokens
+// must have been issued for (see WithSiteverifyScopeChooser).
+// If it returns an error, the error will be passed to the server's error handler.
+type ScopeChooserFunc func(req *http.Request) (pkg.Scope, error)
+
+// NewStaticScopeChooser creates a new ScopeChooserFunc that uses a static scope.
+// Will never return an error.
+func NewStaticScopeChooser(scope pkg.Scope) ScopeChooserFunc {
+	return func(req *http.Request) (pkg.Scope, error) {
+		return scope, nil
+	}
+}
+
+// MetadataExtractorFunc is a function that extracts the metadata to attach to a new challenge from a request.
+// The metadata is returned by the siteverify endpoint when the challenge's redeem token is used.
+// If it returns an error, the error will be passed to the server's error handler.
+type MetadataExtractorFunc func(req *http.Request) (map[string]string, error)
+
 // IPExtractorFunc is a function that extracts the client IP from a request.
 // If the function returns nil, the IP cannot be determined.
 type IPExtractorFunc func(req *http.Request) *netip.Addr
@@ -51,6 +74,10 @@ var RemoteAddrIPExtractor IPExtractorFunc = func(req *http.Request) *netip.Addr
 // If the header is not present or does not contain a valid IP, the extractor returns nil.
 // If the header is a comma-separated list, gets the leftmost entry.
 //
+// The header is trusted unconditionally, so clients can spoof their IP unless a proxy in front of the application
+// always overwrites it. For X-Forwarded-For or Forwarded headers appended to by proxies, use
+// NewTrustedProxyIPExtractor or NewForwardedIPExtractor instead.
+//
 // Example:
 // NewHeaderIPExtractor("X-Forwarded-For")
 func NewHeaderIPExtractor(header string) IPExtractorFunc {
@@ -67,11 +94,11 @@ func NewHeaderIPExtractor(header string) IPExtractorFunc {
 		if commaIdx == -1 {
 			str = val
 		} else {
-			str = str[:commaIdx]
+			str = val[:commaIdx]
 		}
 
 		// Try parsing IP.
-		addr, err := netip.ParseAddr(str)
+		addr, err := netip.ParseAddr(strings.TrimSpace(str))
 		if err != nil {
 			return nil
 		}
@@ -80,6 +107,159 @@ func NewHeaderIPExtractor(header string) IPExtractorFunc {
 	}
 }
 
+// RateLimitSubjectExtractorFunc is a function that extracts the subject to rate limit challenge creation by from a request.
+// If the function returns nil, the subject cannot be determined.
+type RateLimitSubjectExtractorFunc func(req *http.Request) *pkg.RateLimitSubject
+
+// NewIPSubjectExtractor creates a new RateLimitSubjectExtractorFunc that rate limits by the client IP
+// returned by the specified IP extractor.
+func NewIPSubjectExtractor(ipFunc IPExtractorFunc) RateLimitSubjectExtractorFunc {
+	return func(req *http.Request) *pkg.RateLimitSubject {
+		ip := ipFunc(req)
+		if ip == nil {
+			return nil
+		}
+
+		return pkg.NewIPRateLimitSubject(*ip)
+	}
+}
+
+// hashedSubject returns a rate limit subject of the specified kind whose value is the hex SHA-256 hash of value.
+func hashedSubject(kind pkg.RateLimitKind, value string) *pkg.RateLimitSubject {
+	sum := sha256.Sum256([]byte(value))
+	return &pkg.RateLimitSubject{
+		Kind:  kind,
+		Value: hex.EncodeToString(sum[:]),
+	}
+}
+
+// NewHeaderSubjectExtractor creates a new RateLimitSubjectExtractorFunc that rate limits by the value of a header,
+// such as an API key.
+// The value is hashed with SHA-256, so that secrets are not stored by the driver.
+// If the header is not present, the extractor returns nil.
+//
+// Example:
+// NewHeaderSubjectExtractor("X-API-Key", cap.RateLimitKindAPIKey)
+func NewHeaderSubjectExtractor(header string, kind pkg.RateLimitKind) RateLimitSubjectExtractorFunc {
+	return func(req *http.Request) *pkg.RateLimitSubject {
+		val := req.Header.Get(header)
+		if val == "" {
+			return nil
+		}
+
+		return hashedSubject(kind, val)
+	}
+}
+
+// NewCookieSubjectExtractor creates a new RateLimitSubjectExtractorFunc that rate limits by the value of a cookie,
+// such as a session cookie.
+// The value is hashed with SHA-256, so that secrets are not stored by the driver.
+// If the cookie is not present, the extractor returns nil.
+//
+// Example:
+// NewCookieSubjectExtractor("session", cap.RateLimitKindSession)
+func NewCookieSubjectExtractor(cookie string, kind pkg.RateLimitKind) RateLimitSubjectExtractorFunc {
+	return func(req *http.Request) *pkg.RateLimitSubject {
+		c, err := req.Cookie(cookie)
+		if err != nil || c.Value == "" {
+			return nil
+		}
+
+		return hashedSubject(kind, c.Value)
+	}
+}
+
+// NewUserSubjectExtractor creates a new RateLimitSubjectExtractorFunc that rate limits by authenticated user account.
+// The userFunc function returns the ID of the user that made the request, usually from a value that the application's
+// authentication middleware stored in the request context.
+// It returns an empty string if the request is not authenticated, in which case the extractor returns nil.
+func NewUserSubjectExtractor(userFunc func(req *http.Request) string) RateLimitSubjectExtractorFunc {
+	return func(req *http.Request) *pkg.RateLimitSubject {
+		id := userFunc(req)
+		if id == "" {
+			return nil
+		}
+
+		return &pkg.RateLimitSubject{
+			Kind:  pkg.RateLimitKindAccount,
+			Value: id,
+		}
+	}
+}
+
+// NewFallbackSubjectExtractor creates a new RateLimitSubjectExtractorFunc that returns the subject from the first
+// extractor that returns a non-nil subject.
+//
+// Example, rate limiting logged-in users by account and anonymous users by IP:
+// NewFallbackSubjectExtractor(NewUserSubjectExtractor(userID), NewIPSubjectExtractor(RemoteAddrIPExtractor))
+func NewFallbackSubjectExtractor(extractors ...RateLimitSubjectExtractorFunc) RateLimitSubjectExtractorFunc {
+	return func(req *http.Request) *pkg.RateLimitSubject {
+		for _, extractor := range extractors {
+			if subject := extractor(req); subject != nil {
+				return subject
+			}
+		}
+
+		return nil
+	}
+}
+
+// SecretValidatorFunc is a function that checks whether a secret key sent to the siteverify endpoint is valid.
+// It can use the request to determine which secret is expected, for example by using a site key path value.
+// If it returns an error, the error will be passed to the server's error handler.
+type SecretValidatorFunc func(req *http.Request, secret string) (bool, error)
+
+// NewStaticSecretValidator creates a new SecretValidatorFunc that accepts a single static secret.
+// The secret is compared in constant time.
+// Will never return an error.
+func NewStaticSecretValidator(secret string) SecretValidatorFunc {
+	expected := []byte(secret)
+
+	return func(req *http.Request, secret string) (bool, error) {
+		return subtle.ConstantTimeCompare(expected, []byte(secret)) == 1, nil
+	}
+}
+
+// ErrNoSecretValidator is passed to the server's error handler when the siteverify endpoint is called
+// without a secret validator being configured.
+var ErrNoSecretValidator = errors.New("siteverify endpoint called without a secret validator; use WithSecretValidator")
+
+// MetricsRecorder records metrics about HTTP requests to the server's handlers.
+// It is implemented by *metrics.Metrics in the cap/metrics package.
+type MetricsRecorder interface {
+	// ObserveHTTPRequest records a completed request to the handler with the specified name.
+	ObserveHTTPRequest(handler string, status int, duration time.Duration)
+}
+
+// statusRecorder is an http.ResponseWriter that records the status code written to it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument wraps the response writer to record metrics for the named handler if metrics are enabled.
+// The returned function must be called once the handler is done.
+func (s *Server) instrument(handler string, res http.ResponseWriter) (http.ResponseWriter, func()) {
+	if s.metrics == nil {
+		return res, func() {}
+	}
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: res, status: 200}
+	return rec, func() {
+		s.metrics.ObserveHTTPRequest(handler, rec.status, time.Since(start))
+	}
+}
+
 // ErrorHandlerFunc is a function that handles an error and optionally writes an HTTP response.
 // The error passed to it will never be nil.
 type ErrorHandlerFunc func(err error, res http.ResponseWriter, req *http.Request)
@@ -107,10 +287,20 @@ type ChallengeHandlerOpts struct {
 type Server struct {
 	cap *pkg.Cap
 
-	paramsFunc    ChallengeParamChooserFunc
-	validDuration time.Duration
-	ipFunc        IPExtractorFunc
-	errFunc       ErrorHandlerFunc
+	paramsFunc          ChallengeParamChooserFunc
+	scopeFunc           ScopeChooserFunc
+	staticScope         pkg.Scope
+	siteverifyScopeFunc ScopeChooserFunc
+	validDuration       time.Duration
+	redeemValidDuration time.Duration
+	metadataFunc        MetadataExtractorFunc
+	ipFunc              IPExtractorFunc
+	subjectFunc         RateLimitSubjectExtractorFunc
+	policy              *IPPolicy
+	errFunc             ErrorHandlerFunc
+	secretFunc          SecretValidatorFunc
+	metrics             MetricsRecorder
+	cors                *CORSPolicy
 }
 
 // NewServer creates a new Cap server with the specified options.
@@ -118,16 +308,30 @@ func NewServer(cap *pkg.Cap, opts ...func(h *Server)) *Server {
 	h := &Server{
 		cap: cap,
 
-		paramsFunc:    NewStaticChallengeParamsChooser(pkg.DefaultChallengeParams),
-		validDuration: pkg.DefaultValidDuration,
-		ipFunc:        nil,
-		errFunc:       defaultErrFunc,
+		paramsFunc:          NewStaticChallengeParamsChooser(pkg.DefaultChallengeParams),
+		scopeFunc:           NewStaticScopeChooser(pkg.Scope{}),
+		staticScope:         pkg.Scope{},
+		siteverifyScopeFunc: nil,
+		validDuration:       pkg.DefaultValidDuration,
+		redeemValidDuration: 0,
+		metadataFunc:        nil,
+		ipFunc:              nil,
+		subjectFunc:         nil,
+		policy:              nil,
+		errFunc:             defaultErrFunc,
+		secretFunc:          nil,
+		metrics:             nil,
+		cors:                nil,
 	}
 
 	for _, opt := range opts {
 		opt(h)
 	}
 
+	if h.siteverifyScopeFunc == nil {
+		h.siteverifyScopeFunc = NewStaticScopeChooser(h.staticScope)
+	}
+
 	return h
 }
 
@@ -149,6 +353,50 @@ func WithChallengeParamsChooser(chooser ChallengeParamChooserFunc) func(h *Serve
 	}
 }
 
+// WithScope sets the scope that redeem tokens are issued for.
+// Unless WithSiteverifyScope or WithSiteverifyScopeChooser is specified, it is also the scope that the siteverify
+// endpoint expects.
+// When not specified, redeem tokens are unscoped.
+// To specify a dynamic scope chooser, use WithScopeChooser.
+func WithScope(scope pkg.Scope) func(h *Server) {
+	return func(h *Server) {
+		h.scopeFunc = NewStaticScopeChooser(scope)
+		h.staticScope = scope
+	}
+}
+
+// WithScopeChooser sets the scope chooser used to choose the scope that redeem tokens are issued for.
+// It is called with the client's request to the challenge endpoint, so it is not used by the siteverify endpoint,
+// which is called by other servers. Use WithSiteverifyScopeChooser to choose the scope that the siteverify endpoint
+// expects, otherwise it only accepts unscoped redeem tokens.
+// When not specified, see comment on WithScope.
+func WithScopeChooser(chooser ScopeChooserFunc) func(h *Server) {
+	return func(h *Server) {
+		h.scopeFunc = chooser
+		h.staticScope = pkg.Scope{}
+	}
+}
+
+// WithSiteverifyScope sets the scope that redeem tokens passed to the siteverify endpoint must have been issued for.
+// When not specified, uses the scope set by WithScope.
+// To specify a dynamic scope chooser, use WithSiteverifyScopeChooser.
+func WithSiteverifyScope(scope pkg.Scope) func(h *Server) {
+	return func(h *Server) {
+		h.siteverifyScopeFunc = NewStaticScopeChooser(scope)
+	}
+}
+
+// WithSiteverifyScopeChooser sets the scope chooser used by the siteverify endpoint to choose the scope that redeem
+// tokens must have been issued for.
+// It is called with the server-to-server siteverify request, so it can choose the scope from a header or the path
+// that the calling server uses, but not from the client's request.
+// When not specified, see comment on WithSiteverifyScope.
+func WithSiteverifyScopeChooser(chooser ScopeChooserFunc) func(h *Server) {
+	return func(h *Server) {
+		h.siteverifyScopeFunc = chooser
+	}
+}
+
 // WithValidDuration sets the duration that a Cap challenge is valid before it expires.
 // When not specified, uses cap.DefaultValidDuration.
 func WithValidDuration(duration time.Duration) func(h *Server) {
@@ -157,6 +405,24 @@ func WithValidDuration(duration time.Duration) func(h *Server) {
 	}
 }
 
+// WithRedeemValidDuration sets the duration that a redeem token is valid after its challenge is solved.
+// A duration of zero makes redeem tokens expire with their challenges; cap.DefaultRedeemValidDuration is a reasonable
+// value to give users more time, for example to fill out a form after solving its challenge.
+// When not specified, redeem tokens expire with their challenges.
+func WithRedeemValidDuration(duration time.Duration) func(h *Server) {
+	return func(h *Server) {
+		h.redeemValidDuration = duration
+	}
+}
+
+// WithMetadataExtractor sets the function used to extract the metadata to attach to new challenges.
+// When not specified, challenges have no metadata.
+func WithMetadataExtractor(metadataFunc MetadataExtractorFunc) func(h *Server) {
+	return func(h *Server) {
+		h.metadataFunc = metadataFunc
+	}
+}
+
 // WithIPForRateLimit uses the specified IP extractor function to pass IPs to the driver for rate limiting.
 // Without an IP extractor function, the driver cannot perform rate limiting, even if it is enabled.
 func WithIPForRateLimit(ipFunc IPExtractorFunc) func(h *Server) {
@@ -165,6 +431,28 @@ func WithIPForRateLimit(ipFunc IPExtractorFunc) func(h *Server) {
 	}
 }
 
+// WithRateLimitSubject uses the specified subject extractor function to pass rate limit subjects to the driver,
+// for example to rate limit logged-in users by account instead of by IP.
+// When the extractor returns a subject, it is used for rate limiting instead of the IP from WithIPForRateLimit.
+// When it returns nil, the IP is used if available.
+func WithRateLimitSubject(subjectFunc RateLimitSubjectExtractorFunc) func(h *Server) {
+	return func(h *Server) {
+		h.subjectFunc = subjectFunc
+	}
+}
+
+// WithIPPolicy applies the specified IP policy to challenge requests before challenges are created.
+// Clients in allowed ranges receive pre-approved challenges, clients in denied ranges receive 403 Forbidden, and
+// challenge rules with params override the params chooser.
+// Pre-approved challenges are not rate limited but are stored like other challenges, unless the Cap uses stateless
+// challenges (see PolicyActionAllow).
+// The client IP is extracted with the function set by WithIPForRateLimit, so the policy is not applied without it.
+func WithIPPolicy(policy *IPPolicy) func(h *Server) {
+	return func(h *Server) {
+		h.policy = policy
+	}
+}
+
 // WithErrorHandler sets a function to handle errors in the HTTP handlers.
 // The function is called when an error occurs, such as when the Cap driver returns an error.
 func WithErrorHandler(errFunc ErrorHandlerFunc) func(h *Server) {
@@ -173,9 +461,53 @@ func WithErrorHandler(errFunc ErrorHandlerFunc) func(h *Server) {
 	}
 }
 
+// WithSecretValidator sets the function used to validate secret keys sent to the siteverify endpoint.
+// Without a secret validator, the siteverify endpoint cannot be used.
+func WithSecretValidator(secretFunc SecretValidatorFunc) func(h *Server) {
+	return func(h *Server) {
+		h.secretFunc = secretFunc
+	}
+}
+
+// WithMetrics records metrics for every request to the server's handlers using the specified recorder.
+// The recorder is usually a *metrics.Metrics from the cap/metrics package.
+func WithMetrics(recorder MetricsRecorder) func(h *Server) {
+	return func(h *Server) {
+		h.metrics = recorder
+	}
+}
+
+// WithCORS applies the specified CORS policy to the challenge and redeem handlers, so that the widget can be served
+// from a different origin than the server.
+// Preflight requests are answered by the handlers, and are not recorded in metrics.
+// The siteverify handler is meant to be called by servers, not browsers, so the policy is not applied to it.
+// When not specified, no CORS headers are set, and preflight requests are rejected with 405 Method Not Allowed.
+func WithCORS(policy *CORSPolicy) func(h *Server) {
+	return func(h *Server) {
+		h.cors = policy
+	}
+}
+
+// handleCORS applies the server's CORS policy to a request for a POST handler.
+// Returns true if the request was a preflight request, which is fully handled.
+func (s *Server) handleCORS(res http.ResponseWriter, req *http.Request) bool {
+	if s.cors == nil {
+		return false
+	}
+
+	return s.cors.handle(res, req, http.MethodPost)
+}
+
 // ChallengeHandler is the HTTP handler that issues new challenges.
 // Should be mounted on `/challenge`.
 func (s *Server) ChallengeHandler(res http.ResponseWriter, req *http.Request) {
+	if s.handleCORS(res, req) {
+		return
+	}
+
+	res, done := s.instrument("challenge", res)
+	defer done()
+
 	if req.Method != http.MethodPost {
 		res.WriteHeader(405)
 		_, _ = res.Write([]byte("method not allowed"))
@@ -189,16 +521,62 @@ func (s *Server) ChallengeHandler(res http.ResponseWriter, req *http.Request) {
 		ip = s.ipFunc(req)
 	}
 
-	params, err := s.paramsFunc(req)
+	var subject *pkg.RateLimitSubject
+	if s.subjectFunc != nil {
+		subject = s.subjectFunc(req)
+	}
+
+	var rule PolicyRule
+	var hasRule bool
+	if s.policy != nil && ip != nil {
+		rule, hasRule = s.policy.Lookup(*ip)
+	}
+
+	var params pkg.ChallengeParams
+	var err error
+	switch {
+	case hasRule && rule.Action == PolicyActionDeny:
+		res.WriteHeader(403)
+		_, _ = res.Write([]byte("forbidden"))
+		return
+	case hasRule && rule.Action == PolicyActionAllow:
+		// Pre-approved challenges are not rate limited.
+		params = PreApprovedChallengeParams
+		ip = nil
+		subject = nil
+	case hasRule && rule.Params != nil:
+		params = *rule.Params
+	default:
+		params, err = s.paramsFunc(req)
+		if err != nil {
+			s.errFunc(err, res, req)
+			return
+		}
+	}
+
+	scope, err := s.scopeFunc(req)
 	if err != nil {
 		s.errFunc(err, res, req)
 		return
 	}
 
+	var metadata map[string]string
+	if s.metadataFunc != nil {
+		metadata, err = s.metadataFunc(req)
+		if err != nil {
+			s.errFunc(err, res, req)
+			return
+		}
+	}
+
 	chalData, err := s.cap.CreateChallenge(ctx, pkg.ChallengeRequest{
-		Params:        params,
-		IP:            ip,
-		ValidDuration: s.validDuration,
+		Params:              params,
+		IP:                  ip,
+		RateLimitSubject:    subject,
+		Scope:               scope,
+		ValidDuration:       s.validDuration,
+		RedeemValidDuration: s.redeemValidDuration,
+		Metadata:            metadata,
 	})
 	if err != nil {
 		if errors.Is(err, pkg.ErrRateLimited) {
@@ -218,6 +596,13 @@ func (s *Server) ChallengeHandler(res http.ResponseWriter, req *http.Request) {
 // RedeemHandler is the HTTP handler that accepts solutions and verifies them, returning a redeem token if correct and valid.
 // Should be mounted on `/redeem`.
 func (s *Server) RedeemHandler(res http.ResponseWriter, req *http.Request) {
+	if s.handleCORS(res, req) {
+		return
+	}
+
+	res, done := s.instrument("redeem", res)
+	defer done()
+
 	if req.Method != http.MethodPost {
 		res.WriteHeader(405)
 		_, _ = res.Write([]byte("method not allowed"))
@@ -255,6 +640,9 @@ func (s *Server) RedeemHandler(res http.ResponseWriter, req *http.Request) {
 	}
 
 	ctx := req.Context()
+	if s.ipFunc != nil {
+		ctx = pkg.ContextWithClientIP(ctx, s.ipFunc(req))
+	}
 
 	redeemData, err := s.cap.VerifyChallengeSolutions(ctx, body)
 	if err != nil {
@@ -266,6 +654,14 @@ func (s *Server) RedeemHandler(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		if errors.Is(err, pkg.ErrChallengeAlreadySolved) {
+			doJson(409, redeemRes{
+				Success: false,
+				Message: "challenge already solved",
+			})
+			return
+		}
+
 		if errors.Is(err, pkg.ErrInsufficientSolutions) {
 			doJson(400, redeemRes{
 				Success: false,
@@ -293,3 +689,135 @@ func (s *Server) RedeemHandler(res http.ResponseWriter, req *http.Request) {
 	})
 	return
 }
+
+// SiteverifyHandler is the HTTP handler that allows other servers to verify and consume redeem tokens.
+// It is compatible with the Cap standalone siteverify endpoint: it accepts a JSON body (or a form body) with
+// the secret key in "secret" and the redeem token in "response", and responds with a JSON object with "success"
+// set to whether the token was valid, and "metadata" set to the metadata attached to the challenge, if any.
+// The redeem token is consumed by the request, so it cannot be verified again.
+// The redeem token must have been issued for the scope chosen by the siteverify scope chooser
+// (see WithSiteverifyScopeChooser).
+// Requires a secret validator set by WithSecretValidator.
+// Should be mounted on `/siteverify`.
+func (s *Server) SiteverifyHandler(res http.ResponseWriter, req *http.Request) {
+	res, done := s.instrument("siteverify", res)
+	defer done()
+
+	if req.Method != http.MethodPost {
+		res.WriteHeader(405)
+		_, _ = res.Write([]byte("method not allowed"))
+		return
+	}
+
+	if s.secretFunc == nil {
+		s.errFunc(ErrNoSecretValidator, res, req)
+		return
+	}
+
+	type siteverifyReq struct {
+		Secret   string `json:"secret"`
+		Response string `json:"response"`
+	}
+
+	type siteverifyRes struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error,omitempty"`
+
+		// The metadata attached to the challenge, if any.
+		Metadata map[string]string `json:"metadata,omitempty"`
+	}
+
+	doJson := func(status int, data siteverifyRes) {
+		res.Header().Set("Content-Type", "application/json")
+		res.WriteHeader(status)
+		enc := json.NewEncoder(res)
+		_ = enc.Encode(data)
+	}
+
+	// Decode request body.
+	var body siteverifyReq
+	defer func() {
+		_ = req.Body.Close()
+	}()
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		if req.ParseForm() != nil {
+			doJson(400, siteverifyRes{
+				Success: false,
+				Error:   "malformed request body",
+			})
+			return
+		}
+
+		body.Secret = req.PostForm.Get("secret")
+		body.Response = req.PostForm.Get("response")
+	} else {
+		dec := json.NewDecoder(req.Body)
+		if dec.Decode(&body) != nil {
+			doJson(400, siteverifyRes{
+				Success: false,
+				Error:   "malformed request body, expected JSON body with secret and response",
+			})
+			return
+		}
+	}
+
+	if body.Secret == "" || body.Response == "" {
+		doJson(400, siteverifyRes{
+			Success: false,
+			Error:   "missing secret or response",
+		})
+		return
+	}
+
+	isValidSecret, err := s.secretFunc(req, body.Secret)
+	if err != nil {
+		s.errFunc(err, res, req)
+		return
+	}
+	if !isValidSecret {
+		doJson(403, siteverifyRes{
+			Success: false,
+			Error:   "invalid secret",
+		})
+		return
+	}
+
+	scope, err := s.siteverifyScopeFunc(req)
+	if err != nil {
+		s.errFunc(err, res, req)
+		return
+	}
+
+	ctx := req.Context()
+
+	redemption, err := s.cap.Redeem(ctx, pkg.RedeemRequest{
+		RedeemToken: body.Response,
+		Scope:       scope,
+	})
+	if err != nil {
+		if errors.Is(err, pkg.ErrInvalidRedeemToken) {
+			doJson(200, siteverifyRes{
+				Success: false,
+				Error:   "invalid token",
+			})
+			return
+		}
+
+		if errors.Is(err, pkg.ErrScopeMismatch) {
+			doJson(200, siteverifyRes{
+				Success: false,
+				Error:   "token was issued for a different scope",
+			})
+			return
+		}
+
+		s.errFunc(err, res, req)
+		return
+	}
+
+	doJson(200, siteverifyRes{
+		Success:  true,
+		Metadata: redemption.Metadata,
+	})
+}
@@ -0,0 +1,422 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	pkg "github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/fake"
+	"github.com/termermc/go-capjs/cap/solver"
+)
+
+// testParams are cheap challenge params for tests.
+var testParams = pkg.ChallengeParams{Difficulty: 1, Count: 2, SaltSize: 8}
+
+// newRedeemToken solves a new challenge with the specified scope and metadata, and returns its redeem token.
+func newRedeemToken(t *testing.T, c *pkg.Cap, scope pkg.Scope, metadata map[string]string) string {
+	t.Helper()
+	ctx := context.Background()
+
+	chal, err := c.CreateChallenge(ctx, pkg.ChallengeRequest{
+		Params:        testParams,
+		Scope:         scope,
+		ValidDuration: time.Minute,
+		Metadata:      metadata,
+	})
+	if err != nil {
+		t.Fatalf("CreateChallenge: unexpected error: %v", err)
+	}
+
+	req, err := solver.Solve(ctx, chal.ToResponse())
+	if err != nil {
+		t.Fatalf("Solve: unexpected error: %v", err)
+	}
+
+	data, err := c.VerifyChallengeSolutions(ctx, *req)
+	if err != nil {
+		t.Fatalf("VerifyChallengeSolutions: unexpected error: %v", err)
+	}
+
+	return data.RedeemToken
+}
+
+// siteverifyResponse is the JSON body of a siteverify response.
+type siteverifyResponse struct {
+	Success  bool              `json:"success"`
+	Error    string            `json:"error"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+func TestSiteverifyHandler(t *testing.T) {
+	const secret = "s3cret"
+	scope := pkg.Scope{SiteKey: "site"}
+
+	jsonBody := func(secret string, response string) string {
+		b, _ := json.Marshal(map[string]string{"secret": secret, "response": response})
+		return string(b)
+	}
+	formBody := func(secret string, response string) string {
+		return url.Values{"secret": {secret}, "response": {response}}.Encode()
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		// body creates the request body from a fresh redeem token for the server's scope, and one for another scope.
+		body         func(token string, otherScopeToken string) string
+		reuse        bool
+		noValidator  bool
+		wantStatus   int
+		wantSuccess  bool
+		wantError    string
+		wantMetadata bool
+	}{
+		{
+			name:       "MethodNotAllowed",
+			method:     http.MethodGet,
+			body:       func(token, _ string) string { return "" },
+			wantStatus: 405,
+		},
+		{
+			name:        "NoSecretValidator",
+			method:      http.MethodPost,
+			body:        func(token, _ string) string { return jsonBody(secret, token) },
+			noValidator: true,
+			wantStatus:  500,
+		},
+		{
+			name:       "MalformedJSON",
+			method:     http.MethodPost,
+			body:       func(token, _ string) string { return "{" },
+			wantStatus: 400,
+			wantError:  "malformed request body, expected JSON body with secret and response",
+		},
+		{
+			name:       "MissingSecret",
+			method:     http.MethodPost,
+			body:       func(token, _ string) string { return jsonBody("", token) },
+			wantStatus: 400,
+			wantError:  "missing secret or response",
+		},
+		{
+			name:       "MissingResponse",
+			method:     http.MethodPost,
+			body:       func(token, _ string) string { return jsonBody(secret, "") },
+			wantStatus: 400,
+			wantError:  "missing secret or response",
+		},
+		{
+			name:       "InvalidSecret",
+			method:     http.MethodPost,
+			body:       func(token, _ string) string { return jsonBody("wrong", token) },
+			wantStatus: 403,
+			wantError:  "invalid secret",
+		},
+		{
+			name:         "ValidJSON",
+			method:       http.MethodPost,
+			contentType:  "application/json",
+			body:         func(token, _ string) string { return jsonBody(secret, token) },
+			wantStatus:   200,
+			wantSuccess:  true,
+			wantMetadata: true,
+		},
+		{
+			name:         "ValidForm",
+			method:       http.MethodPost,
+			contentType:  "application/x-www-form-urlencoded; charset=utf-8",
+			body:         func(token, _ string) string { return formBody(secret, token) },
+			wantStatus:   200,
+			wantSuccess:  true,
+			wantMetadata: true,
+		},
+		{
+			name:       "UnknownToken",
+			method:     http.MethodPost,
+			body:       func(token, _ string) string { return jsonBody(secret, "unknown") },
+			wantStatus: 200,
+			wantError:  "invalid token",
+		},
+		{
+			name:       "ReusedToken",
+			method:     http.MethodPost,
+			body:       func(token, _ string) string { return jsonBody(secret, token) },
+			reuse:      true,
+			wantStatus: 200,
+			wantError:  "invalid token",
+		},
+		{
+			name:       "ScopeMismatch",
+			method:     http.MethodPost,
+			body:       func(_, otherScopeToken string) string { return jsonBody(secret, otherScopeToken) },
+			wantStatus: 200,
+			wantError:  "token was issued for a different scope",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := pkg.NewCap(fake.NewDriver(pkg.SystemClock))
+			metadata := map[string]string{"form": "signup"}
+			token := newRedeemToken(t, c, scope, metadata)
+			otherScopeToken := newRedeemToken(t, c, pkg.Scope{SiteKey: "other"}, nil)
+
+			opts := []func(h *Server){WithScope(scope)}
+			if !tt.noValidator {
+				opts = append(opts, WithSecretValidator(NewStaticSecretValidator(secret)))
+			}
+			s := NewServer(c, opts...)
+
+			if tt.reuse {
+				if _, err := c.Redeem(context.Background(), pkg.RedeemRequest{RedeemToken: token, Scope: scope}); err != nil {
+					t.Fatalf("Redeem: unexpected error: %v", err)
+				}
+			}
+
+			req := httptest.NewRequest(tt.method, "/siteverify", strings.NewReader(tt.body(token, otherScopeToken)))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			s.SiteverifyHandler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %q)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if rec.Header().Get("Content-Type") != "application/json" {
+				return
+			}
+
+			var res siteverifyResponse
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if res.Success != tt.wantSuccess || res.Error != tt.wantError {
+				t.Errorf("response = %+v, want success %t and error %q", res, tt.wantSuccess, tt.wantError)
+			}
+			if tt.wantMetadata && !maps.Equal(res.Metadata, metadata) {
+				t.Errorf("metadata = %v, want %v", res.Metadata, metadata)
+			}
+		})
+	}
+}
+
+func TestSiteverifyScope(t *testing.T) {
+	const secret = "s3cret"
+	site := pkg.Scope{SiteKey: "site"}
+	other := pkg.Scope{SiteKey: "other"}
+
+	// headerScope chooses the scope from a header, which the client and the calling server set differently.
+	headerScope := func(req *http.Request) (pkg.Scope, error) {
+		return pkg.Scope{SiteKey: req.Header.Get("X-Site-Key")}, nil
+	}
+
+	tests := []struct {
+		name string
+		opts []func(h *Server)
+		// header is the X-Site-Key header of the siteverify request.
+		header      string
+		tokenScope  pkg.Scope
+		wantSuccess bool
+	}{
+		{"DefaultUnscoped", nil, "", pkg.Scope{}, true},
+		{"DefaultRejectsScoped", nil, "", site, false},
+		{"Scope", []func(h *Server){WithScope(site)}, "", site, true},
+		{"ScopeChooserNotUsed", []func(h *Server){WithScopeChooser(headerScope)}, "site", site, false},
+		{"ScopeChooserUnscoped", []func(h *Server){WithScopeChooser(headerScope)}, "site", pkg.Scope{}, true},
+		{"ScopeChooserAfterScope", []func(h *Server){WithScope(site), WithScopeChooser(headerScope)}, "", site, false},
+		{"SiteverifyScope", []func(h *Server){WithScopeChooser(headerScope), WithSiteverifyScope(site)}, "", site, true},
+		{"SiteverifyScopeOverridesScope", []func(h *Server){WithSiteverifyScope(other), WithScope(site)}, "", site, false},
+		{"SiteverifyScopeOther", []func(h *Server){WithSiteverifyScope(other), WithScope(site)}, "", other, true},
+		{"SiteverifyScopeChooser", []func(h *Server){WithSiteverifyScopeChooser(headerScope)}, "site", site, true},
+		{"SiteverifyScopeChooserMismatch", []func(h *Server){WithSiteverifyScopeChooser(headerScope)}, "other", site, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := pkg.NewCap(fake.NewDriver(pkg.SystemClock))
+			token := newRedeemToken(t, c, tt.tokenScope, nil)
+
+			opts := append([]func(h *Server){WithSecretValidator(NewStaticSecretValidator(secret))}, tt.opts...)
+			s := NewServer(c, opts...)
+
+			b, _ := json.Marshal(map[string]string{"secret": secret, "response": token})
+			req := httptest.NewRequest(http.MethodPost, "/siteverify", strings.NewReader(string(b)))
+			req.Header.Set("X-Site-Key", tt.header)
+			rec := httptest.NewRecorder()
+			s.SiteverifyHandler(rec, req)
+
+			var res siteverifyResponse
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if res.Success != tt.wantSuccess {
+				t.Errorf("response = %+v, want success %t", res, tt.wantSuccess)
+			}
+		})
+	}
+}
+
+func TestSiteverifyScopeChooserError(t *testing.T) {
+	errChooser := errors.New("chooser failed")
+
+	var handled error
+	s := NewServer(pkg.NewCap(fake.NewDriver(pkg.SystemClock)),
+		WithSecretValidator(NewStaticSecretValidator("s3cret")),
+		WithSiteverifyScopeChooser(func(req *http.Request) (pkg.Scope, error) {
+			return pkg.Scope{}, errChooser
+		}),
+		WithErrorHandler(func(err error, res http.ResponseWriter, req *http.Request) {
+			handled = err
+			res.WriteHeader(503)
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/siteverify", strings.NewReader(`{"secret":"s3cret","response":"b"}`))
+	rec := httptest.NewRecorder()
+	s.SiteverifyHandler(rec, req)
+
+	if rec.Code != 503 || !errors.Is(handled, errChooser) {
+		t.Errorf("got status %d and error %v, want 503 and %v", rec.Code, handled, errChooser)
+	}
+}
+
+func TestSiteverifySecretValidatorError(t *testing.T) {
+	errValidator := errors.New("validator failed")
+
+	var handled error
+	s := NewServer(pkg.NewCap(fake.NewDriver(pkg.SystemClock)),
+		WithSecretValidator(func(req *http.Request, secret string) (bool, error) {
+			return false, errValidator
+		}),
+		WithErrorHandler(func(err error, res http.ResponseWriter, req *http.Request) {
+			handled = err
+			res.WriteHeader(503)
+		}),
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/siteverify", strings.NewReader(`{"secret":"a","response":"b"}`))
+	rec := httptest.NewRecorder()
+	s.SiteverifyHandler(rec, req)
+
+	if rec.Code != 503 || !errors.Is(handled, errValidator) {
+		t.Errorf("got status %d and error %v, want 503 and %v", rec.Code, handled, errValidator)
+	}
+}
+
+func TestNewStaticSecretValidator(t *testing.T) {
+	validate := NewStaticSecretValidator("s3cret")
+
+	for secret, want := range map[string]bool{
+		"s3cret":  true,
+		"s3cret ": false,
+		"S3cret":  false,
+		"":        false,
+	} {
+		got, err := validate(httptest.NewRequest(http.MethodPost, "/", nil), secret)
+		if err != nil || got != want {
+			t.Errorf("validate(%q) = %t, %v, want %t", secret, got, err, want)
+		}
+	}
+}
+
+func TestRateLimitSubjectExtractors(t *testing.T) {
+	hashed := func(value string) string {
+		sum := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(sum[:])
+	}
+	userID := func(req *http.Request) string {
+		return req.Header.Get("X-Test-User")
+	}
+
+	tests := []struct {
+		name      string
+		extractor RateLimitSubjectExtractorFunc
+		header    http.Header
+		cookie    *http.Cookie
+		want      *pkg.RateLimitSubject
+	}{
+		{
+			name:      "IP",
+			extractor: NewIPSubjectExtractor(RemoteAddrIPExtractor),
+			want:      &pkg.RateLimitSubject{Kind: pkg.RateLimitKindIP, Value: "192.0.2.1"},
+		},
+		{
+			name:      "IPMissing",
+			extractor: NewIPSubjectExtractor(NewHeaderIPExtractor("X-Real-IP")),
+		},
+		{
+			name:      "Header",
+			extractor: NewHeaderSubjectExtractor("X-API-Key", pkg.RateLimitKindAPIKey),
+			header:    http.Header{"X-Api-Key": {"secret-key"}},
+			want:      &pkg.RateLimitSubject{Kind: pkg.RateLimitKindAPIKey, Value: hashed("secret-key")},
+		},
+		{
+			name:      "HeaderMissing",
+			extractor: NewHeaderSubjectExtractor("X-API-Key", pkg.RateLimitKindAPIKey),
+		},
+		{
+			name:      "Cookie",
+			extractor: NewCookieSubjectExtractor("session", pkg.RateLimitKindSession),
+			cookie:    &http.Cookie{Name: "session", Value: "abc"},
+			want:      &pkg.RateLimitSubject{Kind: pkg.RateLimitKindSession, Value: hashed("abc")},
+		},
+		{
+			name:      "CookieEmpty",
+			extractor: NewCookieSubjectExtractor("session", pkg.RateLimitKindSession),
+			cookie:    &http.Cookie{Name: "session", Value: ""},
+		},
+		{
+			name:      "User",
+			extractor: NewUserSubjectExtractor(userID),
+			header:    http.Header{"X-Test-User": {"42"}},
+			want:      &pkg.RateLimitSubject{Kind: pkg.RateLimitKindAccount, Value: "42"},
+		},
+		{
+			name:      "UserAnonymous",
+			extractor: NewUserSubjectExtractor(userID),
+		},
+		{
+			name:      "FallbackFirst",
+			extractor: NewFallbackSubjectExtractor(NewUserSubjectExtractor(userID), NewIPSubjectExtractor(RemoteAddrIPExtractor)),
+			header:    http.Header{"X-Test-User": {"42"}},
+			want:      &pkg.RateLimitSubject{Kind: pkg.RateLimitKindAccount, Value: "42"},
+		},
+		{
+			name:      "FallbackSecond",
+			extractor: NewFallbackSubjectExtractor(NewUserSubjectExtractor(userID), NewIPSubjectExtractor(RemoteAddrIPExtractor)),
+			want:      &pkg.RateLimitSubject{Kind: pkg.RateLimitKindIP, Value: "192.0.2.1"},
+		},
+		{
+			name:      "FallbackNone",
+			extractor: NewFallbackSubjectExtractor(NewUserSubjectExtractor(userID)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/challenge", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			maps.Copy(req.Header, tt.header)
+			if tt.cookie != nil {
+				req.AddCookie(tt.cookie)
+			}
+
+			got := tt.extractor(req)
+			if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+				t.Errorf("extractor = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
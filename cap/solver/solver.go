@@ -0,0 +1,218 @@
+package solver
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	pkg "github.com/termermc/go-capjs/cap"
+)
+
+// ErrUnsolvable is returned when a sub-challenge has no solution in the range of possible solutions,
+// the challenge's params are invalid, or the challenge uses an unknown proof-of-work scheme.
+var ErrUnsolvable = errors.New("challenge cannot be solved")
+
+// cancelCheckInterval is how many attempts are made between checks for context cancellation.
+// Other schemes than cap.SHA256Scheme are assumed to be slow, so cancellation is checked before every attempt for them.
+const cancelCheckInterval = 4096
+
+// ProgressFunc is a function that is called after each sub-challenge is solved.
+// It receives the number of solved sub-challenges and the total number of sub-challenges.
+// Calls are serialized, so the function does not need to be safe for concurrent use,
+// but it should return quickly because it blocks the solver.
+type ProgressFunc func(solved int, total int)
+
+// Solver solves Cap challenges.
+// It can be used by non-browser clients that need to pass Cap, and for end-to-end tests of Cap servers.
+type Solver struct {
+	workers  int
+	progress ProgressFunc
+	schemes  map[string]pkg.PoWScheme
+}
+
+// NewSolver creates a new Solver with the specified options.
+func NewSolver(opts ...func(s *Solver)) *Solver {
+	s := &Solver{
+		workers:  runtime.GOMAXPROCS(0),
+		progress: nil,
+		schemes: map[string]pkg.PoWScheme{
+			"":                   pkg.SHA256Scheme,
+			pkg.SHA256SchemeName: pkg.SHA256Scheme,
+		},
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.workers < 1 {
+		s.workers = 1
+	}
+
+	return s
+}
+
+// WithWorkers sets the number of goroutines used to solve sub-challenges in parallel.
+// When not specified, uses runtime.GOMAXPROCS(0).
+func WithWorkers(workers int) func(s *Solver) {
+	return func(s *Solver) {
+		s.workers = workers
+	}
+}
+
+// WithProgress sets a function to call after each sub-challenge is solved.
+func WithProgress(progress ProgressFunc) func(s *Solver) {
+	return func(s *Solver) {
+		s.progress = progress
+	}
+}
+
+// WithSchemes registers proof-of-work schemes that the solver can solve challenges for, in addition to
+// cap.SHA256Scheme.
+func WithSchemes(schemes ...pkg.PoWScheme) func(s *Solver) {
+	return func(s *Solver) {
+		for _, scheme := range schemes {
+			s.schemes[scheme.Name()] = scheme
+		}
+	}
+}
+
+// Solve solves all sub-challenges of a challenge and returns a request that can be sent to the redeem endpoint.
+// Returns ErrUnsolvable if the challenge cannot be solved.
+// Returns the context's error if it is cancelled before all sub-challenges are solved.
+func (s *Solver) Solve(ctx context.Context, chal pkg.ChallengeResponse) (*pkg.VerifySolutionsRequest, error) {
+	params := chal.Params
+	if params.Count < 0 || params.SaltSize < 0 || params.Difficulty < 0 || params.Difficulty > sha256.Size*2 {
+		return nil, ErrUnsolvable
+	}
+
+	scheme, has := s.schemes[params.Scheme]
+	if !has {
+		return nil, ErrUnsolvable
+	}
+
+	subs := pkg.DeriveSubChallenges(chal.ChallengeHash, params)
+	total := len(subs)
+	solutions := make([]uint32, total)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var next atomic.Int64
+	var progressMu sync.Mutex
+	solved := 0
+
+	var wg sync.WaitGroup
+	errs := make([]error, min(s.workers, max(total, 1)))
+	for w := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= total {
+					return
+				}
+
+				sol, err := solveSub(ctx, scheme, subs[i])
+				if err != nil {
+					errs[w] = err
+					cancel()
+					return
+				}
+				solutions[i] = sol
+
+				if s.progress != nil {
+					progressMu.Lock()
+					solved++
+					s.progress(solved, total)
+					progressMu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Prefer ErrUnsolvable over the cancellation it caused in other workers.
+	for _, err := range errs {
+		if errors.Is(err, ErrUnsolvable) {
+			return nil, err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &pkg.VerifySolutionsRequest{
+		ChallengeToken: chal.ChallengeHash,
+		Solutions:      solutions,
+	}, nil
+}
+
+// Solve solves a challenge using a Solver with default options.
+// See Solver.Solve.
+func Solve(ctx context.Context, chal pkg.ChallengeResponse) (*pkg.VerifySolutionsRequest, error) {
+	return NewSolver().Solve(ctx, chal)
+}
+
+// solveSub finds the smallest solution for a single sub-challenge.
+func solveSub(ctx context.Context, scheme pkg.PoWScheme, sub pkg.SubChallenge) (uint32, error) {
+	// Decode the target into nibbles so that digests can be compared without hex-encoding them.
+	target := make([]byte, len(sub.Target))
+	for i := 0; i < len(sub.Target); i++ {
+		n, err := strconv.ParseUint(sub.Target[i:i+1], 16, 8)
+		if err != nil {
+			return 0, ErrUnsolvable
+		}
+		target[i] = byte(n)
+	}
+
+	buf := make([]byte, len(sub.Salt), len(sub.Salt)+10)
+	copy(buf, sub.Salt)
+
+	checkInterval := uint64(cancelCheckInterval)
+	if scheme != pkg.SHA256Scheme {
+		checkInterval = 1
+	}
+
+	for nonce := uint64(0); nonce <= math.MaxUint32; nonce++ {
+		if nonce%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+		}
+
+		digest := scheme.Digest(strconv.AppendUint(buf, nonce, 10))
+		if hasNibblePrefix(&digest, target) {
+			return uint32(nonce), nil
+		}
+	}
+
+	return 0, ErrUnsolvable
+}
+
+// hasNibblePrefix returns whether the digest starts with the specified nibbles.
+func hasNibblePrefix(digest *[sha256.Size]byte, nibbles []byte) bool {
+	for i, want := range nibbles {
+		got := digest[i/2]
+		if i%2 == 0 {
+			got >>= 4
+		} else {
+			got &= 0xf
+		}
+
+		if got != want {
+			return false
+		}
+	}
+
+	return true
+}
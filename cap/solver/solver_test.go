@@ -0,0 +1,166 @@
+package solver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pkg "github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+func TestSolveRoundTrip(t *testing.T) {
+	scrypt, err := pkg.NewScryptScheme(64, 2, 1)
+	if err != nil {
+		t.Fatalf("NewScryptScheme: unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		params  pkg.ChallengeParams
+		workers int
+		scheme  pkg.PoWScheme
+	}{
+		{"Default", pkg.DefaultChallengeParams, 0, nil},
+		{"SingleWorker", pkg.ChallengeParams{Difficulty: 3, Count: 10, SaltSize: 16}, 1, nil},
+		{"MoreWorkersThanSubChallenges", pkg.ChallengeParams{Difficulty: 2, Count: 3, SaltSize: 8}, 16, nil},
+		{"ExplicitSHA256", pkg.ChallengeParams{Difficulty: 3, Count: 10, SaltSize: 32, Scheme: pkg.SHA256SchemeName}, 4, nil},
+		{"LargeSalt", pkg.ChallengeParams{Difficulty: 2, Count: 5, SaltSize: 300}, 0, nil},
+		{"ZeroCount", pkg.ChallengeParams{Difficulty: 4, Count: 0, SaltSize: 32}, 0, nil},
+		{"Scrypt", pkg.ChallengeParams{Difficulty: 2, Count: 4, SaltSize: 16, Scheme: scrypt.Name()}, 0, scrypt},
+		{"DefaultScrypt", pkg.ChallengeParams{Difficulty: 1, Count: 2, SaltSize: 16, Scheme: pkg.DefaultScryptScheme.Name()}, 0, pkg.DefaultScryptScheme},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var capOpts []func(c *pkg.Cap)
+			var opts []func(s *Solver)
+			if tt.scheme != nil {
+				capOpts = append(capOpts, pkg.WithPoWSchemes(tt.scheme))
+				opts = append(opts, WithSchemes(tt.scheme))
+			}
+			c := pkg.NewCap(fake.NewDriver(pkg.SystemClock), capOpts...)
+
+			chal, err := c.CreateChallenge(ctx, pkg.ChallengeRequest{
+				Params:        tt.params,
+				ValidDuration: time.Minute,
+			})
+			if err != nil {
+				t.Fatalf("CreateChallenge: unexpected error: %v", err)
+			}
+
+			if tt.workers > 0 {
+				opts = append(opts, WithWorkers(tt.workers))
+			}
+			req, err := NewSolver(opts...).Solve(ctx, chal.ToResponse())
+			if err != nil {
+				t.Fatalf("Solve: unexpected error: %v", err)
+			}
+			if len(req.Solutions) != tt.params.Count {
+				t.Fatalf("Solve: got %d solutions, want %d", len(req.Solutions), tt.params.Count)
+			}
+
+			data, err := c.VerifyChallengeSolutions(ctx, *req)
+			if err != nil {
+				t.Fatalf("VerifyChallengeSolutions: unexpected error: %v", err)
+			}
+
+			ok, err := c.UseRedeemToken(ctx, data.RedeemToken)
+			if err != nil || !ok {
+				t.Fatalf("UseRedeemToken: got %t, %v, want true", ok, err)
+			}
+		})
+	}
+}
+
+func TestSolveUnsolvable(t *testing.T) {
+	tests := []struct {
+		name   string
+		params pkg.ChallengeParams
+	}{
+		{"NegativeCount", pkg.ChallengeParams{Difficulty: 1, Count: -1, SaltSize: 8}},
+		{"NegativeSaltSize", pkg.ChallengeParams{Difficulty: 1, Count: 1, SaltSize: -1}},
+		{"NegativeDifficulty", pkg.ChallengeParams{Difficulty: -1, Count: 1, SaltSize: 8}},
+		{"DifficultyTooHigh", pkg.ChallengeParams{Difficulty: 65, Count: 1, SaltSize: 8}},
+		{"UnknownScheme", pkg.ChallengeParams{Difficulty: 1, Count: 1, SaltSize: 8, Scheme: "md5"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Solve(context.Background(), pkg.ChallengeResponse{
+				Params:        tt.params,
+				ChallengeHash: "token",
+			})
+			if !errors.Is(err, ErrUnsolvable) {
+				t.Errorf("Solve: error = %v, want %v", err, ErrUnsolvable)
+			}
+		})
+	}
+}
+
+func TestSolveCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := Solve(ctx, pkg.ChallengeResponse{
+		Params:        pkg.ChallengeParams{Difficulty: 16, Count: 4, SaltSize: 32},
+		ChallengeHash: "token",
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Solve: error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSolveProgress(t *testing.T) {
+	params := pkg.ChallengeParams{Difficulty: 2, Count: 20, SaltSize: 16}
+
+	var calls []int
+	s := NewSolver(WithWorkers(4), WithProgress(func(solved int, total int) {
+		if total != params.Count {
+			t.Errorf("progress: total = %d, want %d", total, params.Count)
+		}
+		calls = append(calls, solved)
+	}))
+
+	_, err := s.Solve(context.Background(), pkg.ChallengeResponse{
+		Params:        params,
+		ChallengeHash: "token",
+	})
+	if err != nil {
+		t.Fatalf("Solve: unexpected error: %v", err)
+	}
+
+	if len(calls) != params.Count {
+		t.Fatalf("progress: %d calls, want %d", len(calls), params.Count)
+	}
+	for i, solved := range calls {
+		if solved != i+1 {
+			t.Errorf("progress call %d: solved = %d, want %d", i, solved, i+1)
+		}
+	}
+}
+
+func TestHasNibblePrefix(t *testing.T) {
+	digest := [32]byte{0xab, 0xcd, 0xef}
+
+	tests := []struct {
+		nibbles []byte
+		want    bool
+	}{
+		{nil, true},
+		{[]byte{0xa}, true},
+		{[]byte{0xa, 0xb, 0xc}, true},
+		{[]byte{0xa, 0xb, 0xc, 0xd, 0xe, 0xf, 0x0}, true},
+		{[]byte{0xb}, false},
+		{[]byte{0xa, 0xc}, false},
+		{[]byte{0xa, 0xb, 0xc, 0xd, 0xe, 0xf, 0x1}, false},
+	}
+
+	for _, tt := range tests {
+		if got := hasNibblePrefix(&digest, tt.nibbles); got != tt.want {
+			t.Errorf("hasNibblePrefix(%x, %x) = %t, want %t", digest[:4], tt.nibbles, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package cap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"math"
+	"strings"
+	"time"
+)
+
+// statelessTokenPrefix is the prefix of all stateless challenge tokens.
+// It includes a version number so that the format can be changed in the future.
+const statelessTokenPrefix = "s1."
+
+// statelessPayloadSize is the size of the fixed part of a decoded stateless challenge token payload.
+// Layout (big endian):
+//   - 8 bytes: expiration UNIX millisecond timestamp
+//   - 4 bytes: difficulty
+//   - 4 bytes: count
+//   - 4 bytes: salt size
+//   - 16 bytes: random nonce
+//
+// The fixed part is followed by the scope's site key, action and audience, each prefixed with its length as a uvarint,
+// then the redeem token's valid duration in milliseconds as a uvarint, the challenge's metadata (see appendMetadata),
+// and finally the name of the challenge's proof-of-work scheme prefixed with its length as a uvarint.
+const statelessPayloadSize = 8 + 4 + 4 + 4 + 16
+
+// HMACKey is a secret key used to sign and verify tokens with HMAC-SHA256.
+// The ID is included in the tokens signed by the key so that the correct key can be found for verification
+// after keys are rotated.
+type HMACKey struct {
+	// The key ID.
+	// Must not be empty and must not contain '.'.
+	ID string
+
+	// The secret key material.
+	// Must be at least 32 bytes long, and should be generated by a cryptographically secure random source.
+	Secret []byte
+}
+
+// KeyID returns the key's ID.
+func (k HMACKey) KeyID() string {
+	return k.ID
+}
+
+// Validate returns an error wrapping ErrInvalidSigningKey if the key is not valid.
+func (k HMACKey) Validate() error {
+	if err := validateKeyID(k.ID); err != nil {
+		return err
+	}
+	if len(k.Secret) < 32 {
+		return fmt.Errorf("%w: secret must be at least 32 bytes", ErrInvalidSigningKey)
+	}
+
+	return nil
+}
+
+// sign returns the HMAC-SHA256 of the specified data.
+func (k HMACKey) sign(data string) []byte {
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// NewRandomHMACKey creates a new HMACKey with the specified ID and a random 32 byte secret.
+func NewRandomHMACKey(id string) HMACKey {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+
+	return HMACKey{
+		ID:     id,
+		Secret: secret,
+	}
+}
+
+// HMACKeyring is a Keyring of HMAC keys.
+type HMACKeyring = Keyring[HMACKey]
+
+// NewHMACKeyring creates a new keyring with the specified primary key and optional verification-only keys.
+// Returns ErrInvalidSigningKey if any of the keys are invalid.
+func NewHMACKeyring(primary HMACKey, verifyOnly ...HMACKey) (*HMACKeyring, error) {
+	return NewKeyring(primary, verifyOnly...)
+}
+
+// WithStatelessChallenges enables stateless challenges signed with the specified keyring.
+//
+// In stateless mode, challenge tokens carry the challenge params, scope and expiration time, signed with HMAC-SHA256.
+// CreateChallenge does not call the driver at all, and VerifyChallengeSolutions validates the token's signature
+// instead of looking it up.
+// The driver is only used to store the challenge once its solutions were verified, so that its redeem token can be used.
+// Redeem tokens for stateless challenges are derived from the challenge token, so re-submitting solutions for the same
+// challenge yields the same redeem token.
+//
+// Because the driver is not called when creating challenges, any rate limiting performed by the driver is not applied.
+// Use WithRateLimiter to rate limit stateless challenges.
+func WithStatelessChallenges(keyring *HMACKeyring) func(c *Cap) {
+	return func(c *Cap) {
+		c.keyring = keyring
+	}
+}
+
+// createStatelessChallenge creates a new signed challenge without storing it.
+func (s *Cap) createStatelessChallenge(req ChallengeRequest, expires time.Time) *Challenge {
+	key := s.keyring.Primary()
+
+	payload := make([]byte, statelessPayloadSize)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(expires.UnixMilli()))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(req.Params.Difficulty))
+	binary.BigEndian.PutUint32(payload[12:16], uint32(req.Params.Count))
+	binary.BigEndian.PutUint32(payload[16:20], uint32(req.Params.SaltSize))
+	s.tokens.GenerateToken(payload[20:])
+	for _, str := range []string{req.Scope.SiteKey, req.Scope.Action, req.Scope.Audience} {
+		payload = binary.AppendUvarint(payload, uint64(len(str)))
+		payload = append(payload, str...)
+	}
+	payload = binary.AppendUvarint(payload, uint64(req.RedeemValidDuration.Milliseconds()))
+	payload = appendMetadata(payload, req.Metadata)
+	payload = binary.AppendUvarint(payload, uint64(len(req.Params.Scheme)))
+	payload = append(payload, req.Params.Scheme...)
+
+	signed := statelessTokenPrefix + key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(key.sign(signed))
+
+	expires = time.UnixMilli(expires.UnixMilli())
+
+	return &Challenge{
+		ChallengeToken:      token,
+		RedeemToken:         statelessRedeemToken(key, token),
+		Params:              req.Params,
+		Scope:               req.Scope,
+		Expires:             expires,
+		RedeemValidDuration: req.RedeemValidDuration.Truncate(time.Millisecond),
+		RedeemExpires:       expires,
+		Metadata:            maps.Clone(req.Metadata),
+	}
+}
+
+// parseStatelessChallenge parses and verifies a stateless challenge token.
+// Returns nil if the token is malformed, has an invalid signature, was signed by an unknown key, or is expired.
+func (s *Cap) parseStatelessChallenge(token string) *Challenge {
+	if !strings.HasPrefix(token, statelessTokenPrefix) {
+		return nil
+	}
+
+	parts := strings.Split(token[len(statelessTokenPrefix):], ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	key, has := s.keyring.Get(parts[0])
+	if !has {
+		return nil
+	}
+
+	mac, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil
+	}
+
+	signed := token[:len(token)-len(parts[2])-1]
+	if !hmac.Equal(mac, key.sign(signed)) {
+		return nil
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || len(payload) < statelessPayloadSize {
+		return nil
+	}
+
+	var scopeFields [3]string
+	rest := payload[statelessPayloadSize:]
+	for i := range scopeFields {
+		var ok bool
+		if scopeFields[i], rest, ok = readUvarintString(rest); !ok {
+			return nil
+		}
+	}
+	redeemValidMs, size := binary.Uvarint(rest)
+	if size <= 0 || redeemValidMs > math.MaxInt64/uint64(time.Millisecond) {
+		return nil
+	}
+	metadata, rest, ok := readMetadata(rest[size:])
+	if !ok {
+		return nil
+	}
+	scheme, rest, ok := readUvarintString(rest)
+	if !ok || len(rest) != 0 {
+		return nil
+	}
+
+	expires := time.UnixMilli(int64(binary.BigEndian.Uint64(payload[0:8])))
+	if !expires.After(s.clock.Now()) {
+		return nil
+	}
+
+	return &Challenge{
+		ChallengeToken: token,
+		RedeemToken:    statelessRedeemToken(key, token),
+		Params: ChallengeParams{
+			Difficulty: int(binary.BigEndian.Uint32(payload[8:12])),
+			Count:      int(binary.BigEndian.Uint32(payload[12:16])),
+			SaltSize:   int(binary.BigEndian.Uint32(payload[16:20])),
+			Scheme:     scheme,
+		},
+		Scope: Scope{
+			SiteKey:  scopeFields[0],
+			Action:   scopeFields[1],
+			Audience: scopeFields[2],
+		},
+		Expires:             expires,
+		RedeemValidDuration: time.Duration(redeemValidMs) * time.Millisecond,
+		RedeemExpires:       expires,
+		Metadata:            metadata,
+	}
+}
+
+// statelessRedeemToken derives the redeem token for a stateless challenge token.
+// The token has the same length as randomly generated redeem tokens.
+func statelessRedeemToken(key HMACKey, challengeToken string) string {
+	return hex.EncodeToString(key.sign("redeem:" + challengeToken)[:25])
+}
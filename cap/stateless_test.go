@@ -0,0 +1,194 @@
+package cap
+
+import (
+	"encoding/base64"
+	"maps"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStatelessCap creates a Cap with stateless challenges signed by a new keyring with the specified key ID.
+// Stateless challenges are created and parsed without the driver, so it has none.
+func newStatelessCap(t *testing.T, keyID string) (*Cap, *HMACKeyring) {
+	t.Helper()
+
+	keyring, err := NewHMACKeyring(NewRandomHMACKey(keyID))
+	if err != nil {
+		t.Fatalf("NewHMACKeyring: unexpected error: %v", err)
+	}
+
+	return NewCap(nil, WithStatelessChallenges(keyring)), keyring
+}
+
+// signStatelessRaw returns a stateless challenge token with the specified encoded payload, signed with key.
+func signStatelessRaw(key HMACKey, encodedPayload string) string {
+	signed := statelessTokenPrefix + key.ID + "." + encodedPayload
+	return signed + "." + base64.RawURLEncoding.EncodeToString(key.sign(signed))
+}
+
+// signStateless returns a stateless challenge token with the specified payload, signed with key.
+func signStateless(key HMACKey, payload []byte) string {
+	return signStatelessRaw(key, base64.RawURLEncoding.EncodeToString(payload))
+}
+
+// statelessPayload decodes the payload of a stateless challenge token.
+func statelessPayload(t *testing.T, token string) []byte {
+	t.Helper()
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[2])
+	if err != nil {
+		t.Fatalf("decoding payload: %v", err)
+	}
+	return payload
+}
+
+// replacePart replaces the part of a stateless challenge token at index i, where 0 is the prefix.
+func replacePart(token string, i int, part string) string {
+	parts := strings.Split(token, ".")
+	parts[i] = part
+	return strings.Join(parts, ".")
+}
+
+// flipFirst replaces the first character of s with a different base64url character.
+// The last character is not changed, since some of its bits may be ignored when decoding.
+func flipFirst(s string) string {
+	if strings.HasPrefix(s, "A") {
+		return "B" + s[1:]
+	}
+	return "A" + s[1:]
+}
+
+func TestParseStatelessChallengeRoundTrip(t *testing.T) {
+	c, _ := newStatelessCap(t, "k1")
+	expires := time.Now().Add(time.Minute)
+
+	tests := []struct {
+		name string
+		req  ChallengeRequest
+	}{
+		{"Minimal", ChallengeRequest{Params: ChallengeParams{Difficulty: 4, Count: 50, SaltSize: 32}}},
+		{"Full", ChallengeRequest{
+			Params:              ChallengeParams{Difficulty: 2, Count: 8, SaltSize: 16, Scheme: DefaultScryptScheme.Name()},
+			Scope:               Scope{SiteKey: "site", Action: "signup", Audience: "api"},
+			RedeemValidDuration: 5*time.Minute + 1500*time.Microsecond,
+			Metadata:            map[string]string{"form": "signup", "": "empty key", "empty value": ""},
+		}},
+		{"PreApproved", ChallengeRequest{Params: ChallengeParams{}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created := c.createStatelessChallenge(tt.req, expires)
+			if !strings.HasPrefix(created.ChallengeToken, statelessTokenPrefix+"k1.") {
+				t.Fatalf("challenge token %q does not have prefix %q", created.ChallengeToken, statelessTokenPrefix+"k1.")
+			}
+
+			got := c.parseStatelessChallenge(created.ChallengeToken)
+			if got == nil {
+				t.Fatalf("parseStatelessChallenge: got nil for valid token")
+			}
+			if got.ChallengeToken != created.ChallengeToken || got.RedeemToken != created.RedeemToken {
+				t.Errorf("tokens = %q, %q, want %q, %q", got.ChallengeToken, got.RedeemToken, created.ChallengeToken, created.RedeemToken)
+			}
+			if got.Params != tt.req.Params || got.Scope != tt.req.Scope {
+				t.Errorf("params and scope = %+v, %+v, want %+v, %+v", got.Params, got.Scope, tt.req.Params, tt.req.Scope)
+			}
+			if !got.Expires.Equal(created.Expires) || !got.RedeemExpires.Equal(created.Expires) {
+				t.Errorf("Expires = %v, RedeemExpires = %v, want %v", got.Expires, got.RedeemExpires, created.Expires)
+			}
+			if want := tt.req.RedeemValidDuration.Truncate(time.Millisecond); got.RedeemValidDuration != want {
+				t.Errorf("RedeemValidDuration = %v, want %v", got.RedeemValidDuration, want)
+			}
+			if !maps.Equal(got.Metadata, tt.req.Metadata) {
+				t.Errorf("Metadata = %v, want %v", got.Metadata, tt.req.Metadata)
+			}
+		})
+	}
+}
+
+func TestParseStatelessChallengeRejects(t *testing.T) {
+	c, keyring := newStatelessCap(t, "k1")
+	key := keyring.Primary()
+	other, _ := newStatelessCap(t, "k2")
+	sameID, _ := newStatelessCap(t, "k1")
+
+	req := ChallengeRequest{
+		Params:   ChallengeParams{Difficulty: 4, Count: 50, SaltSize: 32},
+		Scope:    Scope{SiteKey: "site"},
+		Metadata: map[string]string{"form": "signup"},
+	}
+	valid := c.createStatelessChallenge(req, time.Now().Add(time.Minute)).ChallengeToken
+	payload := statelessPayload(t, valid)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"Empty", ""},
+		{"NoPrefix", strings.TrimPrefix(valid, statelessTokenPrefix)},
+		{"OtherVersion", "s2." + strings.TrimPrefix(valid, statelessTokenPrefix)},
+		{"StatefulToken", "5d1c0a6f3e9b2d7c8a4f1e6b3c9d0a2f5e8b7c4d1a3f6e9b2c"},
+		{"MissingMAC", valid[:strings.LastIndex(valid, ".")]},
+		{"ExtraPart", valid + ".x"},
+		{"TamperedPayload", replacePart(valid, 2, flipFirst(strings.Split(valid, ".")[2]))},
+		{"TamperedMAC", replacePart(valid, 3, flipFirst(strings.Split(valid, ".")[3]))},
+		{"MACNotBase64", replacePart(valid, 3, "!"+strings.Split(valid, ".")[3])},
+		{"EmptyMAC", replacePart(valid, 3, "")},
+		{"UnknownKeyID", other.createStatelessChallenge(req, time.Now().Add(time.Minute)).ChallengeToken},
+		{"RenamedKeyID", replacePart(valid, 1, "k2")},
+		{"OtherKeyWithSameID", sameID.createStatelessChallenge(req, time.Now().Add(time.Minute)).ChallengeToken},
+		{"Expired", c.createStatelessChallenge(req, time.Now().Add(-time.Millisecond)).ChallengeToken},
+		{"PayloadNotBase64", signStatelessRaw(key, "!"+strings.Split(valid, ".")[2])},
+		{"ShortPayload", signStateless(key, payload[:statelessPayloadSize-1])},
+		{"FixedPartOnly", signStateless(key, payload[:statelessPayloadSize])},
+		{"TruncatedPayload", signStateless(key, payload[:len(payload)-1])},
+		{"TrailingData", signStateless(key, append(payload[:len(payload):len(payload)], 0))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.parseStatelessChallenge(tt.token); got != nil {
+				t.Errorf("parseStatelessChallenge(%q) = %+v, want nil", tt.token, got)
+			}
+		})
+	}
+
+	// The re-signed payload is accepted, so the cases above fail because of their change only.
+	if got := c.parseStatelessChallenge(signStateless(key, payload)); got == nil {
+		t.Errorf("parseStatelessChallenge: re-signed payload was rejected")
+	}
+}
+
+func TestStatelessChallengeKeyRotation(t *testing.T) {
+	c, keyring := newStatelessCap(t, "old")
+	req := ChallengeRequest{Params: ChallengeParams{Difficulty: 4, Count: 50, SaltSize: 32}}
+	expires := time.Now().Add(time.Minute)
+
+	old := c.createStatelessChallenge(req, expires)
+
+	if err := keyring.Rotate(NewRandomHMACKey("new")); err != nil {
+		t.Fatalf("Rotate: unexpected error: %v", err)
+	}
+	rotated := c.createStatelessChallenge(req, expires)
+	if !strings.HasPrefix(rotated.ChallengeToken, statelessTokenPrefix+"new.") {
+		t.Errorf("challenge token %q is not signed with the new primary key", rotated.ChallengeToken)
+	}
+
+	// Tokens signed with the previous primary key are accepted until it is removed, and keep their redeem token.
+	got := c.parseStatelessChallenge(old.ChallengeToken)
+	if got == nil {
+		t.Fatalf("parseStatelessChallenge with old key: got nil")
+	}
+	if got.RedeemToken != old.RedeemToken {
+		t.Errorf("redeem token with old key = %q, want %q", got.RedeemToken, old.RedeemToken)
+	}
+
+	keyring.Remove("old")
+	if got := c.parseStatelessChallenge(old.ChallengeToken); got != nil {
+		t.Errorf("parseStatelessChallenge with removed key = %+v, want nil", got)
+	}
+	if got := c.parseStatelessChallenge(rotated.ChallengeToken); got == nil {
+		t.Errorf("parseStatelessChallenge with new key: got nil")
+	}
+}
@@ -3,90 +3,74 @@ package cap
 import (
 	"encoding/binary"
 	"encoding/hex"
-	"fmt"
 	"net/netip"
-	"strings"
+	"unicode"
 	"unicode/utf16"
 )
 
-// fnv1a implements the FNV-1a hash algorithm.
-func fnv1a(str string) uint32 {
-	var hash uint32 = 2166136261
-	// Convert string to runes, then to UTF-16 code units
-	runes := []rune(str)
-	utf16s := utf16.Encode(runes)
-	for _, codeUnit := range utf16s {
-		hash ^= uint32(codeUnit)
-		hash += (hash << 1) + (hash << 4) + (hash << 7) + (hash << 8) + (hash << 24)
+// fnv1aOffset is the FNV-1a offset basis.
+const fnv1aOffset uint32 = 2166136261
+
+// fnv1aString continues an FNV-1a hash with the UTF-16 code units of a string.
+func fnv1aString(hash uint32, str string) uint32 {
+	for _, r := range str {
+		if r1, r2 := utf16.EncodeRune(r); r1 != unicode.ReplacementChar || r2 != unicode.ReplacementChar {
+			// Surrogate pair.
+			hash = fnv1aUpdate(hash, uint16(r1))
+			hash = fnv1aUpdate(hash, uint16(r2))
+		} else {
+			hash = fnv1aUpdate(hash, uint16(r))
+		}
 	}
 	return hash
 }
 
-// prng generates a deterministic hex string of given length from a string seed.
-// `seed` is the initial seed value.
-// `length` is the output hex string length.
-func prng(seed string, length int) string {
-	state := fnv1a(seed)
-	var result strings.Builder
+// fnv1aUpdate continues an FNV-1a hash with a single UTF-16 code unit.
+func fnv1aUpdate(hash uint32, codeUnit uint16) uint32 {
+	hash ^= uint32(codeUnit)
+	hash += (hash << 1) + (hash << 4) + (hash << 7) + (hash << 8) + (hash << 24)
+	return hash
+}
+
+// IPPrefix returns the network prefix of an IP address, containing the significant bits specified.
+// The significant bits are applied bit by bit, so a /20 prefix keeps exactly 20 bits.
+// IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) are treated as IPv4 addresses, and zones are dropped.
+// Significant bits outside of the address length (0 to 32 for IPv4, 0 to 128 for IPv6) are clamped.
+//
+// Returns the zero netip.Prefix if the address is invalid.
+func IPPrefix(addr netip.Addr, ipV4SignificantBits int, ipV6SignificantBits int) netip.Prefix {
+	addr = addr.Unmap()
 
-	next := func() uint32 {
-		state ^= state << 13
-		state ^= state >> 17
-		state ^= state << 5
-		return state
+	bits := ipV6SignificantBits
+	if addr.Is4() {
+		bits = ipV4SignificantBits
 	}
 
-	for result.Len() < length {
-		rnd := next()
-		// Format as 8-digit hex, pad with zeros if needed
-		result.WriteString(fmt.Sprintf("%08x", rnd))
+	prefix, err := addr.Prefix(min(max(bits, 0), addr.BitLen()))
+	if err != nil {
+		return netip.Prefix{}
 	}
 
-	return result.String()[:length]
+	return prefix
 }
 
 // IpToInt64 converts an IP address to an integer, containing the significant bits specified.
 // The ipV4SignificantBits parameter must be between 0 and 32 (inclusive),
 // and the ipV6SignificantBits parameter must be between 0 and 64 (inclusive).
-// IPv6 significant bits are capped to 64 instead of 128 because properly configured IPv6 networks
-// tend not to provide smaller than /64 blocks. We also want to be able to store the IP in a 64 bit
-// integer.
+// IPv6 significant bits are capped to 64 instead of 128 so that the IP can be stored in a 64 bit integer.
+// IPv4-mapped IPv6 addresses are treated as IPv4 addresses.
 //
-// If the significant bits parameters are out of bounds, this function panics.
+// Deprecated: IpToInt64 cannot represent IPv6 prefixes longer than 64 bits.
+// Use IPPrefix, which supports full 128-bit IPv6 prefixes.
 func IpToInt64(addr *netip.Addr, ipV4SignificantBits int, ipV6SignificantBits int) (version int, integer int64) {
-	if addr.Is6() {
-		byteCount := ipV6SignificantBits / 8
-		if byteCount > 64 {
-
-		}
-
-		var beBytes [8]byte
-		for i, b := range addr.As16() {
-			if i >= byteCount {
-				break
-			}
-
-			beBytes[i] = b
-		}
-
-		version = 6
-		integer = int64(binary.BigEndian.Uint64(beBytes[:]))
-	} else {
-		byteCount := ipV4SignificantBits / 8
-		var beBytes [8]byte
-		for i, b := range addr.As4() {
-			if i >= byteCount {
-				break
-			}
-
-			beBytes[i+4] = b
-		}
-
-		version = 4
-		integer = int64(binary.BigEndian.Uint64(beBytes[:]))
+	prefix := IPPrefix(*addr, ipV4SignificantBits, min(ipV6SignificantBits, 64))
+	if prefix.Addr().Is4() {
+		b := prefix.Addr().As4()
+		return 4, int64(binary.BigEndian.Uint32(b[:]))
 	}
 
-	return
+	b := prefix.Addr().As16()
+	return 6, int64(binary.BigEndian.Uint64(b[:8]))
 }
 
 // Int64ToHex converts an int64 into a hex string.
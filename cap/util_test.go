@@ -0,0 +1,91 @@
+package cap
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestIPPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		addr   string
+		v4Bits int
+		v6Bits int
+		want   string
+	}{
+		{"IPv4Full", "192.0.2.255", 32, 64, "192.0.2.255/32"},
+		{"IPv4Byte", "192.0.2.255", 24, 64, "192.0.2.0/24"},
+		{"IPv4Slash20", "198.51.100.7", 20, 64, "198.51.96.0/20"},
+		{"IPv4Slash20Boundary", "198.51.111.255", 20, 64, "198.51.96.0/20"},
+		{"IPv4Slash20Next", "198.51.112.0", 20, 64, "198.51.112.0/20"},
+		{"IPv4Slash1", "192.0.2.1", 1, 64, "128.0.0.0/1"},
+		{"IPv4Slash31", "192.0.2.3", 31, 64, "192.0.2.2/31"},
+		{"IPv4Zero", "192.0.2.1", 0, 64, "0.0.0.0/0"},
+		{"IPv4Clamped", "192.0.2.1", 40, 64, "192.0.2.1/32"},
+		{"IPv4Negative", "192.0.2.1", -1, 64, "0.0.0.0/0"},
+		{"IPv4Mapped", "::ffff:192.0.2.1", 24, 64, "192.0.2.0/24"},
+		{"IPv4MappedUsesIPv4Bits", "::ffff:198.51.100.7", 20, 128, "198.51.96.0/20"},
+		{"IPv6Slash64", "2001:db8:1:2:3:4:5:6", 32, 64, "2001:db8:1:2::/64"},
+		{"IPv6Slash48", "2001:db8:1:2:3:4:5:6", 32, 48, "2001:db8:1::/48"},
+		{"IPv6Slash56", "2001:db8:1:2ff:3:4:5:6", 32, 56, "2001:db8:1:200::/56"},
+		{"IPv6Slash60", "2001:db8:1:2ff:3:4:5:6", 32, 60, "2001:db8:1:2f0::/60"},
+		{"IPv6Slash96", "2001:db8:1:2:3:4:5:6", 32, 96, "2001:db8:1:2:3:4::/96"},
+		{"IPv6Slash127", "2001:db8::7", 32, 127, "2001:db8::6/127"},
+		{"IPv6Full", "2001:db8:1:2:3:4:5:6", 32, 128, "2001:db8:1:2:3:4:5:6/128"},
+		{"IPv6Clamped", "2001:db8::1", 32, 200, "2001:db8::1/128"},
+		{"IPv6UsesIPv6Bits", "2001:db8::1", 8, 32, "2001:db8::/32"},
+		{"IPv6Zone", "fe80::1%eth0", 32, 64, "fe80::/64"},
+		// Only the ::ffff: prefix maps IPv4 addresses; other embeddings are IPv6 addresses.
+		{"IPv4Compatible", "::192.0.2.1", 24, 128, "::c000:201/128"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := IPPrefix(netip.MustParseAddr(tt.addr), tt.v4Bits, tt.v6Bits)
+			if got.String() != tt.want {
+				t.Errorf("IPPrefix(%s, %d, %d) = %s, want %s", tt.addr, tt.v4Bits, tt.v6Bits, got, tt.want)
+			}
+		})
+	}
+
+	if got := IPPrefix(netip.Addr{}, 32, 64); got.IsValid() {
+		t.Errorf("IPPrefix of invalid address = %s, want invalid prefix", got)
+	}
+}
+
+func TestIPPrefixMappedEqualsIPv4(t *testing.T) {
+	for _, bits := range []int{0, 8, 13, 20, 24, 31, 32} {
+		ipv4 := IPPrefix(netip.MustParseAddr("203.0.113.77"), bits, 64)
+		mapped := IPPrefix(netip.MustParseAddr("::ffff:203.0.113.77"), bits, 64)
+		if ipv4 != mapped {
+			t.Errorf("/%d: mapped address prefix %s, want %s", bits, mapped, ipv4)
+		}
+	}
+}
+
+func TestIpToInt64(t *testing.T) {
+	tests := []struct {
+		addr        string
+		v4Bits      int
+		v6Bits      int
+		wantVersion int
+		want        int64
+	}{
+		{"192.0.2.1", 32, 64, 4, 0xc0000201},
+		{"192.0.2.1", 24, 64, 4, 0xc0000200},
+		{"198.51.100.7", 20, 64, 4, 0xc6336000},
+		{"::ffff:198.51.100.7", 20, 64, 4, 0xc6336000},
+		{"2001:db8:1:2:3:4:5:6", 32, 64, 6, 0x20010db800010002},
+		{"2001:db8:1:2ff:3:4:5:6", 32, 60, 6, 0x20010db8000102f0},
+		// IPv6 significant bits are capped to 64.
+		{"2001:db8:1:2:3:4:5:6", 32, 128, 6, 0x20010db800010002},
+	}
+
+	for _, tt := range tests {
+		addr := netip.MustParseAddr(tt.addr)
+		version, got := IpToInt64(&addr, tt.v4Bits, tt.v6Bits)
+		if version != tt.wantVersion || got != tt.want {
+			t.Errorf("IpToInt64(%s, %d, %d) = %d, %#x, want %d, %#x", tt.addr, tt.v4Bits, tt.v6Bits, version, got, tt.wantVersion, tt.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package cap
+
+import (
+	"context"
+	"crypto/sha256"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultVerifyParallelism is the default maximum number of goroutines used to verify a single set of solutions.
+const DefaultVerifyParallelism = 1
+
+// minSolutionsPerWorker is the minimum number of sub-challenges each verification goroutine is given.
+// Below this, the overhead of spawning goroutines outweighs the gain.
+const minSolutionsPerWorker = 64
+
+// cancelCheckInterval is how many sub-challenges are verified between checks for context cancellation.
+const cancelCheckInterval = 16
+
+// maxDifficulty is the maximum difficulty that can be satisfied, the length of a hex-encoded digest.
+const maxDifficulty = sha256.Size * 2
+
+const hexDigits = "0123456789abcdef"
+
+// WithVerifyParallelism sets the maximum number of goroutines used to verify the solutions of a single challenge.
+// Challenges with few sub-challenges are always verified on the calling goroutine, so this only has an effect
+// on challenges with a large Count.
+// When not specified, uses DefaultVerifyParallelism.
+func WithVerifyParallelism(workers int) func(c *Cap) {
+	return func(c *Cap) {
+		c.verifyParallelism = workers
+	}
+}
+
+// xorshift advances the prng state.
+func xorshift(state uint32) uint32 {
+	state ^= state << 13
+	state ^= state >> 17
+	state ^= state << 5
+	return state
+}
+
+// fillPrngHex fills dst with the hex digits that prng would generate from a seed with the specified FNV-1a hash.
+func fillPrngHex(dst []byte, state uint32) {
+	for i := 0; i < len(dst); {
+		state = xorshift(state)
+		for shift := 28; shift >= 0 && i < len(dst); shift -= 4 {
+			dst[i] = hexDigits[(state>>shift)&0xf]
+			i++
+		}
+	}
+}
+
+// hasPrngHexPrefix returns whether the hex encoding of digest starts with the hex string that prng would
+// generate from a seed with the specified FNV-1a hash.
+// Nibbles are compared directly, without hex-encoding either value.
+func hasPrngHexPrefix(digest *[sha256.Size]byte, state uint32, length int) bool {
+	if length > maxDifficulty {
+		return false
+	}
+
+	for i := 0; i < length; {
+		state = xorshift(state)
+		for shift := 28; shift >= 0 && i < length; shift -= 4 {
+			want := byte(state>>shift) & 0xf
+
+			got := digest[i/2]
+			if i%2 == 0 {
+				got >>= 4
+			} else {
+				got &= 0xf
+			}
+
+			if got != want {
+				return false
+			}
+
+			i++
+		}
+	}
+
+	return true
+}
+
+// subChallengeSeeds returns the FNV-1a hashes of the salt and target seeds for the sub-challenge at the specified
+// 1-based index, given the hash of the challenge token.
+// They are equivalent to hashing the strings token + idx and token + idx + "d" from the offset basis.
+func subChallengeSeeds(tokenHash uint32, idx int) (saltSeed uint32, targetSeed uint32) {
+	var digits [20]byte
+	saltSeed = tokenHash
+	for _, b := range strconv.AppendInt(digits[:0], int64(idx), 10) {
+		saltSeed = fnv1aUpdate(saltSeed, uint16(b))
+	}
+
+	targetSeed = fnv1aUpdate(saltSeed, 'd')
+	return
+}
+
+// saltAndSolution fills buf with the salt generated from saltSeed, and appends the solution in decimal.
+// buf must have a capacity of at least len(buf)+10.
+func saltAndSolution(buf []byte, saltSeed uint32, solution uint32) []byte {
+	fillPrngHex(buf, saltSeed)
+	return strconv.AppendUint(buf, uint64(solution), 10)
+}
+
+// verifyRange verifies the solutions for the sub-challenges with 0-based indexes in [lo, hi).
+// It stops early if failed is set by another goroutine or ctx is cancelled.
+func verifyRange(ctx context.Context, scheme PoWScheme, tokenHash uint32, params ChallengeParams, solutions []uint32, lo int, hi int, failed *atomic.Bool) (bool, error) {
+	saltSize := max(params.SaltSize, 0)
+
+	// Salts are usually small, so SHA-256 digests are computed from a buffer on the stack.
+	// SHA256Scheme is called directly for it, since passing the buffer to an interface method would move it to the heap.
+	var stackBuf [128]byte
+	var heapBuf []byte
+	useStack := scheme == SHA256Scheme && saltSize+20 <= len(stackBuf)
+	if !useStack {
+		heapBuf = make([]byte, saltSize, saltSize+20)
+	}
+
+	for i := lo; i < hi; i++ {
+		if (i-lo)%cancelCheckInterval == 0 {
+			if failed.Load() {
+				return false, nil
+			}
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+		}
+
+		saltSeed, targetSeed := subChallengeSeeds(tokenHash, i+1)
+
+		var digest [sha256.Size]byte
+		if useStack {
+			digest = sha256.Sum256(saltAndSolution(stackBuf[:saltSize], saltSeed, solutions[i]))
+		} else {
+			digest = scheme.Digest(saltAndSolution(heapBuf, saltSeed, solutions[i]))
+		}
+
+		if !hasPrngHexPrefix(&digest, targetSeed, params.Difficulty) {
+			failed.Store(true)
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// verifySolutions verifies all solutions for a challenge, using up to the specified number of goroutines.
+// The number of solutions must be at least params.Count.
+// Returns an error only if ctx is cancelled.
+func verifySolutions(ctx context.Context, scheme PoWScheme, token string, params ChallengeParams, solutions []uint32, parallelism int) (bool, error) {
+	count := params.Count
+	tokenHash := fnv1aString(fnv1aOffset, token)
+
+	workers := min(parallelism, count/minSolutionsPerWorker)
+	if workers <= 1 {
+		var failed atomic.Bool
+		return verifyRange(ctx, scheme, tokenHash, params, solutions, 0, count, &failed)
+	}
+
+	return verifyParallel(ctx, scheme, tokenHash, params, solutions, workers)
+}
+
+// verifyParallel verifies all solutions for a challenge, split evenly between the specified number of goroutines.
+func verifyParallel(ctx context.Context, scheme PoWScheme, tokenHash uint32, params ChallengeParams, solutions []uint32, workers int) (bool, error) {
+	count := params.Count
+
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	chunk := (count + workers - 1) / workers
+	for w := 0; w < workers; w++ {
+		lo := w * chunk
+		hi := min(lo+chunk, count)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[w] = verifyRange(ctx, scheme, tokenHash, params, solutions, lo, hi, &failed)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return !failed.Load(), nil
+}
+
+// SubChallenge is one of the proof-of-work sub-challenges derived from a challenge token.
+// A solution is a number which, when appended in decimal to Salt, produces a digest (with the challenge's
+// PoWScheme) whose hex encoding starts with Target.
+type SubChallenge struct {
+	Salt   string
+	Target string
+}
+
+// DeriveSubChallenges derives the sub-challenges for a challenge token and its params, in order.
+// It uses the same derivation as the Cap.js widget and VerifyChallengeSolutions.
+func DeriveSubChallenges(token string, params ChallengeParams) []SubChallenge {
+	tokenHash := fnv1aString(fnv1aOffset, token)
+
+	subs := make([]SubChallenge, max(params.Count, 0))
+	for i := range subs {
+		saltSeed, targetSeed := subChallengeSeeds(tokenHash, i+1)
+
+		salt := make([]byte, max(params.SaltSize, 0))
+		fillPrngHex(salt, saltSeed)
+		target := make([]byte, max(params.Difficulty, 0))
+		fillPrngHex(target, targetSeed)
+
+		subs[i] = SubChallenge{
+			Salt:   string(salt),
+			Target: string(target),
+		}
+	}
+
+	return subs
+}
@@ -0,0 +1,273 @@
+package cap
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// referenceFnv1a is the FNV-1a implementation used by the verifier before it was rewritten.
+func referenceFnv1a(str string) uint32 {
+	var hash uint32 = 2166136261
+	for _, codeUnit := range utf16.Encode([]rune(str)) {
+		hash ^= uint32(codeUnit)
+		hash += (hash << 1) + (hash << 4) + (hash << 7) + (hash << 8) + (hash << 24)
+	}
+	return hash
+}
+
+// prng is the salt and target generator used by the verifier before it was rewritten, and by the Cap.js widget.
+// It generates a deterministic hex string of the given length from a string seed.
+func prng(seed string, length int) string {
+	state := referenceFnv1a(seed)
+	var result strings.Builder
+
+	next := func() uint32 {
+		state ^= state << 13
+		state ^= state >> 17
+		state ^= state << 5
+		return state
+	}
+
+	for result.Len() < length {
+		result.WriteString(fmt.Sprintf("%08x", next()))
+	}
+
+	return result.String()[:length]
+}
+
+// referenceVerify is the verifier before it was rewritten.
+// It returns the same errors as VerifyChallengeSolutions.
+func referenceVerify(token string, params ChallengeParams, solutions []uint32) error {
+	if len(solutions) < params.Count {
+		return ErrInsufficientSolutions
+	}
+
+	for i := 0; i < params.Count; i++ {
+		idx := i + 1
+		salt := prng(fmt.Sprintf("%s%d", token, idx), params.SaltSize)
+		target := prng(fmt.Sprintf("%s%dd", token, idx), params.Difficulty)
+
+		hasher := sha256.New()
+		hasher.Write([]byte(salt))
+		hasher.Write([]byte(strconv.FormatInt(int64(solutions[i]), 10)))
+		if !strings.HasPrefix(hex.EncodeToString(hasher.Sum(nil)), target) {
+			return ErrInvalidSolution
+		}
+	}
+
+	return nil
+}
+
+// referenceSolve solves a challenge by brute force using the reference derivation.
+func referenceSolve(token string, params ChallengeParams) []uint32 {
+	solutions := make([]uint32, params.Count)
+	for i := range solutions {
+		idx := i + 1
+		salt := prng(fmt.Sprintf("%s%d", token, idx), params.SaltSize)
+		target := prng(fmt.Sprintf("%s%dd", token, idx), params.Difficulty)
+
+		for n := uint32(0); ; n++ {
+			digest := sha256.Sum256([]byte(salt + strconv.FormatUint(uint64(n), 10)))
+			if strings.HasPrefix(hex.EncodeToString(digest[:]), target) {
+				solutions[i] = n
+				break
+			}
+		}
+	}
+
+	return solutions
+}
+
+// invalidSolution returns a solution that the reference verifier rejects for the sub-challenge at the 0-based index.
+func invalidSolution(t *testing.T, token string, params ChallengeParams, solutions []uint32, i int) uint32 {
+	t.Helper()
+
+	bad := make([]uint32, len(solutions))
+	copy(bad, solutions)
+	for n := solutions[i] + 1; n != solutions[i]; n++ {
+		bad[i] = n
+		if referenceVerify(token, params, bad) != nil {
+			return n
+		}
+	}
+
+	t.Fatalf("no invalid solution found for sub-challenge %d", i)
+	return 0
+}
+
+// challengeDriver is a Driver that only knows a single unexpiring challenge, so that verifyWithCap does not depend on a
+// driver implementation. Its other methods are not implemented.
+type challengeDriver struct {
+	Driver
+	challenge Challenge
+}
+
+func (d *challengeDriver) GetUnredeemedChallenge(ctx context.Context, challengeToken string) (*Challenge, error) {
+	if challengeToken != d.challenge.ChallengeToken {
+		return nil, nil
+	}
+
+	c := d.challenge
+	return &c, nil
+}
+
+func (d *challengeDriver) SolveChallenge(ctx context.Context, challengeToken string, redeemExpires time.Time) (bool, error) {
+	return challengeToken == d.challenge.ChallengeToken, nil
+}
+
+// verifyWithCap verifies solutions for a challenge with the specified token and params with Cap.VerifyChallengeSolutions.
+func verifyWithCap(t *testing.T, token string, params ChallengeParams, solutions []uint32, parallelism int) error {
+	t.Helper()
+
+	d := &challengeDriver{challenge: Challenge{
+		ChallengeToken: token,
+		RedeemToken:    "redeem-" + token,
+		Params:         params,
+		Expires:        time.Now().Add(time.Hour),
+		RedeemExpires:  time.Now().Add(time.Hour),
+	}}
+	c := NewCap(d, WithVerifyParallelism(parallelism))
+
+	_, err := c.VerifyChallengeSolutions(context.Background(), VerifySolutionsRequest{
+		ChallengeToken: token,
+		Solutions:      solutions,
+	})
+	return err
+}
+
+func TestVerifyMatchesReference(t *testing.T) {
+	type testCase struct {
+		name        string
+		token       string
+		params      ChallengeParams
+		parallelism int
+		mutate      func(t *testing.T, token string, params ChallengeParams, solutions []uint32) []uint32
+		wantErr     error
+	}
+
+	valid := func(t *testing.T, token string, params ChallengeParams, solutions []uint32) []uint32 {
+		return solutions
+	}
+	invalidAt := func(i int) func(t *testing.T, token string, params ChallengeParams, solutions []uint32) []uint32 {
+		return func(t *testing.T, token string, params ChallengeParams, solutions []uint32) []uint32 {
+			solutions[i] = invalidSolution(t, token, params, solutions, i)
+			return solutions
+		}
+	}
+	short := func(t *testing.T, token string, params ChallengeParams, solutions []uint32) []uint32 {
+		return solutions[:len(solutions)-1]
+	}
+	extra := func(t *testing.T, token string, params ChallengeParams, solutions []uint32) []uint32 {
+		return append(solutions, 12345)
+	}
+
+	tests := []testCase{
+		{"Valid", "3f2a9c1b", ChallengeParams{Difficulty: 3, Count: 20, SaltSize: 32}, 1, valid, nil},
+		{"ValidExtraSolutions", "3f2a9c1b", ChallengeParams{Difficulty: 3, Count: 20, SaltSize: 32}, 1, extra, nil},
+		{"ValidLargeSalt", "c0ffee", ChallengeParams{Difficulty: 2, Count: 10, SaltSize: 300}, 1, valid, nil},
+		{"ValidNonASCIIToken", "tök€n😀", ChallengeParams{Difficulty: 2, Count: 10, SaltSize: 16}, 1, valid, nil},
+		{"ValidOddSaltAndDifficulty", "odd", ChallengeParams{Difficulty: 1, Count: 15, SaltSize: 7}, 1, valid, nil},
+		{"ValidParallel", "parallel", ChallengeParams{Difficulty: 1, Count: 300, SaltSize: 16}, 4, valid, nil},
+		{"ValidZeroCount", "empty", ChallengeParams{Difficulty: 4, Count: 0, SaltSize: 32}, 1, valid, nil},
+		{"InvalidFirst", "3f2a9c1b", ChallengeParams{Difficulty: 3, Count: 20, SaltSize: 32}, 1, invalidAt(0), ErrInvalidSolution},
+		{"InvalidLast", "3f2a9c1b", ChallengeParams{Difficulty: 3, Count: 20, SaltSize: 32}, 1, invalidAt(19), ErrInvalidSolution},
+		{"InvalidParallel", "parallel", ChallengeParams{Difficulty: 1, Count: 300, SaltSize: 16}, 4, invalidAt(250), ErrInvalidSolution},
+		{"Short", "3f2a9c1b", ChallengeParams{Difficulty: 3, Count: 20, SaltSize: 32}, 1, short, ErrInsufficientSolutions},
+		{"ShortEmpty", "3f2a9c1b", ChallengeParams{Difficulty: 3, Count: 1, SaltSize: 32}, 1, short, ErrInsufficientSolutions},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			solutions := tt.mutate(t, tt.token, tt.params, referenceSolve(tt.token, tt.params))
+
+			refErr := referenceVerify(tt.token, tt.params, solutions)
+			if !errors.Is(refErr, tt.wantErr) && refErr != tt.wantErr {
+				t.Fatalf("reference verifier: error = %v, want %v", refErr, tt.wantErr)
+			}
+
+			err := verifyWithCap(t, tt.token, tt.params, solutions, tt.parallelism)
+			if err != refErr {
+				t.Errorf("VerifyChallengeSolutions: error = %v, reference verifier error = %v", err, refErr)
+			}
+		})
+	}
+}
+
+func TestVerifyUnsatisfiableDifficulty(t *testing.T) {
+	params := ChallengeParams{Difficulty: maxDifficulty + 1, Count: 1, SaltSize: 8}
+	solutions := []uint32{0}
+
+	if err := referenceVerify("token", params, solutions); err != ErrInvalidSolution {
+		t.Fatalf("reference verifier: error = %v, want %v", err, ErrInvalidSolution)
+	}
+	if err := verifyWithCap(t, "token", params, solutions, 1); err != ErrInvalidSolution {
+		t.Errorf("VerifyChallengeSolutions: error = %v, want %v", err, ErrInvalidSolution)
+	}
+}
+
+func TestDeriveSubChallengesMatchesReference(t *testing.T) {
+	token := "tök€n😀-derive"
+	params := ChallengeParams{Difficulty: 9, Count: 12, SaltSize: 33}
+
+	for i, sub := range DeriveSubChallenges(token, params) {
+		idx := i + 1
+		if want := prng(fmt.Sprintf("%s%d", token, idx), params.SaltSize); sub.Salt != want {
+			t.Errorf("sub-challenge %d: Salt = %q, want %q", idx, sub.Salt, want)
+		}
+		if want := prng(fmt.Sprintf("%s%dd", token, idx), params.Difficulty); sub.Target != want {
+			t.Errorf("sub-challenge %d: Target = %q, want %q", idx, sub.Target, want)
+		}
+	}
+}
+
+// benchmarkToken and benchmarkParams are the challenge verified by the benchmarks, with the default params.
+const benchmarkToken = "5d1c0a6f3e9b2d7c8a4f1e6b3c9d0a2f5e8b7c4d1a3f6e9b2c"
+
+var benchmarkParams = DefaultChallengeParams
+
+// benchmarkSolutions are the solutions to the benchmark challenge, computed once because they take a while.
+var benchmarkSolutions []uint32
+
+func solvedBenchmark(b *testing.B) []uint32 {
+	b.Helper()
+
+	if benchmarkSolutions == nil {
+		benchmarkSolutions = referenceSolve(benchmarkToken, benchmarkParams)
+	}
+
+	return benchmarkSolutions
+}
+
+func BenchmarkVerifyReference(b *testing.B) {
+	solutions := solvedBenchmark(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		if err := referenceVerify(benchmarkToken, benchmarkParams, solutions); err != nil {
+			b.Fatalf("referenceVerify: unexpected error: %v", err)
+		}
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	solutions := solvedBenchmark(b)
+	ctx := context.Background()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for b.Loop() {
+		ok, err := verifySolutions(ctx, SHA256Scheme, benchmarkToken, benchmarkParams, solutions, 1)
+		if err != nil || !ok {
+			b.Fatalf("verifySolutions: got %t, %v, want true", ok, err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/termermc/go-capjs/cap"
@@ -60,39 +61,34 @@ func main() {
 		server.WithIPForRateLimit(server.RemoteAddrIPExtractor),
 	)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
-		sendPage := func(status int, msg string) {
-			res.WriteHeader(status)
-			_, _ = fmt.Fprintf(res, page, msg)
-		}
-
-		if req.Method == http.MethodPost {
-			if err := req.ParseForm(); err != nil {
-				sendPage(400, "malformed body")
-				return
-			}
-
-			token := req.Form.Get("cap-token")
-
-			if token == "" {
-				sendPage(400, "missing cap token")
-				return
-			}
-
-			wasValid, err := capSvc.UseRedeemToken(req.Context(), token)
-			if err != nil {
-				sendPage(500, "error: "+err.Error())
-				return
-			}
+	sendPage := func(res http.ResponseWriter, status int, msg string) {
+		res.WriteHeader(status)
+		_, _ = fmt.Fprintf(res, page, msg)
+	}
 
-			if wasValid {
-				sendPage(200, "cap token was valid! success!")
+	// Form submissions are only passed to the handler if they contain a valid cap token.
+	requireToken := server.RequireToken(capSvc,
+		server.WithRejectionHandler(func(reason error, res http.ResponseWriter, req *http.Request) {
+			if errors.Is(reason, server.ErrMissingRedeemToken) {
+				sendPage(res, 400, "missing cap token")
 			} else {
-				sendPage(403, "invalid cap token")
+				sendPage(res, 403, "invalid cap token")
 			}
+		}),
+		server.WithTokenErrorHandler(func(err error, res http.ResponseWriter, req *http.Request) {
+			sendPage(res, 500, "error: "+err.Error())
+		}),
+	)
+	submitHandler := requireToken(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		sendPage(res, 200, "cap token was valid! success!")
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			submitHandler.ServeHTTP(res, req)
 		} else {
-			sendPage(200, "")
+			sendPage(res, 200, "")
 		}
 	})
 	mux.HandleFunc("/cap/challenge", capServer.ChallengeHandler)
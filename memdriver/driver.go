@@ -0,0 +1,475 @@
+package memdriver
+
+import (
+	"context"
+	"hash/maphash"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/termermc/go-capjs/cap"
+)
+
+const DefaultPruneInterval = 1 * time.Minute
+const DefaultShardCount = 32
+
+// Driver is the in-memory driver for Cap.
+// It stores challenges in sharded maps, and optionally uses them for rate limiting.
+// Challenges are lost when the process exits, so it is only suitable for single-instance deployments.
+//
+// Expired challenges are pruned by a background goroutine, which is stopped when Driver.Close is called.
+//
+// Rate limiting is supported if enabled, and counts the challenges stored for each subject in a sliding window (see
+// cap.RateLimitOptions).
+// The driver also implements cap.RateLimitStore, so it can store the state of cap.RateLimiter implementations.
+type Driver struct {
+	logger        *slog.Logger
+	pruneInterval time.Duration
+	shardCount    int
+	rlOpts        *cap.RateLimitOptions
+	clock         cap.Clock
+
+	seed   maphash.Seed
+	shards []*shard
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// entry is a stored challenge.
+// The same entry is referenced by the challenge token in one shard, and by the redeem token in another.
+type entry struct {
+	challenge  cap.Challenge
+	isSolved   atomic.Bool
+	isRedeemed atomic.Bool
+
+	// The redeem token's expiration time as a UNIX nanosecond timestamp.
+	// It is changed when the challenge is solved, so it is stored separately from the challenge.
+	redeemExpires atomic.Int64
+}
+
+// snapshot returns a copy of the entry's challenge.
+func (e *entry) snapshot() *cap.Challenge {
+	chal := e.challenge
+	chal.RedeemExpires = time.Unix(0, e.redeemExpires.Load())
+	chal.Solved = e.isSolved.Load()
+	chal.Metadata = maps.Clone(chal.Metadata)
+	return &chal
+}
+
+// isExpired returns whether both the challenge and its redeem token are expired.
+func (e *entry) isExpired(now time.Time) bool {
+	return !e.challenge.Expires.After(now) && e.redeemExpires.Load() <= now.UnixNano()
+}
+
+// reputationKey is the key used to count reputation signals.
+type reputationKey struct {
+	prefix netip.Prefix
+	signal cap.ReputationSignal
+}
+
+// rateWindow is a fixed window counter, used for reputation signals.
+type rateWindow struct {
+	count   int
+	resetAt time.Time
+}
+
+// limitState is the state of a cap.RateLimiter, stored by UpdateRateLimitState.
+type limitState struct {
+	state     []byte
+	expiresAt time.Time
+}
+
+// shard is a single partition of the driver's maps.
+type shard struct {
+	mu         sync.Mutex
+	challenges map[string]*entry
+	redeem     map[string]*entry
+	// challengeLogs are the creation times of the challenges stored for each rate limit key within the window,
+	// oldest first.
+	challengeLogs map[string][]time.Time
+	reputation    map[reputationKey]*rateWindow
+	spent         map[string]time.Time
+	limits        map[string]limitState
+}
+
+// WithLogger sets the logger.
+// When not specified, uses slog.Default.
+func WithLogger(logger *slog.Logger) func(d *Driver) {
+	return func(d *Driver) {
+		d.logger = logger
+	}
+}
+
+// WithPruneInterval sets the expired challenge prune interval.
+// When not specified, uses DefaultPruneInterval.
+func WithPruneInterval(interval time.Duration) func(d *Driver) {
+	return func(d *Driver) {
+		d.pruneInterval = interval
+	}
+}
+
+// WithShardCount sets the number of shards that challenges are partitioned into.
+// More shards reduce lock contention at the cost of memory.
+// When not specified, uses DefaultShardCount.
+func WithShardCount(count int) func(d *Driver) {
+	return func(d *Driver) {
+		d.shardCount = count
+	}
+}
+
+// WithRateLimit enables rate limiting and uses the specified options for it.
+func WithRateLimit(opts ...func(rl *cap.RateLimitOptions)) func(d *Driver) {
+	return func(d *Driver) {
+		rl := cap.NewDefaultRateLimitOptions()
+
+		for _, opt := range opts {
+			opt(rl)
+		}
+
+		d.rlOpts = rl
+	}
+}
+
+// WithClock sets the clock used to check expiration times and rate limit windows.
+// It should be the same clock that is passed to cap.WithClock.
+// When not specified, uses cap.SystemClock.
+func WithClock(clock cap.Clock) func(d *Driver) {
+	return func(d *Driver) {
+		d.clock = clock
+	}
+}
+
+// NewDriver creates a new in-memory driver with the specified options.
+// Driver.Close must be called to stop its background goroutine.
+func NewDriver(opts ...func(d *Driver)) *Driver {
+	d := &Driver{
+		logger:        slog.Default(),
+		pruneInterval: DefaultPruneInterval,
+		shardCount:    DefaultShardCount,
+		rlOpts:        nil,
+		clock:         cap.SystemClock,
+
+		seed: maphash.MakeSeed(),
+		stop: make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	if d.shardCount < 1 {
+		d.shardCount = 1
+	}
+
+	d.shards = make([]*shard, d.shardCount)
+	for i := range d.shards {
+		d.shards[i] = &shard{
+			challenges:    make(map[string]*entry),
+			redeem:        make(map[string]*entry),
+			challengeLogs: make(map[string][]time.Time),
+			reputation:    make(map[reputationKey]*rateWindow),
+			spent:         make(map[string]time.Time),
+			limits:        make(map[string]limitState),
+		}
+	}
+
+	d.wg.Add(1)
+	go d.delExpiredDaemon()
+
+	return d
+}
+
+func (d *Driver) shardFor(token string) *shard {
+	return d.shards[maphash.String(d.seed, token)%uint64(len(d.shards))]
+}
+
+func (d *Driver) shardForReputation(key reputationKey) *shard {
+	return d.shards[maphash.Comparable(d.seed, key)%uint64(len(d.shards))]
+}
+
+func (d *Driver) delExpiredDaemon() {
+	defer d.wg.Done()
+
+	t := time.NewTicker(d.pruneInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-t.C:
+		}
+
+		now := d.clock.Now()
+		count := 0
+		for _, s := range d.shards {
+			s.mu.Lock()
+			for token, e := range s.challenges {
+				if e.isExpired(now) {
+					delete(s.challenges, token)
+					count++
+				}
+			}
+			for token, e := range s.redeem {
+				if e.isExpired(now) {
+					delete(s.redeem, token)
+				}
+			}
+			if d.rlOpts != nil {
+				cutoff := now.Add(-d.rlOpts.MaxChallengesWindow)
+				for key, log := range s.challengeLogs {
+					if len(trimChallengeLog(log, cutoff)) == 0 {
+						delete(s.challengeLogs, key)
+					}
+				}
+			}
+			for key, w := range s.reputation {
+				if !w.resetAt.After(now) {
+					delete(s.reputation, key)
+				}
+			}
+			for id, expires := range s.spent {
+				if !expires.After(now) {
+					delete(s.spent, id)
+				}
+			}
+			for key, l := range s.limits {
+				if !l.expiresAt.After(now) {
+					delete(s.limits, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+
+		d.logger.Debug("deleted expired Cap challenges",
+			"service", "memdriver.Driver",
+			"count", count,
+		)
+	}
+}
+
+// Close stops the driver's background goroutine.
+// It is safe to call more than once.
+func (d *Driver) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.stop)
+	})
+	d.wg.Wait()
+
+	return nil
+}
+
+// trimChallengeLog removes the creation times that are not after cutoff from the start of log.
+func trimChallengeLog(log []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(log) && !log[i].After(cutoff) {
+		i++
+	}
+
+	return log[i:]
+}
+
+func (d *Driver) Store(ctx context.Context, challenge *cap.Challenge, subject *cap.RateLimitSubject) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Rate limit if enabled.
+	if subject != nil && d.rlOpts != nil {
+		rl := d.rlOpts
+		key := subject.Key(rl)
+		now := d.clock.Now()
+
+		s := d.shardFor(key)
+		s.mu.Lock()
+		log := trimChallengeLog(s.challengeLogs[key], now.Add(-rl.MaxChallengesWindow))
+		isLimited := len(log) >= rl.MaxChallenges(subject.Kind)
+		if !isLimited {
+			log = append(log, now)
+		}
+		if len(log) == 0 {
+			delete(s.challengeLogs, key)
+		} else {
+			s.challengeLogs[key] = log
+		}
+		s.mu.Unlock()
+
+		// Rejected challenges are not counted.
+		if isLimited {
+			return cap.ErrRateLimited
+		}
+	}
+
+	e := &entry{challenge: *challenge}
+	e.challenge.Metadata = maps.Clone(challenge.Metadata)
+	e.redeemExpires.Store(challenge.RedeemExpires.UnixNano())
+	e.isSolved.Store(challenge.Solved)
+
+	s := d.shardFor(challenge.ChallengeToken)
+	s.mu.Lock()
+	if _, has := s.challenges[challenge.ChallengeToken]; has {
+		// Already stored (and possibly redeemed).
+		s.mu.Unlock()
+		return nil
+	}
+	s.challenges[challenge.ChallengeToken] = e
+	s.mu.Unlock()
+
+	s = d.shardFor(challenge.RedeemToken)
+	s.mu.Lock()
+	s.redeem[challenge.RedeemToken] = e
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (d *Driver) GetUnredeemedChallenge(ctx context.Context, challengeToken string) (*cap.Challenge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s := d.shardFor(challengeToken)
+	s.mu.Lock()
+	e, has := s.challenges[challengeToken]
+	s.mu.Unlock()
+
+	if !has || e.isRedeemed.Load() || !e.challenge.Expires.After(d.clock.Now()) {
+		return nil, nil
+	}
+
+	return e.snapshot(), nil
+}
+
+func (d *Driver) SolveChallenge(ctx context.Context, challengeToken string, redeemExpires time.Time) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s := d.shardFor(challengeToken)
+	s.mu.Lock()
+	e, has := s.challenges[challengeToken]
+	s.mu.Unlock()
+
+	if !has || e.isRedeemed.Load() || !e.challenge.Expires.After(d.clock.Now()) {
+		return false, nil
+	}
+
+	if !e.isSolved.CompareAndSwap(false, true) {
+		return false, nil
+	}
+
+	e.redeemExpires.Store(redeemExpires.UnixNano())
+	return true, nil
+}
+
+func (d *Driver) UseRedeemToken(ctx context.Context, redeemToken string) (*cap.Challenge, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s := d.shardFor(redeemToken)
+	s.mu.Lock()
+	e, has := s.redeem[redeemToken]
+	if has {
+		delete(s.redeem, redeemToken)
+	}
+	s.mu.Unlock()
+
+	if !has || e.redeemExpires.Load() <= d.clock.Now().UnixNano() {
+		return nil, nil
+	}
+
+	if !e.isRedeemed.CompareAndSwap(false, true) {
+		return nil, nil
+	}
+
+	return e.snapshot(), nil
+}
+
+func (d *Driver) AddReputationSignal(ctx context.Context, prefix netip.Prefix, signal cap.ReputationSignal, window time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	key := reputationKey{prefix: prefix.Masked(), signal: signal}
+	now := d.clock.Now()
+
+	s := d.shardForReputation(key)
+	s.mu.Lock()
+	w, has := s.reputation[key]
+	if !has || !w.resetAt.After(now) {
+		w = &rateWindow{resetAt: now.Add(window)}
+		s.reputation[key] = w
+	}
+	w.count++
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (d *Driver) GetReputation(ctx context.Context, prefix netip.Prefix) (cap.ReputationCounts, error) {
+	var counts cap.ReputationCounts
+	if err := ctx.Err(); err != nil {
+		return counts, err
+	}
+
+	prefix = prefix.Masked()
+	now := d.clock.Now()
+
+	for _, signal := range cap.ReputationSignals {
+		key := reputationKey{prefix: prefix, signal: signal}
+
+		s := d.shardForReputation(key)
+		s.mu.Lock()
+		if w, has := s.reputation[key]; has && w.resetAt.After(now) {
+			counts.Add(signal, int64(w.count))
+		}
+		s.mu.Unlock()
+	}
+
+	return counts, nil
+}
+
+func (d *Driver) MarkTokenSpent(ctx context.Context, id string, expires time.Time) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s := d.shardFor(id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, has := s.spent[id]; has {
+		return false, nil
+	}
+	s.spent[id] = expires
+
+	return true, nil
+}
+
+func (d *Driver) UpdateRateLimitState(ctx context.Context, key string, update func(state []byte) ([]byte, time.Duration)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	now := d.clock.Now()
+
+	s := d.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var state []byte
+	if l, has := s.limits[key]; has && l.expiresAt.After(now) {
+		state = l.state
+	}
+
+	newState, ttl := update(state)
+	s.limits[key] = limitState{state: newState, expiresAt: now.Add(ttl)}
+
+	return nil
+}
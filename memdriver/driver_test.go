@@ -0,0 +1,144 @@
+package memdriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/drivertest"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+func TestConformance(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T, clock cap.Clock, rl *cap.RateLimitOptions) cap.Driver {
+		opts := []func(d *Driver){WithClock(clock)}
+		if rl != nil {
+			opts = append(opts, WithRateLimit(func(o *cap.RateLimitOptions) { *o = *rl }))
+		}
+
+		d := NewDriver(opts...)
+		t.Cleanup(func() { _ = d.Close() })
+		return d
+	})
+}
+
+func newChallenge(token string, expires time.Time) *cap.Challenge {
+	return &cap.Challenge{
+		ChallengeToken: "chal-" + token,
+		RedeemToken:    "redeem-" + token,
+		Params:         cap.DefaultChallengeParams,
+		Expires:        expires,
+		RedeemExpires:  expires,
+		Metadata:       map[string]string{"form": "signup"},
+	}
+}
+
+// countEntries returns the number of challenges and redeem tokens stored in all shards.
+func countEntries(d *Driver) (challenges int, redeem int) {
+	for _, s := range d.shards {
+		s.mu.Lock()
+		challenges += len(s.challenges)
+		redeem += len(s.redeem)
+		s.mu.Unlock()
+	}
+
+	return challenges, redeem
+}
+
+func TestShardCount(t *testing.T) {
+	tests := []struct {
+		count int
+		want  int
+	}{
+		{0, 1},
+		{-5, 1},
+		{1, 1},
+		{7, 7},
+	}
+
+	for _, tt := range tests {
+		d := NewDriver(WithShardCount(tt.count))
+		if got := len(d.shards); got != tt.want {
+			t.Errorf("WithShardCount(%d): %d shards, want %d", tt.count, got, tt.want)
+		}
+		_ = d.Close()
+	}
+
+	d := NewDriver()
+	defer d.Close()
+	if got := len(d.shards); got != DefaultShardCount {
+		t.Errorf("NewDriver: %d shards, want %d", got, DefaultShardCount)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	clock := fake.NewClock(time.Now())
+	d := NewDriver(WithClock(clock), WithPruneInterval(5*time.Millisecond), WithShardCount(4))
+	defer d.Close()
+
+	expiring := newChallenge("expiring", clock.Now().Add(time.Minute))
+	kept := newChallenge("kept", clock.Now().Add(time.Hour))
+	for _, chal := range []*cap.Challenge{expiring, kept} {
+		if err := d.Store(ctx, chal, nil); err != nil {
+			t.Fatalf("Store: unexpected error: %v", err)
+		}
+	}
+
+	clock.Advance(2 * time.Minute)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		challenges, redeem := countEntries(d)
+		if challenges == 1 && redeem == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expired challenge was not pruned: %d challenges and %d redeem tokens left, want 1 and 1", challenges, redeem)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	got, err := d.GetUnredeemedChallenge(ctx, kept.ChallengeToken)
+	if err != nil || got == nil {
+		t.Fatalf("GetUnredeemedChallenge: got %v, %v, want unexpired challenge", got, err)
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	ctx := context.Background()
+	d := NewDriver()
+	defer d.Close()
+
+	chal := newChallenge("isolated", time.Now().Add(time.Minute))
+	if err := d.Store(ctx, chal, nil); err != nil {
+		t.Fatalf("Store: unexpected error: %v", err)
+	}
+
+	// Changes to the stored or returned challenge must not affect the driver's copy.
+	chal.Metadata["form"] = "changed"
+	got, err := d.GetUnredeemedChallenge(ctx, chal.ChallengeToken)
+	if err != nil {
+		t.Fatalf("GetUnredeemedChallenge: unexpected error: %v", err)
+	}
+	got.Metadata["form"] = "changed again"
+
+	got, err = d.UseRedeemToken(ctx, chal.RedeemToken)
+	if err != nil {
+		t.Fatalf("UseRedeemToken: unexpected error: %v", err)
+	}
+	if got.Metadata["form"] != "signup" {
+		t.Errorf("UseRedeemToken: Metadata[form] = %q, want %q", got.Metadata["form"], "signup")
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	d := NewDriver()
+	if err := d.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("second Close: unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/termermc/go-capjs/memdriver
+
+go 1.25.2
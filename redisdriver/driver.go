@@ -18,12 +18,40 @@ import (
 // DefaultKeyPrefix is the default Redis key prefix to use.
 const DefaultKeyPrefix = "cap:"
 
+// redeemedMarker is the value that challenge keys are set to after their redeem token is used.
+const redeemedMarker = ""
+
+// maxRateLimitAttempts is the maximum number of times UpdateRateLimitState tries to update state that is being
+// changed concurrently.
+const maxRateLimitAttempts = 50
+
+// rateLimitScript counts a challenge in the sliding window of a rate limit subject, whose key holds a sorted set of
+// challenge tokens scored by their creation time in milliseconds.
+// It removes the challenges that left the window, and only adds the challenge if fewer than the maximum remain, so
+// that rejected challenges are not counted.
+//
+// KEYS[1] is the subject's key, and ARGV holds the current time and the window in milliseconds, the maximum number of
+// challenges, and the challenge token.
+// Returns 1 if the challenge was counted, or 0 if it is rate limited.
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+if redis.call("ZCARD", KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], now, ARGV[4])
+redis.call("PEXPIRE", KEYS[1], window)
+return 1
+`)
+
 type Driver struct {
 	client redis.UniversalClient
 
 	logger    *slog.Logger
 	rlOpts    *cap.RateLimitOptions
 	keyPrefix string
+	clock     cap.Clock
 }
 
 // WithLogger sets the logger.
@@ -35,6 +63,7 @@ func WithLogger(logger *slog.Logger) func(d *Driver) {
 }
 
 // WithRateLimit enables rate limiting and uses the specified options for it.
+// Challenges stored for each subject are counted in a sliding window (see cap.RateLimitOptions).
 func WithRateLimit(opts ...func(rl *cap.RateLimitOptions)) func(d *Driver) {
 	return func(d *Driver) {
 		rl := cap.NewDefaultRateLimitOptions()
@@ -55,6 +84,16 @@ func WithKeyPrefix(prefix string) func(d *Driver) {
 	}
 }
 
+// WithClock sets the clock used to check expiration times, to compute key TTLs and to measure rate limit windows.
+// It should be the same clock that is passed to cap.WithClock.
+// Keys are still expired by Redis according to its own clock.
+// When not specified, uses cap.SystemClock.
+func WithClock(clock cap.Clock) func(d *Driver) {
+	return func(d *Driver) {
+		d.clock = clock
+	}
+}
+
 // NewDriver creates a new Redis driver with the specified Redis connection options.
 func NewDriver(clientOpts ToRedisClient, opts ...func(d *Driver)) (*Driver, error) {
 	client := clientOpts.ToClient()
@@ -70,6 +109,7 @@ func NewDriver(clientOpts ToRedisClient, opts ...func(d *Driver)) (*Driver, erro
 		logger:    slog.Default(),
 		rlOpts:    nil,
 		keyPrefix: DefaultKeyPrefix,
+		clock:     cap.SystemClock,
 	}
 
 	for _, opt := range opts {
@@ -83,33 +123,37 @@ func (d *Driver) Close() error {
 	return d.client.Close()
 }
 
-func (d *Driver) Store(ctx context.Context, challenge *cap.Challenge, ip *netip.Addr) error {
-	if ip != nil && d.rlOpts != nil {
+func (d *Driver) Store(ctx context.Context, challenge *cap.Challenge, subject *cap.RateLimitSubject) error {
+	if subject != nil && d.rlOpts != nil {
 		// Rate limit.
 		rl := d.rlOpts
 
-		ipVer, ipInt := cap.IpToInt64(ip, rl.IPv4SignificantBits, rl.IPv6SignificantBits)
-
-		key := d.keyPrefix + "limit:" + strconv.Itoa(ipVer) + cap.Int64ToHex(ipInt)
+		// Earlier versions stored fixed window counters under "limit:" keys, which have a different type.
+		key := d.keyPrefix + "challengelimit:" + subject.Key(rl)
 
-		res, err := d.client.Incr(ctx, key).Result()
+		counted, err := rateLimitScript.Run(ctx, d.client, []string{key},
+			d.clock.Now().UnixMilli(),
+			rl.MaxChallengesWindow.Milliseconds(),
+			rl.MaxChallenges(subject.Kind),
+			challenge.ChallengeToken,
+		).Int()
 		if err != nil {
-			return fmt.Errorf(`redisdriver: failed to increment rate limit key: %w`, err)
+			return fmt.Errorf(`redisdriver: failed to count challenge for rate limit key: %w`, err)
 		}
 
-		if res == 1 {
-			// New key, set TTL.
-			err = d.client.Expire(ctx, key, rl.MaxChallengesWindow).Err()
-			if err != nil {
-				return fmt.Errorf(`redisdriver: failed to set rate limit key expiration: %w`, err)
-			}
-		}
-
-		if res > int64(rl.MaxChallengesPerIP) {
+		if counted == 0 {
 			return cap.ErrRateLimited
 		}
 	}
 
+	now := d.clock.Now()
+	expDur := challengeExpires(challenge).Sub(now)
+	redeemExpDur := challenge.RedeemExpires.Sub(now)
+	if expDur <= 0 {
+		// Already expired, so there is nothing to store.
+		return nil
+	}
+
 	// Encode challenge.
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)
@@ -121,31 +165,42 @@ func (d *Driver) Store(ctx context.Context, challenge *cap.Challenge, ip *netip.
 	chalKey := d.keyPrefix + "challenge:" + challenge.ChallengeToken
 	redeemKey := d.keyPrefix + "redeem:" + challenge.RedeemToken
 
-	expDur := time.Now().Sub(challenge.Expires)
-
-	// Set challenge and redeem token pointer to challenge.
-	_, err = d.client.TxPipelined(ctx, func(pipeline redis.Pipeliner) error {
-		err = d.client.Set(ctx, chalKey, buf.Bytes(), expDur).Err()
-		if err != nil {
-			return err
-		}
-		err = d.client.Set(ctx, redeemKey, challenge.ChallengeToken, expDur).Err()
-		if err != nil {
-			return nil
-		}
+	// Set challenge, then the redeem token pointer to challenge.
+	// If the challenge key already exists, the challenge was already stored (and possibly redeemed), so do nothing.
+	wasSet, err := d.client.SetNX(ctx, chalKey, buf.Bytes(), expDur).Result()
+	if err != nil {
+		return fmt.Errorf(`redisdriver: failed to save challenge to Redis: %w`, err)
+	}
+	if !wasSet {
+		return nil
+	}
 
+	if redeemExpDur <= 0 {
+		// The redeem token is already expired.
 		return nil
-	})
+	}
+
+	err = d.client.Set(ctx, redeemKey, challenge.ChallengeToken, redeemExpDur).Err()
 	if err != nil {
-		return fmt.Errorf(`redisdriver: failed to save challenge to Redis: %w`, err)
+		return fmt.Errorf(`redisdriver: failed to save redeem token to Redis: %w`, err)
 	}
 
 	return nil
 }
 
+// challengeExpires returns when a challenge key can expire, which is when both the challenge and its redeem token expired.
+func challengeExpires(challenge *cap.Challenge) time.Time {
+	if challenge.RedeemExpires.After(challenge.Expires) {
+		return challenge.RedeemExpires
+	}
+
+	return challenge.Expires
+}
+
 func (d *Driver) GetUnredeemedChallenge(ctx context.Context, challengeToken string) (*cap.Challenge, error) {
 	// Get challenge.
-	// We don't need to worry about checking whether it's expired or redeemed because it will be deleted in either of those cases.
+	// Challenges are kept until their redeem tokens expire, so solved challenges may be expired.
+	// Redeemed challenges are kept as empty values until they expire.
 	key := d.keyPrefix + "challenge:" + challengeToken
 	res, err := d.client.Get(ctx, key).Result()
 	if err != nil {
@@ -156,6 +211,9 @@ func (d *Driver) GetUnredeemedChallenge(ctx context.Context, challengeToken stri
 
 		return nil, fmt.Errorf(`redisdriver: failed to get challenge with token "%s": %w`, challengeToken, err)
 	}
+	if res == redeemedMarker {
+		return nil, nil
+	}
 
 	// Decode challenge.
 	var chal cap.Challenge
@@ -164,30 +222,211 @@ func (d *Driver) GetUnredeemedChallenge(ctx context.Context, challengeToken stri
 	if err != nil {
 		return nil, fmt.Errorf(`redisdriver: failed to decode challenge data for token "%s": %w`, challengeToken, err)
 	}
+	if !chal.Expires.After(d.clock.Now()) {
+		return nil, nil
+	}
 
 	return &chal, nil
 }
 
-func (d *Driver) UseRedeemToken(ctx context.Context, redeemToken string) (wasRedeemed bool, err error) {
+func (d *Driver) SolveChallenge(ctx context.Context, challengeToken string, redeemExpires time.Time) (bool, error) {
+	chalKey := d.keyPrefix + "challenge:" + challengeToken
+
+	var chal cap.Challenge
+	now := d.clock.Now()
+	err := d.client.Watch(ctx, func(tx *redis.Tx) error {
+		res, err := tx.Get(ctx, chalKey).Result()
+		if err != nil {
+			return err
+		}
+		if res == redeemedMarker {
+			return redis.Nil
+		}
+
+		dec := gob.NewDecoder(strings.NewReader(res))
+		if err = dec.Decode(&chal); err != nil {
+			return fmt.Errorf(`failed to decode challenge data: %w`, err)
+		}
+		if chal.Solved || !chal.Expires.After(now) {
+			return redis.Nil
+		}
+
+		chal.Solved = true
+		chal.RedeemExpires = redeemExpires
+
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		if err = enc.Encode(&chal); err != nil {
+			return fmt.Errorf(`failed to encode challenge: %w`, err)
+		}
+
+		// Only write the challenge if it was not solved or redeemed in the meantime.
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.SetArgs(ctx, chalKey, buf.Bytes(), redis.SetArgs{
+				Mode: "XX",
+				TTL:  challengeExpires(&chal).Sub(now),
+			})
+			return nil
+		})
+		return err
+	}, chalKey)
+	if err != nil {
+		if errors.Is(err, redis.Nil) || errors.Is(err, redis.TxFailedErr) {
+			// Nonexistent, expired, redeemed, already solved, or changed while solving.
+			return false, nil
+		}
+
+		return false, fmt.Errorf(`redisdriver: failed to solve challenge with token "%s": %w`, challengeToken, err)
+	}
+
+	// Expiring the redeem key does nothing if it was already used.
+	redeemKey := d.keyPrefix + "redeem:" + chal.RedeemToken
+	err = d.client.PExpire(ctx, redeemKey, redeemExpires.Sub(now)).Err()
+	if err != nil {
+		return false, fmt.Errorf(`redisdriver: failed to set redeem token expiration: %w`, err)
+	}
+
+	return true, nil
+}
+
+func (d *Driver) UseRedeemToken(ctx context.Context, redeemToken string) (*cap.Challenge, error) {
 	redeemKey := d.keyPrefix + "redeem:" + redeemToken
 	chalToken, err := d.client.GetDel(ctx, redeemKey).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
-			return false, nil
+			return nil, nil
 		}
 
-		return false, fmt.Errorf(`redisdriver: failed to getdel Redis entry for redeem token "%s": %w`, redeemToken, err)
+		return nil, fmt.Errorf(`redisdriver: failed to getdel Redis entry for redeem token "%s": %w`, redeemToken, err)
 	}
 
+	// Replace the challenge with the redeemed marker instead of deleting it, so that it cannot be stored again until it expires.
 	chalKey := d.keyPrefix + "challenge:" + chalToken
-	delCount, err := d.client.Del(ctx, chalKey).Result()
+	res, err := d.client.SetArgs(ctx, chalKey, redeemedMarker, redis.SetArgs{
+		Mode:    "XX",
+		KeepTTL: true,
+		Get:     true,
+	}).Result()
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
-			return false, nil
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf(`redisdriver: failed to mark challenge token "%s" as redeemed in Redis: %w`, chalToken, err)
+	}
+	if res == redeemedMarker {
+		return nil, nil
+	}
+
+	// Decode challenge.
+	var chal cap.Challenge
+	dec := gob.NewDecoder(strings.NewReader(res))
+	err = dec.Decode(&chal)
+	if err != nil {
+		return nil, fmt.Errorf(`redisdriver: failed to decode challenge data for token "%s": %w`, chalToken, err)
+	}
+
+	return &chal, nil
+}
+
+func (d *Driver) reputationKey(prefix netip.Prefix, signal cap.ReputationSignal) string {
+	return d.keyPrefix + "reputation:" + signal.String() + ":" + prefix.Masked().String()
+}
+
+func (d *Driver) AddReputationSignal(ctx context.Context, prefix netip.Prefix, signal cap.ReputationSignal, window time.Duration) error {
+	key := d.reputationKey(prefix, signal)
+
+	res, err := d.client.Incr(ctx, key).Result()
+	if err != nil {
+		return fmt.Errorf(`redisdriver: failed to increment reputation key: %w`, err)
+	}
+
+	if res == 1 {
+		// New key, set TTL.
+		err = d.client.Expire(ctx, key, window).Err()
+		if err != nil {
+			return fmt.Errorf(`redisdriver: failed to set reputation key expiration: %w`, err)
+		}
+	}
+
+	return nil
+}
+
+func (d *Driver) GetReputation(ctx context.Context, prefix netip.Prefix) (cap.ReputationCounts, error) {
+	var counts cap.ReputationCounts
+
+	keys := make([]string, len(cap.ReputationSignals))
+	for i, signal := range cap.ReputationSignals {
+		keys[i] = d.reputationKey(prefix, signal)
+	}
+
+	vals, err := d.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return counts, fmt.Errorf(`redisdriver: failed to get reputation keys: %w`, err)
+	}
+
+	for i, val := range vals {
+		str, ok := val.(string)
+		if !ok {
+			// Nonexistent or expired key.
+			continue
+		}
+
+		count, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return counts, fmt.Errorf(`redisdriver: invalid reputation count in key "%s": %w`, keys[i], err)
+		}
+
+		counts.Add(cap.ReputationSignals[i], count)
+	}
+
+	return counts, nil
+}
+
+func (d *Driver) MarkTokenSpent(ctx context.Context, id string, expires time.Time) (bool, error) {
+	expDur := expires.Sub(d.clock.Now())
+	if expDur <= 0 {
+		// Expired tokens cannot be used anyway.
+		return false, nil
+	}
+
+	key := d.keyPrefix + "spent:" + id
+	wasSet, err := d.client.SetNX(ctx, key, "", expDur).Result()
+	if err != nil {
+		return false, fmt.Errorf(`redisdriver: failed to mark token "%s" as spent: %w`, id, err)
+	}
+
+	return wasSet, nil
+}
+
+func (d *Driver) UpdateRateLimitState(ctx context.Context, key string, update func(state []byte) ([]byte, time.Duration)) error {
+	limitKey := d.keyPrefix + "ratelimit:" + key
+
+	for range maxRateLimitAttempts {
+		err := d.client.Watch(ctx, func(tx *redis.Tx) error {
+			state, err := tx.Get(ctx, limitKey).Bytes()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+
+			newState, ttl := update(state)
+
+			// Only write the state if it was not changed in the meantime.
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, limitKey, newState, ttl)
+				return nil
+			})
+			return err
+		}, limitKey)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, redis.TxFailedErr) {
+			return fmt.Errorf(`redisdriver: failed to update rate limit state for key "%s": %w`, key, err)
 		}
 
-		return false, fmt.Errorf(`redisdriver: failed to delete challenge token "%s" key in Redis: %w`, chalToken, err)
+		// Changed concurrently, try again.
 	}
 
-	return delCount > 0, nil
+	return fmt.Errorf(`redisdriver: rate limit state for key "%s" was changed concurrently %d times`, key, maxRateLimitAttempts)
 }
@@ -0,0 +1,56 @@
+package redisdriver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/drivertest"
+)
+
+// testClientOpt returns the options of the Redis server to test against.
+// The server's address is read from the REDIS_ADDR environment variable, and defaults to localhost:6379.
+func testClientOpt() RedisClientOpt {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+
+	return RedisClientOpt{
+		Addr:        addr,
+		DialTimeout: 1 * time.Second,
+	}
+}
+
+func TestConformance(t *testing.T) {
+	probe, err := NewDriver(testClientOpt())
+	if err != nil {
+		t.Skipf("no Redis server reachable, set REDIS_ADDR to run the conformance tests: %v", err)
+	}
+	_ = probe.Close()
+
+	// Redis expires keys and rate limit windows by its own clock, so the suite has to wait in real time.
+	drivertest.Run(t, func(t *testing.T, clock cap.Clock, rl *cap.RateLimitOptions) cap.Driver {
+		// Each test gets its own key prefix, so that tests do not see each other's keys.
+		b := make([]byte, 8)
+		_, _ = rand.Read(b)
+
+		opts := []func(d *Driver){
+			WithClock(clock),
+			WithKeyPrefix("cap-test:" + hex.EncodeToString(b) + ":"),
+		}
+		if rl != nil {
+			opts = append(opts, WithRateLimit(func(o *cap.RateLimitOptions) { *o = *rl }))
+		}
+
+		d, err := NewDriver(testClientOpt(), opts...)
+		if err != nil {
+			t.Fatalf("NewDriver: unexpected error: %v", err)
+		}
+		t.Cleanup(func() { _ = d.Close() })
+		return d
+	}, drivertest.WithRealTime())
+}
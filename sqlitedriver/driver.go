@@ -3,10 +3,12 @@ package sqlitedriver
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/netip"
+	"sync"
 	"time"
 
 	"github.com/termermc/go-capjs/cap"
@@ -15,25 +17,48 @@ import (
 
 const DefaultPruneInterval = 1 * time.Minute
 
+// maxRateLimitAttempts is the maximum number of times UpdateRateLimitState tries to update state that is being
+// changed concurrently.
+const maxRateLimitAttempts = 10
+
 // Driver is the SQLite driver for Cap.
 // It stores challenges in an SQLite database, and optionally uses it for rate limiting.
 //
 // Note that the DB used to create the Driver will be closed when Driver.Close is called.
 // The DB should be in WAL mode for ideal performance.
 //
-// Rate limiting is supported if enabled, and uses a sliding window algorithm.
+// Rate limiting is supported if enabled, and counts the challenges stored for each subject in a sliding window (see
+// cap.RateLimitOptions).
+// The driver also implements cap.RateLimitStore, so it can store the state of cap.RateLimiter implementations.
 type Driver struct {
 	sqlite *sql.DB
 
 	logger        *slog.Logger
 	pruneInterval time.Duration
 	rlOpts        *cap.RateLimitOptions
-
-	delExpiredStmt     *sql.Stmt
-	insertStmt         *sql.Stmt
-	getIPCountStmt     *sql.Stmt
-	getUnredeemedStmt  *sql.Stmt
-	useRedeemTokenStmt *sql.Stmt
+	clock         cap.Clock
+
+	delExpiredStmt      *sql.Stmt
+	insertStmt          *sql.Stmt
+	getSubjectCountStmt *sql.Stmt
+	getUnredeemedStmt   *sql.Stmt
+	solveStmt           *sql.Stmt
+	useRedeemTokenStmt  *sql.Stmt
+
+	delExpiredReputationStmt *sql.Stmt
+	addReputationStmt        *sql.Stmt
+	getReputationStmt        *sql.Stmt
+
+	delExpiredSpentStmt *sql.Stmt
+	insertSpentStmt     *sql.Stmt
+
+	// limitMu serializes rate limit state updates made by this driver.
+	// Updates made by other processes using the same database are detected with compare-and-swap.
+	limitMu             sync.Mutex
+	delExpiredLimitStmt *sql.Stmt
+	getLimitStmt        *sql.Stmt
+	insertLimitStmt     *sql.Stmt
+	updateLimitStmt     *sql.Stmt
 
 	isClosed bool
 }
@@ -67,6 +92,15 @@ func WithRateLimit(opts ...func(rl *cap.RateLimitOptions)) func(d *Driver) {
 	}
 }
 
+// WithClock sets the clock used to check expiration times and rate limit windows.
+// It should be the same clock that is passed to cap.WithClock.
+// When not specified, uses cap.SystemClock.
+func WithClock(clock cap.Clock) func(d *Driver) {
+	return func(d *Driver) {
+		d.clock = clock
+	}
+}
+
 // NewDriver creates a new SQLite driver with the specified DB and options.
 // Note that the DB passed in will be closed when Driver.Close is called.
 func NewDriver(sqlite *sql.DB, opts ...func(d *Driver)) (*Driver, error) {
@@ -76,6 +110,7 @@ func NewDriver(sqlite *sql.DB, opts ...func(d *Driver)) (*Driver, error) {
 		logger:        slog.Default(),
 		pruneInterval: DefaultPruneInterval,
 		rlOpts:        nil,
+		clock:         cap.SystemClock,
 	}
 
 	for _, opt := range opts {
@@ -86,7 +121,11 @@ func NewDriver(sqlite *sql.DB, opts ...func(d *Driver)) (*Driver, error) {
 		return nil, err
 	}
 
-	stmt, err := sqlite.Prepare("delete from cap_challenge where expires_ts < ?")
+	// Challenges are rate limited by counting stored challenges, so they are kept until they leave the window.
+	stmt, err := sqlite.Prepare(`
+		delete from cap_challenge
+		where expires_ts < ? and redeem_expires_ts < ? and (rate_limit_key is null or created_ts <= ?)
+	`)
 	if err != nil {
 		return nil, err
 	}
@@ -99,21 +138,30 @@ func NewDriver(sqlite *sql.DB, opts ...func(d *Driver)) (*Driver, error) {
 		    challenge_difficulty,
 		    challenge_count,
 		    challenge_salt_size,
-		    ip_version,
-		    ip_significant_bits,
-		    expires_ts
-		) values (?, ?, ?, ?, ?, ?, ?, ?)
+		    challenge_scheme,
+		    rate_limit_key,
+		    scope_site_key,
+		    scope_action,
+		    scope_audience,
+		    expires_ts,
+		    redeem_valid_ms,
+		    redeem_expires_ts,
+		    metadata,
+		    is_solved,
+		    created_ts
+		) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		on conflict do nothing
 	`)
 	if err != nil {
 		return nil, err
 	}
 	d.insertStmt = stmt
 
-	stmt, err = sqlite.Prepare("select count(*) from cap_challenge where ip_version = ? and ip_significant_bits = ? and expires_ts > ?")
+	stmt, err = sqlite.Prepare("select count(*) from cap_challenge where rate_limit_key = ? and created_ts > ?")
 	if err != nil {
 		return nil, err
 	}
-	d.getIPCountStmt = stmt
+	d.getSubjectCountStmt = stmt
 
 	stmt, err = sqlite.Prepare(`
 		select
@@ -121,7 +169,15 @@ func NewDriver(sqlite *sql.DB, opts ...func(d *Driver)) (*Driver, error) {
 		    challenge_difficulty,
 		    challenge_count,
 		    challenge_salt_size,
-		    expires_ts
+		    challenge_scheme,
+		    scope_site_key,
+		    scope_action,
+		    scope_audience,
+		    expires_ts,
+		    redeem_valid_ms,
+		    redeem_expires_ts,
+		    metadata,
+		    is_solved
 		from cap_challenge
 		where
 			challenge_token = ? and
@@ -133,19 +189,109 @@ func NewDriver(sqlite *sql.DB, opts ...func(d *Driver)) (*Driver, error) {
 	}
 	d.getUnredeemedStmt = stmt
 
+	stmt, err = sqlite.Prepare(`
+		update cap_challenge
+		set
+		    is_solved = 1,
+		    redeem_expires_ts = ?
+		where
+		    challenge_token = ? and
+		    is_solved = 0 and
+		    is_redeemed = 0 and
+		    expires_ts > ?
+	`)
+	if err != nil {
+		return nil, err
+	}
+	d.solveStmt = stmt
+
 	stmt, err = sqlite.Prepare(`
 		update cap_challenge
 		set is_redeemed = 1
 		where
 		    redeem_token = ? and
 		    is_redeemed = 0 and
-		    expires_ts > ?
+		    redeem_expires_ts > ?
+		returning
+		    challenge_token,
+		    challenge_difficulty,
+		    challenge_count,
+		    challenge_salt_size,
+		    challenge_scheme,
+		    scope_site_key,
+		    scope_action,
+		    scope_audience,
+		    expires_ts,
+		    redeem_valid_ms,
+		    redeem_expires_ts,
+		    metadata,
+		    is_solved
 	`)
 	if err != nil {
 		return nil, err
 	}
 	d.useRedeemTokenStmt = stmt
 
+	stmt, err = sqlite.Prepare("delete from cap_reputation where expires_ts < ?")
+	if err != nil {
+		return nil, err
+	}
+	d.delExpiredReputationStmt = stmt
+
+	stmt, err = sqlite.Prepare(`
+		insert into cap_reputation (prefix, signal, count, expires_ts)
+		values (?, ?, 1, ?)
+		on conflict (prefix, signal) do update set
+			count = case when expires_ts > ? then count + 1 else 1 end,
+			expires_ts = case when expires_ts > ? then expires_ts else excluded.expires_ts end
+	`)
+	if err != nil {
+		return nil, err
+	}
+	d.addReputationStmt = stmt
+
+	stmt, err = sqlite.Prepare("select signal, count from cap_reputation where prefix = ? and expires_ts > ?")
+	if err != nil {
+		return nil, err
+	}
+	d.getReputationStmt = stmt
+
+	stmt, err = sqlite.Prepare("delete from cap_spent_token where expires_ts < ?")
+	if err != nil {
+		return nil, err
+	}
+	d.delExpiredSpentStmt = stmt
+
+	stmt, err = sqlite.Prepare("insert into cap_spent_token (id, expires_ts) values (?, ?) on conflict do nothing")
+	if err != nil {
+		return nil, err
+	}
+	d.insertSpentStmt = stmt
+
+	stmt, err = sqlite.Prepare("delete from cap_rate_limit where expires_ms < ?")
+	if err != nil {
+		return nil, err
+	}
+	d.delExpiredLimitStmt = stmt
+
+	stmt, err = sqlite.Prepare("select state from cap_rate_limit where key = ?")
+	if err != nil {
+		return nil, err
+	}
+	d.getLimitStmt = stmt
+
+	stmt, err = sqlite.Prepare("insert into cap_rate_limit (key, state, expires_ms) values (?, ?, ?) on conflict do nothing")
+	if err != nil {
+		return nil, err
+	}
+	d.insertLimitStmt = stmt
+
+	stmt, err = sqlite.Prepare("update cap_rate_limit set state = ?, expires_ms = ? where key = ? and state = ?")
+	if err != nil {
+		return nil, err
+	}
+	d.updateLimitStmt = stmt
+
 	go d.delExpiredDaemon()
 
 	return d, nil
@@ -158,7 +304,12 @@ func (d *Driver) delExpiredDaemon() {
 			return
 		}
 
-		res, err := d.delExpiredStmt.Exec(time.Now().Unix())
+		now := d.clock.Now()
+		windowStart := now
+		if d.rlOpts != nil {
+			windowStart = now.Add(-d.rlOpts.MaxChallengesWindow)
+		}
+		res, err := d.delExpiredStmt.Exec(now.Unix(), now.Unix(), windowStart.Unix())
 		if err != nil {
 			d.logger.Error("failed to delete expired Cap challenges",
 				"service", "sqlitedriver.Driver",
@@ -180,13 +331,35 @@ func (d *Driver) delExpiredDaemon() {
 			"service", "sqlitedriver.Driver",
 			"count", count,
 		)
+
+		if _, err = d.delExpiredReputationStmt.Exec(d.clock.Now().Unix()); err != nil {
+			d.logger.Error("failed to delete expired Cap reputation counts",
+				"service", "sqlitedriver.Driver",
+				"error", err,
+			)
+		}
+
+		if _, err = d.delExpiredSpentStmt.Exec(d.clock.Now().Unix()); err != nil {
+			d.logger.Error("failed to delete expired spent Cap redeem tokens",
+				"service", "sqlitedriver.Driver",
+				"error", err,
+			)
+		}
+
+		// Rate limit state expiry has millisecond precision, since it can expire in less than a second.
+		if _, err = d.delExpiredLimitStmt.Exec(d.clock.Now().UnixMilli()); err != nil {
+			d.logger.Error("failed to delete expired Cap rate limit state",
+				"service", "sqlitedriver.Driver",
+				"error", err,
+			)
+		}
 	}
 }
 
 func (d *Driver) Close() error {
 	d.isClosed = true
 
-	errs := make([]error, 0, 5)
+	errs := make([]error, 0, 12)
 
 	if err := d.delExpiredStmt.Close(); err != nil {
 		errs = append(errs, err)
@@ -194,7 +367,43 @@ func (d *Driver) Close() error {
 	if err := d.insertStmt.Close(); err != nil {
 		errs = append(errs, err)
 	}
-	if err := d.getIPCountStmt.Close(); err != nil {
+	if err := d.getSubjectCountStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.getUnredeemedStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.solveStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.useRedeemTokenStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.delExpiredReputationStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.addReputationStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.getReputationStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.delExpiredSpentStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.insertSpentStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.delExpiredLimitStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.getLimitStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.insertLimitStmt.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := d.updateLimitStmt.Close(); err != nil {
 		errs = append(errs, err)
 	}
 
@@ -209,40 +418,81 @@ func (d *Driver) Close() error {
 	return nil
 }
 
-func (d *Driver) Store(ctx context.Context, challenge *cap.Challenge, ip *netip.Addr) error {
-	var ipVerPtr *int
-	var ipIntPtr *int64
+// encodeMetadata encodes challenge metadata for the metadata column.
+// Empty metadata is encoded as an empty string.
+func encodeMetadata(metadata map[string]string) (string, error) {
+	if len(metadata) == 0 {
+		return "", nil
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// decodeMetadata decodes the value of the metadata column.
+func decodeMetadata(str string) (map[string]string, error) {
+	if str == "" {
+		return nil, nil
+	}
+
+	var metadata map[string]string
+	if err := json.Unmarshal([]byte(str), &metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+func (d *Driver) Store(ctx context.Context, challenge *cap.Challenge, subject *cap.RateLimitSubject) error {
+	var keyPtr *string
+	now := d.clock.Now()
 
 	// Rate limit if enabled.
-	if ip != nil && d.rlOpts != nil {
+	if subject != nil && d.rlOpts != nil {
 		rl := d.rlOpts
-		ipVer, ipInt := cap.IpToInt64(ip, rl.IPv4SignificantBits, rl.IPv6SignificantBits)
-		ipVerPtr = &ipVer
-		ipIntPtr = &ipInt
-		windowStart := time.Now().Add(-rl.MaxChallengesWindow)
+		key := subject.Key(rl)
+		keyPtr = &key
+		windowStart := now.Add(-rl.MaxChallengesWindow)
 
-		row := d.getIPCountStmt.QueryRowContext(ctx, ipVer, ipInt, windowStart.Unix())
+		row := d.getSubjectCountStmt.QueryRowContext(ctx, key, windowStart.Unix())
 
 		var count int
 		if err := row.Scan(&count); err != nil {
-			return fmt.Errorf(`sqlitedriver: failed to get number of Cap challenges by IP %s: %w`, ip.String(), err)
+			return fmt.Errorf(`sqlitedriver: failed to get number of Cap challenges by rate limit subject %s: %w`, key, err)
 		}
 
-		if count > rl.MaxChallengesPerIP {
+		if count >= rl.MaxChallenges(subject.Kind) {
 			return cap.ErrRateLimited
 		}
 	}
 
+	metadata, err := encodeMetadata(challenge.Metadata)
+	if err != nil {
+		return fmt.Errorf(`sqlitedriver: failed to encode Cap challenge metadata: %w`, err)
+	}
+
 	p := challenge.Params
-	_, err := d.insertStmt.ExecContext(ctx,
+	_, err = d.insertStmt.ExecContext(ctx,
 		challenge.ChallengeToken,
 		challenge.RedeemToken,
 		p.Difficulty,
 		p.Count,
 		p.SaltSize,
-		ipVerPtr,
-		ipIntPtr,
+		p.Scheme,
+		keyPtr,
+		challenge.Scope.SiteKey,
+		challenge.Scope.Action,
+		challenge.Scope.Audience,
 		challenge.Expires.Unix(),
+		challenge.RedeemValidDuration.Milliseconds(),
+		challenge.RedeemExpires.Unix(),
+		metadata,
+		challenge.Solved,
+		now.Unix(),
 	)
 	if err != nil {
 		return fmt.Errorf(`sqlitedriver: failed to insert Cap challenge: %w`, err)
@@ -252,14 +502,20 @@ func (d *Driver) Store(ctx context.Context, challenge *cap.Challenge, ip *netip.
 }
 
 func (d *Driver) GetUnredeemedChallenge(ctx context.Context, challengeToken string) (*cap.Challenge, error) {
-	row := d.getUnredeemedStmt.QueryRowContext(ctx, challengeToken, time.Now().Unix())
+	row := d.getUnredeemedStmt.QueryRowContext(ctx, challengeToken, d.clock.Now().Unix())
 
 	var redeemToken string
+	var isSolved bool
 	var difficulty int
 	var count int
 	var saltSize int
+	var scheme string
+	var scope cap.Scope
 	var expTs int64
-	if err := row.Scan(&redeemToken, &difficulty, &count, &saltSize, &expTs); err != nil {
+	var redeemValidMs int64
+	var redeemExpTs int64
+	var metadataJSON string
+	if err := row.Scan(&redeemToken, &difficulty, &count, &saltSize, &scheme, &scope.SiteKey, &scope.Action, &scope.Audience, &expTs, &redeemValidMs, &redeemExpTs, &metadataJSON, &isSolved); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
@@ -267,6 +523,71 @@ func (d *Driver) GetUnredeemedChallenge(ctx context.Context, challengeToken stri
 		return nil, fmt.Errorf(`sqlitedriver: failed to get challenge with token "%s": %w`, challengeToken, err)
 	}
 
+	metadata, err := decodeMetadata(metadataJSON)
+	if err != nil {
+		return nil, fmt.Errorf(`sqlitedriver: failed to decode metadata of challenge with token "%s": %w`, challengeToken, err)
+	}
+
+	return &cap.Challenge{
+		ChallengeToken: challengeToken,
+		RedeemToken:    redeemToken,
+		Params: cap.ChallengeParams{
+			Difficulty: difficulty,
+			Count:      count,
+			SaltSize:   saltSize,
+			Scheme:     scheme,
+		},
+		Scope:               scope,
+		Expires:             time.Unix(expTs, 0),
+		RedeemValidDuration: time.Duration(redeemValidMs) * time.Millisecond,
+		RedeemExpires:       time.Unix(redeemExpTs, 0),
+		Metadata:            metadata,
+		Solved:              isSolved,
+	}, nil
+}
+
+func (d *Driver) SolveChallenge(ctx context.Context, challengeToken string, redeemExpires time.Time) (bool, error) {
+	res, err := d.solveStmt.ExecContext(ctx, redeemExpires.Unix(), challengeToken, d.clock.Now().Unix())
+	if err != nil {
+		return false, fmt.Errorf(`sqlitedriver: failed to solve challenge with token "%s": %w`, challengeToken, err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(`sqlitedriver: failed to get number of solved challenges with token "%s": %w`, challengeToken, err)
+	}
+
+	return affected == 1, nil
+}
+
+func (d *Driver) UseRedeemToken(ctx context.Context, redeemToken string) (*cap.Challenge, error) {
+	row := d.useRedeemTokenStmt.QueryRowContext(ctx, redeemToken, d.clock.Now().Unix())
+
+	var challengeToken string
+	var isSolved bool
+	var difficulty int
+	var count int
+	var saltSize int
+	var scheme string
+	var scope cap.Scope
+	var expTs int64
+	var redeemValidMs int64
+	var redeemExpTs int64
+	var metadataJSON string
+	if err := row.Scan(&challengeToken, &difficulty, &count, &saltSize, &scheme, &scope.SiteKey, &scope.Action, &scope.Audience, &expTs, &redeemValidMs, &redeemExpTs, &metadataJSON, &isSolved); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Nonexistent, redeemed or expired.
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf(`sqlitedriver: failed to use redeem token "%s": %w`, redeemToken, err)
+	}
+
+	metadata, err := decodeMetadata(metadataJSON)
+	if err != nil {
+		return nil, fmt.Errorf(`sqlitedriver: failed to decode metadata of redeem token "%s": %w`, redeemToken, err)
+	}
+
 	return &cap.Challenge{
 		ChallengeToken: challengeToken,
 		RedeemToken:    redeemToken,
@@ -274,22 +595,114 @@ func (d *Driver) GetUnredeemedChallenge(ctx context.Context, challengeToken stri
 			Difficulty: difficulty,
 			Count:      count,
 			SaltSize:   saltSize,
+			Scheme:     scheme,
 		},
-		Expires: time.Unix(expTs, 0),
+		Scope:               scope,
+		Expires:             time.Unix(expTs, 0),
+		RedeemValidDuration: time.Duration(redeemValidMs) * time.Millisecond,
+		RedeemExpires:       time.Unix(redeemExpTs, 0),
+		Metadata:            metadata,
+		Solved:              isSolved,
 	}, nil
 }
 
-func (d *Driver) UseRedeemToken(ctx context.Context, redeemToken string) (wasRedeemed bool, err error) {
-	res, err := d.useRedeemTokenStmt.ExecContext(ctx, redeemToken, time.Now().Unix())
+func (d *Driver) AddReputationSignal(ctx context.Context, prefix netip.Prefix, signal cap.ReputationSignal, window time.Duration) error {
+	now := d.clock.Now()
+
+	_, err := d.addReputationStmt.ExecContext(ctx,
+		prefix.Masked().String(),
+		signal.String(),
+		now.Add(window).Unix(),
+		now.Unix(),
+		now.Unix(),
+	)
 	if err != nil {
-		return false, fmt.Errorf(`sqlitedriver: failed to use redeem token "%s": %w`, redeemToken, err)
+		return fmt.Errorf(`sqlitedriver: failed to add %s reputation signal for prefix %s: %w`, signal, prefix, err)
 	}
 
-	var count int64
-	count, err = res.RowsAffected()
+	return nil
+}
+
+func (d *Driver) GetReputation(ctx context.Context, prefix netip.Prefix) (cap.ReputationCounts, error) {
+	var counts cap.ReputationCounts
+
+	rows, err := d.getReputationStmt.QueryContext(ctx, prefix.Masked().String(), d.clock.Now().Unix())
 	if err != nil {
-		return false, fmt.Errorf(`sqlitedriver: failed to check if redeem token "%s" was already redeemed: %w`, redeemToken, err)
+		return counts, fmt.Errorf(`sqlitedriver: failed to get reputation for prefix %s: %w`, prefix, err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var signalName string
+		var count int64
+		if err = rows.Scan(&signalName, &count); err != nil {
+			return counts, fmt.Errorf(`sqlitedriver: failed to scan reputation for prefix %s: %w`, prefix, err)
+		}
+
+		for _, signal := range cap.ReputationSignals {
+			if signal.String() == signalName {
+				counts.Add(signal, count)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return counts, fmt.Errorf(`sqlitedriver: failed to get reputation for prefix %s: %w`, prefix, err)
+	}
+
+	return counts, nil
+}
+
+func (d *Driver) MarkTokenSpent(ctx context.Context, id string, expires time.Time) (bool, error) {
+	res, err := d.insertSpentStmt.ExecContext(ctx, id, expires.Unix())
+	if err != nil {
+		return false, fmt.Errorf(`sqlitedriver: failed to mark token "%s" as spent: %w`, id, err)
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf(`sqlitedriver: failed to get number of inserted spent tokens: %w`, err)
+	}
+
+	return count == 1, nil
+}
+
+func (d *Driver) UpdateRateLimitState(ctx context.Context, key string, update func(state []byte) ([]byte, time.Duration)) error {
+	d.limitMu.Lock()
+	defer d.limitMu.Unlock()
+
+	for range maxRateLimitAttempts {
+		var state []byte
+		err := d.getLimitStmt.QueryRowContext(ctx, key).Scan(&state)
+		exists := err == nil
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf(`sqlitedriver: failed to get rate limit state for key "%s": %w`, key, err)
+		}
+
+		newState, ttl := update(state)
+		expires := d.clock.Now().Add(ttl).UnixMilli()
+
+		var res sql.Result
+		if exists {
+			res, err = d.updateLimitStmt.ExecContext(ctx, newState, expires, key, state)
+		} else {
+			res, err = d.insertLimitStmt.ExecContext(ctx, key, newState, expires)
+		}
+		if err != nil {
+			return fmt.Errorf(`sqlitedriver: failed to store rate limit state for key "%s": %w`, key, err)
+		}
+
+		count, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf(`sqlitedriver: failed to get number of updated rate limit states: %w`, err)
+		}
+		if count == 1 {
+			return nil
+		}
+
+		// Changed concurrently by another process, try again.
 	}
 
-	return count > 0, nil
+	return fmt.Errorf(`sqlitedriver: rate limit state for key "%s" was changed concurrently %d times`, key, maxRateLimitAttempts)
 }
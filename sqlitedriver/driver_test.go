@@ -0,0 +1,86 @@
+package sqlitedriver
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/termermc/go-capjs/cap"
+	"github.com/termermc/go-capjs/cap/drivertest"
+	"github.com/termermc/go-capjs/cap/fake"
+)
+
+// newTestDriver creates a Driver backed by a new database file in a temporary directory.
+func newTestDriver(t *testing.T, opts ...func(d *Driver)) *Driver {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "cap.sqlite")+"?_journal=WAL&_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	d, err := NewDriver(db, opts...)
+	if err != nil {
+		_ = db.Close()
+		t.Fatalf("NewDriver: unexpected error: %v", err)
+	}
+	t.Cleanup(func() { _ = d.Close() })
+	return d
+}
+
+func TestConformance(t *testing.T) {
+	drivertest.Run(t, func(t *testing.T, clock cap.Clock, rl *cap.RateLimitOptions) cap.Driver {
+		opts := []func(d *Driver){WithClock(clock)}
+		if rl != nil {
+			opts = append(opts, WithRateLimit(func(o *cap.RateLimitOptions) { *o = *rl }))
+		}
+
+		return newTestDriver(t, opts...)
+	})
+}
+
+func TestRateLimitStateExpiry(t *testing.T) {
+	ctx := context.Background()
+	clock := fake.NewClock(time.UnixMilli(1_700_000_000_123))
+	d := newTestDriver(t, WithClock(clock))
+
+	const key = "test:ip:192.0.2.1/32"
+	err := d.UpdateRateLimitState(ctx, key, func(state []byte) ([]byte, time.Duration) {
+		return []byte{1}, 1500 * time.Millisecond
+	})
+	if err != nil {
+		t.Fatalf("UpdateRateLimitState: unexpected error: %v", err)
+	}
+
+	var expires int64
+	if err = d.sqlite.QueryRow("select expires_ms from cap_rate_limit where key = ?", key).Scan(&expires); err != nil {
+		t.Fatalf("failed to get rate limit state expiry: %v", err)
+	}
+	if want := clock.Now().Add(1500 * time.Millisecond).UnixMilli(); expires != want {
+		t.Errorf("expires_ms = %d, want %d", expires, want)
+	}
+
+	// State must survive pruning until its TTL has passed, even if that is not a whole second.
+	for _, tt := range []struct {
+		after time.Duration
+		want  int
+	}{
+		{1400 * time.Millisecond, 1},
+		{1600 * time.Millisecond, 0},
+	} {
+		if _, err = d.delExpiredLimitStmt.Exec(clock.Now().Add(tt.after).UnixMilli()); err != nil {
+			t.Fatalf("failed to delete expired rate limit state: %v", err)
+		}
+
+		var count int
+		if err = d.sqlite.QueryRow("select count(*) from cap_rate_limit where key = ?", key).Scan(&count); err != nil {
+			t.Fatalf("failed to count rate limit state: %v", err)
+		}
+		if count != tt.want {
+			t.Errorf("after pruning %v later: %d rows, want %d", tt.after, count, tt.want)
+		}
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/termermc/go-capjs/sqlitedriver
 
 go 1.25.2
+
+require github.com/mattn/go-sqlite3 v1.14.32
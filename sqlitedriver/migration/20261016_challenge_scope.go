@@ -0,0 +1,35 @@
+package migration
+
+import "database/sql"
+
+type M20261016ChallengeScope struct {
+}
+
+func (m *M20261016ChallengeScope) Name() string {
+	return "20261016_challenge_scope"
+}
+
+func (m *M20261016ChallengeScope) Apply(tx *sql.Tx) error {
+	const q = `
+-- The scope_site_key, scope_action and scope_audience fields are the scope that the redeem token was issued for.
+-- Empty strings mean that the field is unscoped.
+-- Redeem tokens can only be used when the expected scope matches.
+alter table cap_challenge add column scope_site_key text default '' not null;
+alter table cap_challenge add column scope_action text default '' not null;
+alter table cap_challenge add column scope_audience text default '' not null;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
+
+func (m *M20261016ChallengeScope) Revert(tx *sql.Tx) error {
+	const q = `
+alter table cap_challenge drop column scope_audience;
+alter table cap_challenge drop column scope_action;
+alter table cap_challenge drop column scope_site_key;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
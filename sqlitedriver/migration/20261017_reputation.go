@@ -0,0 +1,42 @@
+package migration
+
+import "database/sql"
+
+type M20261017Reputation struct {
+}
+
+func (m *M20261017Reputation) Name() string {
+	return "20261017_reputation"
+}
+
+func (m *M20261017Reputation) Apply(tx *sql.Tx) error {
+	const q = `
+-- Reputation signal counts for IP prefixes.
+-- The prefix field is the IP prefix in CIDR notation, such as 192.0.2.0/24.
+-- The signal field is the name of the signal, such as challenge or failed_solution.
+-- The count field is the number of times the signal was recorded since the window started.
+-- Counts must be treated as zero if expires_ts is in the past.
+create table cap_reputation (
+    prefix     text    not null,
+    signal     text    not null,
+    count      integer not null,
+    expires_ts integer not null,
+    primary key (prefix, signal)
+);
+
+create index cap_reputation_expires_ts_index
+    on cap_reputation (expires_ts);
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
+
+func (m *M20261017Reputation) Revert(tx *sql.Tx) error {
+	const q = `
+drop table cap_reputation;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
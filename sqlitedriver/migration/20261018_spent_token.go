@@ -0,0 +1,37 @@
+package migration
+
+import "database/sql"
+
+type M20261018SpentToken struct {
+}
+
+func (m *M20261018SpentToken) Name() string {
+	return "20261018_spent_token"
+}
+
+func (m *M20261018SpentToken) Apply(tx *sql.Tx) error {
+	const q = `
+-- IDs of signed redeem tokens that were used.
+-- Signed redeem tokens are not stored anywhere else, so this table is what prevents them from being used twice.
+-- Rows can be deleted once expires_ts is in the past, since the tokens themselves are expired by then.
+create table cap_spent_token (
+    id         text    not null primary key,
+    expires_ts integer not null
+);
+
+create index cap_spent_token_expires_ts_index
+    on cap_spent_token (expires_ts);
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
+
+func (m *M20261018SpentToken) Revert(tx *sql.Tx) error {
+	const q = `
+drop table cap_spent_token;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
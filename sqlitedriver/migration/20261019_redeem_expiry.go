@@ -0,0 +1,42 @@
+package migration
+
+import "database/sql"
+
+type M20261019RedeemExpiry struct {
+}
+
+func (m *M20261019RedeemExpiry) Name() string {
+	return "20261019_redeem_expiry"
+}
+
+func (m *M20261019RedeemExpiry) Apply(tx *sql.Tx) error {
+	const q = `
+-- The redeem_valid_ms field is how long the redeem token is valid for after the challenge is solved, in milliseconds.
+-- 0 means that the redeem token expires with the challenge.
+-- The redeem_expires_ts field is when the redeem token expires.
+-- It starts out the same as expires_ts, and is changed when the challenge is solved.
+-- Redeem tokens must not be accepted if redeem_expires_ts is in the past.
+-- Rows must not be deleted until both expires_ts and redeem_expires_ts are in the past.
+alter table cap_challenge add column redeem_valid_ms integer default 0 not null;
+alter table cap_challenge add column redeem_expires_ts integer default 0 not null;
+
+update cap_challenge set redeem_expires_ts = expires_ts;
+
+create index cap_challenge_redeem_expires_ts_index
+    on cap_challenge (redeem_expires_ts);
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
+
+func (m *M20261019RedeemExpiry) Revert(tx *sql.Tx) error {
+	const q = `
+drop index cap_challenge_redeem_expires_ts_index;
+alter table cap_challenge drop column redeem_expires_ts;
+alter table cap_challenge drop column redeem_valid_ms;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
@@ -0,0 +1,30 @@
+package migration
+
+import "database/sql"
+
+type M20261020ChallengeMetadata struct {
+}
+
+func (m *M20261020ChallengeMetadata) Name() string {
+	return "20261020_challenge_metadata"
+}
+
+func (m *M20261020ChallengeMetadata) Apply(tx *sql.Tx) error {
+	const q = `
+-- The metadata field is the metadata attached to the challenge, encoded as a JSON object.
+-- An empty string means that the challenge has no metadata.
+alter table cap_challenge add column metadata text default '' not null;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
+
+func (m *M20261020ChallengeMetadata) Revert(tx *sql.Tx) error {
+	const q = `
+alter table cap_challenge drop column metadata;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
@@ -0,0 +1,33 @@
+package migration
+
+import "database/sql"
+
+type M20261021ChallengeSolved struct {
+}
+
+func (m *M20261021ChallengeSolved) Name() string {
+	return "20261021_challenge_solved"
+}
+
+func (m *M20261021ChallengeSolved) Apply(tx *sql.Tx) error {
+	const q = `
+-- The is_solved field is set to 1 when valid solutions are submitted for the challenge.
+-- A solved challenge must not be solved again, so that each challenge yields one redeem token.
+alter table cap_challenge add column is_solved integer default 0 not null;
+
+-- Challenges whose redeem token lifetime was changed can only have been solved.
+update cap_challenge set is_solved = 1 where redeem_expires_ts <> expires_ts;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
+
+func (m *M20261021ChallengeSolved) Revert(tx *sql.Tx) error {
+	const q = `
+alter table cap_challenge drop column is_solved;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
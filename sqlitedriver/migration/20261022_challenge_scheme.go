@@ -0,0 +1,30 @@
+package migration
+
+import "database/sql"
+
+type M20261022ChallengeScheme struct {
+}
+
+func (m *M20261022ChallengeScheme) Name() string {
+	return "20261022_challenge_scheme"
+}
+
+func (m *M20261022ChallengeScheme) Apply(tx *sql.Tx) error {
+	const q = `
+-- The challenge_scheme field is the name of the challenge's proof-of-work scheme.
+-- An empty string means the default SHA-256 scheme.
+alter table cap_challenge add column challenge_scheme text default '' not null;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
+
+func (m *M20261022ChallengeScheme) Revert(tx *sql.Tx) error {
+	const q = `
+alter table cap_challenge drop column challenge_scheme;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
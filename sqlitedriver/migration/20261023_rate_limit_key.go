@@ -0,0 +1,45 @@
+package migration
+
+import "database/sql"
+
+type M20261023RateLimitKey struct {
+}
+
+func (m *M20261023RateLimitKey) Name() string {
+	return "20261023_rate_limit_key"
+}
+
+func (m *M20261023RateLimitKey) Apply(tx *sql.Tx) error {
+	const q = `
+-- The rate_limit_key field is the key of the rate limit subject that the challenge was created for (see cap.RateLimitSubject.Key).
+-- It replaces the ip_version and ip_significant_bits fields for rate limiting, which are no longer set.
+alter table cap_challenge add column rate_limit_key text null;
+
+-- Existing challenges were rate limited by IP.
+update cap_challenge
+set rate_limit_key = 'ip:' || ip_version || ':' || ip_significant_bits
+where ip_version is not null and ip_significant_bits is not null;
+
+drop index cap_challenge_ip_index;
+
+create index cap_challenge_rate_limit_key_index
+	on cap_challenge (rate_limit_key, created_ts);
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
+
+func (m *M20261023RateLimitKey) Revert(tx *sql.Tx) error {
+	const q = `
+drop index cap_challenge_rate_limit_key_index;
+
+alter table cap_challenge drop column rate_limit_key;
+
+create index cap_challenge_ip_index
+	on cap_challenge (ip_version, ip_significant_bits);
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
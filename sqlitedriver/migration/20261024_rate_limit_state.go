@@ -0,0 +1,39 @@
+package migration
+
+import "database/sql"
+
+type M20261024RateLimitState struct {
+}
+
+func (m *M20261024RateLimitState) Name() string {
+	return "20261024_rate_limit_state"
+}
+
+func (m *M20261024RateLimitState) Apply(tx *sql.Tx) error {
+	const q = `
+-- State of rate limiters that use the driver as their cap.RateLimitStore.
+-- The state is an opaque value defined by the rate limit algorithm, and is updated with compare-and-swap.
+-- The expires_ms field is a UNIX millisecond timestamp, since rate limit state can expire less than a second after it was stored.
+-- Rows can be deleted once expires_ms is in the past, since expired state has the same effect as no state.
+create table cap_rate_limit (
+    key        text    not null primary key,
+    state      blob    not null,
+    expires_ms integer not null
+);
+
+create index cap_rate_limit_expires_ms_index
+    on cap_rate_limit (expires_ms);
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
+
+func (m *M20261024RateLimitState) Revert(tx *sql.Tx) error {
+	const q = `
+drop table cap_rate_limit;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
@@ -0,0 +1,117 @@
+package migration
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"net/netip"
+
+	"github.com/termermc/go-capjs/cap"
+)
+
+type M20261025IPPrefix struct {
+}
+
+func (m *M20261025IPPrefix) Name() string {
+	return "20261025_ip_prefix"
+}
+
+// ipPrefixKey converts the ip_version and ip_significant_bits fields of a challenge to the rate limit key of its IP
+// prefix.
+// The prefix lengths that the challenge was stored with are not known, so the default ones are used. They match
+// the whole bytes that were kept in ip_significant_bits unless other lengths were configured, in which case the
+// converted keys only stop matching for the length of a rate limit window.
+func ipPrefixKey(version int, significantBits int64) (string, bool) {
+	var addr netip.Addr
+	switch version {
+	case 4:
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(significantBits))
+		addr = netip.AddrFrom4(b)
+	case 6:
+		var b [16]byte
+		binary.BigEndian.PutUint64(b[:8], uint64(significantBits))
+		addr = netip.AddrFrom16(b)
+	default:
+		return "", false
+	}
+
+	return cap.NewIPRateLimitSubject(addr).Key(&cap.RateLimitOptions{
+		IPv4SignificantBits: cap.DefaultIPv4SignificantBits,
+		IPv6SignificantBits: cap.DefaultIPv6SignificantBits,
+	}), true
+}
+
+func (m *M20261025IPPrefix) Apply(tx *sql.Tx) error {
+	// IP rate limit keys are now network prefixes such as "ip:192.0.2.0/24" or "ip:2001:db8::/48",
+	// which can hold full IPv6 prefixes.
+	// Keys in the old "ip:<version>:<integer>" format were backfilled from the ip_version and ip_significant_bits
+	// fields, so they are converted from them.
+	rows, err := tx.Query(`
+select distinct ip_version, ip_significant_bits
+from cap_challenge
+where ip_version is not null and ip_significant_bits is not null
+	`)
+	if err != nil {
+		return err
+	}
+
+	type ipFields struct {
+		version         int
+		significantBits int64
+	}
+	var fields []ipFields
+	for rows.Next() {
+		var f ipFields
+		if err = rows.Scan(&f.version, &f.significantBits); err != nil {
+			_ = rows.Close()
+			return err
+		}
+
+		fields = append(fields, f)
+	}
+	_ = rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range fields {
+		key, ok := ipPrefixKey(f.version, f.significantBits)
+		if !ok {
+			continue
+		}
+
+		_, err = tx.Exec(`
+update cap_challenge
+set rate_limit_key = ?
+where ip_version = ? and ip_significant_bits = ?
+		`, key, f.version, f.significantBits)
+		if err != nil {
+			return err
+		}
+	}
+
+	const q = `
+-- Keys in the old format that could not be converted are cleared.
+-- They only affect rate limits for the length of a rate limit window.
+update cap_challenge
+set rate_limit_key = null
+where rate_limit_key like 'ip:%' and rate_limit_key not like '%/%';
+
+-- The ip_version and ip_significant_bits fields were replaced by rate_limit_key, and could only hold 64 bits of IPv6 addresses.
+alter table cap_challenge drop column ip_version;
+alter table cap_challenge drop column ip_significant_bits;
+	`
+
+	_, err = tx.Exec(q)
+	return err
+}
+
+func (m *M20261025IPPrefix) Revert(tx *sql.Tx) error {
+	const q = `
+alter table cap_challenge add column ip_version integer null;
+alter table cap_challenge add column ip_significant_bits integer null;
+	`
+
+	_, err := tx.Exec(q)
+	return err
+}
@@ -19,6 +19,16 @@ type Migration interface {
 
 var migrations = []Migration{
 	&M20251010InitialSchema{},
+	&M20261016ChallengeScope{},
+	&M20261017Reputation{},
+	&M20261018SpentToken{},
+	&M20261019RedeemExpiry{},
+	&M20261020ChallengeMetadata{},
+	&M20261021ChallengeSolved{},
+	&M20261022ChallengeScheme{},
+	&M20261023RateLimitKey{},
+	&M20261024RateLimitState{},
+	&M20261025IPPrefix{},
 }
 
 // DoMigrations applies all migrations to the database.
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/termermc/go-capjs/standalone/migration"
 	"path"
@@ -13,7 +15,8 @@ type DB struct {
 	CapDB        *sql.DB
 	StandaloneDB *sql.DB
 
-	incrSolveStmt *sql.Stmt
+	incrSolveStmt    *sql.Stmt
+	getSecretKeyStmt *sql.Stmt
 }
 
 func NewDB(env *Env) (*DB, error) {
@@ -50,10 +53,32 @@ func NewDB(env *Env) (*DB, error) {
 		return nil, fmt.Errorf(`failed to prepare statement: %w`, err)
 	}
 
+	getSecretKeyStmt, err := standaloneDB.Prepare(`select secret_key from site_key where site_key = ?`)
+	if err != nil {
+		return nil, fmt.Errorf(`failed to prepare statement: %w`, err)
+	}
+
 	return &DB{
 		CapDB:        capDB,
 		StandaloneDB: standaloneDB,
 
-		incrSolveStmt: incrSolveStmt,
+		incrSolveStmt:    incrSolveStmt,
+		getSecretKeyStmt: getSecretKeyStmt,
 	}, nil
 }
+
+// GetSecretKey returns the secret key for the specified site key.
+// Returns an empty string if the site key does not exist.
+func (db *DB) GetSecretKey(ctx context.Context, siteKey string) (string, error) {
+	var secretKey string
+	err := db.getSecretKeyStmt.QueryRowContext(ctx, siteKey).Scan(&secretKey)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf(`failed to get secret key for site key "%s": %w`, siteKey, err)
+	}
+
+	return secretKey, nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/termermc/go-capjs/cap"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
@@ -22,6 +23,8 @@ const envCorsOrigin = "CORS_ORIGIN"
 
 const envRateLimitIPHeader = "RATELIMIT_IP_HEADER"
 
+const envRateLimitTrustedProxies = "RATELIMIT_TRUSTED_PROXIES"
+
 const envRateLimitMaxChallengesPerIP = "RATELIMIT_MAX_CHALLENGES_PER_IP"
 const envRateLimitMaxChallengesWindowSeconds = "RATELIMIT_MAX_CHALLENGES_WINDOW_SECONDS"
 
@@ -42,12 +45,18 @@ type Env struct {
 
 	// The allowed CORS origins.
 	// An empty/nil slice means that all origins are allowed.
+	// Origins can contain a wildcard for subdomains, such as "https://*.example.com" (see server.NewCORSPolicy).
 	CorsOrigins []string
 
 	// The header to use for extracting the request IP.
 	// If empty, uses the remote address (not recommended).
 	RateLimitIPHeader string
 
+	// The CIDR ranges of trusted reverse proxies.
+	// If not empty, RateLimitIPHeader is only trusted for requests from these proxies, and X-Forwarded-For and
+	// Forwarded headers are walked from the right, skipping trusted proxies.
+	RateLimitTrustedProxies []netip.Prefix
+
 	// RateLimitMaxChallengesPerIP is the maximum number of challenge creations to allow per IP within a window of time.
 	RateLimitMaxChallengesPerIP int
 
@@ -111,6 +120,17 @@ func MustResolveEnv() *Env {
 		envData.RateLimitIPHeader = env
 	}
 
+	if env := os.Getenv(envRateLimitTrustedProxies); env != "" {
+		for _, str := range strings.Split(env, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(str))
+			if err != nil {
+				panic(envRateLimitTrustedProxies + " must be a comma-separated list of CIDR ranges")
+			}
+
+			envData.RateLimitTrustedProxies = append(envData.RateLimitTrustedProxies, prefix)
+		}
+	}
+
 	{
 		def := int64(cap.DefaultMaxChallengesPerIP)
 		envData.RateLimitMaxChallengesPerIP = int(MustGetenvInt(envRateLimitMaxChallengesPerIP, &def))
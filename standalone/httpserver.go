@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"github.com/termermc/go-capjs/cap"
 	"github.com/termermc/go-capjs/cap/server"
 	"log/slog"
 	"net/http"
+	"strings"
 )
 
 type HttpServer struct {
@@ -26,12 +28,29 @@ func NewHttpServer(
 	errJson := []byte(`{"success":false,"message":"internal error"}`)
 
 	var ipFunc server.IPExtractorFunc
-	if env.RateLimitIPHeader == "" {
+	switch {
+	case len(env.RateLimitTrustedProxies) > 0 && (env.RateLimitIPHeader == "" || strings.EqualFold(env.RateLimitIPHeader, server.HeaderXForwardedFor)):
+		ipFunc = server.NewTrustedProxyIPExtractor(env.RateLimitTrustedProxies...)
+	case len(env.RateLimitTrustedProxies) > 0 && strings.EqualFold(env.RateLimitIPHeader, server.HeaderForwarded):
+		ipFunc = server.NewForwardedIPExtractor(env.RateLimitTrustedProxies...)
+	case len(env.RateLimitTrustedProxies) > 0:
+		ipFunc = server.NewTrustedHeaderIPExtractor(env.RateLimitIPHeader, env.RateLimitTrustedProxies...)
+	case env.RateLimitIPHeader == "":
 		ipFunc = server.RemoteAddrIPExtractor
-	} else {
+	default:
 		ipFunc = server.NewHeaderIPExtractor(env.RateLimitIPHeader)
 	}
 
+	// An empty list of CORS origins allows all origins.
+	corsOrigins := env.CorsOrigins
+	if len(corsOrigins) == 0 {
+		corsOrigins = []string{"*"}
+	}
+
+	siteKeyScope := func(req *http.Request) (cap.Scope, error) {
+		return cap.Scope{SiteKey: req.PathValue("site_key")}, nil
+	}
+
 	capServer := server.NewServer(c,
 		server.WithErrorHandler(func(err error, res http.ResponseWriter, req *http.Request) {
 			logger.Error("internal error in Cap endpoint",
@@ -44,6 +63,7 @@ func NewHttpServer(
 			_, _ = res.Write(errJson)
 		}),
 		server.WithIPForRateLimit(ipFunc),
+		server.WithCORS(server.NewCORSPolicy(corsOrigins)),
 		server.WithChallengeParamsChooser(func(req *http.Request) (cap.ChallengeParams, error) {
 			siteKey := req.PathValue("site_key")
 			_ = siteKey
@@ -51,6 +71,18 @@ func NewHttpServer(
 			// TODO Use PathValue to get site key, then fetch params from there.
 			return cap.DefaultChallengeParams, nil
 		}),
+		// Both the client and siteverify endpoints are mounted under the site key, and redeem tokens can only be verified
+		// with the secret of the site key they were issued for.
+		server.WithScopeChooser(siteKeyScope),
+		server.WithSiteverifyScopeChooser(siteKeyScope),
+		server.WithSecretValidator(func(req *http.Request, secret string) (bool, error) {
+			expected, err := db.GetSecretKey(req.Context(), req.PathValue("site_key"))
+			if err != nil || expected == "" {
+				return false, err
+			}
+
+			return subtle.ConstantTimeCompare([]byte(expected), []byte(secret)) == 1, nil
+		}),
 	)
 
 	return &HttpServer{
@@ -69,6 +101,7 @@ func (s *HttpServer) Listen() error {
 
 	mux.HandleFunc("/{site_key}/api/challenge", s.capServer.ChallengeHandler)
 	mux.HandleFunc("/{site_key}/api/redeem", s.capServer.RedeemHandler)
+	mux.HandleFunc("/{site_key}/siteverify", s.capServer.SiteverifyHandler)
 
 	s.logger.Info("HTTP server is listening",
 		"address", addr,